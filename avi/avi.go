@@ -0,0 +1,451 @@
+// Package avi writes frames as Motion-JPEG AVI files. Files over 1 GB use the
+// OpenDML extensions, which every current player supports.
+package avi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/jpegenc"
+)
+
+// DefaultFPS is the timeline rate when Options.FPS is 0.
+const DefaultFPS = 30
+
+// riffLimit is the size at which a RIFF list is closed and the next one
+// started. The first list also carries the legacy index read by old players,
+// which only understand files under 1 GB.
+const riffLimit = 1 << 30
+
+// superIndexEntries is the room reserved in the header for OpenDML index
+// entries, one per RIFF list, allowing recordings of about 256 GB.
+const superIndexEntries = 256
+
+// ErrSizeChanged is returned for a frame whose size differs from the first
+// frame's. AVI cannot change resolution; start a new file.
+var ErrSizeChanged = errors.New("avi: frame size changed")
+
+// Options configures a Writer. A nil *Options uses the defaults.
+type Options struct {
+	// FPS is the rate of the AVI timeline. Frames are placed on it by their
+	// timestamps: gaps become repeats of the previous frame, which cost a
+	// few bytes each, and frames within one interval after another are
+	// dropped.
+	FPS int
+	// Quality is the JPEG quality, jpegenc.DefaultQuality if 0.
+	Quality     int
+	Subsampling jpegenc.Subsampling
+}
+
+// Stats counts frames.
+type Stats struct {
+	// Frames is the number of frames on the timeline, including repeats.
+	Frames int64
+	// Repeated counts timeline frames that repeat the previous one.
+	Repeated int64
+	// Dropped counts frames that fell into an interval already filled.
+	Dropped int64
+}
+
+type stdEntry struct {
+	offset uint32 // of the chunk data, from the movi list
+	size   uint32
+}
+
+type superEntry struct {
+	offset   int64
+	size     uint32
+	duration uint32
+}
+
+// Writer writes an AVI file. The file is complete once Close has been called.
+type Writer struct {
+	w    io.WriteSeeker
+	bw   *bufio.Writer
+	opts Options
+	enc  *jpegenc.Encoder
+	jpeg bytes.Buffer
+
+	off           int64
+	started       bool
+	width, height int
+	start         time.Time
+	interval      time.Duration
+	next          int64
+
+	riffStart int64 // offset of the current RIFF size field
+	moviStart int64 // offset of the current movi list type
+	entries   []stdEntry
+	idx1      []stdEntry
+	super     []superEntry
+	first     int64 // frames in the first RIFF list
+	maxChunk  uint32
+	stats     Stats
+
+	// Offsets of header fields patched on Close.
+	avihFrames, avihBuffer, strhLength, strhBuffer, indxAt, dmlhFrames int64
+
+	err    error
+	closed bool
+}
+
+// New returns a writer for an AVI file written to w. Nothing is written until
+// the first frame, whose size becomes the video size.
+func New(w io.WriteSeeker, opts *Options) (*Writer, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.FPS <= 0 {
+		o.FPS = DefaultFPS
+	}
+	enc, err := jpegenc.NewEncoder(&jpegenc.Options{Quality: o.Quality, Subsampling: o.Subsampling})
+	if err != nil {
+		return nil, err
+	}
+	start, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:        w,
+		bw:       bufio.NewWriterSize(w, 1<<20),
+		opts:     o,
+		enc:      enc,
+		off:      start,
+		interval: time.Second / time.Duration(o.FPS),
+	}, nil
+}
+
+// WriteFrame encodes f and adds it at f.Time, or now if f has none.
+func (aw *Writer) WriteFrame(f *frame.Frame) error {
+	if aw.err != nil {
+		return aw.err
+	}
+	if aw.closed {
+		return errors.New("avi: writer is closed")
+	}
+	t := f.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	if !aw.started {
+		if f.Width <= 0 || f.Height <= 0 || f.Width > 0xFFFF || f.Height > 0xFFFF {
+			return errors.New("avi: invalid frame size")
+		}
+		aw.width, aw.height = f.Width, f.Height
+		aw.start = t
+		aw.started = true
+		if err := aw.writeHeader(); err != nil {
+			return aw.fail(err)
+		}
+	} else if f.Width != aw.width || f.Height != aw.height {
+		return ErrSizeChanged
+	}
+
+	slot := int64(0)
+	if d := t.Sub(aw.start); d > 0 {
+		slot = int64((d + aw.interval/2) / aw.interval)
+	}
+	if slot < aw.next {
+		aw.stats.Dropped++
+		return nil
+	}
+	for ; aw.next < slot; aw.next++ {
+		// Empty chunks tell players to keep showing the previous frame.
+		if err := aw.writeChunk(nil); err != nil {
+			return aw.fail(err)
+		}
+		aw.stats.Repeated++
+	}
+
+	aw.jpeg.Reset()
+	if err := aw.enc.Encode(&aw.jpeg, f.Pix, f.Width, f.Height, f.Stride); err != nil {
+		return err
+	}
+	if err := aw.writeChunk(aw.jpeg.Bytes()); err != nil {
+		return aw.fail(err)
+	}
+	aw.next++
+	return nil
+}
+
+// Stats returns the frame counters.
+func (aw *Writer) Stats() Stats {
+	return aw.stats
+}
+
+func (aw *Writer) fail(err error) error {
+	aw.err = err
+	return err
+}
+
+func (aw *Writer) write(b []byte) error {
+	n, err := aw.bw.Write(b)
+	aw.off += int64(n)
+	return err
+}
+
+// writeChunk appends a '00dc' video chunk to the movi list, starting a new
+// RIFF list first if the current one is full.
+func (aw *Writer) writeChunk(data []byte) error {
+	if aw.off+int64(len(data))+8-aw.riffStart > riffLimit-int64(len(aw.entries)+1)*24-1024 {
+		if err := aw.endRIFF(); err != nil {
+			return err
+		}
+		if err := aw.beginRIFF("AVIX"); err != nil {
+			return err
+		}
+	}
+	e := stdEntry{offset: uint32(aw.off + 8 - aw.moviStart), size: uint32(len(data))}
+	aw.entries = append(aw.entries, e)
+	if len(aw.super) == 0 {
+		aw.idx1 = append(aw.idx1, stdEntry{offset: uint32(aw.off - aw.moviStart), size: e.size})
+		aw.first++
+	}
+	aw.maxChunk = max(aw.maxChunk, e.size)
+	aw.stats.Frames++
+
+	hdr := append([]byte("00dc"), le32(uint32(len(data)))...)
+	if err := aw.write(hdr); err != nil {
+		return err
+	}
+	if err := aw.write(data); err != nil {
+		return err
+	}
+	if len(data)%2 == 1 {
+		return aw.write([]byte{0})
+	}
+	return nil
+}
+
+// writeHeader writes the first RIFF list header up to its movi list.
+func (aw *Writer) writeHeader() error {
+	var h bytes.Buffer
+	base := aw.off
+	at := func() int64 { return base + int64(h.Len()) }
+
+	h.WriteString("RIFF\x00\x00\x00\x00AVI ")
+	hdrl := listStart(&h, "hdrl")
+
+	h.WriteString("avih")
+	h.Write(le32(56))
+	h.Write(le32(uint32(aw.interval / time.Microsecond)))
+	h.Write(le32(0))    // max bytes per second
+	h.Write(le32(0))    // padding granularity
+	h.Write(le32(0x10)) // AVIF_HASINDEX
+	aw.avihFrames = at()
+	h.Write(le32(0))
+	h.Write(le32(0)) // initial frames
+	h.Write(le32(1)) // streams
+	aw.avihBuffer = at()
+	h.Write(le32(0))
+	h.Write(le32(uint32(aw.width)))
+	h.Write(le32(uint32(aw.height)))
+	h.Write(make([]byte, 16))
+
+	strl := listStart(&h, "strl")
+	h.WriteString("strh")
+	h.Write(le32(56))
+	h.WriteString("vidsMJPG")
+	h.Write(le32(0)) // flags
+	h.Write(le32(0)) // priority, language
+	h.Write(le32(0)) // initial frames
+	h.Write(le32(1)) // scale
+	h.Write(le32(uint32(aw.opts.FPS)))
+	h.Write(le32(0)) // start
+	aw.strhLength = at()
+	h.Write(le32(0))
+	aw.strhBuffer = at()
+	h.Write(le32(0))
+	h.Write(le32(0xFFFFFFFF)) // quality
+	h.Write(le32(0))          // sample size
+	h.Write(le16(0))
+	h.Write(le16(0))
+	h.Write(le16(uint16(aw.width)))
+	h.Write(le16(uint16(aw.height)))
+
+	h.WriteString("strf")
+	h.Write(le32(40))
+	h.Write(le32(40))
+	h.Write(le32(uint32(aw.width)))
+	h.Write(le32(uint32(aw.height)))
+	h.Write(le16(1))
+	h.Write(le16(24))
+	h.WriteString("MJPG")
+	h.Write(le32(uint32(aw.width * aw.height * 3)))
+	h.Write(make([]byte, 16))
+
+	// OpenDML super index, filled in on Close.
+	aw.indxAt = at()
+	h.WriteString("indx")
+	h.Write(le32(24 + superIndexEntries*16))
+	h.Write(make([]byte, 24+superIndexEntries*16))
+	listEnd(&h, strl)
+
+	odml := listStart(&h, "odml")
+	h.WriteString("dmlh")
+	h.Write(le32(248))
+	aw.dmlhFrames = at()
+	h.Write(make([]byte, 248))
+	listEnd(&h, odml)
+	listEnd(&h, hdrl)
+
+	if err := aw.write(h.Bytes()); err != nil {
+		return err
+	}
+	aw.riffStart = base + 4
+	return aw.beginMovi()
+}
+
+func (aw *Writer) beginRIFF(form string) error {
+	aw.riffStart = aw.off + 4
+	if err := aw.write([]byte("RIFF\x00\x00\x00\x00" + form)); err != nil {
+		return err
+	}
+	return aw.beginMovi()
+}
+
+func (aw *Writer) beginMovi() error {
+	aw.moviStart = aw.off + 8
+	aw.entries = aw.entries[:0]
+	return aw.write([]byte("LIST\x00\x00\x00\x00movi"))
+}
+
+// endRIFF closes the current movi list with its standard index, adds the
+// legacy index to the first RIFF list and patches the list sizes.
+func (aw *Writer) endRIFF() error {
+	ixAt := aw.off
+	ix := make([]byte, 0, 32+len(aw.entries)*8)
+	ix = append(ix, "ix00"...)
+	ix = append(ix, le32(uint32(24+len(aw.entries)*8))...)
+	ix = append(ix, le16(2)...)
+	ix = append(ix, 0, 1) // sub type, AVI_INDEX_OF_CHUNKS
+	ix = append(ix, le32(uint32(len(aw.entries)))...)
+	ix = append(ix, "00dc"...)
+	ix = binary.LittleEndian.AppendUint64(ix, uint64(aw.moviStart))
+	ix = append(ix, le32(0)...)
+	for _, e := range aw.entries {
+		ix = append(ix, le32(e.offset)...)
+		ix = append(ix, le32(e.size)...) // every frame is a keyframe
+	}
+	if err := aw.write(ix); err != nil {
+		return err
+	}
+	if len(aw.super) == superIndexEntries {
+		return errors.New("avi: file too large")
+	}
+	aw.super = append(aw.super, superEntry{offset: ixAt, size: uint32(len(ix)), duration: uint32(len(aw.entries))})
+	moviEnd := aw.off
+
+	if len(aw.super) == 1 {
+		b := make([]byte, 0, 8+len(aw.idx1)*16)
+		b = append(b, "idx1"...)
+		b = append(b, le32(uint32(len(aw.idx1)*16))...)
+		for _, e := range aw.idx1 {
+			b = append(b, "00dc"...)
+			b = append(b, le32(0x10)...) // AVIIF_KEYFRAME
+			b = append(b, le32(e.offset)...)
+			b = append(b, le32(e.size)...)
+		}
+		if err := aw.write(b); err != nil {
+			return err
+		}
+		aw.idx1 = nil
+	}
+
+	if err := aw.patch(aw.moviStart-4, uint32(moviEnd-aw.moviStart)); err != nil {
+		return err
+	}
+	return aw.patch(aw.riffStart, uint32(aw.off-aw.riffStart-4))
+}
+
+// patch overwrites a 32 bit field written earlier.
+func (aw *Writer) patch(at int64, v uint32) error {
+	return aw.patchBytes(at, le32(v))
+}
+
+// Close finishes the indexes and headers. The underlying writer is not closed.
+func (aw *Writer) Close() error {
+	if aw.closed {
+		return aw.err
+	}
+	aw.closed = true
+	if aw.err != nil {
+		return aw.err
+	}
+	if !aw.started {
+		return errors.New("avi: no frames written")
+	}
+	if err := aw.endRIFF(); err != nil {
+		return aw.fail(err)
+	}
+
+	indx := make([]byte, 0, 24+len(aw.super)*16)
+	indx = append(indx, le16(4)...)
+	indx = append(indx, 0, 0) // sub type, AVI_INDEX_OF_INDEXES
+	indx = append(indx, le32(uint32(len(aw.super)))...)
+	indx = append(indx, "00dc"...)
+	indx = append(indx, make([]byte, 12)...)
+	for _, e := range aw.super {
+		indx = binary.LittleEndian.AppendUint64(indx, uint64(e.offset))
+		indx = append(indx, le32(e.size)...)
+		indx = append(indx, le32(e.duration)...)
+	}
+	buffer := aw.maxChunk + 8
+	for _, p := range []struct {
+		at int64
+		b  []byte
+	}{
+		{aw.avihFrames, le32(uint32(aw.first))},
+		{aw.avihBuffer, le32(buffer)},
+		{aw.strhLength, le32(uint32(aw.stats.Frames))},
+		{aw.strhBuffer, le32(buffer)},
+		{aw.dmlhFrames, le32(uint32(aw.stats.Frames))},
+		{aw.indxAt + 8, indx},
+	} {
+		if err := aw.patchBytes(p.at, p.b); err != nil {
+			return aw.fail(err)
+		}
+	}
+	return aw.bw.Flush()
+}
+
+func (aw *Writer) patchBytes(at int64, b []byte) error {
+	if err := aw.bw.Flush(); err != nil {
+		return err
+	}
+	if _, err := aw.w.Seek(at, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := aw.w.Write(b); err != nil {
+		return err
+	}
+	_, err := aw.w.Seek(aw.off, io.SeekStart)
+	return err
+}
+
+// listStart writes a LIST header and returns the position of its size.
+func listStart(b *bytes.Buffer, typ string) int {
+	b.WriteString("LIST\x00\x00\x00\x00")
+	at := b.Len() - 4
+	b.WriteString(typ)
+	return at
+}
+
+func listEnd(b *bytes.Buffer, at int) {
+	binary.LittleEndian.PutUint32(b.Bytes()[at:], uint32(b.Len()-at-4))
+}
+
+func le32(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
+
+func le16(v uint16) []byte {
+	return binary.LittleEndian.AppendUint16(nil, v)
+}
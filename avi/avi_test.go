@@ -0,0 +1,256 @@
+package avi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+var start = time.Unix(1700000000, 0)
+
+// file is an in-memory io.WriteSeeker.
+type file struct {
+	b   []byte
+	off int64
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if end := f.off + int64(len(p)); end > int64(len(f.b)) {
+		f.b = append(f.b, make([]byte, end-int64(len(f.b)))...)
+	}
+	n := copy(f.b[f.off:], p)
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *file) Seek(off int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		off += f.off
+	case io.SeekEnd:
+		off += int64(len(f.b))
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.off = off
+	return off, nil
+}
+
+// testFrame returns a gradient frame whose color depends on i, taken at ms.
+func testFrame(i, ms int) *frame.Frame {
+	f := frame.New(40, 24)
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			copy(f.Pix[f.PixOffset(x, y):], []byte{byte(x * 4), byte(y * 6), byte(i * 40), 0xFF})
+		}
+	}
+	f.Time = start.Add(time.Duration(ms) * time.Millisecond)
+	return f
+}
+
+// chunk is a RIFF chunk or list. off is the file offset of its header.
+type chunk struct {
+	id, form string
+	off      int
+	data     []byte
+	sub      []*chunk
+}
+
+// parseRIFF returns the chunks in b, descending into RIFF and LIST chunks.
+func parseRIFF(t *testing.T, b []byte, base int) []*chunk {
+	t.Helper()
+	var chunks []*chunk
+	for i := 0; i < len(b); {
+		if i+8 > len(b) {
+			t.Fatalf("truncated chunk header at %d", base+i)
+		}
+		n := int(binary.LittleEndian.Uint32(b[i+4:]))
+		if i+8+n > len(b) {
+			t.Fatalf("chunk %q at %d: size %d past the end", b[i:i+4], base+i, n)
+		}
+		c := &chunk{id: string(b[i : i+4]), off: base + i, data: b[i+8 : i+8+n]}
+		if c.id == "RIFF" || c.id == "LIST" {
+			c.form = string(c.data[:4])
+			c.sub = parseRIFF(t, c.data[4:], base+i+12)
+		}
+		chunks = append(chunks, c)
+		i += 8 + n + n%2
+	}
+	return chunks
+}
+
+// find returns the first chunk with the id or list form along path.
+func find(t *testing.T, chunks []*chunk, path ...string) *chunk {
+	t.Helper()
+	for _, c := range chunks {
+		if c.id == path[0] || c.form == path[0] {
+			if len(path) == 1 {
+				return c
+			}
+			return find(t, c.sub, path[1:]...)
+		}
+	}
+	t.Fatalf("no %q chunk", path[0])
+	return nil
+}
+
+func u32(b []byte, at int) int { return int(binary.LittleEndian.Uint32(b[at:])) }
+
+// checkJPEG decodes a video chunk and compares it with f.
+func checkJPEG(t *testing.T, data []byte, f *frame.Frame) {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != f.Rect() {
+		t.Fatalf("JPEG bounds %v, want %v", img.Bounds(), f.Rect())
+	}
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			p := f.Pix[f.PixOffset(x, y):]
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			for k, v := range []byte{c.B, c.G, c.R} {
+				if d := int(v) - int(p[k]); d < -12 || d > 12 {
+					t.Fatalf("pixel %d,%d is %v, want % x", x, y, c, p[:3])
+				}
+			}
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	// The file may start after other data in the writer.
+	for _, prefix := range []int{0, 5} {
+		frames := []*frame.Frame{testFrame(0, 0), testFrame(1, 100), testFrame(2, 400), testFrame(3, 430), testFrame(4, 520)}
+		out := &file{}
+		out.Write(make([]byte, prefix))
+		w, err := New(out, &Options{FPS: 10, Quality: 95})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range frames {
+			if err := w.WriteFrame(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// Frame 3 falls into the interval of frame 2; 200 and 300ms repeat
+		// frame 1.
+		if s := w.Stats(); s != (Stats{Frames: 6, Repeated: 2, Dropped: 1}) {
+			t.Errorf("stats %+v", s)
+		}
+		want := []*frame.Frame{frames[0], frames[1], nil, nil, frames[2], frames[4]}
+
+		b := out.b[prefix:]
+		top := parseRIFF(t, b, prefix)
+		if len(top) != 1 || top[0].id != "RIFF" || top[0].form != "AVI " || 8+len(top[0].data) != len(b) {
+			t.Fatalf("file is not one AVI RIFF list")
+		}
+		riff := top[0].sub
+
+		avih := find(t, riff, "hdrl", "avih").data
+		if u32(avih, 0) != 100000 || u32(avih, 16) != 6 || u32(avih, 24) != 1 || u32(avih, 32) != 40 || u32(avih, 36) != 24 {
+			t.Errorf("avih: % x", avih[:40])
+		}
+		strh := find(t, riff, "hdrl", "strl", "strh").data
+		if string(strh[:8]) != "vidsMJPG" || u32(strh, 20) != 1 || u32(strh, 24) != 10 || u32(strh, 32) != 6 {
+			t.Errorf("strh: % x", strh)
+		}
+		if strf := find(t, riff, "hdrl", "strl", "strf").data; u32(strf, 4) != 40 || u32(strf, 8) != 24 || string(strf[16:20]) != "MJPG" {
+			t.Errorf("strf: % x", strf)
+		}
+		if dmlh := find(t, riff, "hdrl", "odml", "dmlh").data; u32(dmlh, 0) != 6 {
+			t.Errorf("dmlh frames %d", u32(dmlh, 0))
+		}
+
+		movi := find(t, riff, "movi")
+		var video []*chunk
+		for _, c := range movi.sub {
+			if c.id == "00dc" {
+				video = append(video, c)
+			}
+		}
+		if len(video) != len(want) {
+			t.Fatalf("%d video chunks, want %d", len(video), len(want))
+		}
+		for i, f := range want {
+			if f == nil {
+				if len(video[i].data) != 0 {
+					t.Errorf("repeat %d has %d bytes", i, len(video[i].data))
+				}
+				continue
+			}
+			checkJPEG(t, video[i].data, f)
+		}
+
+		// The legacy index holds chunk offsets from the movi list type.
+		moviType := movi.off + 8
+		idx1 := find(t, riff, "idx1").data
+		if len(idx1) != len(video)*16 {
+			t.Fatalf("idx1 has %d bytes", len(idx1))
+		}
+		for i, c := range video {
+			e := idx1[i*16:]
+			if string(e[:4]) != "00dc" || u32(e, 4) != 0x10 || moviType+u32(e, 8) != c.off || u32(e, 12) != len(c.data) {
+				t.Errorf("idx1 entry %d: % x", i, e[:16])
+			}
+		}
+
+		// The OpenDML indexes: the super index names the standard index,
+		// which holds data offsets from the movi list type.
+		indx := find(t, riff, "hdrl", "strl", "indx").data
+		if indx[0] != 4 || indx[3] != 0 || u32(indx, 4) != 1 || string(indx[8:12]) != "00dc" {
+			t.Fatalf("indx: % x", indx[:24])
+		}
+		ixAt := int(binary.LittleEndian.Uint64(indx[24:]))
+		if u32(indx, 36) != len(video) {
+			t.Errorf("indx duration %d", u32(indx, 36))
+		}
+		ix := find(t, movi.sub, "ix00")
+		if ix.off != ixAt || u32(indx, 32) != 8+len(ix.data) {
+			t.Fatalf("indx points at %d, ix00 is at %d", ixAt, ix.off)
+		}
+		if u32(ix.data, 4) != len(video) || int(binary.LittleEndian.Uint64(ix.data[12:])) != moviType {
+			t.Fatalf("ix00: % x", ix.data[:24])
+		}
+		for i, c := range video {
+			e := ix.data[24+i*8:]
+			if moviType+u32(e, 0) != c.off+8 || u32(e, 4) != len(c.data) {
+				t.Errorf("ix00 entry %d: % x", i, e[:8])
+			}
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := New(&file{}, &Options{Quality: 101}); err == nil {
+		t.Error("New accepted quality 101")
+	}
+	w, _ := New(&file{}, nil)
+	if err := w.Close(); err == nil {
+		t.Error("closed a file without frames")
+	}
+	w, _ = New(&file{}, nil)
+	if err := w.WriteFrame(frame.New(0, 4)); err == nil {
+		t.Error("wrote an empty frame")
+	}
+	w.WriteFrame(testFrame(0, 0))
+	if err := w.WriteFrame(frame.New(41, 24)); err != ErrSizeChanged {
+		t.Errorf("resized frame: %v, want ErrSizeChanged", err)
+	}
+	w.Close()
+	if err := w.WriteFrame(testFrame(1, 100)); err == nil {
+		t.Error("wrote a frame after Close")
+	}
+}
@@ -1,16 +1,23 @@
+//go:build windows
+
 package capture
 
 import (
-	"errors"
 	"fmt"
+	"time"
 	"unsafe"
 
+	"github.com/shinkar94/godesktopdup/cursor"
 	"github.com/shinkar94/godesktopdup/disp"
 	resultcode "github.com/shinkar94/godesktopdup/errors"
+	"github.com/shinkar94/godesktopdup/frame"
 	"github.com/shinkar94/godesktopdup/gfx11"
+	"github.com/shinkar94/godesktopdup/parallel"
+	"github.com/shinkar94/godesktopdup/rotate"
+	"golang.org/x/sys/windows"
 )
 
-var ErrNoImageYet = errors.New("no image yet")
+var ErrNoImageYet = frame.ErrNoImageYet
 
 type ScreenCapture struct {
 	device            *gfx11.Device
@@ -34,14 +41,25 @@ type ScreenCapture struct {
 	currentFrameInfo  disp.DuplicationFrameInfo
 	cursorShapeBuffer []byte
 	cursorShapeInfo   disp.DuplicationPointerShapeInfo
+	cursorState       cursor.State
+	cursorShape       *cursor.Shape
+	cursorCache       *cursor.Cache
+	lastCursorRect    disp.Rect
+	cursorScale       float64
+	cursorFilter      cursor.Filter
+	drawShape         *cursor.Shape
+	drawShapeSource   *cursor.Shape
+	drawShapeRotation disp.ModeRotation
 
 	monitorBounds *disp.Rect
 	captureCursor bool
 
 	lastOutputPtr    uintptr
 	frameInitialized bool
+	damage           []disp.Rect
+	damageFull       bool
 
-	cachedIsVertical  bool
+	cachedRotated      bool
 	cachedContentWidth int
 	cachedDataWidth    int
 	cachedSize         disp.Point
@@ -121,7 +139,7 @@ func (sc *ScreenCapture) Snapshot(timeoutMs uint) (func() int32, *disp.MappedRec
 	height := int32(desc.ModeDesc.Height)
 	rotation := disp.ModeRotation(desc.Rotation)
 
-	if sc.rotation == 0 {
+	if sc.rotation == disp.ModeRotationUnspecified {
 		sc.rotation = rotation
 	}
 
@@ -136,6 +154,9 @@ func (sc *ScreenCapture) Snapshot(timeoutMs uint) (func() int32, *disp.MappedRec
 	var desktop *disp.Resource
 	var frameInfo disp.DuplicationFrameInfo
 
+	sc.cursorState.Shape = nil
+	sc.cursorState.LastUpdate = 0
+
 	sc.ReleaseFrame()
 	hrF := sc.outputDuplication.AcquireNextFrame(uint32(timeoutMs), &frameInfo, &desktop)
 	sc.acquiredFrame = true
@@ -149,16 +170,11 @@ func (sc *ScreenCapture) Snapshot(timeoutMs uint) (func() int32, *disp.MappedRec
 	defer sc.ReleaseFrame()
 	defer desktop.Release()
 
-	if frameInfo.AccumulatedFrames == 0 {
-		return nil, nil, nil, ErrNoImageYet
-	}
-
 	sc.currentFrameInfo = frameInfo
+	sc.updateCursorState()
 
-	if sc.captureCursor && frameInfo.PointerShapeBufferSize > 0 {
-		if err := sc.getCursorShape(); err != nil {
-			_ = err
-		}
+	if frameInfo.AccumulatedFrames == 0 {
+		return nil, nil, nil, ErrNoImageYet
 	}
 
 	var desktop2d *gfx11.Texture2D
@@ -259,19 +275,22 @@ func (sc *ScreenCapture) GetFrameBGRA(buffer []byte, timeoutMs uint) error {
 	data := unsafe.Slice((*byte)(mappedRect.PBits), dataSize)
 
 	var contentWidth, dataWidth int
-	var isVertical bool
+	var rotated bool
 	if sc.cachedSize.X == size.X && sc.cachedSize.Y == size.Y {
 		contentWidth = sc.cachedContentWidth
 		dataWidth = sc.cachedDataWidth
-		isVertical = sc.cachedIsVertical
+		rotated = sc.cachedRotated
 	} else {
 		contentWidth = int(size.X) * 4
 		dataWidth = int(mappedRect.Pitch)
-		isVertical = sc.logicalWidth > 0 && sc.logicalHeight > 0 && sc.logicalWidth < sc.logicalHeight
-		
+		// DDA hands out the panel's orientation; any rotation other than
+		// identity, including 180 degrees, needs a rotated copy.
+		rotated = sc.rotation != disp.ModeRotationUnspecified && sc.rotation != disp.ModeRotationIdentity &&
+			sc.logicalWidth > 0 && sc.logicalHeight > 0
+
 		sc.cachedContentWidth = contentWidth
 		sc.cachedDataWidth = dataWidth
-		sc.cachedIsVertical = isVertical
+		sc.cachedRotated = rotated
 		sc.cachedSize = *size
 	}
 
@@ -289,15 +308,17 @@ func (sc *ScreenCapture) GetFrameBGRA(buffer []byte, timeoutMs uint) error {
 	logicalWidthInt := int(sc.logicalWidth)
 	logicalHeightInt := int(sc.logicalHeight)
 
-	if isVertical && (physicalWidth != logicalWidthInt || physicalHeight != logicalHeightInt) {
+	if rotated {
 		if err := sc.copyRotatedFrame(buffer, data, *size, mappedRect.Pitch, sc.rotation, sc.logicalWidth, sc.logicalHeight); err != nil {
 			return err
 		}
 		if sc.captureCursor {
-			if err := sc.drawCursor(buffer, logicalWidthInt, logicalHeightInt); err != nil {
+			if err := sc.drawCursor(buffer, logicalWidthInt, logicalHeightInt, disp.ModeRotationIdentity); err != nil {
 				_ = err
 			}
 		}
+		sc.damageFull = true
+		sc.damage = sc.damage[:0]
 		sc.frameInitialized = true
 		sc.lastOutputPtr = outputPtr
 		return nil
@@ -306,30 +327,52 @@ func (sc *ScreenCapture) GetFrameBGRA(buffer []byte, timeoutMs uint) error {
 	hasDirtyRects := len(sc.dirtyRects) > 0
 	hasMovedRects := len(sc.movedRects) > 0
 	needFullCopy := !sc.frameInitialized || !hasDirtyRects || hasMovedRects
+	sc.damageFull = !sc.frameInitialized || (!hasDirtyRects && !hasMovedRects)
+	prevCursorRect := sc.lastCursorRect
 	if needFullCopy {
 		if err := sc.copyFullFrame(buffer, data, *size, contentWidth, dataWidth); err != nil {
 			return err
 		}
 	} else {
+		if sc.lastCursorRect.Right > sc.lastCursorRect.Left && sc.lastCursorRect.Bottom > sc.lastCursorRect.Top {
+			// Restore the pixels under the previously drawn cursor.
+			sc.dirtyRects = append(sc.dirtyRects, sc.lastCursorRect)
+		}
 		if err := sc.copyDirtyRegions(buffer, data, *size, contentWidth, dataWidth); err != nil {
 			if errFull := sc.copyFullFrame(buffer, data, *size, contentWidth, dataWidth); errFull != nil {
 				return errFull
 			}
+			sc.damageFull = true
 		}
 	}
 
 	if sc.captureCursor {
-		if err := sc.drawCursor(buffer, physicalWidth, physicalHeight); err != nil {
+		if err := sc.drawCursor(buffer, physicalWidth, physicalHeight, sc.rotation); err != nil {
 			_ = err
 		}
 	}
 
+	sc.damage = append(sc.damage[:0], sc.dirtyRects...)
+	sc.damage = append(sc.damage, prevCursorRect, sc.lastCursorRect)
+
 	sc.frameInitialized = true
 	sc.lastOutputPtr = outputPtr
 
 	return nil
 }
 
+// Damage describes how the buffer passed to the last successful GetFrameBGRA
+// changed: dirty regions (including cursor redraws) and move rects, or full
+// when the whole buffer was rewritten. Empty rects may be present.
+func (sc *ScreenCapture) Damage() (dirty []disp.Rect, moves []disp.DuplicationMoveRect, full bool) {
+	if sc.damageFull {
+		return nil, nil, true
+	}
+	return sc.damage, sc.movedRects, false
+}
+
+// copyFullFrame copies every row of the mapped surface, splitting rows across
+// the worker pool on large frames.
 func (sc *ScreenCapture) copyFullFrame(buffer []byte, data []byte, size disp.Point, contentWidth, dataWidth int) error {
 	requiredSize := contentWidth * int(size.Y)
 	if len(buffer) < requiredSize {
@@ -338,31 +381,20 @@ func (sc *ScreenCapture) copyFullFrame(buffer []byte, data []byte, size disp.Poi
 
 	height := int(size.Y)
 	if contentWidth == dataWidth {
-		copy(buffer[:requiredSize], data[:requiredSize])
-	} else {
-		if contentWidth%4 == 0 && dataWidth%4 == 0 {
-			pixelsPerRow := contentWidth / 4
-			dataWidthU32 := dataWidth / 4
-			bufU32 := (*[1 << 30]uint32)(unsafe.Pointer(&buffer[0]))[:len(buffer)/4]
-			dataU32 := (*[1 << 30]uint32)(unsafe.Pointer(&data[0]))[:len(data)/4]
-			
-			imgStart := 0
-			dataStart := 0
-			for i := 0; i < height; i++ {
-				copy(bufU32[imgStart:imgStart+pixelsPerRow], dataU32[dataStart:dataStart+pixelsPerRow])
-				imgStart += pixelsPerRow
-				dataStart += dataWidthU32
-			}
-		} else {
-			imgStart := 0
-			dataStart := 0
-			for i := 0; i < height; i++ {
-				copy(buffer[imgStart:imgStart+contentWidth], data[dataStart:dataStart+contentWidth])
-				imgStart += contentWidth
-				dataStart += dataWidth
-			}
-		}
+		parallel.Default.Rows(height, int(size.X), func(lo, hi int) {
+			copy(buffer[lo*contentWidth:hi*contentWidth], data[lo*dataWidth:hi*dataWidth])
+		})
+		return nil
 	}
+	parallel.Default.Rows(height, int(size.X), func(lo, hi int) {
+		imgStart := lo * contentWidth
+		dataStart := lo * dataWidth
+		for i := lo; i < hi; i++ {
+			copy(buffer[imgStart:imgStart+contentWidth], data[dataStart:dataStart+contentWidth])
+			imgStart += contentWidth
+			dataStart += dataWidth
+		}
+	})
 	return nil
 }
 
@@ -433,6 +465,7 @@ func clampInt(value, minVal, maxVal int) int {
 // DDA returns data in physical panel orientation (e.g., 1920x1080),
 // but we need logical orientation (e.g., 1080x1920).
 func (sc *ScreenCapture) copyRotatedFrame(dst, src []byte, physicalSize disp.Point, pitch int32, rotation disp.ModeRotation, logicalWidth, logicalHeight int32) error {
+	physWidth := int(physicalSize.X)
 	physHeight := int(physicalSize.Y)
 	logWidth := int(logicalWidth)
 	logHeight := int(logicalHeight)
@@ -445,51 +478,11 @@ func (sc *ScreenCapture) copyRotatedFrame(dst, src []byte, physicalSize disp.Poi
 	if len(dst) < expectedDstSize {
 		return fmt.Errorf("destination buffer too small: %d < %d", len(dst), expectedDstSize)
 	}
-
-	pitchInt := int(pitch)
-	pitchU32 := pitchInt / 4
-	dstU32 := (*[1 << 30]uint32)(unsafe.Pointer(&dst[0]))[:len(dst)/4]
-	srcU32 := (*[1 << 30]uint32)(unsafe.Pointer(&src[0]))[:len(src)/4]
-
-	if rotation == disp.ModeRotationRotate90 {
-		physHeightMinus1 := physHeight - 1
-		
-		for logY := 0; logY < logHeight; logY++ {
-			dstRowStart := logY * logWidth
-			physX := logY
-			for logX := 0; logX < logWidth; logX++ {
-				physY := physHeightMinus1 - logX
-				srcOffset := physY*pitchU32 + physX
-				dstOffset := dstRowStart + logX
-				dstU32[dstOffset] = srcU32[srcOffset]
-			}
-		}
-	} else if rotation == disp.ModeRotationRotate180 {
-		physHeightMinus1 := physHeight - 1
-		for logY := 0; logY < logHeight; logY++ {
-			dstRowStart := logY * logWidth
-			physX := logY
-			for logX := 0; logX < logWidth; logX++ {
-				physY := physHeightMinus1 - logX
-				srcOffset := physY*pitchU32 + physX
-				dstOffset := dstRowStart + logX
-				dstU32[dstOffset] = srcU32[srcOffset]
-			}
-		}
-	} else if rotation == disp.ModeRotationRotate270 {
-		physHeightMinus1 := physHeight - 1
-		for logY := 0; logY < logHeight; logY++ {
-			dstRowStart := logY * logWidth
-			physX := physHeightMinus1 - logY
-			for logX := 0; logX < logWidth; logX++ {
-				physY := logX
-				srcOffset := physY*pitchU32 + physX
-				dstOffset := dstRowStart + logX
-				dstU32[dstOffset] = srcU32[srcOffset]
-			}
-		}
+	if w, h := rotate.LogicalSize(physWidth, physHeight, rotation); w != logWidth || h != logHeight {
+		return fmt.Errorf("rotated size %dx%d does not match output %dx%d", w, h, logWidth, logHeight)
 	}
 
+	rotate.Frame(dst, logWidth*4, src, int(pitch), physWidth, physHeight, rotation)
 	return nil
 }
 
@@ -515,8 +508,38 @@ func (sc *ScreenCapture) GetBounds() (disp.Rect, error) {
 	return desc.DesktopCoordinates, nil
 }
 
+// FrameSize returns the size of frames written by GetFrameBGRA.
+func (sc *ScreenCapture) FrameSize() (int, int) {
+	return int(sc.logicalWidth), int(sc.logicalHeight)
+}
+
+// OutputName returns the device name of the captured output, e.g. \\.\DISPLAY1.
+func (sc *ScreenCapture) OutputName() string {
+	if sc.dxgiOutput == nil {
+		return ""
+	}
+	desc := disp.OutputDesc{}
+	hr := sc.dxgiOutput.GetDesc(&desc)
+	if hr := resultcode.ResultCode(hr); hr.Failed() {
+		return ""
+	}
+	return windows.UTF16ToString(desc.DeviceName[:])
+}
+
+// PresentTime returns the wall-clock time at which the last acquired frame was
+// presented, derived from DuplicationFrameInfo.LastPresentTime.
+func (sc *ScreenCapture) PresentTime() time.Time {
+	return qpcToTime(sc.currentFrameInfo.LastPresentTime)
+}
+
+// ProtectedContentMasked reports whether the last acquired frame had protected
+// content masked out, from DuplicationFrameInfo.ProtectedContentMaskedOut.
+func (sc *ScreenCapture) ProtectedContentMasked() bool {
+	return sc.currentFrameInfo.ProtectedContentMaskedOut != 0
+}
+
 // SetMonitorBounds sets monitor coordinates from MonitorInfo.
-// These coordinates will be used in drawCursor instead of GetBounds().
+// These coordinates will be returned by GetBounds() instead of the output description.
 func (sc *ScreenCapture) SetMonitorBounds(left, top, right, bottom int32) {
 	sc.monitorBounds = &disp.Rect{
 		Left:   left,
@@ -531,6 +554,14 @@ func (sc *ScreenCapture) SetCaptureCursor(enabled bool) {
 	sc.captureCursor = enabled
 }
 
+// SetCursorScale sets the factor by which the drawn cursor shape is resized.
+// Use it to keep the cursor readable when frames are scaled afterwards.
+func (sc *ScreenCapture) SetCursorScale(scale float64, filter cursor.Filter) {
+	sc.cursorScale = scale
+	sc.cursorFilter = filter
+	sc.drawShape = nil
+}
+
 func newScreenCaptureFormat(device *gfx11.Device, deviceCtx *gfx11.DeviceContext, output uint, format disp.PixelFormat) (*ScreenCapture, error) {
 	var hr int32
 
@@ -0,0 +1,42 @@
+//go:build windows
+
+package capture
+
+import (
+	"testing"
+
+	"github.com/shinkar94/godesktopdup/disp"
+)
+
+func BenchmarkCopyFullFrame(b *testing.B) {
+	for _, sz := range []struct {
+		name          string
+		width, height int
+	}{
+		{"1080p", 1920, 1080},
+		{"1440p", 2560, 1440},
+		{"4K", 3840, 2160},
+	} {
+		contentWidth := sz.width * 4
+		for _, layout := range []struct {
+			name      string
+			dataWidth int
+		}{
+			{"tight", contentWidth},
+			{"padded", (contentWidth+255)&^255 + 256},
+		} {
+			b.Run(sz.name+"/"+layout.name, func(b *testing.B) {
+				var sc ScreenCapture
+				size := disp.Point{X: int32(sz.width), Y: int32(sz.height)}
+				buffer := make([]byte, contentWidth*sz.height)
+				data := make([]byte, layout.dataWidth*sz.height)
+				b.SetBytes(int64(len(buffer)))
+				for i := 0; i < b.N; i++ {
+					if err := sc.copyFullFrame(buffer, data, size, contentWidth, layout.dataWidth); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
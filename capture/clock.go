@@ -0,0 +1,44 @@
+//go:build windows
+
+package capture
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modKernel32                   = windows.NewLazySystemDLL("kernel32.dll")
+	procQueryPerformanceCounter   = modKernel32.NewProc("QueryPerformanceCounter")
+	procQueryPerformanceFrequency = modKernel32.NewProc("QueryPerformanceFrequency")
+
+	qpcFrequencyOnce sync.Once
+	qpcFrequency     int64
+)
+
+func queryPerformanceCounter() int64 {
+	var counter int64
+	procQueryPerformanceCounter.Call(uintptr(unsafe.Pointer(&counter)))
+	return counter
+}
+
+// qpcToTime converts a QueryPerformanceCounter value such as
+// DuplicationFrameInfo.LastPresentTime to wall-clock time.
+// Zero means the frame carried no present time and maps to time.Now().
+func qpcToTime(ticks int64) time.Time {
+	now := time.Now()
+	if ticks == 0 {
+		return now
+	}
+	qpcFrequencyOnce.Do(func() {
+		procQueryPerformanceFrequency.Call(uintptr(unsafe.Pointer(&qpcFrequency)))
+	})
+	if qpcFrequency == 0 {
+		return now
+	}
+	elapsed := queryPerformanceCounter() - ticks
+	return now.Add(-time.Duration(float64(elapsed) * float64(time.Second) / float64(qpcFrequency)))
+}
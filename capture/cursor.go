@@ -1,57 +1,15 @@
+//go:build windows
+
 package capture
 
 import (
 	"fmt"
-	"sync"
-	"syscall"
-	"unsafe"
 
+	"github.com/shinkar94/godesktopdup/cursor"
 	"github.com/shinkar94/godesktopdup/disp"
 	resultcode "github.com/shinkar94/godesktopdup/errors"
 )
 
-var (
-	cursorDLLOnce sync.Once
-	cursorDLL     *syscall.LazyDLL
-	cursorProc    *syscall.LazyProc
-)
-
-func initCursorAPI() {
-	cursorDLLOnce.Do(func() {
-		cursorDLL = syscall.NewLazyDLL("user32.dll")
-		cursorProc = cursorDLL.NewProc("GetCursorInfo")
-	})
-}
-
-// getGlobalCursorPos retrieves global cursor position via Windows API.
-func getGlobalCursorPos() (x, y int, visible bool, err error) {
-	initCursorAPI()
-
-	type POINT struct {
-		X int32
-		Y int32
-	}
-
-	type CURSORINFO struct {
-		cbSize      uint32
-		flags       uint32
-		hCursor     uintptr
-		ptScreenPos POINT
-	}
-
-	const CURSOR_SHOWING = 0x00000001
-
-	var ci CURSORINFO
-	ci.cbSize = uint32(unsafe.Sizeof(ci))
-
-	ret, _, _ := cursorProc.Call(uintptr(unsafe.Pointer(&ci)))
-	if ret == 0 {
-		return 0, 0, false, fmt.Errorf("GetCursorInfo failed")
-	}
-
-	return int(ci.ptScreenPos.X), int(ci.ptScreenPos.Y), (ci.flags & CURSOR_SHOWING) != 0, nil
-}
-
 // getCursorShape retrieves cursor shape from current frame.
 func (sc *ScreenCapture) getCursorShape() error {
 	if sc.outputDuplication == nil {
@@ -99,262 +57,96 @@ func (sc *ScreenCapture) getCursorShape() error {
 		}
 	}
 
+	if int(bufferSizeRequired) < len(sc.cursorShapeBuffer) {
+		sc.cursorShapeBuffer = sc.cursorShapeBuffer[:bufferSizeRequired]
+	}
 	sc.cursorShapeInfo = shapeInfo
 
 	return nil
 }
 
-// drawCursor draws cursor on frame.
-func (sc *ScreenCapture) drawCursor(buffer []byte, width, height int) error {
-	desktopCursorX, desktopCursorY, visible, err := getGlobalCursorPos()
-	if err != nil || !visible {
-		return nil
-	}
-
-	var bounds disp.Rect
-	if sc.monitorBounds != nil {
-		bounds = *sc.monitorBounds
-	} else {
-		var err error
-		bounds, err = sc.GetBounds()
-		if err != nil {
-			return nil
-		}
+// updateCursorState records pointer position and shape reported with the current frame.
+// Position is only updated when the frame carries a mouse update.
+func (sc *ScreenCapture) updateCursorState() {
+	frameInfo := &sc.currentFrameInfo
+	sc.cursorState.LastUpdate = frameInfo.LastMouseUpdateTime
+	if frameInfo.LastMouseUpdateTime != 0 {
+		sc.cursorState.X = int(frameInfo.PointerPosition.Position.X)
+		sc.cursorState.Y = int(frameInfo.PointerPosition.Position.Y)
+		sc.cursorState.Visible = frameInfo.PointerPosition.Visible != 0
 	}
 
-	boundsLeft := int(bounds.Left)
-	boundsTop := int(bounds.Top)
-	boundsRight := int(bounds.Right)
-	boundsBottom := int(bounds.Bottom)
-
-	if desktopCursorX < boundsLeft || desktopCursorX >= boundsRight ||
-		desktopCursorY < boundsTop || desktopCursorY >= boundsBottom {
-		return nil
+	if frameInfo.PointerShapeBufferSize == 0 {
+		return
 	}
-
-	if sc.cursorShapeInfo.Width == 0 || sc.cursorShapeInfo.Height == 0 {
-		return nil
+	if err := sc.getCursorShape(); err != nil {
+		return
 	}
 
-	cursorX := desktopCursorX - boundsLeft
-	cursorY := desktopCursorY - boundsTop
-
-	cursorWidth := int(sc.cursorShapeInfo.Width)
-	cursorHeight := int(sc.cursorShapeInfo.Height)
-	cursorPitch := int(sc.cursorShapeInfo.Pitch)
-	hotSpotX := int(sc.cursorShapeInfo.HotSpot.X)
-	hotSpotY := int(sc.cursorShapeInfo.HotSpot.Y)
-
-	startX := cursorX - hotSpotX
-	startY := cursorY - hotSpotY
-
-	if startX+cursorWidth <= 0 || startX >= width || startY+cursorHeight <= 0 || startY >= height {
-		return nil
+	if sc.cursorCache == nil {
+		sc.cursorCache = cursor.NewCache(0)
 	}
-
-	switch sc.cursorShapeInfo.Type {
-	case disp.DuplicationPointerShapeTypeMonochrome:
-		return sc.drawMonochromeCursor(buffer, width, height, startX, startY, cursorWidth, cursorHeight, cursorPitch)
-	case disp.DuplicationPointerShapeTypeColor:
-		return sc.drawColorCursor(buffer, width, height, startX, startY, cursorWidth, cursorHeight, cursorPitch)
-	case disp.DuplicationPointerShapeTypeMaskedColor:
-		return sc.drawMaskedColorCursor(buffer, width, height, startX, startY, cursorWidth, cursorHeight, cursorPitch)
-	default:
-		return nil
+	shape, err := sc.cursorCache.Get(sc.cursorShapeInfo, sc.cursorShapeBuffer)
+	if err != nil || shape.ID == sc.cursorState.ShapeID {
+		return
 	}
+	sc.cursorShape = shape
+	sc.cursorState.ShapeID = shape.ID
+	sc.cursorState.HotSpot = shape.HotSpot
+	sc.cursorState.Shape = shape
 }
 
-// drawMonochromeCursor draws monochrome cursor (AND mask + XOR mask).
-func (sc *ScreenCapture) drawMonochromeCursor(buffer []byte, width, height, startX, startY, cursorWidth, cursorHeight, cursorPitch int) error {
-	andMaskPitch := (cursorWidth + 7) / 8
-	andMaskSize := andMaskPitch * cursorHeight
-	xorMaskOffset := andMaskSize
-
-	andMask := sc.cursorShapeBuffer[:andMaskSize]
-	xorMask := sc.cursorShapeBuffer[xorMaskOffset : xorMaskOffset+andMaskSize]
-
-	clipTop := 0
-	if startY < 0 {
-		clipTop = -startY
-	}
-	clipBottom := cursorHeight
-	if startY+cursorHeight > height {
-		clipBottom = height - startY
-	}
-	clipLeft := 0
-	if startX < 0 {
-		clipLeft = -startX
-	}
-	clipRight := cursorWidth
-	if startX+cursorWidth > width {
-		clipRight = width - startX
-	}
-
-	bufU32 := (*[1 << 30]uint32)(unsafe.Pointer(&buffer[0]))[:len(buffer)/4]
-	widthU32 := width
-
-	andMaskRowStart := clipTop * andMaskPitch
-	for y := clipTop; y < clipBottom; y++ {
-		frameY := startY + y
-		dstRowStart := frameY*widthU32 + startX
-		andMaskByteStart := andMaskRowStart + clipLeft/8
-
-		for x := clipLeft; x < clipRight; x++ {
-			byteIdx := andMaskByteStart + x/8
-			bitIdx := 7 - (x & 7)
-
-			andBit := (andMask[byteIdx] >> bitIdx) & 1
-			if andBit == 0 {
-				continue
-			}
-
-			xorBit := (xorMask[byteIdx] >> bitIdx) & 1
-
-			dstOffset := dstRowStart + x
-			if xorBit == 0 {
-				bufU32[dstOffset] = 0x000000FF
-			} else {
-				bufU32[dstOffset] = 0xFFFFFFFF
-			}
-		}
-		andMaskRowStart += andMaskPitch
-	}
+// CursorState returns the pointer state reported with the last acquired frame.
+// State.Shape is non-nil only if the shape changed with that frame.
+func (sc *ScreenCapture) CursorState() cursor.State {
+	return sc.cursorState
+}
 
-	return nil
+// CursorShape returns the most recently decoded pointer shape, or nil.
+func (sc *ScreenCapture) CursorShape() *cursor.Shape {
+	return sc.cursorShape
 }
 
-// drawColorCursor draws color cursor with alpha blending.
-func (sc *ScreenCapture) drawColorCursor(buffer []byte, width, height, startX, startY, cursorWidth, cursorHeight, cursorPitch int) error {
-	clipTop := 0
-	if startY < 0 {
-		clipTop = -startY
-	}
-	clipBottom := cursorHeight
-	if startY+cursorHeight > height {
-		clipBottom = height - startY
-	}
-	clipLeft := 0
-	if startX < 0 {
-		clipLeft = -startX
-	}
-	clipRight := cursorWidth
-	if startX+cursorWidth > width {
-		clipRight = width - startX
+// drawCursor draws cursor on frame at the position reported by DXGI, which is
+// the top-left corner of the shape, clipped to the frame.
+// orientation is the rotation of buffer relative to the logical desktop:
+// ModeRotationIdentity when the frame was already rotated to logical orientation.
+func (sc *ScreenCapture) drawCursor(buffer []byte, width, height int, orientation disp.ModeRotation) error {
+	sc.lastCursorRect = disp.Rect{}
+	if !sc.cursorState.Visible || sc.cursorShape == nil {
+		return nil
 	}
 
-	bufU32 := (*[1 << 30]uint32)(unsafe.Pointer(&buffer[0]))[:len(buffer)/4]
-	cursorU32 := (*[1 << 30]uint32)(unsafe.Pointer(&sc.cursorShapeBuffer[0]))[:len(sc.cursorShapeBuffer)/4]
-	widthU32 := width
-	cursorPitchU32 := cursorPitch / 4
-	
-	maxCursorBufferU32 := len(sc.cursorShapeBuffer) / 4
-
-	for y := clipTop; y < clipBottom; y++ {
-		frameY := startY + y
-		dstRowStart := frameY*widthU32 + startX
-		cursorRowStart := y * cursorPitchU32
-
-		maxCursorOffsetU32 := cursorRowStart + clipRight
-		if maxCursorOffsetU32 > maxCursorBufferU32 {
-			maxCursorOffsetU32 = maxCursorBufferU32
-		}
-
-		for x := clipLeft; x < clipRight; x++ {
-			cursorOffsetU32 := cursorRowStart + x
-			if cursorOffsetU32 >= maxCursorOffsetU32 {
-				continue
-			}
+	// Map the hot spot rather than the corner: the rotated and scaled shape
+	// keeps it at the same desktop pixel.
+	tip := sc.cursorState.Tip()
+	tipX, tipY := cursor.ToPhysical(tip.X, tip.Y, orientation, int(sc.logicalWidth), int(sc.logicalHeight))
 
-			cursorPixel := cursorU32[cursorOffsetU32]
-			a := byte(cursorPixel >> 24)
-			if a == 0 {
-				continue
-			}
-
-			dstOffset := dstRowStart + x
-			
-			if a == 255 {
-				bufU32[dstOffset] = cursorPixel | 0xFF000000
-			} else {
-				alpha := uint16(a)
-				invAlpha := 255 - alpha
-				bgPixel := bufU32[dstOffset]
-				
-				bgB := uint16(bgPixel & 0xFF)
-				bgG := uint16((bgPixel >> 8) & 0xFF)
-				bgR := uint16((bgPixel >> 16) & 0xFF)
-				
-				curB := uint16(cursorPixel & 0xFF)
-				curG := uint16((cursorPixel >> 8) & 0xFF)
-				curR := uint16((cursorPixel >> 16) & 0xFF)
-				
-				newB := byte((bgB*invAlpha + curB*alpha) / 255)
-				newG := byte((bgG*invAlpha + curG*alpha) / 255)
-				newR := byte((bgR*invAlpha + curR*alpha) / 255)
-				
-				bufU32[dstOffset] = uint32(newB) | (uint32(newG) << 8) | (uint32(newR) << 16) | 0xFF000000
-			}
-		}
+	shape := sc.transformedCursorShape(orientation)
+	startX := tipX - shape.HotSpot.X
+	startY := tipY - shape.HotSpot.Y
+	sc.lastCursorRect = disp.Rect{
+		Left:   int32(clampInt(startX, 0, width)),
+		Top:    int32(clampInt(startY, 0, height)),
+		Right:  int32(clampInt(startX+shape.Mask.Width, 0, width)),
+		Bottom: int32(clampInt(startY+shape.Mask.Height, 0, height)),
 	}
 
-	return nil
+	return shape.Draw(buffer, width, height, width*4, tipX, tipY)
 }
 
-// drawMaskedColorCursor draws masked color cursor (XOR mask + AND mask).
-func (sc *ScreenCapture) drawMaskedColorCursor(buffer []byte, width, height, startX, startY, cursorWidth, cursorHeight, cursorPitch int) error {
-	xorMaskPitch := cursorPitch
-	xorMaskSize := xorMaskPitch * cursorHeight
-	andMaskPitch := (cursorWidth + 7) / 8
-	andMaskSize := andMaskPitch * cursorHeight
-	andMaskOffset := xorMaskSize
-
-	xorMask := sc.cursorShapeBuffer[:xorMaskSize]
-	andMask := sc.cursorShapeBuffer[andMaskOffset : andMaskOffset+andMaskSize]
-
-	clipTop := 0
-	if startY < 0 {
-		clipTop = -startY
-	}
-	clipBottom := cursorHeight
-	if startY+cursorHeight > height {
-		clipBottom = height - startY
+// transformedCursorShape returns the current shape scaled and rotated for drawing,
+// reusing the previous result while the shape and orientation are unchanged.
+func (sc *ScreenCapture) transformedCursorShape(orientation disp.ModeRotation) *cursor.Shape {
+	if sc.drawShape != nil && sc.drawShapeSource == sc.cursorShape && sc.drawShapeRotation == orientation {
+		return sc.drawShape
 	}
-	clipLeft := 0
-	if startX < 0 {
-		clipLeft = -startX
+	shape := sc.cursorShape
+	if sc.cursorScale > 0 && sc.cursorScale != 1 {
+		shape = shape.Scale(sc.cursorScale, sc.cursorFilter)
 	}
-	clipRight := cursorWidth
-	if startX+cursorWidth > width {
-		clipRight = width - startX
-	}
-
-	bufU32 := (*[1 << 30]uint32)(unsafe.Pointer(&buffer[0]))[:len(buffer)/4]
-	xorU32 := (*[1 << 30]uint32)(unsafe.Pointer(&xorMask[0]))[:len(xorMask)/4]
-	widthU32 := width
-	xorMaskPitchU32 := xorMaskPitch / 4
-
-	andMaskRowStart := clipTop * andMaskPitch
-	for y := clipTop; y < clipBottom; y++ {
-		frameY := startY + y
-		dstRowStart := frameY*widthU32 + startX
-		cursorRowStart := y * xorMaskPitchU32
-		andMaskByteStart := andMaskRowStart + clipLeft/8
-
-		for x := clipLeft; x < clipRight; x++ {
-			byteIdx := andMaskByteStart + x/8
-			bitIdx := 7 - (x & 7)
-			andBit := (andMask[byteIdx] >> bitIdx) & 1
-
-			if andBit == 0 {
-				continue
-			}
-
-			dstOffset := dstRowStart + x
-			cursorOffset := cursorRowStart + x
-			bufU32[dstOffset] = xorU32[cursorOffset]
-		}
-		andMaskRowStart += andMaskPitch
-	}
-
-	return nil
+	sc.drawShape = shape.Rotate(orientation)
+	sc.drawShapeSource = sc.cursorShape
+	sc.drawShapeRotation = orientation
+	return sc.drawShape
 }
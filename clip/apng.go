@@ -0,0 +1,72 @@
+package clip
+
+import (
+	"encoding/binary"
+	"image"
+	"io"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/pngenc"
+)
+
+// APNG dispose and blend operations, see the fcTL chunk.
+const (
+	apngDisposeNone = 0
+	apngBlendSource = 0
+	apngBlendOver   = 1
+)
+
+// apngFrame returns the zlib image data for region r of f and the blend op to
+// use. Pixels equal to prev are made fully transparent and blended over the
+// previous frame, so they cost almost nothing after compression.
+func apngFrame(f *frame.Frame, r image.Rectangle, prev []byte, opts *Options) ([]byte, byte, error) {
+	w, h := r.Dx(), r.Dy()
+	pix := make([]byte, w*h*4)
+	frame.CopyRect(pix, w*4, f.Pix[f.PixOffset(r.Min.X, r.Min.Y):], f.Stride, image.Rect(0, 0, w, h))
+
+	blend := byte(apngBlendSource)
+	canvasStride := f.Width * 4
+	for y := 0; y < h; y++ {
+		row := pix[y*w*4:]
+		for x := 0; x < w; x++ {
+			p := row[x*4:]
+			p[3] = 0xFF
+			if prev == nil {
+				continue
+			}
+			q := prev[(r.Min.Y+y)*canvasStride+(r.Min.X+x)*4:]
+			if p[0] == q[0] && p[1] == q[1] && p[2] == q[2] {
+				p[0], p[1], p[2], p[3] = 0, 0, 0, 0
+				blend = apngBlendOver
+			}
+		}
+	}
+	data, err := pngenc.ImageData(pix, w*4, image.Rect(0, 0, w, h), &pngenc.Options{Level: opts.PNGLevel, Alpha: true})
+	return data, blend, err
+}
+
+// apngControl returns the fcTL payload.
+func apngControl(seq uint32, r image.Rectangle, delay time.Duration, blend byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, seq)
+	for _, v := range []int{r.Dx(), r.Dy(), r.Min.X, r.Min.Y} {
+		b = binary.BigEndian.AppendUint32(b, uint32(v))
+	}
+	ms := min(max(delay.Milliseconds(), 1), 0xFFFF)
+	b = binary.BigEndian.AppendUint16(b, uint16(ms))
+	b = binary.BigEndian.AppendUint16(b, 1000)
+	return append(b, apngDisposeNone, blend)
+}
+
+// writeAPNGHeader writes the signature, IHDR and acTL chunks.
+func writeAPNGHeader(w io.Writer, width, height, frames int) error {
+	if _, err := io.WriteString(w, pngenc.Signature); err != nil {
+		return err
+	}
+	if err := pngenc.WriteChunk(w, "IHDR", pngenc.Header(width, height, true)); err != nil {
+		return err
+	}
+	actl := binary.BigEndian.AppendUint32(nil, uint32(frames))
+	actl = binary.BigEndian.AppendUint32(actl, 0)
+	return pngenc.WriteChunk(w, "acTL", actl)
+}
@@ -0,0 +1,264 @@
+// Package clip records short animated GIF or APNG clips from a frame stream.
+package clip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/pngenc"
+)
+
+// Format is an animation format.
+type Format int
+
+const (
+	GIF Format = iota
+	APNG
+)
+
+// DefaultDelay is the frame duration used when frames carry no usable
+// timestamps, and for the last frame of a clip.
+const DefaultDelay = 100 * time.Millisecond
+
+// ErrLimit is returned by Add when the frame would exceed MaxDuration or
+// MaxBytes. The frame is not added; the clip can still be closed.
+var ErrLimit = errors.New("clip: limit reached")
+
+// Options configures a Recorder. A nil *Options records a GIF without limits.
+type Options struct {
+	Format Format
+	// MaxDuration caps the time between the first and the last frame. 0 means no limit.
+	MaxDuration time.Duration
+	// MaxBytes caps the size of the output. 0 means no limit.
+	MaxBytes int64
+
+	// Quantizer and Dither apply to GIF. Frames with at most 256 colors are
+	// always stored exactly.
+	Quantizer Quantizer
+	Dither    bool
+
+	// PNGLevel applies to APNG.
+	PNGLevel pngenc.CompressionLevel
+}
+
+// pending is an encoded frame waiting for its duration, which is known only
+// when the next frame arrives.
+type pending struct {
+	time  time.Time
+	size  int
+	write func(delay time.Duration) []byte
+}
+
+// Recorder encodes frames into an animation. Only the bounding box of what
+// changed is stored per frame: the frame's damage narrowed down to pixels that
+// differ from the previous frame. Unchanged pixels inside the box become
+// transparent. GIF is written as frames arrive; APNG, whose header carries
+// the frame count, is buffered until Close.
+type Recorder struct {
+	w    io.Writer
+	opts Options
+
+	width, height int
+	canvas        []byte
+	start         time.Time
+	last          *pending
+	lastDelay     time.Duration
+	frames        int
+	written       int64
+	body          bytes.Buffer
+	seq           uint32
+	closed        bool
+}
+
+// New returns a recorder writing to w.
+func New(w io.Writer, opts *Options) *Recorder {
+	r := &Recorder{w: w, lastDelay: DefaultDelay}
+	if opts != nil {
+		r.opts = *opts
+	}
+	return r
+}
+
+// Frames returns the number of frames added so far.
+func (r *Recorder) Frames() int {
+	return r.frames
+}
+
+// Add appends f. Frames that change nothing extend the previous frame.
+func (r *Recorder) Add(f *frame.Frame) error {
+	if r.closed {
+		return errors.New("clip: recorder is closed")
+	}
+	first := r.canvas == nil
+	if first {
+		if f.Width <= 0 || f.Height <= 0 || f.Width > 0xFFFF || f.Height > 0xFFFF {
+			return fmt.Errorf("clip: invalid frame size %dx%d", f.Width, f.Height)
+		}
+		r.width, r.height = f.Width, f.Height
+		r.start = f.Time
+	} else if f.Width != r.width || f.Height != r.height {
+		return fmt.Errorf("clip: frame size changed from %dx%d to %dx%d", r.width, r.height, f.Width, f.Height)
+	}
+	if r.opts.MaxDuration > 0 && !r.start.IsZero() && f.Time.Sub(r.start) > r.opts.MaxDuration {
+		return ErrLimit
+	}
+
+	var prev []byte
+	rect := f.Rect()
+	if !first {
+		prev = r.canvas
+		rect = r.changed(f)
+		if rect.Empty() {
+			return nil
+		}
+	}
+
+	next, err := r.encode(f, rect, prev, first)
+	if err != nil {
+		return err
+	}
+	if r.opts.MaxBytes > 0 {
+		total := r.written + int64(next.size) + trailerReserve
+		if r.last != nil {
+			total += int64(r.last.size)
+		}
+		if total > r.opts.MaxBytes {
+			return ErrLimit
+		}
+	}
+
+	if first {
+		r.canvas = make([]byte, f.Width*f.Height*4)
+		if r.opts.Format == GIF {
+			if err := r.emit(gifHeader(f.Width, f.Height)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := r.flush(f.Time); err != nil {
+		return err
+	}
+	frame.CopyRect(r.canvas, f.Width*4, f.Pix, f.Stride, rect)
+	r.last = next
+	r.frames++
+	return nil
+}
+
+// trailerReserve covers the bytes Close adds after the last frame.
+const trailerReserve = 128
+
+// changed returns the bounding box of the pixels within f's damage that
+// differ from the previous frame.
+func (r *Recorder) changed(f *frame.Frame) image.Rectangle {
+	damage := f.Damage()
+	if damage == nil {
+		damage = []image.Rectangle{f.Rect()}
+	}
+	x0, y0, x1, y1 := f.Width, f.Height, 0, 0
+	stride := f.Width * 4
+	for _, d := range damage {
+		d = d.Intersect(f.Rect())
+		for y := d.Min.Y; y < d.Max.Y; y++ {
+			p := f.Pix[f.PixOffset(0, y):]
+			q := r.canvas[y*stride:]
+			for x := d.Min.X; x < d.Max.X; x++ {
+				o := x * 4
+				if p[o] != q[o] || p[o+1] != q[o+1] || p[o+2] != q[o+2] {
+					x0, x1 = min(x0, x), max(x1, x+1)
+					y0, y1 = min(y0, y), max(y1, y+1)
+				}
+			}
+		}
+	}
+	if x0 >= x1 {
+		return image.Rectangle{}
+	}
+	return image.Rect(x0, y0, x1, y1)
+}
+
+func (r *Recorder) encode(f *frame.Frame, rect image.Rectangle, prev []byte, first bool) (*pending, error) {
+	if r.opts.Format == APNG {
+		data, blend, err := apngFrame(f, rect, prev, &r.opts)
+		if err != nil {
+			return nil, err
+		}
+		return &pending{time: f.Time, size: len(data) + 2*12 + 30, write: func(delay time.Duration) []byte {
+			var b bytes.Buffer
+			pngenc.WriteChunk(&b, "fcTL", apngControl(r.nextSeq(), rect, delay, blend))
+			if first {
+				pngenc.WriteChunk(&b, "IDAT", data)
+			} else {
+				pngenc.WriteChunk(&b, "fdAT", append(binary.BigEndian.AppendUint32(nil, r.nextSeq()), data...))
+			}
+			return b.Bytes()
+		}}, nil
+	}
+
+	data, transparent := gifFrame(f, rect, prev, &r.opts)
+	return &pending{time: f.Time, size: len(data) + 8, write: func(delay time.Duration) []byte {
+		return append(gifControl(delay, transparent), data...)
+	}}, nil
+}
+
+func (r *Recorder) nextSeq() uint32 {
+	s := r.seq
+	r.seq++
+	return s
+}
+
+// flush writes the pending frame, timing it up to t.
+func (r *Recorder) flush(t time.Time) error {
+	if r.last == nil {
+		return nil
+	}
+	delay := r.lastDelay
+	if !t.IsZero() && !r.last.time.IsZero() && t.After(r.last.time) {
+		delay = t.Sub(r.last.time)
+		r.lastDelay = delay
+	}
+	b := r.last.write(delay)
+	r.last = nil
+	return r.emit(b)
+}
+
+func (r *Recorder) emit(b []byte) error {
+	r.written += int64(len(b))
+	if r.opts.Format == APNG {
+		r.body.Write(b)
+		return nil
+	}
+	_, err := r.w.Write(b)
+	return err
+}
+
+// Close writes the last frame and finishes the file. It does not close the
+// underlying writer.
+func (r *Recorder) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if r.frames == 0 {
+		return errors.New("clip: no frames recorded")
+	}
+	if err := r.flush(time.Time{}); err != nil {
+		return err
+	}
+	if r.opts.Format == GIF {
+		_, err := r.w.Write([]byte{0x3B})
+		return err
+	}
+	if err := writeAPNGHeader(r.w, r.width, r.height, r.frames); err != nil {
+		return err
+	}
+	if _, err := r.w.Write(r.body.Bytes()); err != nil {
+		return err
+	}
+	return pngenc.WriteChunk(r.w, "IEND", nil)
+}
@@ -0,0 +1,439 @@
+package clip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/pngenc"
+)
+
+var start = time.Unix(1700000000, 0)
+
+// block is where frame i of clipFrames has its moving square.
+func block(i int) image.Rectangle {
+	return image.Rect(0, 0, 10, 10).Add(image.Pt(4+5*i, 3+2*i))
+}
+
+// clipFrames returns n frames 40ms apart of a striped 64x48 screen with a
+// square moving over it. Each frame's damage covers the square's old and new
+// position plus a region that did not change.
+func clipFrames(n int) []*frame.Frame {
+	f := frame.New(64, 48)
+	stripes := [][4]byte{{0, 0, 0xFF, 0xFF}, {0, 0xFF, 0, 0xFF}, {0xFF, 0, 0, 0xFF}, {0x20, 0x40, 0x60, 0xFF}}
+	paint := func(r image.Rectangle, square bool) {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				c := stripes[x/8%len(stripes)]
+				if square {
+					c = [4]byte{0xEE, 0xDD, 0xCC, 0xFF}
+				}
+				copy(f.Pix[f.PixOffset(x, y):], c[:])
+			}
+		}
+	}
+	paint(f.Rect(), false)
+	paint(block(0), true)
+	f.Time = start
+	frames := []*frame.Frame{f.Clone()}
+	for i := 1; i < n; i++ {
+		paint(block(i-1), false)
+		paint(block(i), true)
+		f.Time = start.Add(time.Duration(i) * 40 * time.Millisecond)
+		f.Dirty = []image.Rectangle{block(i - 1), block(i), image.Rect(50, 40, 60, 48)}
+		frames = append(frames, f.Clone())
+	}
+	return frames
+}
+
+func record(t *testing.T, opts *Options, frames []*frame.Frame) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	r := New(&buf, opts)
+	for _, f := range frames {
+		if err := r.Add(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// checkCanvas fails unless canvas shows the pixels of f within tol.
+func checkCanvas(t *testing.T, i int, canvas *image.NRGBA, f *frame.Frame, tol int) {
+	t.Helper()
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			p := f.Pix[f.PixOffset(x, y):]
+			c := canvas.NRGBAAt(x, y)
+			for k, v := range []byte{c.B, c.G, c.R} {
+				if d := int(v) - int(p[k]); d < -tol || d > tol || c.A != 0xFF {
+					t.Fatalf("frame %d: pixel %d,%d is %v, want % x", i, x, y, c, p[:3])
+				}
+			}
+		}
+	}
+}
+
+// changedBox is the region a frame after the first is expected to store.
+func changedBox(i int) image.Rectangle {
+	return block(i - 1).Union(block(i))
+}
+
+// playGIF composites the frames of a decoded GIF, with disposal kept, and
+// calls check with the canvas after each.
+func playGIF(t *testing.T, g *gif.GIF, check func(i int, canvas *image.NRGBA)) {
+	t.Helper()
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, img := range g.Image {
+		if g.Disposal[i] != gif.DisposalNone {
+			t.Fatalf("frame %d: disposal %d", i, g.Disposal[i])
+		}
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA); c.A != 0 {
+					canvas.SetNRGBA(x, y, c)
+				}
+			}
+		}
+		check(i, canvas)
+	}
+}
+
+func TestGIF(t *testing.T) {
+	frames := clipFrames(6)
+	// A frame changing nothing extends the one before it.
+	idle := frames[2].Clone()
+	idle.Time = frames[2].Time.Add(20 * time.Millisecond)
+	idle.Dirty = []image.Rectangle{idle.Rect()}
+	frames = append(frames[:3], append([]*frame.Frame{idle}, frames[3:]...)...)
+
+	g, err := gif.DecodeAll(bytes.NewReader(record(t, nil, frames)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 6 || g.LoopCount != 0 {
+		t.Fatalf("%d frames, loop count %d", len(g.Image), g.LoopCount)
+	}
+	if want := []int{4, 4, 4, 4, 4, 4}; !equalInts(g.Delay, want) {
+		t.Errorf("delays %v, want %v", g.Delay, want)
+	}
+	frames = append(frames[:3], frames[4:]...)
+	playGIF(t, g, func(i int, canvas *image.NRGBA) {
+		checkCanvas(t, i, canvas, frames[i], 0)
+		if b := g.Image[i].Bounds(); i > 0 && b != changedBox(i) {
+			t.Errorf("frame %d stores %v, want %v", i, b, changedBox(i))
+		}
+	})
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestGIFDelays checks delays taken from frame times, with the previous delay
+// repeated for the last frame and DefaultDelay used without timestamps.
+func TestGIFDelays(t *testing.T) {
+	frames := clipFrames(4)
+	frames[1].Time = start.Add(100 * time.Millisecond)
+	frames[2].Time = start.Add(105 * time.Millisecond)
+	frames[3].Time = start.Add(405 * time.Millisecond)
+	g, err := gif.DecodeAll(bytes.NewReader(record(t, nil, frames)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{10, 2, 30, 30}; !equalInts(g.Delay, want) {
+		t.Errorf("delays %v, want %v", g.Delay, want)
+	}
+
+	frames = clipFrames(2)
+	for _, f := range frames {
+		f.Time = time.Time{}
+	}
+	if g, err = gif.DecodeAll(bytes.NewReader(record(t, nil, frames))); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{10, 10}; !equalInts(g.Delay, want) {
+		t.Errorf("without timestamps: delays %v, want %v", g.Delay, want)
+	}
+}
+
+func TestGIFQuantize(t *testing.T) {
+	// A gradient with thousands of colors and noise over half of it.
+	f := frame.New(96, 64)
+	rnd := rand.New(rand.NewSource(1))
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			p := []byte{byte(x * 2), byte(y * 4), byte(x + y*2), 0xFF}
+			if x >= 48 {
+				p[0] += byte(rnd.Intn(16))
+			}
+			copy(f.Pix[f.PixOffset(x, y):], p)
+		}
+	}
+	for _, q := range []Quantizer{MedianCut, Octree} {
+		for _, dither := range []bool{false, true} {
+			g, err := gif.DecodeAll(bytes.NewReader(record(t, &Options{Quantizer: q, Dither: dither}, []*frame.Frame{f})))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Dithering trades per-pixel error for accurate averages.
+			var pixel, area int
+			playGIF(t, g, func(_ int, canvas *image.NRGBA) {
+				for by := 0; by < f.Height; by += 4 {
+					for bx := 0; bx < f.Width; bx += 4 {
+						var got, want [3]int
+						for y := by; y < by+4; y++ {
+							for x := bx; x < bx+4; x++ {
+								p := f.Pix[f.PixOffset(x, y):]
+								c := canvas.NRGBAAt(x, y)
+								for k, v := range []byte{c.B, c.G, c.R} {
+									pixel += max(int(v)-int(p[k]), int(p[k])-int(v))
+									got[k] += int(v)
+									want[k] += int(p[k])
+								}
+							}
+						}
+						for k := range got {
+							area += max(got[k]-want[k], want[k]-got[k])
+						}
+					}
+				}
+			})
+			if len(g.Image[0].Palette) > 256 {
+				t.Errorf("quantizer %d dither %v: %d colors", q, dither, len(g.Image[0].Palette))
+			}
+			n := float64(f.Width * f.Height * 3)
+			if mean := float64(pixel) / n; mean > 6 {
+				t.Errorf("quantizer %d dither %v: mean error %.2f", q, dither, mean)
+			}
+			if mean := float64(area) / n; dither && mean > 1.5 {
+				t.Errorf("quantizer %d dither %v: mean error of 4x4 areas %.2f", q, dither, mean)
+			}
+		}
+	}
+}
+
+type chunk struct {
+	typ  string
+	data []byte
+}
+
+// pngChunks splits a PNG file into its chunks, checking the CRCs.
+func pngChunks(t *testing.T, b []byte) []chunk {
+	t.Helper()
+	if !bytes.HasPrefix(b, []byte(pngenc.Signature)) {
+		t.Fatal("missing PNG signature")
+	}
+	var cs []chunk
+	for b = b[len(pngenc.Signature):]; len(b) > 0; {
+		n := int(binary.BigEndian.Uint32(b))
+		if crc := binary.BigEndian.Uint32(b[8+n:]); crc != crc32.ChecksumIEEE(b[4:8+n]) {
+			t.Fatalf("%s chunk: bad CRC", b[4:8])
+		}
+		cs = append(cs, chunk{string(b[4:8]), b[8 : 8+n]})
+		b = b[12+n:]
+	}
+	return cs
+}
+
+// apngFrameInfo is a frame of a parsed APNG.
+type apngFrameInfo struct {
+	rect  image.Rectangle
+	delay time.Duration
+	blend byte
+	img   image.Image
+}
+
+// parseAPNG checks the chunk layout and sequence numbers of an APNG and
+// decodes its frames.
+func parseAPNG(t *testing.T, b []byte) []apngFrameInfo {
+	t.Helper()
+	cs := pngChunks(t, b)
+	if cs[0].typ != "IHDR" || cs[1].typ != "acTL" || cs[len(cs)-1].typ != "IEND" {
+		t.Fatalf("chunks start with %s %s and end with %s", cs[0].typ, cs[1].typ, cs[len(cs)-1].typ)
+	}
+	count := int(binary.BigEndian.Uint32(cs[1].data))
+	if plays := binary.BigEndian.Uint32(cs[1].data[4:]); plays != 0 {
+		t.Errorf("plays %d, want 0 (forever)", plays)
+	}
+
+	var frames []apngFrameInfo
+	seq := uint32(0)
+	for _, c := range cs[2 : len(cs)-1] {
+		var data []byte
+		switch c.typ {
+		case "fcTL":
+			d := c.data
+			if s := binary.BigEndian.Uint32(d); s != seq {
+				t.Fatalf("fcTL sequence %d, want %d", s, seq)
+			}
+			seq++
+			w, h := int(binary.BigEndian.Uint32(d[4:])), int(binary.BigEndian.Uint32(d[8:]))
+			x, y := int(binary.BigEndian.Uint32(d[12:])), int(binary.BigEndian.Uint32(d[16:]))
+			num, den := binary.BigEndian.Uint16(d[20:]), binary.BigEndian.Uint16(d[22:])
+			if d[24] != apngDisposeNone {
+				t.Errorf("frame %d: dispose op %d", len(frames), d[24])
+			}
+			frames = append(frames, apngFrameInfo{
+				rect:  image.Rect(x, y, x+w, y+h),
+				delay: time.Duration(num) * time.Second / time.Duration(den),
+				blend: d[25],
+			})
+			continue
+		case "IDAT":
+			if len(frames) != 1 {
+				t.Fatalf("IDAT after frame %d", len(frames)-1)
+			}
+			data = c.data
+		case "fdAT":
+			if s := binary.BigEndian.Uint32(c.data); s != seq {
+				t.Fatalf("fdAT sequence %d, want %d", s, seq)
+			}
+			seq++
+			data = c.data[4:]
+		default:
+			t.Fatalf("unexpected %s chunk", c.typ)
+		}
+		fr := &frames[len(frames)-1]
+		var buf bytes.Buffer
+		buf.WriteString(pngenc.Signature)
+		pngenc.WriteChunk(&buf, "IHDR", pngenc.Header(fr.rect.Dx(), fr.rect.Dy(), true))
+		pngenc.WriteChunk(&buf, "IDAT", data)
+		pngenc.WriteChunk(&buf, "IEND", nil)
+		img, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatalf("frame %d: %v", len(frames)-1, err)
+		}
+		fr.img = img
+	}
+	if len(frames) != count {
+		t.Errorf("%d frames, acTL says %d", len(frames), count)
+	}
+	return frames
+}
+
+func TestAPNG(t *testing.T) {
+	frames := clipFrames(6)
+	data := record(t, &Options{Format: APNG, PNGLevel: pngenc.BestSpeed}, frames)
+
+	// Decoders without APNG support show the first frame.
+	if img, err := png.Decode(bytes.NewReader(data)); err != nil || img.Bounds() != frames[0].Rect() {
+		t.Fatalf("default image: %v", err)
+	}
+
+	canvas := image.NewNRGBA(frames[0].Rect())
+	for i, fr := range parseAPNG(t, data) {
+		if fr.delay != 40*time.Millisecond {
+			t.Errorf("frame %d: delay %v", i, fr.delay)
+		}
+		if i > 0 && fr.rect != changedBox(i) {
+			t.Errorf("frame %d stores %v, want %v", i, fr.rect, changedBox(i))
+		}
+		if want := byte(apngBlendOver); i > 0 && fr.blend != want {
+			t.Errorf("frame %d: blend op %d, want over", i, fr.blend)
+		}
+		for y := 0; y < fr.rect.Dy(); y++ {
+			for x := 0; x < fr.rect.Dx(); x++ {
+				c := color.NRGBAModel.Convert(fr.img.At(x, y)).(color.NRGBA)
+				if fr.blend == apngBlendSource || c.A != 0 {
+					canvas.SetNRGBA(fr.rect.Min.X+x, fr.rect.Min.Y+y, c)
+				}
+			}
+		}
+		checkCanvas(t, i, canvas, frames[i], 0)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	for _, format := range []Format{GIF, APNG} {
+		frames := clipFrames(10)
+		var buf bytes.Buffer
+		r := New(&buf, &Options{Format: format, MaxDuration: 200 * time.Millisecond})
+		var err error
+		for _, f := range frames {
+			if err = r.Add(f); err != nil {
+				break
+			}
+		}
+		// Frame 5 is exactly at the limit and still added.
+		if !errors.Is(err, ErrLimit) || r.Frames() != 6 {
+			t.Errorf("format %d duration limit: %v after %d frames", format, err, r.Frames())
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		full := record(t, &Options{Format: format}, frames)
+		buf.Reset()
+		limit := int64(len(full) * 2 / 3)
+		r = New(&buf, &Options{Format: format, MaxBytes: limit})
+		for _, f := range frames {
+			if err = r.Add(f); err != nil {
+				break
+			}
+		}
+		if !errors.Is(err, ErrLimit) {
+			t.Errorf("format %d size limit: %v", format, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if int64(buf.Len()) > limit {
+			t.Errorf("format %d: %d bytes, limit %d", format, buf.Len(), limit)
+		}
+		n := 0
+		if format == GIF {
+			g, err := gif.DecodeAll(&buf)
+			if err != nil {
+				t.Fatalf("clip cut at the size limit: %v", err)
+			}
+			n = len(g.Image)
+		} else {
+			n = len(parseAPNG(t, buf.Bytes()))
+		}
+		if n != r.Frames() || n == 0 {
+			t.Errorf("format %d: %d frames decoded, %d added", format, n, r.Frames())
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	r := New(&bytes.Buffer{}, nil)
+	if err := r.Close(); err == nil {
+		t.Error("closed a clip without frames")
+	}
+	if err := New(&bytes.Buffer{}, nil).Add(frame.New(0x10000, 1)); err == nil {
+		t.Error("added a frame wider than 65535 pixels")
+	}
+
+	r = New(&bytes.Buffer{}, nil)
+	r.Add(frame.New(10, 10))
+	if err := r.Add(frame.New(10, 11)); err == nil {
+		t.Error("added a frame of another size")
+	}
+	r.Close()
+	if err := r.Add(frame.New(10, 10)); err == nil {
+		t.Error("added a frame after Close")
+	}
+}
@@ -0,0 +1,201 @@
+package clip
+
+import (
+	"bytes"
+	"compress/lzw"
+	"encoding/binary"
+	"image"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// gifHeader returns the GIF header, logical screen descriptor and the
+// NETSCAPE2.0 extension making the animation loop forever.
+func gifHeader(width, height int) []byte {
+	b := []byte("GIF89a")
+	b = binary.LittleEndian.AppendUint16(b, uint16(width))
+	b = binary.LittleEndian.AppendUint16(b, uint16(height))
+	b = append(b, 0, 0, 0)
+	b = append(b, 0x21, 0xFF, 0x0B)
+	b = append(b, "NETSCAPE2.0"...)
+	return append(b, 0x03, 0x01, 0x00, 0x00, 0x00)
+}
+
+// gifControl returns the graphic control extension for a frame.
+func gifControl(delay time.Duration, transparent int) []byte {
+	cs := (delay + 5*time.Millisecond) / (10 * time.Millisecond)
+	// Browsers play delays below 2 centiseconds slower, not faster.
+	cs = min(max(cs, 2), 0xFFFF)
+	// Disposal 1 keeps the frame, so the next one only covers what changed.
+	packed := byte(1 << 2)
+	if transparent >= 0 {
+		packed |= 1
+	} else {
+		transparent = 0
+	}
+	b := []byte{0x21, 0xF9, 0x04, packed}
+	b = binary.LittleEndian.AppendUint16(b, uint16(cs))
+	return append(b, byte(transparent), 0x00)
+}
+
+// gifFrame encodes region r of f as an image descriptor, local color table and
+// image data. Pixels equal to prev (the previous canvas, nil for the first
+// frame) become transparent. It returns the transparent index, or -1.
+func gifFrame(f *frame.Frame, r image.Rectangle, prev []byte, opts *Options) ([]byte, int) {
+	w, h := r.Dx(), r.Dy()
+	canvasStride := f.Width * 4
+	unchanged := func(x, y int) bool {
+		if prev == nil {
+			return false
+		}
+		p := f.Pix[f.PixOffset(x, y):]
+		q := prev[y*canvasStride+x*4:]
+		return p[0] == q[0] && p[1] == q[1] && p[2] == q[2]
+	}
+
+	transparent := false
+	exact := make(map[[3]byte]int)
+	var last [3]byte
+	hist := newHistogram()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if unchanged(x, y) {
+				transparent = true
+				continue
+			}
+			p := f.Pix[f.PixOffset(x, y):]
+			hist.add(p[2], p[1], p[0])
+			if c := [3]byte{p[2], p[1], p[0]}; len(exact) <= 256 && (c != last || len(exact) == 0) {
+				exact[c]++
+				last = c
+			}
+		}
+	}
+
+	limit := 256
+	if transparent {
+		limit--
+	}
+	var pal *palette
+	if len(exact) <= limit {
+		colors := make([][3]byte, 0, len(exact))
+		for c := range exact {
+			colors = append(colors, c)
+		}
+		pal = newExactPalette(colors)
+	} else if opts.Quantizer == Octree {
+		pal = newPalette(octree(hist, limit))
+	} else {
+		pal = newPalette(medianCut(hist, limit))
+	}
+	ti := -1
+	if transparent {
+		ti = len(pal.colors)
+	}
+
+	indices := make([]byte, w*h)
+	dither := opts.Dither && !pal.isExact()
+	// Floyd-Steinberg error rows for the current and next line, one pixel of
+	// padding on each side.
+	var cur, next [][3]int32
+	if dither {
+		cur = make([][3]int32, w+2)
+		next = make([][3]int32, w+2)
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if unchanged(r.Min.X+x, r.Min.Y+y) {
+				indices[y*w+x] = byte(ti)
+				continue
+			}
+			p := f.Pix[f.PixOffset(r.Min.X+x, r.Min.Y+y):]
+			c := [3]int32{int32(p[2]), int32(p[1]), int32(p[0])}
+			if !dither {
+				indices[y*w+x] = pal.index(byte(c[0]), byte(c[1]), byte(c[2]))
+				continue
+			}
+			for k := range c {
+				c[k] = min(max(c[k]+cur[x+1][k]/16, 0), 255)
+			}
+			i := pal.index(byte(c[0]), byte(c[1]), byte(c[2]))
+			indices[y*w+x] = i
+			for k := range c {
+				e := c[k] - int32(pal.colors[i][k])
+				cur[x+2][k] += e * 7
+				next[x][k] += e * 3
+				next[x+1][k] += e * 5
+				next[x+2][k] += e
+			}
+		}
+		if dither {
+			cur, next = next, cur
+			clear(next)
+		}
+	}
+
+	colors := len(pal.colors)
+	if transparent {
+		colors++
+	}
+	bits := 1
+	for 1<<bits < colors {
+		bits++
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(0x2C)
+	for _, v := range []int{r.Min.X, r.Min.Y, w, h} {
+		binary.Write(&buf, binary.LittleEndian, uint16(v))
+	}
+	buf.WriteByte(0x80 | byte(bits-1))
+	table := make([]byte, 3<<bits)
+	for i, c := range pal.colors {
+		copy(table[i*3:], c[:])
+	}
+	buf.Write(table)
+
+	litWidth := max(bits, 2)
+	buf.WriteByte(byte(litWidth))
+	bw := &blockWriter{w: &buf}
+	lw := lzw.NewWriter(bw, lzw.LSB, litWidth)
+	lw.Write(indices)
+	lw.Close()
+	bw.close()
+	return buf.Bytes(), ti
+}
+
+// blockWriter splits data into GIF sub-blocks of up to 255 bytes.
+type blockWriter struct {
+	w   *bytes.Buffer
+	buf [256]byte
+	n   int
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		k := copy(b.buf[1+b.n:], p)
+		b.n += k
+		p = p[k:]
+		if b.n == 255 {
+			b.flush()
+		}
+	}
+	return total, nil
+}
+
+func (b *blockWriter) flush() {
+	if b.n == 0 {
+		return
+	}
+	b.buf[0] = byte(b.n)
+	b.w.Write(b.buf[:1+b.n])
+	b.n = 0
+}
+
+// close flushes and writes the block terminator.
+func (b *blockWriter) close() {
+	b.flush()
+	b.w.WriteByte(0)
+}
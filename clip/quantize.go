@@ -0,0 +1,277 @@
+package clip
+
+import (
+	"sort"
+)
+
+// Quantizer selects how GIF palettes are built.
+type Quantizer int
+
+const (
+	// MedianCut splits the color cube at the median of its widest channel.
+	MedianCut Quantizer = iota
+	// Octree merges the least used leaves of a color octree. It is faster
+	// and keeps rare saturated colors, like UI accents, better.
+	Octree
+)
+
+// Colors are bucketed to 5 bits per channel before building the palette.
+const (
+	bucketBits = 5
+	buckets    = 1 << (3 * bucketBits)
+)
+
+func bucket(r, g, b byte) int {
+	return int(r>>3)<<10 | int(g>>3)<<5 | int(b>>3)
+}
+
+// histogram holds per bucket the pixel count and the sums of the exact
+// colors, so palette entries are the mean of the pixels they replace.
+type histogram struct {
+	count []uint32
+	sum   [][3]uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{count: make([]uint32, buckets), sum: make([][3]uint64, buckets)}
+}
+
+func (h *histogram) add(r, g, b byte) {
+	k := bucket(r, g, b)
+	h.count[k]++
+	h.sum[k][0] += uint64(r)
+	h.sum[k][1] += uint64(g)
+	h.sum[k][2] += uint64(b)
+}
+
+// entry is a non-empty histogram bucket.
+type entry struct {
+	key   int
+	count uint32
+	sum   [3]uint64
+}
+
+func (e *entry) channel(c int) int {
+	return e.key >> (10 - 5*c) & 0x1F
+}
+
+func (h *histogram) entries() []entry {
+	var es []entry
+	for k, n := range h.count {
+		if n > 0 {
+			es = append(es, entry{key: k, count: n, sum: h.sum[k]})
+		}
+	}
+	return es
+}
+
+func mean(es []entry) [3]byte {
+	var s [3]uint64
+	var n uint64
+	for _, e := range es {
+		for c := range s {
+			s[c] += e.sum[c]
+		}
+		n += uint64(e.count)
+	}
+	if n == 0 {
+		return [3]byte{}
+	}
+	return [3]byte{byte(s[0] / n), byte(s[1] / n), byte(s[2] / n)}
+}
+
+// medianCut returns up to limit colors.
+func medianCut(h *histogram, limit int) [][3]byte {
+	boxes := [][]entry{h.entries()}
+	if len(boxes[0]) == 0 {
+		return [][3]byte{{}}
+	}
+	for len(boxes) < limit {
+		// Split the box with the most pixels times its widest range.
+		best, bestScore, bestChannel := -1, uint64(0), 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			lo, hi := [3]int{31, 31, 31}, [3]int{}
+			var n uint64
+			for j := range box {
+				for c := 0; c < 3; c++ {
+					v := box[j].channel(c)
+					lo[c], hi[c] = min(lo[c], v), max(hi[c], v)
+				}
+				n += uint64(box[j].count)
+			}
+			for c := 0; c < 3; c++ {
+				if score := n * uint64(hi[c]-lo[c]); score > bestScore {
+					best, bestScore, bestChannel = i, score, c
+				}
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		box := boxes[best]
+		sort.Slice(box, func(a, b int) bool { return box[a].channel(bestChannel) < box[b].channel(bestChannel) })
+		var total, acc uint64
+		for _, e := range box {
+			total += uint64(e.count)
+		}
+		split := 1
+		for i := 0; i < len(box)-1; i++ {
+			acc += uint64(box[i].count)
+			if acc*2 >= total {
+				split = i + 1
+				break
+			}
+		}
+		boxes[best] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	pal := make([][3]byte, len(boxes))
+	for i, box := range boxes {
+		pal[i] = mean(box)
+	}
+	return pal
+}
+
+type octreeNode struct {
+	children [8]*octreeNode
+	count    uint64
+	sum      [3]uint64
+	leaf     bool
+}
+
+// octree returns up to limit colors.
+func octree(h *histogram, limit int) [][3]byte {
+	root := &octreeNode{}
+	var levels [bucketBits][]*octreeNode
+	leaves := 0
+	for _, e := range h.entries() {
+		n := root
+		for level := 0; level < bucketBits; level++ {
+			shift := bucketBits - 1 - level
+			i := (e.channel(0)>>shift&1)<<2 | (e.channel(1)>>shift&1)<<1 | e.channel(2)>>shift&1
+			if n.children[i] == nil {
+				n.children[i] = &octreeNode{}
+				if level == bucketBits-1 {
+					n.children[i].leaf = true
+					leaves++
+				} else {
+					levels[level+1] = append(levels[level+1], n.children[i])
+				}
+			}
+			n = n.children[i]
+		}
+		n.count += uint64(e.count)
+		for c := range n.sum {
+			n.sum[c] += e.sum[c]
+		}
+	}
+	levels[0] = []*octreeNode{root}
+
+	// Merge the children of the deepest, least used nodes until few enough leaves remain.
+	for level := bucketBits - 1; level >= 0 && leaves > limit; level-- {
+		nodes := levels[level]
+		for _, n := range nodes {
+			for _, c := range n.children {
+				if c != nil {
+					n.count += c.count
+				}
+			}
+		}
+		sort.Slice(nodes, func(a, b int) bool { return nodes[a].count < nodes[b].count })
+		for _, n := range nodes {
+			if leaves <= limit {
+				break
+			}
+			n.count = 0
+			merged := 0
+			for i, c := range n.children {
+				if c == nil {
+					continue
+				}
+				n.count += c.count
+				for k := range n.sum {
+					n.sum[k] += c.sum[k]
+				}
+				n.children[i] = nil
+				merged++
+			}
+			n.leaf = true
+			leaves -= merged - 1
+		}
+	}
+
+	var pal [][3]byte
+	var walk func(n *octreeNode)
+	walk = func(n *octreeNode) {
+		if n.leaf {
+			if n.count > 0 {
+				pal = append(pal, [3]byte{byte(n.sum[0] / n.count), byte(n.sum[1] / n.count), byte(n.sum[2] / n.count)})
+			}
+			return
+		}
+		for _, c := range n.children {
+			if c != nil {
+				walk(c)
+			}
+		}
+	}
+	walk(root)
+	if len(pal) == 0 {
+		pal = [][3]byte{{}}
+	}
+	return pal
+}
+
+// palette maps colors to their nearest entry, caching the result per bucket.
+type palette struct {
+	colors [][3]byte
+	lut    []int16
+	// exact maps every color of a frame with few enough colors to its entry.
+	exact map[[3]byte]byte
+}
+
+func newExactPalette(colors [][3]byte) *palette {
+	p := &palette{colors: colors, exact: make(map[[3]byte]byte, len(colors))}
+	for i, c := range colors {
+		p.exact[c] = byte(i)
+	}
+	return p
+}
+
+func (p *palette) isExact() bool {
+	return p.exact != nil
+}
+
+func newPalette(colors [][3]byte) *palette {
+	p := &palette{colors: colors, lut: make([]int16, buckets)}
+	for i := range p.lut {
+		p.lut[i] = -1
+	}
+	return p
+}
+
+func (p *palette) index(r, g, b byte) byte {
+	if p.exact != nil {
+		return p.exact[[3]byte{r, g, b}]
+	}
+	k := bucket(r, g, b)
+	if i := p.lut[k]; i >= 0 {
+		return byte(i)
+	}
+	// Compare against the bucket center.
+	cr, cg, cb := int(r&^7)+4, int(g&^7)+4, int(b&^7)+4
+	best, bestDist := 0, 1<<30
+	for i, c := range p.colors {
+		dr, dg, db := cr-int(c[0]), cg-int(c[1]), cb-int(c[2])
+		if d := 2*dr*dr + 4*dg*dg + 3*db*db; d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	p.lut[k] = int16(best)
+	return byte(best)
+}
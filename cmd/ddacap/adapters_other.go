@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// listAdapters has nothing to add: the desktop source fails before it is
+// called on this platform.
+func listAdapters() error {
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	dda "github.com/shinkar94/godesktopdup"
+)
+
+// listAdapters prints the outputs of every adapter. Only those of adapter 0
+// can be captured.
+func listAdapters() error {
+	infos, err := dda.Outputs()
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADAPTER\tOUTPUT\tNAME\tBOUNDS\tATTACHED\tDESCRIPTION")
+	for _, o := range infos {
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%v\t%t\t%s\n", o.Adapter, o.Index, o.Name, o.Bounds, o.Attached, o.AdapterName)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/rawvideo"
+	"github.com/shinkar94/godesktopdup/recording"
+	"github.com/shinkar94/godesktopdup/scale"
+	"github.com/shinkar94/godesktopdup/snapshot"
+)
+
+// benchStage is one timed step applied to every captured frame.
+type benchStage struct {
+	name  string
+	run   func(f *frame.Frame) error
+	times []time.Duration
+}
+
+func runBench(args []string) error {
+	var sf sourceFlags
+	fs := newFlags("bench", "")
+	sf.register(fs)
+	output := fs.Int("output", 0, "output to capture")
+	frames := fs.Int("frames", 100, "number of frames to time")
+	stages := fs.String("stages", "jpeg,png,qoi,scale,nv12,record", "comma-separated `list` of stages to time after capture")
+	size := fs.String("scale", "640x360", "target of the scale stage, `WxH`")
+	quality := fs.Int("quality", 0, "JPEG quality, 1 to 100")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *frames <= 0 {
+		return errors.New("-frames must be positive")
+	}
+
+	capture := &benchStage{name: "capture"}
+	list := []*benchStage{capture}
+	for _, name := range strings.Split(*stages, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		run, err := newBenchStage(name, *size, *quality)
+		if err != nil {
+			return err
+		}
+		list = append(list, &benchStage{name: name, run: run})
+	}
+
+	src, err := sf.open(*output)
+	if err != nil {
+		return err
+	}
+	defer closeSource(src)
+	var width, height int
+	for n := 0; n < *frames; {
+		start := time.Now()
+		f, err := src.GetFrame(1000)
+		if errors.Is(err, frame.ErrNoImageYet) {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		capture.times = append(capture.times, time.Since(start))
+		width, height = f.Width, f.Height
+		for _, s := range list[1:] {
+			start := time.Now()
+			if err := s.run(f); err != nil {
+				return fmt.Errorf("%s: %w", s.name, err)
+			}
+			s.times = append(s.times, time.Since(start))
+		}
+		n++
+	}
+	if len(capture.times) == 0 {
+		return errors.New("no frames captured")
+	}
+
+	fmt.Printf("%d frames of %dx%d; capture includes waiting for the next frame\n\n", len(capture.times), width, height)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "STAGE\tMEAN\tP50\tP95\tMAX\tFPS\t")
+	for _, s := range list {
+		t := slices.Clone(s.times)
+		slices.Sort(t)
+		var sum time.Duration
+		for _, d := range t {
+			sum += d
+		}
+		mean := sum / time.Duration(len(t))
+		fmt.Fprintf(tw, "%s\t%v\t%v\t%v\t%v\t%.1f\t\n", s.name,
+			round(mean), round(t[len(t)/2]), round(t[len(t)*95/100]), round(t[len(t)-1]),
+			float64(time.Second)/float64(max(mean, 1)))
+	}
+	return tw.Flush()
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
+
+// newBenchStage returns the function timed for a stage. Stages only read the
+// frame, so each sees it as captured.
+func newBenchStage(name, size string, quality int) (func(f *frame.Frame) error, error) {
+	switch name {
+	case "jpeg", "png", "qoi":
+		format, err := snapshot.ParseFormat(name)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *frame.Frame) error {
+			return snapshot.Encode(io.Discard, f, format, &snapshot.Options{Quality: quality})
+		}, nil
+	case "scale":
+		w, h, err := parseSize(size)
+		if err != nil {
+			return nil, err
+		}
+		s, err := scale.New(scale.Options{Width: w, Height: h, Mode: scale.Fit})
+		if err != nil {
+			return nil, err
+		}
+		// The scaler renders into its own buffer, leaving the frame as is.
+		return func(f *frame.Frame) error {
+			g := *f
+			return s.Apply(&g)
+		}, nil
+	case "nv12":
+		w := rawvideo.NewWriter(io.Discard, &rawvideo.Options{Format: rawvideo.NV12})
+		return w.WriteFrame, nil
+	case "record":
+		w := recording.NewWriter(io.Discard, nil)
+		return w.WriteFrame, nil
+	}
+	return nil, fmt.Errorf("unknown stage %q", name)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+func runList(args []string) error {
+	var sf sourceFlags
+	fs := newFlags("list", "")
+	sf.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	p, err := sf.provider()
+	if err != nil {
+		return err
+	}
+	outputs, err := p.Outputs()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OUTPUT\tNAME\tPOSITION\tSIZE")
+	for _, o := range outputs {
+		fmt.Fprintf(tw, "%d\t%s\t%d,%d\t%dx%d\n", o.Index, o.Name, o.X, o.Y, o.Width, o.Height)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if sf.kind == "desktop" {
+		return listAdapters()
+	}
+	return nil
+}
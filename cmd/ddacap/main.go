@@ -0,0 +1,100 @@
+// Command ddacap captures screenshots, records, serves and benchmarks
+// capture outputs.
+//
+// Usage:
+//
+//	ddacap list   [source flags]
+//	ddacap shot   [source flags] [-output N | -all] [-region x,y,w,h] file
+//	ddacap record [source flags] [-output N] [-fps N] [-duration d] file|-
+//	ddacap serve  [source flags] [-output N] [-mjpeg addr] [-vnc addr] [-ws addr]
+//	ddacap bench  [source flags] [-output N] [-frames N] [-stages list]
+//
+// Every subcommand takes the source flags, so it runs without a desktop:
+//
+//	-source desktop|synthetic|replay
+//	-size WxH -outputs N -rate N   synthetic outputs and their frame rate
+//	-file path -loop               replay a recording at its recorded pace
+//	-cursor                        draw the cursor into frames
+//
+// Run "ddacap <command> -h" for the flags of a command.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+var commands = []struct {
+	name, summary string
+	run           func(args []string) error
+}{
+	{"list", "list outputs and adapters", runList},
+	{"shot", "save a PNG, JPEG or QOI screenshot", runShot},
+	{"record", "record to AVI, MP4, a recording or raw video", runRecord},
+	{"serve", "serve over MJPEG, VNC or WebSocket", runServe},
+	{"bench", "time capture and processing stages", runBench},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ddacap <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.summary)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+		err := c.run(os.Args[2:])
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ddacap:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	usage()
+	os.Exit(2)
+}
+
+// newFlags returns the flag set of a command, printing args after the flags
+// in its usage.
+func newFlags(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ddacap %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// firstFrame waits up to timeout for a frame of src.
+func firstFrame(src frame.Source, timeout time.Duration) (*frame.Frame, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := src.GetFrame(100)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, frame.ErrNoImageYet) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("no frame within " + timeout.String())
+		}
+	}
+}
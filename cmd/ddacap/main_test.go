@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/shinkar94/godesktopdup/qoi"
+	"github.com/shinkar94/godesktopdup/recording"
+)
+
+// redirect points the standard output and error at files for the rest of the
+// test and returns their paths.
+func redirect(t *testing.T) (stdout, stderr string) {
+	t.Helper()
+	dir := t.TempDir()
+	stdout, stderr = filepath.Join(dir, "stdout"), filepath.Join(dir, "stderr")
+	for _, r := range []struct {
+		std  **os.File
+		path string
+	}{{&os.Stdout, stdout}, {&os.Stderr, stderr}} {
+		f, err := os.Create(r.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := *r.std
+		*r.std = f
+		std := r.std
+		t.Cleanup(func() {
+			*std = old
+			f.Close()
+		})
+	}
+	return stdout, stderr
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// run runs a command and returns what it printed on standard output.
+func run(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	stdout, _ := redirect(t)
+	for _, c := range commands {
+		if c.name == args[0] {
+			err := c.run(args[1:])
+			return readFile(t, stdout), err
+		}
+	}
+	t.Fatalf("no command %q", args[0])
+	return "", nil
+}
+
+func mustRun(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := run(t, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	return out
+}
+
+func checkImage(t *testing.T, path, format string, width, height int) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cfg, got, err := image.DecodeConfig(f)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	if got != format || cfg.Width != width || cfg.Height != height {
+		t.Errorf("%s is a %dx%d %s, want %dx%d %s", path, cfg.Width, cfg.Height, got, width, height, format)
+	}
+}
+
+// synthetic are the source flags of two small synthetic outputs.
+var synthetic = []string{"-source", "synthetic", "-size", "64x48", "-outputs", "2", "-rate", "60"}
+
+func TestList(t *testing.T) {
+	out := mustRun(t, append([]string{"list"}, synthetic...)...)
+	for _, want := range []string{"SYNTHETIC1", "SYNTHETIC2", "64,0", "64x48"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("list output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestShot(t *testing.T) {
+	dir := t.TempDir()
+	shot := func(args ...string) {
+		t.Helper()
+		mustRun(t, append(append([]string{"shot"}, synthetic...), args...)...)
+	}
+	shot(filepath.Join(dir, "a.png"))
+	checkImage(t, filepath.Join(dir, "a.png"), "png", 64, 48)
+	shot("-output", "1", "-quality", "50", filepath.Join(dir, "b.jpg"))
+	checkImage(t, filepath.Join(dir, "b.jpg"), "jpeg", 64, 48)
+	shot("-all", filepath.Join(dir, "all.qoi"))
+	checkImage(t, filepath.Join(dir, "all.qoi"), "qoi", 128, 48)
+	shot("-region", "4,2,10,5", "-format", "png", filepath.Join(dir, "region"))
+	checkImage(t, filepath.Join(dir, "region"), "png", 10, 5)
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{"shot"},
+		{"record", "-source", "synthetic"},
+		{"serve", "-source", "synthetic"},
+	} {
+		if _, err := run(t, args...); !errors.Is(err, flag.ErrHelp) {
+			t.Errorf("%s: %v, want flag.ErrHelp", strings.Join(args, " "), err)
+		}
+	}
+	for _, args := range [][]string{
+		{"list", "-source", "nowhere"},
+		{"list", "-source", "replay"},
+		{"list", "-source", "synthetic", "-size", "64"},
+		{"record", "-source", "synthetic", "out.xyz"},
+		{"bench", "-source", "synthetic", "-stages", "nothing"},
+	} {
+		if _, err := run(t, args...); err == nil || errors.Is(err, flag.ErrHelp) {
+			t.Errorf("%s: %v, want an error", strings.Join(args, " "), err)
+		}
+	}
+}
+
+func TestBench(t *testing.T) {
+	out := mustRun(t, append([]string{"bench", "-frames", "3", "-stages", "jpeg,png,qoi,scale,nv12,record"}, synthetic...)...)
+	for _, want := range []string{"3 frames of 64x48", "capture", "jpeg", "nv12", "record"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("bench output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+// TestRecordReplay records the synthetic source and then runs every command
+// against the recording.
+func TestRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	rec := filepath.Join(dir, "in.ddrc")
+	mustRun(t, append(append([]string{"record", "-fps", "30", "-duration", "300ms"}, synthetic...), rec)...)
+	f, err := os.Open(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, err := recording.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := rd.Len()
+	f.Close()
+	if frames < 2 {
+		t.Fatalf("recorded %d frames", frames)
+	}
+
+	replay := []string{"-source", "replay", "-file", rec}
+	if out := mustRun(t, append([]string{"list"}, replay...)...); !strings.Contains(out, "64x48") {
+		t.Errorf("list output lacks the recorded size:\n%s", out)
+	}
+	mustRun(t, append([]string{"shot"}, append(replay, filepath.Join(dir, "shot.png"))...)...)
+	checkImage(t, filepath.Join(dir, "shot.png"), "png", 64, 48)
+
+	// Replays end, so recording them stops without -duration.
+	for _, name := range []string{"out.avi", "out.mp4", "out.y4m", "out.nv12", "out.ddrc"} {
+		path := filepath.Join(dir, name)
+		mustRun(t, append([]string{"record", "-overlay", "{output}"}, append(replay, path)...)...)
+		if st, err := os.Stat(path); err != nil || st.Size() == 0 {
+			t.Errorf("%s: %v, empty recording", name, err)
+		}
+	}
+	out := mustRun(t, append([]string{"bench", "-frames", "100", "-stages", "jpeg"}, replay...)...)
+	if !strings.Contains(out, "64x48") {
+		t.Errorf("bench output lacks the recorded size:\n%s", out)
+	}
+}
+
+func TestServe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stopping serve needs an interrupt signal")
+	}
+	// Keep the interrupt from killing the test binary before serve handles it.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+
+	_, stderr := redirect(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- runServe(append([]string{"-mjpeg", "127.0.0.1:0", "-ws", "127.0.0.1:0", "-vnc", "127.0.0.1:0"}, synthetic...))
+	}()
+
+	addr := regexp.MustCompile(`mjpeg on (http://\S+/)`)
+	var url string
+	for deadline := time.Now().Add(5 * time.Second); url == ""; {
+		if m := addr.FindStringSubmatch(readFile(t, stderr)); m != nil {
+			url = m[1]
+		} else if time.Now().After(deadline) {
+			t.Fatalf("serve did not start:\n%s", readFile(t, stderr))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, err := http.Get(url + "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("snapshot: %s, %v", resp.Status, err)
+	}
+	if cfg, format, err := image.DecodeConfig(strings.NewReader(string(body))); err != nil || format != "jpeg" || cfg.Width != 64 {
+		t.Errorf("snapshot: %v %s %dx%d", err, format, cfg.Width, cfg.Height)
+	}
+
+	// serve may not have set up its handler yet, so interrupt until it returns.
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		if err := p.Signal(os.Interrupt); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		case <-timeout:
+			t.Fatal("serve did not stop on interrupt")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
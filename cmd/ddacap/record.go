@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/avi"
+	"github.com/shinkar94/godesktopdup/effects"
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/mp4"
+	"github.com/shinkar94/godesktopdup/protect"
+	"github.com/shinkar94/godesktopdup/rawvideo"
+	"github.com/shinkar94/godesktopdup/recording"
+)
+
+// frameWriter is what record needs of the writers.
+type frameWriter interface {
+	WriteFrame(f *frame.Frame) error
+	Close() error
+}
+
+// recordFormats maps format names and file extensions to formats.
+var recordFormats = map[string]string{
+	"avi": "avi", ".avi": "avi",
+	"mp4": "mp4", ".mp4": "mp4",
+	"ddrc": "ddrc", ".ddrc": "ddrc",
+	"y4m": "y4m", ".y4m": "y4m",
+	"bgra": "bgra", ".bgra": "bgra",
+	"nv12": "nv12", ".nv12": "nv12",
+}
+
+var protectActions = map[string]protect.Action{
+	"pass":        protect.Pass,
+	"placeholder": protect.Placeholder,
+	"drop":        protect.Drop,
+}
+
+var rawFormats = map[string]rawvideo.Format{
+	"y4m":  rawvideo.Y4M,
+	"bgra": rawvideo.BGRA,
+	"nv12": rawvideo.NV12,
+}
+
+func runRecord(args []string) error {
+	var sf sourceFlags
+	fs := newFlags("record", "file|-")
+	sf.register(fs)
+	output := fs.Int("output", 0, "output to record")
+	fps := fs.Int("fps", 30, "frame rate")
+	duration := fs.Duration("duration", 0, "stop after this long; 0 records until interrupted")
+	format := fs.String("format", "", "avi, mp4, ddrc, y4m, bgra or nv12; by default from the file extension")
+	quality := fs.Int("quality", 0, "JPEG quality of AVI and MP4, 1 to 100")
+	protected := fs.String("protected", "pass", "frames with protected content masked out: pass, placeholder or drop")
+	overlay := fs.String("overlay", "", "burn in `text`, e.g. \"{time} {host} {output}\", with \\n between lines; see effects.Overlay")
+	command := fs.String("exec", "", "pipe raw video (y4m by default) to the standard input of `command`")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *fps <= 0 {
+		return errors.New("-fps must be positive")
+	}
+	name := *format
+	switch {
+	case *command != "" && fs.NArg() == 0:
+		if name == "" {
+			name = "y4m"
+		}
+	case fs.NArg() == 1 && *command == "":
+		if name == "" {
+			name = filepath.Ext(fs.Arg(0))
+		}
+	default:
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	kind, ok := recordFormats[name]
+	if !ok {
+		return fmt.Errorf("unknown recording format %q", name)
+	}
+	action, ok := protectActions[*protected]
+	if !ok {
+		return fmt.Errorf("unknown -protected action %q", *protected)
+	}
+
+	src, err := sf.open(*output)
+	if err != nil {
+		return err
+	}
+	defer closeSource(src)
+	monitor := protect.New(&protect.Options{Action: action})
+	stages := []frame.Stage{monitor}
+	if *overlay != "" {
+		stages = append(stages, effects.NewOverlay(strings.ReplaceAll(*overlay, `\n`, "\n")))
+	}
+
+	var w frameWriter
+	if *command != "" {
+		raw, ok := rawFormats[kind]
+		if !ok {
+			return fmt.Errorf("-exec needs a raw format, not %s", kind)
+		}
+		fields := strings.Fields(*command)
+		cmd := exec.Command(fields[0], fields[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if w, err = rawvideo.Start(cmd, &rawvideo.Options{Format: raw, FPS: *fps, Block: true}); err != nil {
+			return err
+		}
+	} else {
+		out, err := createOutput(fs.Arg(0), kind)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		if w, err = newWriter(out, kind, *fps, *quality); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	n, err := record(ctx, frame.Process(src, stages...), w, *fps)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	fmt.Fprintf(os.Stderr, "recorded %d frames\n", n)
+	if st := monitor.Stats(); st.Protected > 0 {
+		fmt.Fprintf(os.Stderr, "protected content masked out in %d of %d frames, for %v\n", st.Protected, st.Frames, st.Duration)
+	}
+	return err
+}
+
+// output is the destination of a recording.
+type output struct {
+	file *os.File
+	bw   *bufio.Writer
+}
+
+func createOutput(path, kind string) (*output, error) {
+	if path == "-" {
+		if kind == "avi" {
+			return nil, errors.New("avi needs a file, it cannot be piped")
+		}
+		return &output{file: os.Stdout, bw: bufio.NewWriterSize(os.Stdout, 1<<20)}, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &output{file: file}, nil
+}
+
+// Close flushes the output and closes it unless it is standard output.
+func (o *output) Close() error {
+	var err error
+	if o.bw != nil {
+		err = o.bw.Flush()
+	}
+	if o.file != os.Stdout {
+		if cerr := o.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func newWriter(out *output, kind string, fps, quality int) (frameWriter, error) {
+	var w io.Writer = out.file
+	if out.bw != nil {
+		w = out.bw
+	}
+	switch kind {
+	case "avi":
+		return avi.New(out.file, &avi.Options{FPS: fps, Quality: quality})
+	case "mp4":
+		return mp4.New(w, &mp4.Options{Quality: quality})
+	case "ddrc":
+		return recording.NewWriter(w, nil), nil
+	}
+	return rawvideo.NewWriter(w, &rawvideo.Options{Format: rawFormats[kind], FPS: fps}), nil
+}
+
+// record writes frames of src to w until ctx is done, reading at most fps
+// frames per second. Sources accumulate damage between reads, so no change
+// is lost. It returns the number of frames written.
+func record(ctx context.Context, src frame.Source, w frameWriter, fps int) (int, error) {
+	interval := time.Second / time.Duration(fps)
+	ticker, _ := w.(interface{ Tick(time.Time) error })
+	n := 0
+	for ctx.Err() == nil {
+		f, err := src.GetFrame(uint(max(interval/time.Millisecond, 1)))
+		if errors.Is(err, frame.ErrNoImageYet) {
+			// Raw video keeps its constant rate while nothing changes.
+			if ticker != nil && n > 0 {
+				if err := ticker.Tick(time.Now()); err != nil {
+					return n, err
+				}
+			}
+			continue
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		next := time.Now().Add(interval)
+		if err := w.WriteFrame(f); err != nil {
+			return n, err
+		}
+		n++
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(next)):
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/mjpeg"
+	"github.com/shinkar94/godesktopdup/vnc"
+	"github.com/shinkar94/godesktopdup/wsview"
+)
+
+func runServe(args []string) error {
+	var sf sourceFlags
+	fs := newFlags("serve", "")
+	sf.register(fs)
+	output := fs.Int("output", 0, "output to serve")
+	mjpegAddr := fs.String("mjpeg", "", "serve an MJPEG stream over HTTP on `addr`")
+	vncAddr := fs.String("vnc", "", "serve VNC viewers on `addr`")
+	wsAddr := fs.String("ws", "", "serve the browser viewer over WebSocket on `addr`")
+	fps := fs.Int("fps", 0, "highest frame rate; 0 uses each server's default")
+	quality := fs.Int("quality", 0, "JPEG quality of the MJPEG stream, 1 to 100")
+	password := fs.String("password", "", "VNC password")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *mjpegAddr == "" && *vncAddr == "" && *wsAddr == "" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	// Each server reads its source alone, so each gets its own. Desktop
+	// Duplication allows a few duplications of an output at once.
+	var sources []frame.Source
+	defer func() {
+		for _, src := range sources {
+			closeSource(src)
+		}
+	}()
+	open := func() (frame.Source, error) {
+		src, err := sf.open(*output)
+		if err == nil {
+			sources = append(sources, src)
+		}
+		return src, err
+	}
+
+	errc := make(chan error, 3)
+	var closers []func() error
+	defer func() {
+		for _, c := range closers {
+			c()
+		}
+	}()
+	serveHTTP := func(name, addr string, h http.Handler) error {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		hs := &http.Server{Handler: h}
+		closers = append(closers, hs.Close)
+		fmt.Fprintf(os.Stderr, "%s on http://%s/\n", name, l.Addr())
+		go func() { errc <- hs.Serve(l) }()
+		return nil
+	}
+	if *mjpegAddr != "" {
+		src, err := open()
+		if err != nil {
+			return err
+		}
+		s, err := mjpeg.New(src, &mjpeg.Options{FPS: *fps, Quality: *quality})
+		if err != nil {
+			return err
+		}
+		if err := serveHTTP("mjpeg", *mjpegAddr, s); err != nil {
+			return err
+		}
+	}
+	if *wsAddr != "" {
+		src, err := open()
+		if err != nil {
+			return err
+		}
+		if err := serveHTTP("viewer", *wsAddr, wsview.New(src, &wsview.Options{FPS: *fps})); err != nil {
+			return err
+		}
+	}
+	if *vncAddr != "" {
+		src, err := open()
+		if err != nil {
+			return err
+		}
+		l, err := net.Listen("tcp", *vncAddr)
+		if err != nil {
+			return err
+		}
+		s := vnc.New(src, &vnc.Options{FPS: *fps, Password: *password})
+		closers = append(closers, s.Close)
+		fmt.Fprintf(os.Stderr, "vnc on %s\n", l.Addr())
+		go func() { errc <- s.Serve(l) }()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errc:
+		if errors.Is(err, http.ErrServerClosed) || errors.Is(err, vnc.ErrServerClosed) {
+			return nil
+		}
+		return err
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/daemon"
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/snapshot"
+)
+
+func runShot(args []string) error {
+	var sf sourceFlags
+	fs := newFlags("shot", "file|-")
+	sf.register(fs)
+	output := fs.Int("output", 0, "output to capture")
+	all := fs.Bool("all", false, "capture the whole desktop, every output at its position")
+	region := fs.String("region", "", "capture only `x,y,w,h` of the image")
+	format := fs.String("format", "", "png, jpeg or qoi; by default from the file extension")
+	quality := fs.Int("quality", 0, "JPEG quality, 1 to 100")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for a frame")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	path := fs.Arg(0)
+
+	name := *format
+	if name == "" {
+		name = filepath.Ext(path)
+		if path == "-" {
+			name = "png"
+		}
+	}
+	imgFormat, err := snapshot.ParseFormat(name)
+	if err != nil {
+		return err
+	}
+	p, err := sf.provider()
+	if err != nil {
+		return err
+	}
+	var f *frame.Frame
+	if *all {
+		f, err = grabDesktop(p, *timeout)
+	} else {
+		f, err = grab(p, *output, *timeout)
+	}
+	if err != nil {
+		return err
+	}
+	if *region != "" {
+		r, err := parseRegion(*region)
+		if err != nil {
+			return err
+		}
+		if f, err = crop(f, r); err != nil {
+			return err
+		}
+	}
+	return writeFile(path, func(w io.Writer) error {
+		return snapshot.Encode(w, f, imgFormat, &snapshot.Options{Quality: *quality, Metadata: true})
+	})
+}
+
+// grab returns a copy of the first frame of an output.
+func grab(p daemon.Provider, index int, timeout time.Duration) (*frame.Frame, error) {
+	src, err := p.Open(index)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSource(src)
+	f, err := firstFrame(src, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return f.Clone(), nil
+}
+
+// grabDesktop composites every output at its desktop position. Areas no
+// output covers stay black.
+func grabDesktop(p daemon.Provider, timeout time.Duration) (*frame.Frame, error) {
+	outputs, err := p.Outputs()
+	if err != nil {
+		return nil, err
+	}
+	if len(outputs) == 0 {
+		return nil, errors.New("no outputs")
+	}
+	var bounds image.Rectangle
+	for _, o := range outputs {
+		bounds = bounds.Union(image.Rect(o.X, o.Y, o.X+o.Width, o.Y+o.Height))
+	}
+	desk := frame.New(bounds.Dx(), bounds.Dy())
+	desk.Output = "DESKTOP"
+	desk.Bounds = bounds
+	for i := range desk.Pix {
+		if i%4 == 3 {
+			desk.Pix[i] = 0xff
+		}
+	}
+	for _, o := range outputs {
+		f, err := grab(p, o.Index, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("output %d: %w", o.Index, err)
+		}
+		at := image.Pt(o.X, o.Y).Sub(bounds.Min)
+		r := f.Rect().Intersect(desk.Rect().Sub(at))
+		frame.CopyRect(desk.Pix[desk.PixOffset(at.X, at.Y):], desk.Stride, f.Pix, f.Stride, r)
+		if f.Time.After(desk.Time) {
+			desk.Time = f.Time
+		}
+	}
+	return desk, nil
+}
+
+func parseRegion(s string) (image.Rectangle, error) {
+	var x, y, w, h int
+	if _, err := fmt.Sscanf(s, "%d,%d,%d,%d", &x, &y, &w, &h); err != nil || w <= 0 || h <= 0 {
+		return image.Rectangle{}, fmt.Errorf("invalid region %q, want x,y,w,h", s)
+	}
+	return image.Rect(x, y, x+w, y+h), nil
+}
+
+// crop returns the part r of f.
+func crop(f *frame.Frame, r image.Rectangle) (*frame.Frame, error) {
+	if !r.In(f.Rect()) {
+		return nil, fmt.Errorf("region %v outside the %dx%d image", r, f.Width, f.Height)
+	}
+	c := frame.New(r.Dx(), r.Dy())
+	frame.CopyRect(c.Pix, c.Stride, f.Pix[f.PixOffset(r.Min.X, r.Min.Y):], f.Stride, c.Rect())
+	c.Time, c.Output = f.Time, f.Output
+	c.Bounds = r.Add(f.Bounds.Min)
+	return c, nil
+}
+
+// writeFile writes to path, or to standard output for "-", through a buffer.
+func writeFile(path string, write func(io.Writer) error) error {
+	w := io.Writer(os.Stdout)
+	var file *os.File
+	if path != "-" {
+		var err error
+		if file, err = os.Create(path); err != nil {
+			return err
+		}
+		w = file
+	}
+	bw := bufio.NewWriter(w)
+	err := write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if file != nil {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
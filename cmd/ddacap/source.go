@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/daemon"
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/recording"
+	"github.com/shinkar94/godesktopdup/synth"
+)
+
+// sourceFlags selects what a command captures.
+type sourceFlags struct {
+	kind    string
+	size    string
+	outputs int
+	rate    int
+	file    string
+	loop    bool
+	cursor  bool
+}
+
+func (sf *sourceFlags) register(fs *flag.FlagSet) {
+	kind := "synthetic"
+	if runtime.GOOS == "windows" {
+		kind = "desktop"
+	}
+	fs.StringVar(&sf.kind, "source", kind, "`kind` of source: desktop, synthetic or replay")
+	fs.StringVar(&sf.size, "size", "1280x720", "size of synthetic outputs, `WxH`")
+	fs.IntVar(&sf.outputs, "outputs", 1, "number of synthetic outputs, side by side")
+	fs.IntVar(&sf.rate, "rate", 30, "frame rate of synthetic outputs")
+	fs.StringVar(&sf.file, "file", "", "recording to replay")
+	fs.BoolVar(&sf.loop, "loop", false, "replay the recording endlessly")
+	fs.BoolVar(&sf.cursor, "cursor", true, "draw the cursor into frames")
+}
+
+// provider returns the outputs selected by the flags.
+func (sf *sourceFlags) provider() (daemon.Provider, error) {
+	switch sf.kind {
+	case "desktop":
+		return cursorProvider{daemon.Desktop(), sf.cursor}, nil
+	case "synthetic":
+		return sf.synthetic()
+	case "replay":
+		return sf.replay()
+	}
+	return nil, fmt.Errorf("unknown source %q", sf.kind)
+}
+
+// open opens one output of the provider.
+func (sf *sourceFlags) open(index int) (frame.Source, error) {
+	p, err := sf.provider()
+	if err != nil {
+		return nil, err
+	}
+	return p.Open(index)
+}
+
+// cursorProvider turns cursor drawing on or off for the sources it opens.
+type cursorProvider struct {
+	daemon.Provider
+	cursor bool
+}
+
+func (p cursorProvider) Open(index int) (frame.Source, error) {
+	src, err := p.Provider.Open(index)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := src.(interface{ SetCaptureCursor(bool) }); ok {
+		c.SetCaptureCursor(p.cursor)
+	}
+	return src, nil
+}
+
+func parseSize(s string) (int, int, error) {
+	var w, h int
+	if _, err := fmt.Sscanf(s, "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("invalid size %q, want WxH", s)
+	}
+	return w, h, nil
+}
+
+func (sf *sourceFlags) synthetic() (daemon.Provider, error) {
+	w, h, err := parseSize(sf.size)
+	if err != nil {
+		return nil, err
+	}
+	if sf.outputs < 1 {
+		return nil, errors.New("need at least one output")
+	}
+	p := &daemon.Sources{}
+	for i := 0; i < sf.outputs; i++ {
+		p.List = append(p.List, daemon.Output{
+			Index:  i,
+			Name:   fmt.Sprintf("SYNTHETIC%d", i+1),
+			X:      i * w,
+			Width:  w,
+			Height: h,
+		})
+	}
+	p.New = func(index int) (frame.Source, error) {
+		o := p.List[index]
+		return synth.New(synth.Options{
+			Width:      w,
+			Height:     h,
+			FPS:        sf.rate,
+			Track:      synth.Circle(image.Pt(w/2, h/2), min(w, h)/4, 4*time.Second),
+			DrawCursor: sf.cursor,
+			Output:     o.Name,
+		}), nil
+	}
+	return p, nil
+}
+
+func (sf *sourceFlags) replay() (daemon.Provider, error) {
+	if sf.file == "" {
+		return nil, errors.New("replay needs -file")
+	}
+	// Read the first frame for the output's size.
+	r, err := openReplay(sf.file, false)
+	if err != nil {
+		return nil, err
+	}
+	f, err := r.rd.Next()
+	r.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", sf.file, err)
+	}
+	name := f.Output
+	if name == "" {
+		name = "REPLAY"
+	}
+	return &daemon.Sources{
+		List: []daemon.Output{{Index: 0, Name: name, Width: f.Width, Height: f.Height}},
+		New: func(int) (frame.Source, error) {
+			return openReplay(sf.file, sf.loop)
+		},
+	}, nil
+}
+
+// replaySource plays a recording back at its recorded pace. Frame times are
+// moved to the time of playback.
+type replaySource struct {
+	file *os.File
+	rd   *recording.Reader
+	loop bool
+	// base is the playback time of the recording's start.
+	base    time.Time
+	next    *frame.Frame
+	started bool
+	out     frame.Frame
+}
+
+func openReplay(path string, loop bool) (*replaySource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	rd, err := recording.Open(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &replaySource{file: file, rd: rd, loop: loop}, nil
+}
+
+// GetFrame returns the next frame once it is due, frame.ErrNoImageYet if it
+// is not due within the timeout, and io.EOF at the end of the recording.
+func (s *replaySource) GetFrame(timeoutMs uint) (*frame.Frame, error) {
+	deadline := time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+	if !s.started {
+		s.base = time.Now()
+		s.started = true
+	}
+	if s.next == nil {
+		f, err := s.rd.Next()
+		if err == io.EOF && s.loop {
+			// Start over one average frame interval after the last frame.
+			length := s.rd.End().Sub(s.rd.Start())
+			s.base = s.base.Add(length + length/time.Duration(max(s.rd.Len()-1, 1)))
+			if err = s.rd.Rewind(); err == nil {
+				f, err = s.rd.Next()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.next = f
+	}
+	due := s.base.Add(s.next.Time.Sub(s.rd.Start()))
+	if due.After(deadline) {
+		time.Sleep(time.Until(deadline))
+		return nil, frame.ErrNoImageYet
+	}
+	time.Sleep(time.Until(due))
+	s.out = *s.next
+	s.out.Time = due
+	s.next = nil
+	return &s.out, nil
+}
+
+func (s *replaySource) Close() error {
+	return s.file.Close()
+}
+
+// closeSource closes src if it has a Close or Release method.
+func closeSource(src frame.Source) {
+	switch c := src.(type) {
+	case io.Closer:
+		c.Close()
+	case interface{ Release() }:
+		c.Release()
+	}
+}
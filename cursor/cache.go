@@ -0,0 +1,79 @@
+package cursor
+
+import (
+	"sync"
+
+	"github.com/shinkar94/godesktopdup/disp"
+)
+
+// DefaultCacheSize is the number of shapes kept by NewCache(0).
+const DefaultCacheSize = 32
+
+// Cache keeps decoded pointer shapes keyed by their content hash, so a shape
+// seen before (e.g. arrow -> I-beam -> arrow) is not decoded again.
+type Cache struct {
+	mu     sync.Mutex
+	size   int
+	shapes map[uint64]*Shape
+	order  []uint64
+}
+
+// NewCache returns a cache holding at most size shapes.
+func NewCache(size int) *Cache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	return &Cache{
+		size:   size,
+		shapes: make(map[uint64]*Shape, size),
+	}
+}
+
+// Get returns the decoded shape for info and buf, decoding it on a miss.
+func (c *Cache) Get(info disp.DuplicationPointerShapeInfo, buf []byte) (*Shape, error) {
+	id := ShapeID(info, buf)
+
+	c.mu.Lock()
+	if shape, ok := c.shapes[id]; ok {
+		c.touch(id)
+		c.mu.Unlock()
+		return shape, nil
+	}
+	c.mu.Unlock()
+
+	shape, err := Decode(info, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.shapes[id]; !ok {
+		if len(c.order) >= c.size {
+			delete(c.shapes, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.shapes[id] = shape
+		c.order = append(c.order, id)
+	}
+	return c.shapes[id], nil
+}
+
+// Lookup returns a cached shape by ID.
+func (c *Cache) Lookup(id uint64) (*Shape, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	shape, ok := c.shapes[id]
+	return shape, ok
+}
+
+// touch moves id to the most recently used position.
+func (c *Cache) touch(id uint64) {
+	for i, v := range c.order {
+		if v == id {
+			copy(c.order[i:], c.order[i+1:])
+			c.order[len(c.order)-1] = id
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package cursor
+
+import "fmt"
+
+// Draw composites the shape onto a BGRA frame with the hotspot at (x, y).
+//
+// Monochrome shapes apply the AND mask and then the XOR mask to the background.
+// Color shapes are alpha blended. Masked-color shapes replace the background
+// where the mask byte is 0x00 and XOR the color into it where it is 0xFF.
+func (s *Shape) Draw(dst []byte, width, height, stride, x, y int) error {
+	m := &s.Mask
+	if m.Width <= 0 || m.Height <= 0 || width <= 0 || height <= 0 {
+		return nil
+	}
+	if len(dst) < stride*(height-1)+width*4 {
+		return fmt.Errorf("destination buffer too small")
+	}
+
+	startX := x - s.HotSpot.X
+	startY := y - s.HotSpot.Y
+	left := max(0, -startX)
+	top := max(0, -startY)
+	right := min(m.Width, width-startX)
+	bottom := min(m.Height, height-startY)
+	if left >= right || top >= bottom {
+		return nil
+	}
+
+	for sy := top; sy < bottom; sy++ {
+		row := dst[(startY+sy)*stride:]
+		over := m.Over[sy*m.Width*4:]
+		for sx := left; sx < right; sx++ {
+			o := sx * 4
+			d := (startX + sx) * 4
+			a := uint16(over[o+3])
+			switch a {
+			case 0:
+			case 0xFF:
+				row[d], row[d+1], row[d+2] = over[o], over[o+1], over[o+2]
+			default:
+				inv := 0xFF - a
+				row[d] = byte((uint16(row[d])*inv+0x7F)/0xFF) + over[o]
+				row[d+1] = byte((uint16(row[d+1])*inv+0x7F)/0xFF) + over[o+1]
+				row[d+2] = byte((uint16(row[d+2])*inv+0x7F)/0xFF) + over[o+2]
+			}
+			if m.Xor != nil {
+				xor := m.Xor[sy*m.Width*4:]
+				row[d] ^= xor[o]
+				row[d+1] ^= xor[o+1]
+				row[d+2] ^= xor[o+2]
+			} else if a == 0 {
+				continue
+			}
+			row[d+3] = 0xFF
+		}
+	}
+	return nil
+}
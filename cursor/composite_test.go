@@ -0,0 +1,229 @@
+package cursor
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shinkar94/godesktopdup/disp"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+// The shapes are 4x4 with the hot spot at (1, 1). Every column exercises one
+// rule of the shape type; rows are identical.
+func monochrome(t *testing.T) *Shape {
+	// Columns: AND=0 XOR=0 (black), AND=0 XOR=1 (white), AND=1 XOR=0
+	// (transparent), AND=1 XOR=1 (invert).
+	buf := []byte{0x30, 0x30, 0x30, 0x30, 0x50, 0x50, 0x50, 0x50}
+	return decode(t, disp.DuplicationPointerShapeTypeMonochrome, 8, 1, buf)
+}
+
+func colorShape(t *testing.T) *Shape {
+	// Columns: opaque red, half transparent green, transparent, opaque white.
+	return decode(t, disp.DuplicationPointerShapeTypeColor, 4, 16, colorRows(
+		[4]byte{0x00, 0x00, 0xFF, 0xFF},
+		[4]byte{0x00, 0xFF, 0x00, 0x80},
+		[4]byte{0x12, 0x34, 0x56, 0x00},
+		[4]byte{0xFF, 0xFF, 0xFF, 0xFF},
+	))
+}
+
+func maskedColor(t *testing.T) *Shape {
+	// Columns: replace with red, replace with black, transparent, XOR with
+	// 0x0F0F0F.
+	return decode(t, disp.DuplicationPointerShapeTypeMaskedColor, 4, 16, colorRows(
+		[4]byte{0x00, 0x00, 0xFF, 0x00},
+		[4]byte{0x00, 0x00, 0x00, 0x00},
+		[4]byte{0x00, 0x00, 0x00, 0xFF},
+		[4]byte{0x0F, 0x0F, 0x0F, 0xFF},
+	))
+}
+
+// colorRows returns four BGRA rows of the given columns.
+func colorRows(cols ...[4]byte) []byte {
+	var buf []byte
+	for y := 0; y < 4; y++ {
+		for _, c := range cols {
+			buf = append(buf, c[:]...)
+		}
+	}
+	return buf
+}
+
+func decode(t *testing.T, typ disp.DuplicationPointerShapeType, height, pitch uint32, buf []byte) *Shape {
+	t.Helper()
+	s, err := Decode(disp.DuplicationPointerShapeInfo{
+		Type:    typ,
+		Width:   4,
+		Height:  height,
+		Pitch:   pitch,
+		HotSpot: disp.Point{X: 1, Y: 1},
+	}, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// background returns a 6x6 BGRA frame with a distinct opaque color per pixel.
+func background() []byte {
+	dst := make([]byte, 6*6*4)
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 6; x++ {
+			copy(dst[(y*6+x)*4:], []byte{byte(x * 40), byte(y * 40), 0x80, 0xFF})
+		}
+	}
+	return dst
+}
+
+func pixel(dst []byte, x, y int) [4]byte {
+	var p [4]byte
+	copy(p[:], dst[(y*6+x)*4:])
+	return p
+}
+
+// golden compares a BGRA frame with testdata/name.png.
+func golden(t *testing.T, name string, dst []byte) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 6, 6))
+	for i := 0; i < len(dst); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = dst[i+2], dst[i+1], dst[i], dst[i+3]
+	}
+	path := filepath.Join("testdata", name+".png")
+	if *update {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 6; x++ {
+			if got, w := img.At(x, y), color.RGBAModel.Convert(want.At(x, y)); got != w {
+				t.Errorf("%s: pixel %d,%d is %v, want %v", name, x, y, got, w)
+			}
+		}
+	}
+}
+
+func TestDrawMonochrome(t *testing.T) {
+	dst := background()
+	if err := monochrome(t).Draw(dst, 6, 6, 24, 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "monochrome", dst)
+
+	// The shape covers (1, 1)-(5, 5).
+	for _, c := range []struct {
+		x    int
+		want [4]byte
+	}{
+		{1, [4]byte{0x00, 0x00, 0x00, 0xFF}},
+		{2, [4]byte{0xFF, 0xFF, 0xFF, 0xFF}},
+		{3, [4]byte{3 * 40, 2 * 40, 0x80, 0xFF}},
+		{4, [4]byte{^byte(4 * 40), ^byte(2 * 40), 0x7F, 0xFF}},
+	} {
+		if got := pixel(dst, c.x, 2); got != c.want {
+			t.Errorf("pixel %d,2 is %x, want %x", c.x, got, c.want)
+		}
+	}
+	if got, want := pixel(dst, 0, 0), pixel(background(), 0, 0); got != want {
+		t.Errorf("pixel outside the shape changed to %x", got)
+	}
+}
+
+func TestDrawColor(t *testing.T) {
+	dst := background()
+	if err := colorShape(t).Draw(dst, 6, 6, 24, 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "color", dst)
+
+	// Half transparent green over (80, 80, 0x80): the background keeps
+	// 0x7F/0xFF of its value and green adds its premultiplied 0x80.
+	blend := func(v byte) byte { return byte((uint16(v)*0x7F + 0x7F) / 0xFF) }
+	for _, c := range []struct {
+		x    int
+		want [4]byte
+	}{
+		{1, [4]byte{0x00, 0x00, 0xFF, 0xFF}},
+		{2, [4]byte{blend(80), blend(80) + 0x80, blend(0x80), 0xFF}},
+		{3, [4]byte{3 * 40, 2 * 40, 0x80, 0xFF}},
+		{4, [4]byte{0xFF, 0xFF, 0xFF, 0xFF}},
+	} {
+		if got := pixel(dst, c.x, 2); got != c.want {
+			t.Errorf("pixel %d,2 is %x, want %x", c.x, got, c.want)
+		}
+	}
+}
+
+func TestDrawMaskedColor(t *testing.T) {
+	dst := background()
+	if err := maskedColor(t).Draw(dst, 6, 6, 24, 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "masked", dst)
+
+	for _, c := range []struct {
+		x    int
+		want [4]byte
+	}{
+		{1, [4]byte{0x00, 0x00, 0xFF, 0xFF}},
+		{2, [4]byte{0x00, 0x00, 0x00, 0xFF}},
+		{3, [4]byte{3 * 40, 2 * 40, 0x80, 0xFF}},
+		{4, [4]byte{4*40 ^ 0x0F, 2*40 ^ 0x0F, 0x8F, 0xFF}},
+	} {
+		if got := pixel(dst, c.x, 2); got != c.want {
+			t.Errorf("pixel %d,2 is %x, want %x", c.x, got, c.want)
+		}
+	}
+}
+
+func TestDrawClipped(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		x, y int
+	}{
+		{"clip-top-left", 0, 0},
+		{"clip-bottom-right", 5, 5},
+	} {
+		dst := background()
+		if err := colorShape(t).Draw(dst, 6, 6, 24, c.x, c.y); err != nil {
+			t.Fatal(err)
+		}
+		golden(t, c.name, dst)
+	}
+
+	// Drawing entirely outside leaves the frame alone.
+	dst := background()
+	if err := colorShape(t).Draw(dst, 6, 6, 24, -10, 20); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst, background()) {
+		t.Error("shape outside the frame was drawn")
+	}
+}
+
+func TestDrawTooSmall(t *testing.T) {
+	if err := colorShape(t).Draw(make([]byte, 10), 6, 6, 24, 2, 2); err == nil {
+		t.Error("Draw into a short buffer succeeded")
+	}
+}
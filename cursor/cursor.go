@@ -0,0 +1,184 @@
+package cursor
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+
+	"github.com/shinkar94/godesktopdup/disp"
+)
+
+// maxShapeSize bounds the width and height of a decoded pointer shape.
+const maxShapeSize = 1024
+
+// State describes the pointer as reported for a single captured frame.
+type State struct {
+	// X and Y are the position of the shape's top-left corner relative to the
+	// output's top-left corner, as DXGI reports it. The pointer tip is at
+	// Tip().
+	X, Y    int
+	Visible bool
+	// HotSpot is the hot spot of the current shape.
+	HotSpot image.Point
+	// LastUpdate is DuplicationFrameInfo.LastMouseUpdateTime of the frame
+	// that produced this state. Zero means the pointer did not change.
+	LastUpdate int64
+	// ShapeID identifies the current pointer shape. Zero means no shape has
+	// been received yet.
+	ShapeID uint64
+	// Shape is set only on the frame where the pointer shape changed.
+	Shape *Shape
+}
+
+// Tip returns the position the pointer points at, its shape's hot spot.
+func (s State) Tip() image.Point {
+	return image.Pt(s.X+s.HotSpot.X, s.Y+s.HotSpot.Y)
+}
+
+// Shape is a decoded pointer shape.
+type Shape struct {
+	ID   uint64
+	Type disp.DuplicationPointerShapeType
+	// Image is the shape for display by remote clients. It is premultiplied RGBA;
+	// pixels that invert the background are rendered opaque black.
+	Image   *image.RGBA
+	HotSpot image.Point
+	// Mask is the precomputed compositing data used by Draw.
+	Mask Mask
+}
+
+// Mask holds a shape in compositing form. Every pixel is drawn as
+// dst = (dst*(1-alpha) + Over) ^ Xor, which covers alpha blended color,
+// monochrome AND/XOR and masked-color XOR shapes alike.
+type Mask struct {
+	Width, Height int
+	// Over is premultiplied BGRA blended over the background.
+	Over []byte
+	// Xor is BGRX XORed into the background after blending. It is nil if the
+	// shape has no inverting pixels.
+	Xor []byte
+}
+
+// ShapeID returns a stable identifier for a pointer shape. Identical shapes
+// always produce the same ID, regardless of when they were received.
+func ShapeID(info disp.DuplicationPointerShapeInfo, buf []byte) uint64 {
+	h := fnv.New64a()
+	var hdr [24]byte
+	putUint32(hdr[0:], uint32(info.Type))
+	putUint32(hdr[4:], info.Width)
+	putUint32(hdr[8:], info.Height)
+	putUint32(hdr[12:], info.Pitch)
+	putUint32(hdr[16:], uint32(info.HotSpot.X))
+	putUint32(hdr[20:], uint32(info.HotSpot.Y))
+	h.Write(hdr[:])
+	h.Write(buf)
+	id := h.Sum64()
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
+func putUint32(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+	b[3] = byte(v >> 24)
+}
+
+// Decode converts a DXGI pointer shape into a display image and a compositing mask.
+func Decode(info disp.DuplicationPointerShapeInfo, buf []byte) (*Shape, error) {
+	width := int(info.Width)
+	height := int(info.Height)
+	pitch := int(info.Pitch)
+	if info.Type == disp.DuplicationPointerShapeTypeMonochrome {
+		height /= 2
+	}
+	if width <= 0 || height <= 0 || width > maxShapeSize || height > maxShapeSize {
+		return nil, fmt.Errorf("invalid pointer shape size %dx%d", width, height)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	mask := Mask{
+		Width:  width,
+		Height: height,
+		Over:   make([]byte, width*height*4),
+	}
+	xor := make([]byte, width*height*4)
+	hasXor := false
+
+	switch info.Type {
+	case disp.DuplicationPointerShapeTypeMonochrome:
+		if pitch < (width+7)/8 || pitch > maxShapeSize || len(buf) < pitch*height*2 {
+			return nil, fmt.Errorf("monochrome pointer shape buffer too small")
+		}
+		andMask := buf[:pitch*height]
+		xorMask := buf[pitch*height : pitch*height*2]
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				bit := byte(0x80) >> (x & 7)
+				andBit := andMask[y*pitch+x/8]&bit != 0
+				xorBit := xorMask[y*pitch+x/8]&bit != 0
+				o := (y*width + x) * 4
+				p := y*img.Stride + x*4
+				switch {
+				case !andBit:
+					// AND=0 clears the background, so XOR selects black or white.
+					var v byte
+					if xorBit {
+						v = 0xFF
+					}
+					mask.Over[o], mask.Over[o+1], mask.Over[o+2], mask.Over[o+3] = v, v, v, 0xFF
+					img.Pix[p], img.Pix[p+1], img.Pix[p+2], img.Pix[p+3] = v, v, v, 0xFF
+				case xorBit:
+					xor[o], xor[o+1], xor[o+2] = 0xFF, 0xFF, 0xFF
+					hasXor = true
+					img.Pix[p+3] = 0xFF
+				}
+			}
+		}
+	case disp.DuplicationPointerShapeTypeColor, disp.DuplicationPointerShapeTypeMaskedColor:
+		if pitch < width*4 || pitch > maxShapeSize*4 || len(buf) < pitch*(height-1)+width*4 {
+			return nil, fmt.Errorf("color pointer shape buffer too small")
+		}
+		masked := info.Type == disp.DuplicationPointerShapeTypeMaskedColor
+		for y := 0; y < height; y++ {
+			src := buf[y*pitch:]
+			for x := 0; x < width; x++ {
+				b, g, r, a := src[x*4], src[x*4+1], src[x*4+2], src[x*4+3]
+				o := (y*width + x) * 4
+				p := y*img.Stride + x*4
+				if masked {
+					if a == 0 {
+						mask.Over[o], mask.Over[o+1], mask.Over[o+2], mask.Over[o+3] = b, g, r, 0xFF
+						img.Pix[p], img.Pix[p+1], img.Pix[p+2], img.Pix[p+3] = r, g, b, 0xFF
+					} else if r|g|b != 0 {
+						xor[o], xor[o+1], xor[o+2] = b, g, r
+						hasXor = true
+						img.Pix[p+3] = 0xFF
+					}
+					continue
+				}
+				pb := byte(uint16(b) * uint16(a) / 0xFF)
+				pg := byte(uint16(g) * uint16(a) / 0xFF)
+				pr := byte(uint16(r) * uint16(a) / 0xFF)
+				mask.Over[o], mask.Over[o+1], mask.Over[o+2], mask.Over[o+3] = pb, pg, pr, a
+				img.Pix[p], img.Pix[p+1], img.Pix[p+2], img.Pix[p+3] = pr, pg, pb, a
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown pointer shape type %d", info.Type)
+	}
+
+	if hasXor {
+		mask.Xor = xor
+	}
+
+	return &Shape{
+		ID:      ShapeID(info, buf),
+		Type:    info.Type,
+		Image:   img,
+		HotSpot: image.Point{X: int(info.HotSpot.X), Y: int(info.HotSpot.Y)},
+		Mask:    mask,
+	}, nil
+}
@@ -0,0 +1,148 @@
+package cursor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/shinkar94/godesktopdup/disp"
+)
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		info disp.DuplicationPointerShapeInfo
+		buf  []byte
+	}{
+		{"unknown type", disp.DuplicationPointerShapeInfo{Type: 3, Width: 1, Height: 1, Pitch: 4}, make([]byte, 4)},
+		{"empty", disp.DuplicationPointerShapeInfo{Type: disp.DuplicationPointerShapeTypeColor, Pitch: 4}, nil},
+		{"too large", disp.DuplicationPointerShapeInfo{Type: disp.DuplicationPointerShapeTypeColor, Width: maxShapeSize + 1, Height: 1, Pitch: (maxShapeSize + 1) * 4}, nil},
+		{"odd monochrome", disp.DuplicationPointerShapeInfo{Type: disp.DuplicationPointerShapeTypeMonochrome, Width: 8, Height: 1, Pitch: 1}, make([]byte, 2)},
+		{"short monochrome", disp.DuplicationPointerShapeInfo{Type: disp.DuplicationPointerShapeTypeMonochrome, Width: 8, Height: 4, Pitch: 1}, make([]byte, 3)},
+		{"short pitch", disp.DuplicationPointerShapeInfo{Type: disp.DuplicationPointerShapeTypeColor, Width: 2, Height: 2, Pitch: 4}, make([]byte, 16)},
+		{"short color", disp.DuplicationPointerShapeInfo{Type: disp.DuplicationPointerShapeTypeMaskedColor, Width: 2, Height: 2, Pitch: 8}, make([]byte, 15)},
+	} {
+		if _, err := Decode(c.info, c.buf); err == nil {
+			t.Errorf("%s: Decode succeeded", c.name)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	info := disp.DuplicationPointerShapeInfo{Type: disp.DuplicationPointerShapeTypeColor, Width: 1, Height: 1, Pitch: 4}
+	c := NewCache(2)
+	a, err := c.Get(info, []byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := c.Get(info, []byte{1, 2, 3, 4}); again != a {
+		t.Error("same shape decoded twice")
+	}
+	c.Get(info, []byte{5, 6, 7, 8})
+	c.Get(info, []byte{1, 2, 3, 4})
+	c.Get(info, []byte{9, 9, 9, 9})
+	if _, ok := c.Lookup(a.ID); !ok {
+		t.Error("recently used shape was evicted")
+	}
+	if _, ok := c.Lookup(ShapeID(info, []byte{5, 6, 7, 8})); ok {
+		t.Error("least recently used shape was kept")
+	}
+}
+
+// checkEncode encodes s in both formats and checks that the output describes
+// the shape.
+func checkEncode(t *testing.T, s *Shape) {
+	t.Helper()
+	width, height := s.Image.Rect.Dx(), s.Image.Rect.Dy()
+
+	var buf bytes.Buffer
+	if err := EncodePNG(&buf, s); err != nil {
+		t.Fatalf("EncodePNG: %v", err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatalf("decoding PNG: %v", err)
+	}
+	if img.Bounds() != image.Rect(0, 0, width, height) {
+		t.Fatalf("PNG bounds %v, want %dx%d", img.Bounds(), width, height)
+	}
+
+	buf.Reset()
+	if err := EncodeCUR(&buf, s); err != nil {
+		t.Fatalf("EncodeCUR: %v", err)
+	}
+	cur := buf.Bytes()
+	andPitch := (width + 31) / 32 * 4
+	if want := 22 + 40 + width*height*4 + andPitch*height; len(cur) != want {
+		t.Fatalf("CUR is %d bytes, want %d", len(cur), want)
+	}
+	if binary.LittleEndian.Uint16(cur[2:]) != 2 ||
+		binary.LittleEndian.Uint16(cur[10:]) != uint16(s.HotSpot.X) ||
+		binary.LittleEndian.Uint16(cur[12:]) != uint16(s.HotSpot.Y) ||
+		int(binary.LittleEndian.Uint32(cur[14:])) != len(cur)-22 {
+		t.Fatalf("CUR header % x", cur[:22])
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	mono := disp.DuplicationPointerShapeTypeMonochrome
+	f.Add(uint32(mono), uint32(4), uint32(8), uint32(1), int32(1), int32(1), []byte{0x30, 0x30, 0x30, 0x30, 0x50, 0x50, 0x50, 0x50})
+	f.Add(uint32(disp.DuplicationPointerShapeTypeColor), uint32(2), uint32(2), uint32(8), int32(0), int32(0), bytes.Repeat([]byte{0x10, 0x20, 0x30, 0x80}, 4))
+	f.Add(uint32(disp.DuplicationPointerShapeTypeMaskedColor), uint32(2), uint32(1), uint32(12), int32(-1), int32(3), []byte{0, 0, 0xFF, 0, 0x0F, 0x0F, 0x0F, 0xFF, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, typ, width, height, pitch uint32, hx, hy int32, buf []byte) {
+		info := disp.DuplicationPointerShapeInfo{
+			Type:    disp.DuplicationPointerShapeType(typ),
+			Width:   width,
+			Height:  height,
+			Pitch:   pitch,
+			HotSpot: disp.Point{X: hx, Y: hy},
+		}
+		s, err := Decode(info, buf)
+		if err != nil {
+			return
+		}
+		w, h := int(width), int(height)
+		if info.Type == mono {
+			h /= 2
+		}
+		m := s.Mask
+		if s.Image.Rect != image.Rect(0, 0, w, h) || m.Width != w || m.Height != h ||
+			len(m.Over) != w*h*4 || (m.Xor != nil && len(m.Xor) != w*h*4) {
+			t.Fatalf("%+v: image %v, mask %dx%d over %d xor %d",
+				info, s.Image.Rect, m.Width, m.Height, len(m.Over), len(m.Xor))
+		}
+		if s.ID != ShapeID(info, buf) {
+			t.Fatal("ID differs from ShapeID")
+		}
+
+		// Draw it over every edge of a small frame.
+		dst := make([]byte, 16*16*4)
+		for _, p := range []image.Point{{-w, -h}, {0, 0}, {8, 8}, {15, 15}, {16, 16}} {
+			if err := s.Draw(dst, 16, 16, 16*4, p.X, p.Y); err != nil {
+				t.Fatal(err)
+			}
+		}
+		checkEncode(t, s)
+	})
+}
+
+func FuzzEncode(f *testing.F) {
+	f.Add(uint8(3), uint8(2), int16(1), int16(1), []byte{0xFF, 0x80, 0x00, 0x40})
+	f.Add(uint8(33), uint8(1), int16(-5), int16(300), []byte{0x00})
+	f.Fuzz(func(t *testing.T, width, height uint8, hx, hy int16, pix []byte) {
+		if width == 0 || height == 0 {
+			return
+		}
+		// The image need not be validly premultiplied; the encoders must
+		// still produce well-formed files.
+		img := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+		for i := range img.Pix {
+			if len(pix) > 0 {
+				img.Pix[i] = pix[i%len(pix)]
+			}
+		}
+		checkEncode(t, &Shape{Image: img, HotSpot: image.Pt(int(hx), int(hy))})
+	})
+}
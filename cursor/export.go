@@ -0,0 +1,76 @@
+package cursor
+
+import (
+	"encoding/binary"
+	"image/png"
+	"io"
+)
+
+// EncodePNG writes the display image of the shape as PNG.
+func EncodePNG(w io.Writer, s *Shape) error {
+	return png.Encode(w, s.Image)
+}
+
+// EncodeCUR writes the shape as a Windows .cur file with a 32-bit BGRA bitmap
+// and an AND mask, preserving the hotspot.
+func EncodeCUR(w io.Writer, s *Shape) error {
+	width := s.Image.Rect.Dx()
+	height := s.Image.Rect.Dy()
+	andPitch := ((width + 31) / 32) * 4
+	imageSize := 40 + width*height*4 + andPitch*height
+
+	dimension := func(v int) byte {
+		if v >= 256 {
+			return 0
+		}
+		return byte(v)
+	}
+
+	// ICONDIR + ICONDIRENTRY
+	hdr := make([]byte, 6+16)
+	binary.LittleEndian.PutUint16(hdr[2:], 2)
+	binary.LittleEndian.PutUint16(hdr[4:], 1)
+	hdr[6] = dimension(width)
+	hdr[7] = dimension(height)
+	binary.LittleEndian.PutUint16(hdr[10:], uint16(s.HotSpot.X))
+	binary.LittleEndian.PutUint16(hdr[12:], uint16(s.HotSpot.Y))
+	binary.LittleEndian.PutUint32(hdr[14:], uint32(imageSize))
+	binary.LittleEndian.PutUint32(hdr[18:], uint32(len(hdr)))
+
+	// BITMAPINFOHEADER, height covers both the color bitmap and the AND mask.
+	bih := make([]byte, 40)
+	binary.LittleEndian.PutUint32(bih[0:], 40)
+	binary.LittleEndian.PutUint32(bih[4:], uint32(width))
+	binary.LittleEndian.PutUint32(bih[8:], uint32(height*2))
+	binary.LittleEndian.PutUint16(bih[12:], 1)
+	binary.LittleEndian.PutUint16(bih[14:], 32)
+	binary.LittleEndian.PutUint32(bih[20:], uint32(width*height*4+andPitch*height))
+
+	pixels := make([]byte, width*height*4)
+	andMask := make([]byte, andPitch*height)
+	for y := 0; y < height; y++ {
+		// DIB rows are stored bottom-up.
+		dstRow := height - 1 - y
+		for x := 0; x < width; x++ {
+			p := s.Image.Pix[y*s.Image.Stride+x*4:]
+			r, g, b, a := p[0], p[1], p[2], p[3]
+			if a != 0 && a != 0xFF {
+				r = byte(uint16(r) * 0xFF / uint16(a))
+				g = byte(uint16(g) * 0xFF / uint16(a))
+				b = byte(uint16(b) * 0xFF / uint16(a))
+			}
+			o := (dstRow*width + x) * 4
+			pixels[o], pixels[o+1], pixels[o+2], pixels[o+3] = b, g, r, a
+			if a == 0 {
+				andMask[dstRow*andPitch+x/8] |= 0x80 >> (x & 7)
+			}
+		}
+	}
+
+	for _, chunk := range [][]byte{hdr, bih, pixels, andMask} {
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
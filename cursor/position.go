@@ -0,0 +1,19 @@
+package cursor
+
+import "github.com/shinkar94/godesktopdup/disp"
+
+// ToPhysical maps a pointer position from the output's logical (rotated desktop)
+// space, in which DXGI reports PointerPosition, to the unrotated panel
+// orientation in which the desktop image is returned.
+func ToPhysical(x, y int, rotation disp.ModeRotation, logicalWidth, logicalHeight int) (int, int) {
+	switch rotation {
+	case disp.ModeRotationRotate90:
+		return y, logicalWidth - 1 - x
+	case disp.ModeRotationRotate180:
+		return logicalWidth - 1 - x, logicalHeight - 1 - y
+	case disp.ModeRotationRotate270:
+		return logicalHeight - 1 - y, x
+	default:
+		return x, y
+	}
+}
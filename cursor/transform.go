@@ -0,0 +1,138 @@
+package cursor
+
+import (
+	"image"
+	"math"
+
+	"github.com/shinkar94/godesktopdup/disp"
+)
+
+// Filter selects the resampling used by Shape.Scale.
+type Filter int
+
+const (
+	FilterNearest Filter = iota
+	FilterBilinear
+)
+
+// Rotate returns the shape transformed from logical orientation into the
+// physical orientation of an output with the given rotation, matching ToPhysical.
+// The returned shape keeps the ID of s.
+func (s *Shape) Rotate(rotation disp.ModeRotation) *Shape {
+	w, h := s.Mask.Width, s.Mask.Height
+	var dw, dh int
+	var hotSpot image.Point
+	var srcOf func(x, y int) (int, int)
+
+	switch rotation {
+	case disp.ModeRotationRotate90:
+		dw, dh = h, w
+		hotSpot = image.Point{X: s.HotSpot.Y, Y: w - 1 - s.HotSpot.X}
+		srcOf = func(x, y int) (int, int) { return w - 1 - y, x }
+	case disp.ModeRotationRotate180:
+		dw, dh = w, h
+		hotSpot = image.Point{X: w - 1 - s.HotSpot.X, Y: h - 1 - s.HotSpot.Y}
+		srcOf = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	case disp.ModeRotationRotate270:
+		dw, dh = h, w
+		hotSpot = image.Point{X: h - 1 - s.HotSpot.Y, Y: s.HotSpot.X}
+		srcOf = func(x, y int) (int, int) { return y, h - 1 - x }
+	default:
+		return s
+	}
+
+	out := newShapeLike(s, dw, dh, hotSpot)
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := srcOf(x, y)
+			copy(out.Image.Pix[y*out.Image.Stride+x*4:][:4], s.Image.Pix[sy*s.Image.Stride+sx*4:])
+			copy(out.Mask.Over[(y*dw+x)*4:][:4], s.Mask.Over[(sy*w+sx)*4:])
+			if s.Mask.Xor != nil {
+				copy(out.Mask.Xor[(y*dw+x)*4:][:4], s.Mask.Xor[(sy*w+sx)*4:])
+			}
+		}
+	}
+	return out
+}
+
+// Scale returns the shape resized by factor. XOR pixels are always sampled
+// with nearest neighbour since inverting cannot be interpolated.
+// The returned shape keeps the ID of s.
+func (s *Shape) Scale(factor float64, filter Filter) *Shape {
+	if factor <= 0 || factor == 1 {
+		return s
+	}
+	w, h := s.Mask.Width, s.Mask.Height
+	dw := max(1, int(math.Round(float64(w)*factor)))
+	dh := max(1, int(math.Round(float64(h)*factor)))
+	if dw > maxShapeSize || dh > maxShapeSize {
+		return s
+	}
+	hotSpot := image.Point{
+		X: min(dw-1, int(float64(s.HotSpot.X)*factor)),
+		Y: min(dh-1, int(float64(s.HotSpot.Y)*factor)),
+	}
+
+	out := newShapeLike(s, dw, dh, hotSpot)
+	resample(out.Image.Pix, out.Image.Stride, dw, dh, s.Image.Pix, s.Image.Stride, w, h, filter)
+	resample(out.Mask.Over, dw*4, dw, dh, s.Mask.Over, w*4, w, h, filter)
+	if s.Mask.Xor != nil {
+		resample(out.Mask.Xor, dw*4, dw, dh, s.Mask.Xor, w*4, w, h, FilterNearest)
+	}
+	return out
+}
+
+func newShapeLike(s *Shape, width, height int, hotSpot image.Point) *Shape {
+	out := &Shape{
+		ID:      s.ID,
+		Type:    s.Type,
+		Image:   image.NewRGBA(image.Rect(0, 0, width, height)),
+		HotSpot: hotSpot,
+		Mask: Mask{
+			Width:  width,
+			Height: height,
+			Over:   make([]byte, width*height*4),
+		},
+	}
+	if s.Mask.Xor != nil {
+		out.Mask.Xor = make([]byte, width*height*4)
+	}
+	return out
+}
+
+// resample scales a 4-byte-per-pixel plane.
+func resample(dst []byte, dstStride, dw, dh int, src []byte, srcStride, sw, sh int, filter Filter) {
+	sx := float64(sw) / float64(dw)
+	sy := float64(sh) / float64(dh)
+	for y := 0; y < dh; y++ {
+		row := dst[y*dstStride:]
+		fy := (float64(y)+0.5)*sy - 0.5
+		for x := 0; x < dw; x++ {
+			fx := (float64(x)+0.5)*sx - 0.5
+			d := row[x*4 : x*4+4]
+			if filter == FilterNearest {
+				nx := min(sw-1, int((float64(x)+0.5)*sx))
+				ny := min(sh-1, int((float64(y)+0.5)*sy))
+				copy(d, src[ny*srcStride+nx*4:])
+				continue
+			}
+			x0 := int(math.Floor(fx))
+			y0 := int(math.Floor(fy))
+			ax := fx - float64(x0)
+			ay := fy - float64(y0)
+			x1 := min(sw-1, max(0, x0+1))
+			y1 := min(sh-1, max(0, y0+1))
+			x0 = min(sw-1, max(0, x0))
+			y0 = min(sh-1, max(0, y0))
+			p00 := src[y0*srcStride+x0*4:]
+			p10 := src[y0*srcStride+x1*4:]
+			p01 := src[y1*srcStride+x0*4:]
+			p11 := src[y1*srcStride+x1*4:]
+			for c := 0; c < 4; c++ {
+				top := float64(p00[c])*(1-ax) + float64(p10[c])*ax
+				bottom := float64(p01[c])*(1-ax) + float64(p11[c])*ax
+				d[c] = byte(top*(1-ay) + bottom*ay + 0.5)
+			}
+		}
+	}
+}
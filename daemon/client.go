@@ -0,0 +1,239 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/shmring"
+	"github.com/shinkar94/godesktopdup/snapshot"
+)
+
+// ErrSubscriptionEnded is returned by Subscription.GetFrame once the daemon
+// ended an inline subscription.
+var ErrSubscriptionEnded = errors.New("daemon: subscription ended")
+
+// Client talks to a daemon. It is safe for concurrent use; requests are sent
+// one at a time.
+type Client struct {
+	addr string
+	mu   sync.Mutex
+	conn io.ReadWriteCloser
+}
+
+// Dial connects to the daemon at addr, DefaultAddr if empty.
+func Dial(addr string) (*Client, error) {
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	conn, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{addr: addr, conn: conn}, nil
+}
+
+// roundTrip sends a request and returns the response, and the image following
+// it if want is set.
+func (c *Client) roundTrip(req *Request, want bool) (*Response, []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return roundTrip(c.conn, req, want)
+}
+
+func roundTrip(conn io.ReadWriter, req *Request, want bool) (*Response, []byte, error) {
+	if err := writeJSON(conn, msgRequest, req); err != nil {
+		return nil, nil, err
+	}
+	typ, body, err := readMsg(conn, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var resp Response
+	if typ != msgResponse || json.Unmarshal(body, &resp) != nil {
+		return nil, nil, errProtocol
+	}
+	if resp.Error != "" {
+		return nil, nil, errors.New(resp.Error)
+	}
+	if !want {
+		return &resp, nil, nil
+	}
+	typ, body, err = readMsg(conn, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if typ != msgImage {
+		return nil, nil, errProtocol
+	}
+	return &resp, body, nil
+}
+
+// Outputs lists the outputs the daemon serves.
+func (c *Client) Outputs() ([]Output, error) {
+	resp, _, err := c.roundTrip(&Request{Cmd: CmdListOutputs}, false)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Outputs, nil
+}
+
+// Snapshot returns the current image of an output encoded in format. quality
+// applies to JPEG; 0 means the default.
+func (c *Client) Snapshot(output int, format snapshot.Format, quality int) ([]byte, error) {
+	_, img, err := c.roundTrip(&Request{
+		Cmd:     CmdSnapshot,
+		Output:  output,
+		Format:  format.String(),
+		Quality: quality,
+	}, true)
+	return img, err
+}
+
+// SetOptions changes how an output is captured, for every client.
+func (c *Client) SetOptions(output int, opts OutputOptions) error {
+	_, _, err := c.roundTrip(&Request{Cmd: CmdSetOptions, Output: output, Options: &opts}, false)
+	return err
+}
+
+// Close closes the connection. Subscriptions have their own and stay open.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// SubscribeOptions configures a subscription. A nil *SubscribeOptions uses
+// the defaults.
+type SubscribeOptions struct {
+	// FPS is the highest frame rate wanted, at most the daemon's MaxFPS,
+	// which is also the default.
+	FPS float64
+	// Inline sends frames on the connection instead of through a
+	// shared-memory ring, for clients that cannot map the daemon's files.
+	// Only changed regions are sent.
+	Inline bool
+}
+
+// Subscription receives the frames of an output. It implements frame.Source
+// and is not safe for concurrent use.
+type Subscription struct {
+	conn io.ReadWriteCloser
+	ring *shmring.Reader
+
+	frames chan *frameMsg
+	done   chan struct{}
+	err    error
+	fr     frame.Frame
+	once   sync.Once
+}
+
+// Subscribe starts receiving frames of an output on a new connection. With
+// ring delivery GetFrame returns shmring.ErrClosed when the daemon replaces
+// the ring for a larger output size; subscribe again to continue.
+func (c *Client) Subscribe(output int, opts *SubscribeOptions) (*Subscription, error) {
+	var o SubscribeOptions
+	if opts != nil {
+		o = *opts
+	}
+	conn, err := dial(c.addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, _, err := roundTrip(conn, &Request{Cmd: CmdSubscribe, Output: output, FPS: o.FPS, Inline: o.Inline}, false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s := &Subscription{conn: conn, done: make(chan struct{})}
+	if o.Inline {
+		s.frames = make(chan *frameMsg, 1)
+		go s.receive()
+		return s, nil
+	}
+	if s.ring, err = shmring.Open(resp.Ring); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// receive reads inline frames until the connection ends.
+func (s *Subscription) receive() {
+	defer close(s.frames)
+	for {
+		typ, body, err := readMsg(s.conn, nil)
+		var m *frameMsg
+		if err == nil {
+			if typ != msgFrame {
+				err = errProtocol
+			} else {
+				m, err = parseFrame(body)
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = ErrSubscriptionEnded
+			}
+			s.err = err
+			return
+		}
+		select {
+		case s.frames <- m:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// GetFrame returns the next frame, waiting up to timeoutMs. The frame stays
+// valid until the next call.
+func (s *Subscription) GetFrame(timeoutMs uint) (*frame.Frame, error) {
+	if s.ring != nil {
+		return s.ring.GetFrame(timeoutMs)
+	}
+	t := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+	defer t.Stop()
+	var m *frameMsg
+	select {
+	case m = <-s.frames:
+	case <-t.C:
+		return nil, frame.ErrNoImageYet
+	}
+	if m == nil {
+		return nil, s.err
+	}
+	f := &s.fr
+	resized := f.Width != m.width || f.Height != m.height
+	if resized {
+		*f = *frame.New(m.width, m.height)
+	}
+	for i, r := range m.rects {
+		frame.CopyRect(f.Pix[r.Min.Y*f.Stride+r.Min.X*4:], f.Stride, m.pix[i], r.Dx()*4, r.Sub(r.Min))
+	}
+	switch {
+	case resized:
+		f.Dirty = nil
+	case m.rects == nil:
+		f.Dirty = []image.Rectangle{}
+	default:
+		f.Dirty = m.rects
+	}
+	f.Seq, f.Time = m.seq, m.time
+	return f, nil
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		if s.ring != nil {
+			s.ring.Close()
+		}
+		err = s.conn.Close()
+	})
+	return err
+}
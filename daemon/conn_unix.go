@@ -0,0 +1,132 @@
+//go:build !windows
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// DefaultAddr is the daemon's address when none is given: a Unix socket in
+// $XDG_RUNTIME_DIR, or in a directory of the current user in the temporary
+// directory.
+var DefaultAddr = defaultAddr()
+
+func defaultAddr() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("ddacap-%d", os.Getuid()))
+	}
+	return filepath.Join(dir, "ddacap.sock")
+}
+
+type unixListener struct {
+	*net.UnixListener
+	addr string
+}
+
+// Accept returns the next connection of the current user. Connections of
+// other users are closed.
+func (l unixListener) Accept() (io.ReadWriteCloser, error) {
+	for {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		if checkPeer(c) == nil {
+			return c, nil
+		}
+		c.Close()
+	}
+}
+
+func (l unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.addr)
+	return err
+}
+
+// listen creates the socket at addr, accessible to the current user only. A
+// socket left behind by a daemon that died is replaced. The socket is bound
+// in a new directory of mode 0700 and moved into place once its mode is set,
+// so other users never get to connect, and the directory of addr is created
+// with mode 0700 if missing.
+func listen(addr string) (listener, error) {
+	if _, err := os.Stat(addr); err == nil {
+		if c, err := net.Dial("unix", addr); err == nil {
+			c.Close()
+			return nil, errors.New("daemon: already running at " + addr)
+		}
+		os.Remove(addr)
+	}
+	dir := filepath.Dir(addr)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp(dir, ".ddacap-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed at its final path by Close.
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(path, addr); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return unixListener{l, addr}, nil
+}
+
+// dial connects to addr and makes sure the daemon runs as the current user,
+// so frames and requests are not exchanged with another user's process.
+func dial(addr string) (io.ReadWriteCloser, error) {
+	c, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: addr, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPeer(c); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("daemon: %s: %w", addr, err)
+	}
+	return c, nil
+}
+
+var errPeerUser = errors.New("peer runs as another user")
+
+// checkPeer returns an error if the other end of c runs as another user.
+// Where the platform cannot tell, the mode of the socket and its directory
+// are the only protection.
+func checkPeer(c *net.UnixConn) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var uid int
+	var credErr error
+	if err := raw.Control(func(fd uintptr) { uid, credErr = peerUID(fd) }); err != nil {
+		return err
+	}
+	if credErr != nil {
+		if credErr == errNoPeerCred {
+			return nil
+		}
+		return credErr
+	}
+	if uid != os.Getuid() {
+		return errPeerUser
+	}
+	return nil
+}
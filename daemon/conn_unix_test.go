@@ -0,0 +1,49 @@
+//go:build !windows
+
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenMode(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "run")
+	addr := filepath.Join(dir, "ddacap.sock")
+	l, err := listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]os.FileMode{dir: 0o700, addr: 0o600} {
+		st, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := st.Mode().Perm(); perm != want {
+			t.Errorf("%s has mode %v, want %v", path, perm, want)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("socket directory holds %d entries, want only the socket", len(entries))
+	}
+
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if _, err := listen(addr); err == nil {
+		t.Error("second listen on a live socket succeeded")
+	}
+	l.Close()
+	if _, err := os.Stat(addr); !os.IsNotExist(err) {
+		t.Errorf("socket left behind after Close: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+//go:build windows
+
+package daemon
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// DefaultAddr is the daemon's address when none is given: a named pipe.
+var DefaultAddr = `\\.\pipe\ddacap`
+
+// pipeSDDL grants access to the system, administrators and the pipe's owner
+// only, as frames show whatever is on screen.
+const pipeSDDL = "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GA;;;OW)"
+
+type pipeListener struct {
+	addr string
+	name *uint16
+	sa   *windows.SecurityAttributes
+
+	mu sync.Mutex
+	// next is the instance the next Accept waits on; pending the one it is
+	// waiting on.
+	next    windows.Handle
+	pending windows.Handle
+	closed  bool
+}
+
+// listen creates the named pipe at addr. It fails if another process already
+// serves the pipe.
+func listen(addr string) (listener, error) {
+	sd, err := windows.SecurityDescriptorFromString(pipeSDDL)
+	if err != nil {
+		return nil, err
+	}
+	name, err := windows.UTF16PtrFromString(addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &pipeListener{
+		addr: addr,
+		name: name,
+		sa: &windows.SecurityAttributes{
+			Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+			SecurityDescriptor: sd,
+		},
+	}
+	if l.next, err = l.create(true); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *pipeListener) create(first bool) (windows.Handle, error) {
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX)
+	if first {
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	return windows.CreateNamedPipe(l.name, flags,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		windows.PIPE_UNLIMITED_INSTANCES, 1<<16, 1<<16, 0, l.sa)
+}
+
+func (l *pipeListener) Accept() (io.ReadWriteCloser, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	h := l.next
+	l.next = 0
+	if h == 0 {
+		var err error
+		if h, err = l.create(false); err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+	}
+	l.pending = h
+	l.mu.Unlock()
+
+	err := windows.ConnectNamedPipe(h, nil)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending = 0
+	if l.closed {
+		windows.CloseHandle(h)
+		return nil, net.ErrClosed
+	}
+	if err != nil && err != windows.ERROR_PIPE_CONNECTED {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	// Have the next instance ready, so clients do not find the pipe busy.
+	l.next, _ = l.create(false)
+	return &pipeConn{h: h, server: true}, nil
+}
+
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	next, pending := l.next, l.pending
+	l.next = 0
+	l.mu.Unlock()
+	if next != 0 {
+		windows.CloseHandle(next)
+	}
+	if pending != 0 {
+		// Connecting releases the blocked ConnectNamedPipe.
+		if c, err := dial(l.addr); err == nil {
+			c.Close()
+		}
+	}
+	return nil
+}
+
+// pipeConn is one end of a pipe connection in blocking mode.
+type pipeConn struct {
+	h      windows.Handle
+	server bool
+	once   sync.Once
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	var n uint32
+	err := windows.ReadFile(c.h, b, &n, nil)
+	switch err {
+	case nil:
+		return int(n), nil
+	case windows.ERROR_BROKEN_PIPE, windows.ERROR_PIPE_NOT_CONNECTED:
+		return 0, io.EOF
+	}
+	return int(n), err
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	done := 0
+	for done < len(b) {
+		var n uint32
+		if err := windows.WriteFile(c.h, b[done:], &n, nil); err != nil {
+			return done, err
+		}
+		done += int(n)
+	}
+	return done, nil
+}
+
+func (c *pipeConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		if c.server {
+			windows.DisconnectNamedPipe(c.h)
+		}
+		err = windows.CloseHandle(c.h)
+	})
+	return err
+}
+
+func dial(addr string) (io.ReadWriteCloser, error) {
+	name, err := windows.UTF16PtrFromString(addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING, 0, 0)
+		if err == nil {
+			return &pipeConn{h: h}, nil
+		}
+		// Every instance is taken until the daemon creates the next one.
+		if err != windows.ERROR_PIPE_BUSY || time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
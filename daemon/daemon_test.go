@@ -0,0 +1,481 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/shmring"
+	"github.com/shinkar94/godesktopdup/snapshot"
+	"github.com/shinkar94/godesktopdup/synth"
+)
+
+// scripted is a source returning the frames pushed by a test.
+type scripted struct {
+	frames chan *frame.Frame
+	cursor atomic.Bool
+	closed atomic.Bool
+}
+
+func newScripted() *scripted {
+	return &scripted{frames: make(chan *frame.Frame, 1)}
+}
+
+func (s *scripted) GetFrame(timeoutMs uint) (*frame.Frame, error) {
+	t := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+	defer t.Stop()
+	select {
+	case f := <-s.frames:
+		return f, nil
+	case <-t.C:
+		return nil, frame.ErrNoImageYet
+	}
+}
+
+func (s *scripted) SetCaptureCursor(on bool) { s.cursor.Store(on) }
+
+func (s *scripted) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+// provider serves src as output 0.
+func provider(src frame.Source) *Sources {
+	return &Sources{
+		List: []Output{{Index: 0, Name: "TEST", Width: 32, Height: 24}},
+		New:  func(int) (frame.Source, error) { return src, nil },
+	}
+}
+
+// fill sets the pixels of r to v.
+func fill(f *frame.Frame, r image.Rectangle, v byte) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := f.Pix[y*f.Stride+r.Min.X*4 : y*f.Stride+r.Max.X*4]
+		for i := range row {
+			row[i] = v
+		}
+	}
+}
+
+func testAddr(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		return fmt.Sprintf(`\\.\pipe\ddacap-test-%d-%d`, os.Getpid(), time.Now().UnixNano())
+	}
+	return filepath.Join(t.TempDir(), "d.sock")
+}
+
+// start serves p and returns the server and a connected client.
+func start(t *testing.T, p Provider, opts *Options) (*Server, *Client) {
+	t.Helper()
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	o.RingDir = t.TempDir()
+	srv := New(p, &o)
+	addr := testAddr(t)
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(addr) }()
+	var c *Client
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		var err error
+		if c, err = Dial(addr); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dialing the daemon: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		srv.Close()
+		if err := <-errc; err != ErrServerClosed {
+			t.Errorf("ListenAndServe: %v", err)
+		}
+	})
+	return srv, c
+}
+
+func getFrame(t *testing.T, src frame.Source) *frame.Frame {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		f, err := src.GetFrame(100)
+		if err == nil {
+			return f
+		}
+		if !errors.Is(err, frame.ErrNoImageYet) || time.Now().After(deadline) {
+			t.Fatalf("GetFrame: %v", err)
+		}
+	}
+}
+
+// samePixels reports whether two frames of the same size hold the same image.
+func samePixels(a, b *frame.Frame) bool {
+	for y := 0; y < a.Height; y++ {
+		if !bytes.Equal(a.Pix[y*a.Stride:][:a.Width*4], b.Pix[y*b.Stride:][:b.Width*4]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMessages(t *testing.T) {
+	var b bytes.Buffer
+	for i, body := range [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{7}, 1000)} {
+		if err := writeMsg(&b, byte(i+1), body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf []byte
+	for i, want := range [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{7}, 1000)} {
+		typ, body, err := readMsg(&b, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != byte(i+1) || !bytes.Equal(body, want) {
+			t.Errorf("message %d: type %d, %d bytes", i, typ, len(body))
+		}
+		buf = body
+	}
+	if _, _, err := readMsg(&b, nil); err != io.EOF {
+		t.Errorf("at the end: %v, want io.EOF", err)
+	}
+
+	for _, c := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"zero length", []byte{0, 0, 0, 0, 1}, errProtocol},
+		{"too long", []byte{0x7F, 0xFF, 0xFF, 0xFF, 1}, errProtocol},
+		{"truncated", []byte{0, 0, 0, 9, 1, 'a'}, io.ErrUnexpectedEOF},
+	} {
+		if _, _, err := readMsg(bytes.NewReader(c.data), nil); err != c.want {
+			t.Errorf("%s: %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestFrameMessage(t *testing.T) {
+	canvas := make([]byte, 8*6*4)
+	for i := range canvas {
+		canvas[i] = byte(i)
+	}
+	rects := []image.Rectangle{image.Rect(1, 1, 3, 4), image.Rect(5, 0, 8, 6)}
+	now := time.Unix(1700000000, 12345)
+	b := appendFrame(nil, 42, now, canvas, 8, 6, rects)
+	m, err := parseFrame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.seq != 42 || !m.time.Equal(now) || m.width != 8 || m.height != 6 || !reflect.DeepEqual(m.rects, rects) {
+		t.Fatalf("decoded %+v", m)
+	}
+	for i, r := range rects {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			got := m.pix[i][(y-r.Min.Y)*r.Dx()*4:][:r.Dx()*4]
+			if !bytes.Equal(got, canvas[(y*8+r.Min.X)*4:(y*8+r.Max.X)*4]) {
+				t.Fatalf("rect %v row %d differs", r, y)
+			}
+		}
+	}
+
+	if _, err := parseFrame(b[:frameHeaderSize-1]); err == nil {
+		t.Error("short header accepted")
+	}
+	if _, err := parseFrame(b[:len(b)-1]); err == nil {
+		t.Error("truncated pixels accepted")
+	}
+	outside := appendFrame(nil, 1, now, make([]byte, 16*6*4), 16, 6, []image.Rectangle{image.Rect(9, 0, 12, 2)})
+	copy(outside[16:], b[16:24]) // claim an 8x6 frame
+	if _, err := parseFrame(outside); err == nil {
+		t.Error("region outside the frame accepted")
+	}
+}
+
+func TestDamageSince(t *testing.T) {
+	ss := newSession(New(nil, nil), 0, nil)
+	f := frame.New(32, 24)
+	store := func(dirty ...image.Rectangle) uint64 {
+		f.Dirty = dirty
+		ss.store(f)
+		return ss.seq
+	}
+	first := store()
+	a, b := image.Rect(0, 0, 8, 8), image.Rect(4, 4, 12, 12)
+	store(a)
+	store(b)
+	f.Moves = []frame.Move{{Src: image.Pt(0, 0), Dst: image.Rect(20, 20, 24, 24)}}
+	last := store(image.Rect(0, 0, 1, 1))
+	f.Moves = nil
+
+	if got := ss.damageSince(0); got != nil {
+		t.Errorf("since nothing: %v, want the whole frame", got)
+	}
+	want := frame.Disjoint([]image.Rectangle{a, b, image.Rect(20, 20, 24, 24)})
+	if got := ss.damageSince(first); !reflect.DeepEqual(got, want) {
+		t.Errorf("since the first frame: %v, want %v", got, want)
+	}
+	if got := ss.damageSince(last); got == nil || len(got) != 0 {
+		t.Errorf("since the latest frame: %v, want no regions", got)
+	}
+
+	// A full frame in between needs the whole frame.
+	full := store()
+	store(a)
+	if got := ss.damageSince(last); got != nil {
+		t.Errorf("across a full frame: %v, want the whole frame", got)
+	}
+	if got := ss.damageSince(full); !reflect.DeepEqual(got, []image.Rectangle{a}) {
+		t.Errorf("after the full frame: %v, want %v", got, a)
+	}
+
+	// Frames older than the history need the whole frame.
+	old := ss.seq
+	for i := 0; i < historyLen; i++ {
+		store(a)
+	}
+	if got := ss.damageSince(old - 1); got != nil {
+		t.Errorf("beyond the history: %v, want the whole frame", got)
+	}
+	if got := ss.damageSince(old); !reflect.DeepEqual(got, []image.Rectangle{a}) {
+		t.Errorf("at the start of the history: %v, want %v", got, a)
+	}
+}
+
+func TestListOutputs(t *testing.T) {
+	p := &Sources{
+		List: []Output{
+			{Index: 0, Name: "A", Width: 64, Height: 48},
+			{Index: 1, Name: "B", X: 64, Width: 32, Height: 24},
+		},
+		New: func(index int) (frame.Source, error) {
+			return synth.New(synth.Options{Width: 64, Height: 48}), nil
+		},
+	}
+	_, c := start(t, p, nil)
+	got, err := c.Outputs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p.List) {
+		t.Errorf("outputs %+v, want %+v", got, p.List)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	p := &Sources{
+		List: []Output{{Index: 0, Width: 64, Height: 48}},
+		New: func(int) (frame.Source, error) {
+			return synth.New(synth.Options{Width: 64, Height: 48, Static: true}), nil
+		},
+	}
+	_, c := start(t, p, nil)
+	for i := 0; i < 2; i++ {
+		b, err := c.Snapshot(0, snapshot.PNG, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds() != image.Rect(0, 0, 64, 48) {
+			t.Errorf("PNG bounds %v", img.Bounds())
+		}
+	}
+	b, err := c.Snapshot(0, snapshot.JPEG, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(b)); err != nil {
+		t.Errorf("JPEG: %v", err)
+	}
+
+	if _, err := c.Snapshot(3, snapshot.PNG, 0); err == nil {
+		t.Error("snapshot of a missing output succeeded")
+	}
+	if _, _, err := c.roundTrip(&Request{Cmd: CmdSnapshot, Format: "bmp"}, true); err == nil {
+		t.Error("snapshot in an unknown format succeeded")
+	}
+	if _, _, err := c.roundTrip(&Request{Cmd: "reboot"}, false); err == nil {
+		t.Error("unknown command succeeded")
+	}
+	// The connection is still usable after errors.
+	if _, err := c.Outputs(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	src := newScripted()
+	_, c := start(t, provider(src), nil)
+	on := true
+	if err := c.SetOptions(0, OutputOptions{Cursor: &on}); err != nil {
+		t.Fatal(err)
+	}
+	if !src.cursor.Load() {
+		t.Error("cursor option not applied")
+	}
+	if err := c.SetOptions(0, OutputOptions{CursorScale: 2}); err == nil {
+		t.Error("cursor scale accepted by a source without SetCursorScale")
+	}
+}
+
+func TestSubscribeInline(t *testing.T) {
+	src := newScripted()
+	_, c := start(t, provider(src), &Options{MaxFPS: 1000})
+	sub, err := c.Subscribe(0, &SubscribeOptions{Inline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	want := frame.New(32, 24)
+	fill(want, want.Rect(), 1)
+	src.frames <- want.Clone()
+	got := getFrame(t, sub)
+	if !got.Full() || got.Width != 32 || got.Height != 24 || !samePixels(got, want) {
+		t.Fatalf("first frame: %dx%d dirty %v", got.Width, got.Height, got.Dirty)
+	}
+
+	// Following frames carry only their damage.
+	for i, r := range []image.Rectangle{image.Rect(2, 3, 10, 7), image.Rect(30, 0, 32, 24)} {
+		fill(want, r, byte(i+2))
+		next := want.Clone()
+		next.Dirty = []image.Rectangle{r}
+		src.frames <- next
+		got = getFrame(t, sub)
+		if !reflect.DeepEqual(got.Dirty, []image.Rectangle{r}) || !samePixels(got, want) {
+			t.Fatalf("frame %d: dirty %v, want %v", i+2, got.Dirty, r)
+		}
+	}
+
+	// A new size starts over with a full frame.
+	want = frame.New(40, 30)
+	fill(want, want.Rect(), 9)
+	src.frames <- want.Clone()
+	got = getFrame(t, sub)
+	if !got.Full() || got.Width != 40 || !samePixels(got, want) {
+		t.Fatalf("resized frame: %dx%d dirty %v", got.Width, got.Height, got.Dirty)
+	}
+}
+
+func TestSubscribeRing(t *testing.T) {
+	src := newScripted()
+	srv, c := start(t, provider(src), &Options{MaxFPS: 1000})
+	want := frame.New(32, 24)
+	fill(want, want.Rect(), 1)
+	src.frames <- want.Clone()
+	sub, err := c.Subscribe(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := getFrame(t, sub)
+	if got.Width != 32 || !samePixels(got, want) {
+		t.Fatalf("first frame: %dx%d", got.Width, got.Height)
+	}
+
+	srv.mu.Lock()
+	dir := srv.ringDir
+	srv.mu.Unlock()
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ring directory: %v, %d entries", err, len(entries))
+	}
+	ring := filepath.Join(dir, entries[0].Name())
+	if runtime.GOOS != "windows" {
+		for path, mode := range map[string]os.FileMode{dir: 0o700, ring: 0o600} {
+			if st, err := os.Stat(path); err != nil || st.Mode().Perm() != mode {
+				t.Errorf("%s: %v, mode %v, want %v", path, err, st.Mode().Perm(), mode)
+			}
+		}
+	}
+
+	r := image.Rect(4, 4, 8, 8)
+	fill(want, r, 2)
+	next := want.Clone()
+	next.Dirty = []image.Rectangle{r}
+	src.frames <- next
+	got = getFrame(t, sub)
+	if !reflect.DeepEqual(got.Dirty, []image.Rectangle{r}) || !samePixels(got, want) {
+		t.Fatalf("second frame: dirty %v, want %v", got.Dirty, r)
+	}
+
+	// A larger frame does not fit: the ring is replaced and readers of the
+	// old one are told to subscribe again.
+	want = frame.New(64, 48)
+	fill(want, want.Rect(), 3)
+	src.frames <- want.Clone()
+	for {
+		_, err := sub.GetFrame(1000)
+		if err == shmring.ErrClosed {
+			break
+		}
+		if err != nil && !errors.Is(err, frame.ErrNoImageYet) {
+			t.Fatal(err)
+		}
+	}
+	sub.Close()
+	sub, err = c.Subscribe(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = getFrame(t, sub)
+	if got.Width != 64 || got.Height != 48 || !samePixels(got, want) {
+		t.Fatalf("frame after the ring was replaced: %dx%d", got.Width, got.Height)
+	}
+	if _, err := os.Stat(ring); !os.IsNotExist(err) {
+		t.Errorf("replaced ring %s left behind: %v", ring, err)
+	}
+
+	// The ring is removed once nobody subscribes.
+	sub.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if entries, _ := os.ReadDir(dir); len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ring not removed after the last subscriber left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClose(t *testing.T) {
+	src := newScripted()
+	srv, c := start(t, provider(src), nil)
+	src.frames <- frame.New(32, 24)
+	sub, err := c.Subscribe(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	srv.mu.Lock()
+	dir := srv.ringDir
+	srv.mu.Unlock()
+
+	srv.Close()
+	if !src.closed.Load() {
+		t.Error("source not closed")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("ring directory left behind: %v", err)
+	}
+	if _, err := c.Outputs(); err == nil {
+		t.Error("request after Close succeeded")
+	}
+}
@@ -0,0 +1,17 @@
+//go:build darwin || freebsd
+
+package daemon
+
+import "golang.org/x/sys/unix"
+
+var errNoPeerCred error
+
+// peerUID returns the user ID of the process at the other end of a Unix
+// socket.
+func peerUID(fd uintptr) (int, error) {
+	cred, err := unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return 0, err
+	}
+	return int(cred.Uid), nil
+}
@@ -0,0 +1,15 @@
+package daemon
+
+import "golang.org/x/sys/unix"
+
+var errNoPeerCred error
+
+// peerUID returns the user ID of the process at the other end of a Unix
+// socket.
+func peerUID(fd uintptr) (int, error) {
+	cred, err := unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return 0, err
+	}
+	return int(cred.Uid), nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows && !linux && !darwin && !freebsd
+
+package daemon
+
+import "errors"
+
+var errNoPeerCred = errors.New("daemon: peer credentials not supported")
+
+func peerUID(fd uintptr) (int, error) {
+	return 0, errNoPeerCred
+}
@@ -0,0 +1,199 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"time"
+)
+
+// Messages in both directions are framed as
+//
+//	length:u32 type:u8 body[length-1]
+//
+// with big endian integers. Clients send msgRequest with a JSON Request and
+// get a msgResponse with a JSON Response, followed for snapshots by msgImage
+// holding the encoded file. After a successful subscribe the connection
+// belongs to the subscription: with inline delivery the daemon sends msgFrame
+// messages,
+//
+//	seq:u64 time:i64 width:u32 height:u32 rects:u32
+//	{ x:u32 y:u32 w:u32 h:u32 pixels (BGRA, w*h*4) }
+//
+// each holding the regions changed since the previous one sent (the first
+// holds the whole frame); with ring delivery nothing more is sent. Either way
+// the client ends the subscription by closing the connection.
+const (
+	msgRequest  = 1
+	msgResponse = 2
+	msgImage    = 3
+	msgFrame    = 4
+
+	frameHeaderSize = 28
+	// maxMessage bounds messages to protect against corrupt data.
+	maxMessage = 1 << 30
+)
+
+// Commands of a Request.
+const (
+	CmdListOutputs = "list-outputs"
+	CmdSnapshot    = "snapshot"
+	CmdSubscribe   = "subscribe"
+	CmdSetOptions  = "set-options"
+)
+
+// Request is a command sent to the daemon.
+type Request struct {
+	Cmd    string `json:"cmd"`
+	Output int    `json:"output,omitempty"`
+
+	// Snapshot: image format name as accepted by snapshot.ParseFormat, and
+	// JPEG quality.
+	Format  string `json:"format,omitempty"`
+	Quality int    `json:"quality,omitempty"`
+
+	// Subscribe: the highest frame rate wanted, and whether frames come on
+	// the connection rather than through a shared-memory ring.
+	FPS    float64 `json:"fps,omitempty"`
+	Inline bool    `json:"inline,omitempty"`
+
+	// SetOptions.
+	Options *OutputOptions `json:"options,omitempty"`
+}
+
+// Response answers a Request. Error is set if it failed.
+type Response struct {
+	Error   string   `json:"error,omitempty"`
+	Outputs []Output `json:"outputs,omitempty"`
+	// Ring is the path of the shared-memory ring of a subscription, to be
+	// opened with shmring.Open.
+	Ring string `json:"ring,omitempty"`
+}
+
+// OutputOptions change how an output is captured, for every client. Unset
+// fields are left as they are.
+type OutputOptions struct {
+	// Cursor draws the pointer into frames.
+	Cursor *bool `json:"cursor,omitempty"`
+	// CursorScale resizes the drawn pointer, bilinearly.
+	CursorScale float64 `json:"cursor_scale,omitempty"`
+}
+
+var errProtocol = errors.New("daemon: protocol error")
+
+// writeMsg sends one message. Callers serialize writes.
+func writeMsg(w io.Writer, typ byte, body []byte) error {
+	if len(body)+1 > maxMessage {
+		return errors.New("daemon: message too large")
+	}
+	hdr := binary.BigEndian.AppendUint32(make([]byte, 0, 5), uint32(len(body)+1))
+	hdr = append(hdr, typ)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// readMsg receives one message, reusing buf when it is large enough.
+func readMsg(r io.Reader, buf []byte) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint32(hdr[:]))
+	if n < 1 || n > maxMessage {
+		return 0, nil, errProtocol
+	}
+	if cap(buf) < n-1 {
+		buf = make([]byte, n-1)
+	}
+	buf = buf[:n-1]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return hdr[4], buf, nil
+}
+
+func writeJSON(w io.Writer, typ byte, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeMsg(w, typ, b)
+}
+
+// appendFrame encodes the given regions of a BGRA canvas as a msgFrame body.
+func appendFrame(dst []byte, seq uint64, t time.Time, canvas []byte, width, height int, rects []image.Rectangle) []byte {
+	var ns int64
+	if !t.IsZero() {
+		ns = t.UnixNano()
+	}
+	dst = binary.BigEndian.AppendUint64(dst, seq)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(ns))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(width))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(height))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(rects)))
+	for _, r := range rects {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(r.Min.X))
+		dst = binary.BigEndian.AppendUint32(dst, uint32(r.Min.Y))
+		dst = binary.BigEndian.AppendUint32(dst, uint32(r.Dx()))
+		dst = binary.BigEndian.AppendUint32(dst, uint32(r.Dy()))
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			dst = append(dst, canvas[(y*width+r.Min.X)*4:(y*width+r.Max.X)*4]...)
+		}
+	}
+	return dst
+}
+
+// frameMsg is a decoded msgFrame.
+type frameMsg struct {
+	seq           uint64
+	time          time.Time
+	width, height int
+	rects         []image.Rectangle
+	// pix holds the pixels of each rect, referring into the message.
+	pix [][]byte
+}
+
+// parseFrame decodes a msgFrame body, which the result keeps referring to.
+func parseFrame(b []byte) (*frameMsg, error) {
+	if len(b) < frameHeaderSize {
+		return nil, errProtocol
+	}
+	m := &frameMsg{
+		seq:    binary.BigEndian.Uint64(b),
+		width:  int(binary.BigEndian.Uint32(b[16:])),
+		height: int(binary.BigEndian.Uint32(b[20:])),
+	}
+	if ns := int64(binary.BigEndian.Uint64(b[8:])); ns != 0 {
+		m.time = time.Unix(0, ns)
+	}
+	n := int(binary.BigEndian.Uint32(b[24:]))
+	bounds := image.Rect(0, 0, m.width, m.height)
+	if m.width <= 0 || m.height <= 0 || m.width > 1<<15 || m.height > 1<<15 {
+		return nil, errProtocol
+	}
+	b = b[frameHeaderSize:]
+	for i := 0; i < n; i++ {
+		if len(b) < 16 {
+			return nil, errProtocol
+		}
+		x, y := int(binary.BigEndian.Uint32(b)), int(binary.BigEndian.Uint32(b[4:]))
+		w, h := int(binary.BigEndian.Uint32(b[8:])), int(binary.BigEndian.Uint32(b[12:]))
+		r := image.Rect(x, y, x+w, y+h)
+		if w <= 0 || h <= 0 || !r.In(bounds) || len(b)-16 < w*h*4 {
+			return nil, fmt.Errorf("%w: bad region %v", errProtocol, r)
+		}
+		m.rects = append(m.rects, r)
+		m.pix = append(m.pix, b[16:16+w*h*4])
+		b = b[16+w*h*4:]
+	}
+	return m, nil
+}
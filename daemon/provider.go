@@ -0,0 +1,46 @@
+package daemon
+
+import (
+	"fmt"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// Output describes a capture output.
+type Output struct {
+	Index int    `json:"index"`
+	Name  string `json:"name,omitempty"`
+	// X and Y are the position in desktop coordinates.
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Provider lists and opens the outputs a daemon serves. Sources are closed
+// with Close or Release if they have either method; sources with
+// SetCaptureCursor or SetCursorScale methods take OutputOptions.
+type Provider interface {
+	Outputs() ([]Output, error)
+	Open(index int) (frame.Source, error)
+}
+
+// Sources is a Provider over a fixed list of outputs, such as synthetic or
+// replayed sources.
+type Sources struct {
+	List []Output
+	New  func(index int) (frame.Source, error)
+}
+
+func (p *Sources) Outputs() ([]Output, error) {
+	return p.List, nil
+}
+
+func (p *Sources) Open(index int) (frame.Source, error) {
+	for _, o := range p.List {
+		if o.Index == index {
+			return p.New(index)
+		}
+	}
+	return nil, fmt.Errorf("daemon: no output %d", index)
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+
+package daemon
+
+import (
+	"errors"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// Desktop returns the provider of the outputs of the default adapter. Desktop
+// Duplication needs Windows; elsewhere its methods return an error.
+func Desktop() Provider {
+	return desktop{}
+}
+
+type desktop struct{}
+
+var errNoDesktop = errors.New("daemon: desktop capture requires Windows")
+
+func (desktop) Outputs() ([]Output, error) {
+	return nil, errNoDesktop
+}
+
+func (desktop) Open(index int) (frame.Source, error) {
+	return nil, errNoDesktop
+}
@@ -0,0 +1,42 @@
+//go:build windows
+
+package daemon
+
+import (
+	dda "github.com/shinkar94/godesktopdup"
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// Desktop returns the provider of the outputs of the default adapter,
+// captured with Desktop Duplication.
+func Desktop() Provider {
+	return desktop{}
+}
+
+type desktop struct{}
+
+func (desktop) Outputs() ([]Output, error) {
+	infos, err := dda.Outputs()
+	if err != nil {
+		return nil, err
+	}
+	var list []Output
+	for _, o := range infos {
+		if o.Adapter != 0 {
+			continue
+		}
+		list = append(list, Output{
+			Index:  o.Index,
+			Name:   o.Name,
+			X:      o.Bounds.Min.X,
+			Y:      o.Bounds.Min.Y,
+			Width:  o.Bounds.Dx(),
+			Height: o.Bounds.Dy(),
+		})
+	}
+	return list, nil
+}
+
+func (desktop) Open(index int) (frame.Source, error) {
+	return dda.New(uint(index))
+}
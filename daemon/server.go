@@ -0,0 +1,348 @@
+// Package daemon lets several processes share capture outputs. Desktop
+// Duplication allows only a few duplications of an output, so one daemon owns
+// the sources and serves output lists, snapshots, option changes and frame
+// subscriptions over a Unix socket or, on Windows, a named pipe. Subscribers
+// get frames through a shared-memory ring (see package shmring) or inline on
+// the connection.
+//
+// The daemon serves the user it runs as; frames show whatever is on screen.
+// The Unix socket has mode 0600 from the moment it is reachable, and both
+// ends check that the other runs as the same user where the system reports
+// peer credentials (Linux, macOS and FreeBSD). The named pipe on Windows
+// admits its owner, administrators and the system. Rings are created with
+// mode 0600 in a directory of mode 0700 with a random name, so other users
+// can neither open nor find them without going through the daemon. Other
+// processes of the same user are trusted, as they could capture the screen
+// themselves.
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/shinkar94/godesktopdup/cursor"
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/snapshot"
+)
+
+// DefaultFPS is the highest capture rate when Options.MaxFPS is 0.
+const DefaultFPS = 30
+
+// Options configures a Server. A nil *Options uses the defaults.
+type Options struct {
+	// MaxFPS caps the frame rate subscribers can ask for.
+	MaxFPS int
+	// RingDir is where the private directory holding the shared-memory
+	// rings is created. Defaults to /dev/shm if it exists, else the
+	// temporary directory.
+	RingDir string
+	// RingSlots is the number of slots of each ring, shmring.DefaultSlots
+	// if 0.
+	RingSlots int
+}
+
+// ErrServerClosed is returned by ListenAndServe after Close.
+var ErrServerClosed = errors.New("daemon: server closed")
+
+type listener interface {
+	Accept() (io.ReadWriteCloser, error)
+	Close() error
+}
+
+// Server is a capture daemon. Outputs are opened on first use and stay open
+// until Close; each is read by one goroutine while anybody subscribes.
+type Server struct {
+	p    Provider
+	opts Options
+	done chan struct{}
+
+	mu       sync.Mutex
+	sessions map[int]*session
+	// ringDir is the private directory of the rings, created on first use.
+	ringDir   string
+	conns     map[io.ReadWriteCloser]struct{}
+	listeners []listener
+	closed    bool
+	// handlers counts connection goroutines, captures capture goroutines.
+	handlers sync.WaitGroup
+	captures sync.WaitGroup
+}
+
+// New returns a daemon serving the outputs of p.
+func New(p Provider, opts *Options) *Server {
+	s := &Server{
+		p:        p,
+		done:     make(chan struct{}),
+		sessions: make(map[int]*session),
+		conns:    make(map[io.ReadWriteCloser]struct{}),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.MaxFPS <= 0 {
+		s.opts.MaxFPS = DefaultFPS
+	}
+	if s.opts.RingDir == "" {
+		s.opts.RingDir = os.TempDir()
+		if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+			s.opts.RingDir = "/dev/shm"
+		}
+	}
+	return s
+}
+
+// ListenAndServe listens on addr, DefaultAddr if empty, and serves clients
+// until Close.
+func (s *Server) ListenAndServe(addr string) error {
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	l, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return ErrServerClosed
+			default:
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.handlers.Add(1)
+		s.mu.Unlock()
+		go s.serve(c)
+	}
+}
+
+// Close stops listening, ends every connection and closes the sources.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.handlers.Wait()
+	s.captures.Wait()
+	for _, ss := range s.sessions {
+		closeSource(ss.src)
+	}
+	if s.ringDir != "" {
+		os.RemoveAll(s.ringDir)
+	}
+	return nil
+}
+
+// privateRingDir returns the directory rings are created in, creating it
+// with mode 0700 and an unpredictable name on first use.
+func (s *Server) privateRingDir() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ringDir == "" {
+		dir, err := os.MkdirTemp(s.opts.RingDir, "ddacap-")
+		if err != nil {
+			return "", err
+		}
+		s.ringDir = dir
+	}
+	return s.ringDir, nil
+}
+
+func closeSource(src frame.Source) {
+	switch c := src.(type) {
+	case io.Closer:
+		c.Close()
+	case interface{ Release() }:
+		c.Release()
+	}
+}
+
+// serve answers requests until the client disconnects or subscribes.
+func (s *Server) serve(c io.ReadWriteCloser) {
+	defer func() {
+		c.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		s.handlers.Done()
+	}()
+	var buf []byte
+	for {
+		typ, body, err := readMsg(c, buf)
+		if err != nil || typ != msgRequest {
+			return
+		}
+		buf = body
+		var req Request
+		if err := json.Unmarshal(body, &req); err != nil {
+			return
+		}
+
+		var resp Response
+		var img []byte
+		switch req.Cmd {
+		case CmdListOutputs:
+			resp.Outputs, err = s.p.Outputs()
+		case CmdSnapshot:
+			img, err = s.snapshot(&req)
+		case CmdSetOptions:
+			err = s.setOptions(&req)
+		case CmdSubscribe:
+			s.subscribe(c, &req)
+			return
+		default:
+			err = fmt.Errorf("daemon: unknown command %q", req.Cmd)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		if err := writeJSON(c, msgResponse, &resp); err != nil {
+			return
+		}
+		if img != nil {
+			if err := writeMsg(c, msgImage, img); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// session returns the session of an output, opening the output first if
+// needed.
+func (s *Server) session(index int) (*session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrServerClosed
+	}
+	if ss, ok := s.sessions[index]; ok {
+		return ss, nil
+	}
+	src, err := s.p.Open(index)
+	if err != nil {
+		return nil, err
+	}
+	ss := newSession(s, index, src)
+	s.sessions[index] = ss
+	return ss, nil
+}
+
+func (s *Server) snapshot(req *Request) ([]byte, error) {
+	format := snapshot.PNG
+	if req.Format != "" {
+		var err error
+		if format, err = snapshot.ParseFormat(req.Format); err != nil {
+			return nil, err
+		}
+	}
+	ss, err := s.session(req.Output)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ss.current()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := snapshot.Encode(&b, f, format, &snapshot.Options{Quality: req.Quality, Metadata: true}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// setOptions applies options to a source between two frames.
+func (s *Server) setOptions(req *Request) error {
+	if req.Options == nil {
+		return nil
+	}
+	ss, err := s.session(req.Output)
+	if err != nil {
+		return err
+	}
+	o := req.Options
+	ss.srcMu.Lock()
+	defer ss.srcMu.Unlock()
+	if o.Cursor != nil {
+		c, ok := ss.src.(interface{ SetCaptureCursor(bool) })
+		if !ok {
+			return errors.New("daemon: output does not support the cursor option")
+		}
+		c.SetCaptureCursor(*o.Cursor)
+	}
+	if o.CursorScale != 0 {
+		c, ok := ss.src.(interface {
+			SetCursorScale(float64, cursor.Filter)
+		})
+		if !ok || o.CursorScale < 0 {
+			return errors.New("daemon: output does not support the cursor scale option")
+		}
+		c.SetCursorScale(o.CursorScale, cursor.FilterBilinear)
+	}
+	return nil
+}
+
+// subscribe serves a subscription until the client closes the connection.
+func (s *Server) subscribe(c io.ReadWriteCloser, req *Request) {
+	fps := float64(s.opts.MaxFPS)
+	if req.FPS > 0 {
+		fps = min(req.FPS, fps)
+	}
+	ss, err := s.session(req.Output)
+	if err != nil {
+		writeJSON(c, msgResponse, &Response{Error: err.Error()})
+		return
+	}
+	sb := &sub{fps: fps, ring: !req.Inline}
+	ss.join(sb)
+	defer ss.leave(sb)
+
+	if req.Inline {
+		if writeJSON(c, msgResponse, &Response{}) == nil {
+			ss.pump(c, sb)
+		}
+		return
+	}
+	path, err := ss.waitRing()
+	if err != nil {
+		writeJSON(c, msgResponse, &Response{Error: err.Error()})
+		return
+	}
+	if writeJSON(c, msgResponse, &Response{Ring: path}) != nil {
+		return
+	}
+	// The client sends nothing more; reading notices when it leaves.
+	io.Copy(io.Discard, c)
+}
@@ -0,0 +1,358 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/shmring"
+)
+
+// historyLen is the number of frames whose damage is kept, so inline
+// subscribers that fell behind get only the regions changed since.
+const historyLen = 32
+
+// session captures one output for its subscribers.
+type session struct {
+	srv   *Server
+	index int
+	src   frame.Source
+	// srcMu serializes reading the source and changing its options.
+	srcMu sync.Mutex
+
+	mu      sync.Mutex
+	subs    map[*sub]struct{}
+	running bool
+	err     error
+	// polls counts reads of the source, with or without a new frame.
+	polls uint64
+	// update is closed and replaced whenever the fields below change.
+	update chan struct{}
+
+	// canvas holds the current frame. It is kept while capture is stopped:
+	// sources report the damage accumulated meanwhile with the next frame.
+	canvas        []byte
+	width, height int
+	seq           uint64
+	time          time.Time
+	output        string
+	bounds        image.Rectangle
+	// history lists the damage of the latest frames, oldest first.
+	history []damage
+
+	// ring is written by the capture goroutine and closed with ss.mu held;
+	// ringPath is its path.
+	ring     *shmring.Writer
+	ringPath string
+	ringGen  int
+}
+
+type damage struct {
+	seq uint64
+	// rects is nil when the whole frame changed.
+	rects []image.Rectangle
+}
+
+type sub struct {
+	fps  float64
+	ring bool
+}
+
+func newSession(srv *Server, index int, src frame.Source) *session {
+	return &session{
+		srv:    srv,
+		index:  index,
+		src:    src,
+		subs:   make(map[*sub]struct{}),
+		update: make(chan struct{}),
+	}
+}
+
+// join registers a subscriber and starts capturing if it is the first one.
+func (ss *session) join(sb *sub) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.subs[sb] = struct{}{}
+	if !ss.running {
+		ss.running = true
+		ss.err = nil
+		ss.srv.captures.Add(1)
+		go ss.capture()
+	}
+}
+
+func (ss *session) leave(sb *sub) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.subs, sb)
+}
+
+// notify wakes the waiting subscribers. The caller holds ss.mu.
+func (ss *session) notify() {
+	close(ss.update)
+	ss.update = make(chan struct{})
+}
+
+// waitFor waits until ready, called with ss.mu held, is true. It returns the
+// capture error if capture stopped first.
+func (ss *session) waitFor(ready func() bool) error {
+	for {
+		ss.mu.Lock()
+		ok, err, update := ready(), ss.err, ss.update
+		ss.mu.Unlock()
+		if ok {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ss.srv.done:
+			return ErrServerClosed
+		case <-update:
+		}
+	}
+}
+
+// capture reads the source while there are subscribers.
+func (ss *session) capture() {
+	defer ss.srv.captures.Done()
+	for {
+		interval, rings, ok := ss.demand()
+		if !ok {
+			return
+		}
+		ss.srcMu.Lock()
+		f, err := ss.src.GetFrame(uint(max(interval/time.Millisecond, 1)))
+		// Pace from the frame's arrival, as mjpeg does.
+		next := time.Now().Add(interval)
+		got := err == nil
+		if got {
+			ss.store(f)
+			if rings {
+				err = ss.writeRing(f)
+			}
+		} else if errors.Is(err, frame.ErrNoImageYet) {
+			err = nil
+			// A subscriber to an idle output still needs a ring.
+			if rings && ss.ring == nil && ss.canvas != nil {
+				err = ss.writeRing(ss.canvasFrame())
+			}
+		}
+		ss.srcMu.Unlock()
+
+		ss.mu.Lock()
+		ss.polls++
+		if err != nil {
+			ss.closeRing()
+			ss.err = err
+			ss.running = false
+		}
+		ss.notify()
+		ss.mu.Unlock()
+		if err != nil {
+			return
+		}
+		if got {
+			time.Sleep(time.Until(next))
+		}
+	}
+}
+
+// demand returns the capture interval and whether a ring is needed, closing
+// the ring if not. It marks capture as stopped when nobody is left.
+func (ss *session) demand() (time.Duration, bool, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	fps, rings := 0.0, false
+	for sb := range ss.subs {
+		fps = max(fps, sb.fps)
+		rings = rings || sb.ring
+	}
+	if !rings {
+		ss.closeRing()
+	}
+	if len(ss.subs) == 0 {
+		ss.running = false
+		return 0, false, false
+	}
+	return time.Duration(float64(time.Second) / fps), rings, true
+}
+
+// store copies the damaged regions of f into the canvas.
+func (ss *session) store(f *frame.Frame) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.seq++
+	ss.time, ss.output, ss.bounds = f.Time, f.Output, f.Bounds
+	d := damage{seq: ss.seq}
+	if ss.canvas == nil || ss.width != f.Width || ss.height != f.Height {
+		ss.width, ss.height = f.Width, f.Height
+		ss.canvas = make([]byte, f.Width*f.Height*4)
+		frame.CopyRect(ss.canvas, f.Width*4, f.Pix, f.Stride, f.Rect())
+	} else if rects := f.Damage(); rects == nil {
+		frame.CopyRect(ss.canvas, f.Width*4, f.Pix, f.Stride, f.Rect())
+	} else {
+		d.rects = make([]image.Rectangle, 0, len(rects))
+		for _, r := range rects {
+			r = r.Intersect(f.Rect())
+			frame.CopyRect(ss.canvas, f.Width*4, f.Pix, f.Stride, r)
+			d.rects = append(d.rects, r)
+		}
+	}
+	if len(ss.history) == historyLen {
+		ss.history = append(ss.history[:0], ss.history[1:]...)
+	}
+	ss.history = append(ss.history, d)
+}
+
+// damageSince returns the regions changed after frame seq, or nil if the
+// whole frame must be sent. The caller holds ss.mu.
+func (ss *session) damageSince(seq uint64) []image.Rectangle {
+	if seq == 0 || len(ss.history) == 0 || ss.history[0].seq > seq+1 {
+		return nil
+	}
+	var rects []image.Rectangle
+	for _, d := range ss.history {
+		if d.seq <= seq {
+			continue
+		}
+		if d.rects == nil {
+			return nil
+		}
+		rects = append(rects, d.rects...)
+	}
+	if rects = frame.Disjoint(rects); rects == nil {
+		return []image.Rectangle{}
+	}
+	return rects
+}
+
+// canvasFrame returns the canvas as a frame. Only the capture goroutine,
+// which alone modifies the canvas, may use it without holding ss.mu.
+func (ss *session) canvasFrame() *frame.Frame {
+	return &frame.Frame{
+		Pix:    ss.canvas,
+		Width:  ss.width,
+		Height: ss.height,
+		Stride: ss.width * 4,
+		Time:   ss.time,
+		Seq:    ss.seq,
+		Output: ss.output,
+		Bounds: ss.bounds,
+	}
+}
+
+// current returns a copy of the current frame, reading the source once so
+// the copy is up to date.
+func (ss *session) current() (*frame.Frame, error) {
+	sb := &sub{fps: float64(ss.srv.opts.MaxFPS)}
+	ss.mu.Lock()
+	polls := ss.polls
+	ss.mu.Unlock()
+	ss.join(sb)
+	err := ss.waitFor(func() bool { return ss.canvas != nil && ss.polls > polls })
+	ss.leave(sb)
+	if err != nil {
+		return nil, err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.canvasFrame().Clone(), nil
+}
+
+// pump sends frames inline until the connection fails. Frames captured while
+// a send is in progress are merged into the next one.
+func (ss *session) pump(w io.Writer, sb *sub) {
+	interval := time.Duration(float64(time.Second) / sb.fps)
+	var sent uint64
+	var buf []byte
+	for {
+		if ss.waitFor(func() bool { return ss.canvas != nil && ss.seq > sent }) != nil {
+			return
+		}
+		ss.mu.Lock()
+		rects := ss.damageSince(sent)
+		if rects == nil {
+			rects = []image.Rectangle{image.Rect(0, 0, ss.width, ss.height)}
+		}
+		buf = appendFrame(buf[:0], ss.seq, ss.time, ss.canvas, ss.width, ss.height, rects)
+		sent = ss.seq
+		ss.mu.Unlock()
+
+		next := time.Now().Add(interval)
+		if writeMsg(w, msgFrame, buf) != nil {
+			return
+		}
+		if wait := time.Until(next); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-ss.srv.done:
+				t.Stop()
+				return
+			case <-t.C:
+			}
+		}
+	}
+}
+
+// waitRing returns the path of the ring once it holds a frame.
+func (ss *session) waitRing() (string, error) {
+	var path string
+	err := ss.waitFor(func() bool {
+		path = ss.ringPath
+		return path != ""
+	})
+	return path, err
+}
+
+// writeRing publishes f to the ring, replacing the ring by a larger one if
+// f does not fit. Readers of the old ring get shmring.ErrClosed.
+func (ss *session) writeRing(f *frame.Frame) error {
+	if ss.ring != nil {
+		err := ss.ring.WriteFrame(f)
+		if err != shmring.ErrTooLarge {
+			return err
+		}
+		ss.mu.Lock()
+		ss.closeRing()
+		ss.mu.Unlock()
+	}
+	dir, err := ss.srv.privateRingDir()
+	if err != nil {
+		return err
+	}
+	ss.ringGen++
+	path := filepath.Join(dir, fmt.Sprintf("%d-%d", ss.index, ss.ringGen))
+	ring, err := shmring.Create(path, f.Width, f.Height, &shmring.Options{Slots: ss.srv.opts.RingSlots})
+	if err != nil {
+		return err
+	}
+	if err := ring.WriteFrame(f); err != nil {
+		ring.Close()
+		os.Remove(path)
+		return err
+	}
+	ss.ring = ring
+	ss.mu.Lock()
+	ss.ringPath = path
+	ss.mu.Unlock()
+	return nil
+}
+
+// closeRing closes and removes the ring, if any. The caller holds ss.mu.
+func (ss *session) closeRing() {
+	if ss.ring == nil {
+		return
+	}
+	ss.ring.Close()
+	os.Remove(ss.ringPath)
+	ss.ring = nil
+	ss.ringPath = ""
+}
@@ -1,16 +1,28 @@
+//go:build windows
+
 package dda
 
 import (
+	"errors"
 	"fmt"
+	"image"
+	"io"
 
 	"github.com/shinkar94/godesktopdup/capture"
+	"github.com/shinkar94/godesktopdup/cursor"
+	"github.com/shinkar94/godesktopdup/frame"
 	"github.com/shinkar94/godesktopdup/gfx11"
+	"github.com/shinkar94/godesktopdup/snapshot"
 )
 
 type DesktopDuplication struct {
 	device    *gfx11.Device
 	deviceCtx *gfx11.DeviceContext
 	capture   *capture.ScreenCapture
+
+	buffer []byte
+	frame  frame.Frame
+	output string
 }
 
 func New(outputIndex uint) (*DesktopDuplication, error) {
@@ -30,9 +42,82 @@ func New(outputIndex uint) (*DesktopDuplication, error) {
 		device:    device,
 		deviceCtx: deviceCtx,
 		capture:   sc,
+		output:    sc.OutputName(),
 	}, nil
 }
 
+// GetFrame captures the next frame into a buffer owned by dd, together with
+// its damage, cursor state and timing. The frame stays valid until the next
+// call. DesktopDuplication implements frame.Source.
+func (dd *DesktopDuplication) GetFrame(timeoutMs uint) (*frame.Frame, error) {
+	width, height := dd.capture.FrameSize()
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid output size %dx%d", width, height)
+	}
+	resized := len(dd.buffer) != width*height*4
+	if resized {
+		dd.buffer = make([]byte, width*height*4)
+	}
+
+	if err := dd.capture.GetFrameBGRA(dd.buffer, timeoutMs); err != nil {
+		return nil, err
+	}
+
+	f := &dd.frame
+	f.Pix = dd.buffer
+	f.Width = width
+	f.Height = height
+	f.Stride = width * 4
+	f.Cursor = dd.capture.CursorState()
+	f.Time = dd.capture.PresentTime()
+	f.Seq++
+	f.Protected = dd.capture.ProtectedContentMasked()
+	f.Output = dd.output
+	if left, top, right, bottom, err := dd.GetBounds(); err == nil {
+		f.Bounds = image.Rect(left, top, right, bottom)
+	}
+
+	dirty, moves, full := dd.capture.Damage()
+	f.Dirty = f.Dirty[:0]
+	f.Moves = f.Moves[:0]
+	if full || resized {
+		f.Dirty = nil
+		return f, nil
+	}
+	if f.Dirty == nil {
+		f.Dirty = make([]image.Rectangle, 0, len(dirty))
+	}
+	for _, r := range dirty {
+		if rect := image.Rect(int(r.Left), int(r.Top), int(r.Right), int(r.Bottom)).Intersect(f.Rect()); !rect.Empty() {
+			f.Dirty = append(f.Dirty, rect)
+		}
+	}
+	for _, m := range moves {
+		f.Moves = append(f.Moves, frame.Move{
+			Src: image.Pt(int(m.Src.X), int(m.Src.Y)),
+			Dst: image.Rect(int(m.Dest.Left), int(m.Dest.Top), int(m.Dest.Right), int(m.Dest.Bottom)),
+		})
+	}
+	return f, nil
+}
+
+// screenshotTimeoutMs bounds how long Screenshot waits for a new frame.
+const screenshotTimeoutMs = 500
+
+// Screenshot captures a frame and writes it as PNG or JPEG, encoding straight
+// from the BGRA buffer. If the screen has not changed since the previous
+// capture, the previous frame is written.
+func (dd *DesktopDuplication) Screenshot(w io.Writer, format snapshot.Format, opts *snapshot.Options) error {
+	f, err := dd.GetFrame(screenshotTimeoutMs)
+	if errors.Is(err, capture.ErrNoImageYet) && dd.frame.Pix != nil {
+		f, err = &dd.frame, nil
+	}
+	if err != nil {
+		return err
+	}
+	return snapshot.Encode(w, f, format, opts)
+}
+
 func (dd *DesktopDuplication) GetFrameBGRA(buffer []byte, timeoutMs uint) error {
 	return dd.capture.GetFrameBGRA(buffer, timeoutMs)
 }
@@ -62,6 +147,24 @@ func (dd *DesktopDuplication) SetCaptureCursor(enabled bool) {
 	dd.capture.SetCaptureCursor(enabled)
 }
 
+// SetCursorScale resizes the drawn cursor by scale using the given filter.
+// Use it on DPI-scaled outputs or when frames are downscaled after capture.
+func (dd *DesktopDuplication) SetCursorScale(scale float64, filter cursor.Filter) {
+	dd.capture.SetCursorScale(scale, filter)
+}
+
+// GetCursor returns the pointer state reported with the last acquired frame.
+// It is updated even when GetFrameBGRA returns "no image yet" because only the
+// pointer moved. State.Shape is set only when the pointer shape changed.
+func (dd *DesktopDuplication) GetCursor() cursor.State {
+	return dd.capture.CursorState()
+}
+
+// GetCursorShape returns the current pointer shape, or nil if none was received yet.
+func (dd *DesktopDuplication) GetCursorShape() *cursor.Shape {
+	return dd.capture.CursorShape()
+}
+
 func (dd *DesktopDuplication) Release() {
 	if dd.capture != nil {
 		dd.capture.Release()
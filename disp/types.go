@@ -15,10 +15,11 @@ type Rational struct {
 type ModeRotation uint32
 
 const (
-	ModeRotationIdentity   ModeRotation = 0 // No rotation
-	ModeRotationRotate90   ModeRotation = 1 // 90° clockwise
-	ModeRotationRotate180  ModeRotation = 2 // 180°
-	ModeRotationRotate270  ModeRotation = 3 // 270° clockwise (90° counter-clockwise)
+	ModeRotationUnspecified ModeRotation = 0
+	ModeRotationIdentity    ModeRotation = 1 // No rotation
+	ModeRotationRotate90    ModeRotation = 2 // 90° clockwise
+	ModeRotationRotate180   ModeRotation = 3 // 180°
+	ModeRotationRotate270   ModeRotation = 4 // 270° clockwise (90° counter-clockwise)
 )
 
 type OutputDesc struct {
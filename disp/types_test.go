@@ -0,0 +1,23 @@
+package disp
+
+import "testing"
+
+// The rotation constants are compared with DXGI_OUTPUT_DESC.Rotation as
+// returned by the driver, so they must keep the DXGI_MODE_ROTATION values.
+func TestModeRotationValues(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		got  ModeRotation
+		want uint32
+	}{
+		{"DXGI_MODE_ROTATION_UNSPECIFIED", ModeRotationUnspecified, 0},
+		{"DXGI_MODE_ROTATION_IDENTITY", ModeRotationIdentity, 1},
+		{"DXGI_MODE_ROTATION_ROTATE90", ModeRotationRotate90, 2},
+		{"DXGI_MODE_ROTATION_ROTATE180", ModeRotationRotate180, 3},
+		{"DXGI_MODE_ROTATION_ROTATE270", ModeRotationRotate270, 4},
+	} {
+		if uint32(c.got) != c.want {
+			t.Errorf("%s is %d, want %d", c.name, c.got, c.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package effects
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/shinkar94/godesktopdup/cursor"
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// cursorCover tracks the cursor shape, so rings can be drawn under a cursor
+// that was already composited into the frame.
+type cursorCover struct {
+	shape *cursor.Shape
+}
+
+// covers returns whether the visible cursor covers a pixel of f, or nil if
+// there is no cursor to keep clear.
+func (c *cursorCover) covers(f *frame.Frame) func(x, y int) bool {
+	if f.Cursor.Shape != nil {
+		c.shape = f.Cursor.Shape
+	}
+	if c.shape == nil || !f.Cursor.Visible {
+		return nil
+	}
+	m := &c.shape.Mask
+	ox, oy := f.Cursor.X, f.Cursor.Y
+	return func(x, y int) bool {
+		x, y = x-ox, y-oy
+		if x < 0 || y < 0 || x >= m.Width || y >= m.Height {
+			return false
+		}
+		o := (y*m.Width + x) * 4
+		return m.Over[o+3] != 0 || m.Xor != nil && m.Xor[o]|m.Xor[o+1]|m.Xor[o+2] != 0
+	}
+}
+
+// ringBounds returns the bounding box of a circle with the given outer radius.
+func ringBounds(center image.Point, outer float64) image.Rectangle {
+	r := int(math.Ceil(outer)) + 1
+	return image.Rect(center.X-r, center.Y-r, center.X+r+1, center.Y+r+1)
+}
+
+// blendRing alpha blends c into the ring between inner and outer radius around
+// center, anti-aliasing both edges. An inner radius <= 0 fills the disc.
+// Pixels for which skip, if not nil, returns true are left as they are.
+// It returns the region drawn.
+func blendRing(f *frame.Frame, center image.Point, inner, outer float64, c color.NRGBA, skip func(x, y int) bool) image.Rectangle {
+	bounds := ringBounds(center, outer).Intersect(f.Rect())
+	if bounds.Empty() || c.A == 0 || outer <= 0 {
+		return image.Rectangle{}
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := f.Pix[y*f.Stride:]
+		dy := float64(y-center.Y) + 0.5
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			dx := float64(x-center.X) + 0.5
+			d := math.Sqrt(dx*dx + dy*dy)
+			coverage := clamp01(outer - d + 0.5)
+			if inner > 0 {
+				coverage = math.Min(coverage, clamp01(d-inner+0.5))
+			}
+			if coverage <= 0 || skip != nil && skip(x, y) {
+				continue
+			}
+			a := uint32(float64(c.A)*coverage + 0.5)
+			if a == 0 {
+				continue
+			}
+			inv := 255 - a
+			o := x * 4
+			row[o] = byte((uint32(row[o])*inv + uint32(c.B)*a + 127) / 255)
+			row[o+1] = byte((uint32(row[o+1])*inv + uint32(c.G)*a + 127) / 255)
+			row[o+2] = byte((uint32(row[o+2])*inv + uint32(c.R)*a + 127) / 255)
+			row[o+3] = 0xFF
+		}
+	}
+	return bounds
+}
+
+func clamp01(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
@@ -0,0 +1,245 @@
+package effects
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+var errNoRestore = errors.New("effects: spotlight requires frames from frame.Process")
+
+// Highlight surrounds the cursor tip with a translucent halo. Pixels of a
+// cursor drawn into the frame are kept clear, so the halo does not tint it.
+type Highlight struct {
+	Radius int
+	Color  color.NRGBA
+	// Ring draws only an outline of the given thickness; 0 fills the halo.
+	Ring int
+
+	cover cursorCover
+}
+
+// NewHighlight returns a filled yellow halo of the given radius.
+func NewHighlight(radius int) *Highlight {
+	return &Highlight{
+		Radius: radius,
+		Color:  color.NRGBA{R: 0xFF, G: 0xE0, B: 0x00, A: 0x60},
+	}
+}
+
+func (h *Highlight) Apply(f *frame.Frame) error {
+	skip := h.cover.covers(f)
+	if !f.Cursor.Visible || h.Radius <= 0 {
+		return nil
+	}
+	inner := 0.0
+	if h.Ring > 0 {
+		inner = float64(h.Radius - h.Ring)
+	}
+	f.AddDirty(blendRing(f, f.Cursor.Tip(), inner, float64(h.Radius), h.Color, skip))
+	return nil
+}
+
+// Button identifies a mouse button.
+type Button int
+
+const (
+	ButtonLeft Button = iota
+	ButtonRight
+	ButtonMiddle
+)
+
+// ButtonEvent is a mouse button transition.
+type ButtonEvent struct {
+	Time   time.Time
+	Button Button
+	Down   bool
+}
+
+// ButtonSource delivers mouse button events. Events returns, once, every
+// pending event that happened at or before until.
+type ButtonSource interface {
+	Events(until time.Time) []ButtonEvent
+}
+
+// ButtonQueue is a ButtonSource fed by Push, e.g. from a mouse hook, or filled
+// up front with a scripted sequence of clicks.
+type ButtonQueue struct {
+	mu     sync.Mutex
+	events []ButtonEvent
+}
+
+// Push queues an event. Events must be pushed in time order.
+func (q *ButtonQueue) Push(ev ButtonEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.events = append(q.events, ev)
+}
+
+func (q *ButtonQueue) Events(until time.Time) []ButtonEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for n < len(q.events) && !q.events[n].Time.After(until) {
+		n++
+	}
+	out := append([]ButtonEvent(nil), q.events[:n]...)
+	q.events = q.events[n:]
+	return out
+}
+
+// Ripple draws an expanding, fading ring at the cursor tip on every button
+// press. Like Highlight, it keeps a cursor drawn into the frame clear.
+type Ripple struct {
+	Source    ButtonSource
+	Duration  time.Duration
+	Radius    int
+	Thickness int
+	// Colors selects the ring color per button; missing buttons use Color.
+	Colors map[Button]color.NRGBA
+	Color  color.NRGBA
+
+	active []ripple
+	cover  cursorCover
+}
+
+type ripple struct {
+	start  time.Time
+	center image.Point
+	color  color.NRGBA
+}
+
+// NewRipple returns a ripple stage with defaults suitable for 1080p recordings.
+func NewRipple(source ButtonSource) *Ripple {
+	return &Ripple{
+		Source:    source,
+		Duration:  400 * time.Millisecond,
+		Radius:    40,
+		Thickness: 4,
+		Color:     color.NRGBA{R: 0xFF, G: 0x40, B: 0x40, A: 0xC0},
+		Colors: map[Button]color.NRGBA{
+			ButtonRight: {R: 0x40, G: 0x80, B: 0xFF, A: 0xC0},
+		},
+	}
+}
+
+func (rp *Ripple) Apply(f *frame.Frame) error {
+	skip := rp.cover.covers(f)
+	if rp.Source != nil {
+		for _, ev := range rp.Source.Events(f.Time) {
+			if !ev.Down {
+				continue
+			}
+			c, ok := rp.Colors[ev.Button]
+			if !ok {
+				c = rp.Color
+			}
+			rp.active = append(rp.active, ripple{
+				start:  ev.Time,
+				center: f.Cursor.Tip(),
+				color:  c,
+			})
+		}
+	}
+
+	kept := rp.active[:0]
+	for _, r := range rp.active {
+		age := f.Time.Sub(r.start)
+		if age < 0 || age >= rp.Duration {
+			if age < 0 {
+				kept = append(kept, r)
+			}
+			continue
+		}
+		kept = append(kept, r)
+		progress := float64(age) / float64(rp.Duration)
+		outer := math.Max(1, float64(rp.Radius)*progress)
+		c := r.color
+		c.A = uint8(float64(c.A) * (1 - progress))
+		f.AddDirty(blendRing(f, r.center, outer-float64(rp.Thickness), outer, c, skip))
+	}
+	rp.active = kept
+	return nil
+}
+
+// Spotlight dims everything farther than Radius from the cursor tip. Because
+// it re-renders from unprocessed pixels when the cursor moves, it must run on
+// frames from frame.Process and should be the first stage.
+type Spotlight struct {
+	Radius int
+	// Feather is the width of the soft edge.
+	Feather int
+	// Dim is how much the outside is darkened, 0 (none) to 255 (black).
+	Dim uint8
+
+	primed  bool
+	center  image.Point
+	visible bool
+}
+
+// NewSpotlight returns a spotlight with a soft edge dimming the outside by half.
+func NewSpotlight(radius int) *Spotlight {
+	return &Spotlight{Radius: radius, Feather: radius / 4, Dim: 0x80}
+}
+
+func (s *Spotlight) Apply(f *frame.Frame) error {
+	center := f.Cursor.Tip()
+	visible := f.Cursor.Visible
+
+	var regions []image.Rectangle
+	if f.Full() {
+		regions = []image.Rectangle{f.Rect()}
+	} else {
+		regions = f.Damage()
+		if !s.primed || center != s.center || visible != s.visible {
+			for _, r := range []image.Rectangle{s.bounds(s.center, s.visible), s.bounds(center, visible)} {
+				if !f.Restore(r) {
+					return errNoRestore
+				}
+				regions = append(regions, r)
+			}
+		}
+	}
+	s.primed, s.center, s.visible = true, center, visible
+
+	outer := float64(s.Radius + s.Feather)
+	for _, r := range frame.Disjoint(regions) {
+		r = r.Intersect(f.Rect())
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			row := f.Pix[y*f.Stride:]
+			dy := float64(y-center.Y) + 0.5
+			for x := r.Min.X; x < r.Max.X; x++ {
+				amount := float64(s.Dim)
+				if visible {
+					dx := float64(x-center.X) + 0.5
+					d := math.Sqrt(dx*dx + dy*dy)
+					switch {
+					case d <= float64(s.Radius):
+						continue
+					case d < outer:
+						amount *= (d - float64(s.Radius)) / float64(s.Feather)
+					}
+				}
+				keep := uint32(255 - int(amount+0.5))
+				o := x * 4
+				row[o] = byte((uint32(row[o])*keep + 127) / 255)
+				row[o+1] = byte((uint32(row[o+1])*keep + 127) / 255)
+				row[o+2] = byte((uint32(row[o+2])*keep + 127) / 255)
+			}
+		}
+	}
+	return nil
+}
+
+// bounds returns the region left undimmed around center.
+func (s *Spotlight) bounds(center image.Point, visible bool) image.Rectangle {
+	if !visible {
+		return image.Rectangle{}
+	}
+	return ringBounds(center, float64(s.Radius+s.Feather))
+}
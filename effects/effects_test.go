@@ -0,0 +1,194 @@
+package effects
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/synth"
+)
+
+var start = time.Unix(1700000000, 0)
+
+// source returns a deterministic 320x240 synthetic screen at 10 fps with the
+// cursor drawn in. Two sources with the same options produce the same frames,
+// so one serves as the unprocessed reference for the other.
+func source(track synth.Track, static bool) *synth.Source {
+	return synth.New(synth.Options{
+		Width: 320, Height: 240, FPS: 10,
+		Static: static, Track: track, DrawCursor: true,
+		Virtual: true, Start: start,
+	})
+}
+
+// at keeps the cursor tip at one position.
+func at(x, y int) synth.Track {
+	return synth.Path(synth.Waypoint{Pos: image.Pt(x, y)})
+}
+
+func next(t *testing.T, src frame.Source) *frame.Frame {
+	t.Helper()
+	f, err := src.GetFrame(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func pixel(f *frame.Frame, x, y int) [4]byte {
+	var p [4]byte
+	copy(p[:], f.Pix[f.PixOffset(x, y):])
+	return p
+}
+
+// blend returns bg with c drawn over it at alpha a, as blendRing does.
+func blend(bg [4]byte, c color.NRGBA, a uint32) [4]byte {
+	mix := func(v, c byte) byte { return byte((uint32(v)*(255-a) + uint32(c)*a + 127) / 255) }
+	return [4]byte{mix(bg[0], c.B), mix(bg[1], c.G), mix(bg[2], c.R), 0xFF}
+}
+
+// dim returns bg darkened by amount, as Spotlight does.
+func dim(bg [4]byte, amount uint8) [4]byte {
+	keep := uint32(255 - amount)
+	d := func(v byte) byte { return byte((uint32(v)*keep + 127) / 255) }
+	return [4]byte{d(bg[0]), d(bg[1]), d(bg[2]), bg[3]}
+}
+
+func TestHighlight(t *testing.T) {
+	for _, ring := range []int{0, 4} {
+		h := NewHighlight(20)
+		h.Ring = ring
+		out := next(t, frame.Process(source(at(160, 120), true), h))
+		ref := next(t, source(at(160, 120), true))
+
+		// The tip pixel is drawn by the cursor and stays clear.
+		if got, want := pixel(out, 160, 120), pixel(ref, 160, 120); got != want {
+			t.Errorf("ring %d: cursor pixel is %x, want %x", ring, got, want)
+		}
+		// Left of the tip, 10 and 17 pixels away.
+		near, edge := blend(pixel(ref, 150, 120), h.Color, 0x60), blend(pixel(ref, 143, 120), h.Color, 0x60)
+		if ring > 0 {
+			near = pixel(ref, 150, 120)
+		}
+		if got := pixel(out, 150, 120); got != near {
+			t.Errorf("ring %d: pixel 10 left of the tip is %x, want %x", ring, got, near)
+		}
+		if got := pixel(out, 143, 120); got != edge {
+			t.Errorf("ring %d: pixel 17 left of the tip is %x, want %x", ring, got, edge)
+		}
+		if got, want := pixel(out, 130, 120), pixel(ref, 130, 120); got != want {
+			t.Errorf("ring %d: pixel outside the halo is %x, want %x", ring, got, want)
+		}
+	}
+
+	// No halo without a visible cursor.
+	hidden := synth.Path(synth.Waypoint{Pos: image.Pt(160, 120), Hidden: true})
+	out := next(t, frame.Process(source(hidden, true), NewHighlight(20)))
+	if ref := next(t, source(hidden, true)); !bytes.Equal(out.Pix, ref.Pix) {
+		t.Error("halo drawn for a hidden cursor")
+	}
+}
+
+func TestRipple(t *testing.T) {
+	var q ButtonQueue
+	q.Push(ButtonEvent{Time: start.Add(50 * time.Millisecond), Button: ButtonLeft, Down: true})
+	q.Push(ButtonEvent{Time: start.Add(60 * time.Millisecond), Button: ButtonLeft})
+	q.Push(ButtonEvent{Time: start.Add(250 * time.Millisecond), Button: ButtonRight, Down: true})
+	rp := NewRipple(&q)
+	p := frame.Process(source(at(220, 160), false), rp)
+	ref := source(at(220, 160), false)
+
+	// Frames come every 100ms. 50ms after a press a ring spans radius 1 to
+	// 5 at 7/8 of the color's alpha; 4 pixels left of the tip is inside it.
+	a := uint32(float64(0xC0) * 7 / 8)
+	for i := 0; i < 10; i++ {
+		out, want := next(t, p), next(t, ref)
+		var expect [4]byte
+		switch i {
+		case 1:
+			expect = blend(pixel(want, 216, 160), rp.Color, a)
+		case 3:
+			expect = blend(pixel(want, 216, 160), rp.Colors[ButtonRight], a)
+		default:
+			// Before the press, or the ring grew past the pixel.
+			expect = pixel(want, 216, 160)
+		}
+		if got := pixel(out, 216, 160); got != expect {
+			t.Errorf("frame %d: pixel 4 left of the tip is %x, want %x", i, got, expect)
+		}
+		// Once both ripples ended, earlier rings are restored everywhere.
+		if i >= 7 && !bytes.Equal(out.Pix, want.Pix) {
+			t.Errorf("frame %d: ring pixels left after the ripples ended", i)
+		}
+	}
+}
+
+func TestSpotlight(t *testing.T) {
+	s := NewSpotlight(40)
+	out := next(t, frame.Process(source(at(160, 120), true), s))
+	ref := next(t, source(at(160, 120), true))
+	for _, c := range []struct {
+		x, y int
+		want [4]byte
+	}{
+		{140, 120, pixel(ref, 140, 120)},
+		{160, 150, pixel(ref, 160, 150)},
+		{10, 10, dim(pixel(ref, 10, 10), s.Dim)},
+		{300, 220, dim(pixel(ref, 300, 220), s.Dim)},
+		// 45 pixels away is halfway through the 10 pixel feather.
+		{115, 120, dim(pixel(ref, 115, 120), uint8(float64(s.Dim)*(44.5-40)/10+0.5))},
+	} {
+		if got := pixel(out, c.x, c.y); got != c.want {
+			t.Errorf("pixel %d,%d is %x, want %x", c.x, c.y, got, c.want)
+		}
+	}
+
+	// A hidden cursor dims everything.
+	hidden := synth.Path(synth.Waypoint{Pos: image.Pt(160, 120), Hidden: true})
+	out = next(t, frame.Process(source(hidden, true), NewSpotlight(40)))
+	ref = next(t, source(hidden, true))
+	if got, want := pixel(out, 160, 120), dim(pixel(ref, 160, 120), s.Dim); got != want {
+		t.Errorf("pixel at the hidden tip is %x, want %x", got, want)
+	}
+}
+
+func TestSpotlightNeedsProcess(t *testing.T) {
+	s := NewSpotlight(40)
+	f := frame.New(100, 100)
+	f.Cursor.Visible = true
+	if err := s.Apply(f); err != nil {
+		t.Fatalf("full frame: %v", err)
+	}
+	f.Dirty = []image.Rectangle{}
+	if err := s.Apply(f); err != nil {
+		t.Errorf("unchanged cursor: %v", err)
+	}
+	f.Cursor.X += 5
+	if err := s.Apply(f); err != errNoRestore {
+		t.Errorf("moved cursor outside frame.Process: %v, want errNoRestore", err)
+	}
+}
+
+// TestNoLeftovers checks that every processed frame equals its unprocessed
+// twin with the stages applied from scratch, so nothing drawn for earlier
+// cursor positions survives.
+func TestNoLeftovers(t *testing.T) {
+	track := synth.Circle(image.Pt(160, 120), 60, 2*time.Second)
+	p := frame.Process(source(track, false), NewSpotlight(40), NewHighlight(20))
+	ref := source(track, false)
+	arrow := synth.ArrowShape()
+	for i := 0; i < 25; i++ {
+		out := next(t, p)
+		want := next(t, ref).Clone()
+		want.Dirty = nil
+		want.Cursor.Shape = arrow
+		NewSpotlight(40).Apply(want)
+		NewHighlight(20).Apply(want)
+		if !bytes.Equal(out.Pix, want.Pix) {
+			t.Fatalf("frame %d differs from the stages applied to a clean frame", i)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package effects
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+var errOverlayRestore = errors.New("effects: overlay requires frames from frame.Process")
+
+// DefaultTimeLayout formats {time} fields without a layout.
+const DefaultTimeLayout = "2006-01-02 15:04:05 MST"
+
+// OverlayPosition is the frame corner or edge an Overlay is placed at.
+type OverlayPosition int
+
+const (
+	OverlayTopLeft OverlayPosition = iota
+	OverlayTopRight
+	OverlayBottomLeft
+	OverlayBottomRight
+	OverlayTop
+	OverlayBottom
+)
+
+// Overlay burns text into frames, such as the wall-clock time, host and
+// output name of audit recordings. It draws with an embedded 5x7 bitmap font,
+// so it needs no system fonts; characters outside printable ASCII are drawn
+// as '?'.
+//
+// Template holds the text, with lines separated by "\n" and fields written
+// {name} or {name:arg}:
+//
+//	{time}    the frame's time; arg is a Go time layout, DefaultTimeLayout if empty
+//	{host}    Host
+//	{output}  the output name
+//	{seq}     the frame's sequence number
+//	{size}    the frame size, WxH
+//
+// "{{" writes "{". Unknown fields are left as they are.
+//
+// The box is redrawn and marked dirty only when the text changes or the
+// pixels under it do, so delta encoders send it once per change. This needs
+// frames from frame.Process. Put it before a Redact stage, so redacted
+// regions stay hidden under the box.
+type Overlay struct {
+	Template string
+	Position OverlayPosition
+	// Margin is the distance to the frame edges, Padding the space between
+	// the text and the edges of its box.
+	Margin, Padding int
+	// Scale is the size of a font pixel in frame pixels.
+	Scale int
+	// Color is the text color and Background the box color, both blended by
+	// their alpha. A zero Background draws no box.
+	Color, Background color.NRGBA
+	// Location is the time zone of {time}; nil means time.Local.
+	Location *time.Location
+	Host     string
+	// Fields adds or replaces template fields. Functions get the frame and
+	// the field's argument.
+	Fields map[string]func(f *frame.Frame, arg string) string
+
+	text string
+	box  image.Rectangle
+}
+
+// NewOverlay returns an overlay of white text on a translucent black box in
+// the top left corner, with Host set to the host name.
+func NewOverlay(template string) *Overlay {
+	host, _ := os.Hostname()
+	return &Overlay{
+		Template:   template,
+		Margin:     8,
+		Padding:    4,
+		Scale:      2,
+		Color:      color.NRGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF},
+		Background: color.NRGBA{A: 0xA0},
+		Host:       host,
+	}
+}
+
+func (o *Overlay) Apply(f *frame.Frame) error {
+	text := o.Expand(f)
+	box := o.layout(text, f)
+
+	redraw := f.Full()
+	if redraw {
+		// Draw over the capture, as on other frames.
+		f.Restore(box)
+	} else {
+		// Moves into or out of the box would carry its pixels around.
+		for _, m := range f.Moves {
+			if m.Dst.Overlaps(box) || m.Dst.Sub(m.Dst.Min).Add(m.Src).Overlaps(box) {
+				for _, m := range f.Moves {
+					f.Dirty = append(f.Dirty, m.Dst)
+				}
+				f.Moves = nil
+				break
+			}
+		}
+		damage := f.Damage()
+		redraw = text != o.text || box != o.box || touches(box, damage)
+		if redraw && (!f.Restore(o.box) || box != o.box && !f.Restore(box)) {
+			return errOverlayRestore
+		}
+	}
+	o.text, o.box = text, box
+	if redraw {
+		o.draw(f, text, box)
+	}
+	return nil
+}
+
+// Expand returns the template filled in for f.
+func (o *Overlay) Expand(f *frame.Frame) string {
+	t := o.Template
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(t, '{')
+		if i < 0 {
+			b.WriteString(t)
+			return b.String()
+		}
+		b.WriteString(t[:i])
+		t = t[i:]
+		if strings.HasPrefix(t, "{{") {
+			b.WriteByte('{')
+			t = t[2:]
+			continue
+		}
+		end := strings.IndexByte(t, '}')
+		if end < 0 {
+			b.WriteString(t)
+			return b.String()
+		}
+		name, arg, _ := strings.Cut(t[1:end], ":")
+		if v, ok := o.field(f, name, arg); ok {
+			b.WriteString(v)
+		} else {
+			b.WriteString(t[:end+1])
+		}
+		t = t[end+1:]
+	}
+}
+
+func (o *Overlay) field(f *frame.Frame, name, arg string) (string, bool) {
+	if fn, ok := o.Fields[name]; ok {
+		return fn(f, arg), true
+	}
+	switch name {
+	case "time":
+		t := f.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		loc := o.Location
+		if loc == nil {
+			loc = time.Local
+		}
+		if arg == "" {
+			arg = DefaultTimeLayout
+		}
+		return t.In(loc).Format(arg), true
+	case "host":
+		return o.Host, true
+	case "output":
+		return f.Output, true
+	case "seq":
+		return strconv.FormatUint(f.Seq, 10), true
+	case "size":
+		return fmt.Sprintf("%dx%d", f.Width, f.Height), true
+	}
+	return "", false
+}
+
+// layout returns the box of text in f. It may extend past the frame.
+func (o *Overlay) layout(text string, f *frame.Frame) image.Rectangle {
+	if text == "" {
+		return image.Rectangle{}
+	}
+	scale := max(o.Scale, 1)
+	lines := strings.Split(text, "\n")
+	cols := 0
+	for _, l := range lines {
+		cols = max(cols, len([]rune(l)))
+	}
+	w := (cols*cellWidth-1)*scale + 2*o.Padding
+	h := (len(lines)*cellHeight-1)*scale + 2*o.Padding
+
+	var x, y int
+	switch o.Position {
+	case OverlayTopRight, OverlayBottomRight:
+		x = f.Width - o.Margin - w
+	case OverlayTop, OverlayBottom:
+		x = (f.Width - w) / 2
+	default:
+		x = o.Margin
+	}
+	switch o.Position {
+	case OverlayBottomLeft, OverlayBottomRight, OverlayBottom:
+		y = f.Height - o.Margin - h
+	default:
+		y = o.Margin
+	}
+	return image.Rect(x, y, x+w, y+h)
+}
+
+// draw fills the box and draws the text in it, clipped to the frame.
+func (o *Overlay) draw(f *frame.Frame, text string, box image.Rectangle) {
+	clip := box.Intersect(f.Rect())
+	if clip.Empty() {
+		return
+	}
+	blendRect(f, clip, o.Background)
+	scale := max(o.Scale, 1)
+	origin := box.Min.Add(image.Pt(o.Padding, o.Padding))
+	for i, line := range strings.Split(text, "\n") {
+		y := origin.Y + i*cellHeight*scale
+		for j, r := range []rune(line) {
+			x := origin.X + j*cellWidth*scale
+			g := glyph(r)
+			for gy := 0; gy < glyphHeight; gy++ {
+				for gx := 0; gx < glyphWidth; gx++ {
+					if g[gy]&(1<<(glyphWidth-1-gx)) == 0 {
+						continue
+					}
+					px := image.Rect(x+gx*scale, y+gy*scale, x+(gx+1)*scale, y+(gy+1)*scale)
+					blendRect(f, px.Intersect(clip), o.Color)
+				}
+			}
+		}
+	}
+}
+
+// blendRect alpha blends c over r.
+func blendRect(f *frame.Frame, r image.Rectangle, c color.NRGBA) {
+	if c.A == 0 {
+		return
+	}
+	a := uint32(c.A)
+	inv := 255 - a
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := f.Pix[y*f.Stride:]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			o := x * 4
+			row[o] = byte((uint32(row[o])*inv + uint32(c.B)*a + 127) / 255)
+			row[o+1] = byte((uint32(row[o+1])*inv + uint32(c.G)*a + 127) / 255)
+			row[o+2] = byte((uint32(row[o+2])*inv + uint32(c.R)*a + 127) / 255)
+			row[o+3] = 0xFF
+		}
+	}
+}
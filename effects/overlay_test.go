@@ -0,0 +1,250 @@
+package effects
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/synth"
+)
+
+// newOverlay returns an overlay with fixed host and time zone.
+func newOverlay(template string) *Overlay {
+	o := NewOverlay(template)
+	o.Host = "rec01"
+	o.Location = time.UTC
+	return o
+}
+
+func TestExpand(t *testing.T) {
+	f := frame.New(1920, 1080)
+	f.Time = time.Date(2024, 5, 6, 7, 8, 9, 0, time.FixedZone("", 7200))
+	f.Seq = 42
+	f.Output = `\\.\DISPLAY2`
+	o := newOverlay("")
+	o.Fields = map[string]func(*frame.Frame, string) string{
+		"user": func(_ *frame.Frame, arg string) string { return "alice/" + arg },
+		"host": func(*frame.Frame, string) string { return "override" },
+	}
+	for _, c := range []struct {
+		template, want string
+	}{
+		{"{time}", "2024-05-06 05:08:09 UTC"},
+		{"{time:15:04:05.000}", "05:08:09.000"},
+		{"{output} #{seq} {size}", `\\.\DISPLAY2 #42 1920x1080`},
+		{"{host}", "override"},
+		{"{user:x}", "alice/x"},
+		{"{{seq}} {{", "{seq}} {"},
+		{"{nope} {nope:arg}", "{nope} {nope:arg}"},
+		{"line 1\n{seq", "line 1\n{seq"},
+		{"", ""},
+	} {
+		o.Template = c.template
+		if got := o.Expand(f); got != c.want {
+			t.Errorf("Expand(%q) = %q, want %q", c.template, got, c.want)
+		}
+	}
+	o = newOverlay("{time:15:04}")
+	o.Location = time.FixedZone("", -3600)
+	if got := o.Expand(f); got != "04:08" {
+		t.Errorf("time in UTC-1 is %q", got)
+	}
+}
+
+// glyphPixel returns the frame pixel at the top left of font pixel gx, gy
+// of character col in line row of o's text.
+func glyphPixel(o *Overlay, box image.Rectangle, row, col, gx, gy int) image.Point {
+	return box.Min.Add(image.Pt(o.Padding+(col*cellWidth+gx)*o.Scale, o.Padding+(row*cellHeight+gy)*o.Scale))
+}
+
+func TestOverlayLayout(t *testing.T) {
+	// Two columns and two lines at scale 2 with padding 4: 30x38.
+	for _, c := range []struct {
+		pos OverlayPosition
+		min image.Point
+	}{
+		{OverlayTopLeft, image.Pt(8, 8)},
+		{OverlayTopRight, image.Pt(282, 8)},
+		{OverlayBottomLeft, image.Pt(8, 194)},
+		{OverlayBottomRight, image.Pt(282, 194)},
+		{OverlayTop, image.Pt(145, 8)},
+		{OverlayBottom, image.Pt(145, 194)},
+	} {
+		o := newOverlay("AT\nL")
+		o.Position = c.pos
+		out := next(t, frame.Process(source(at(300, 10), true), o))
+		ref := next(t, source(at(300, 10), true))
+		box := image.Rectangle{c.min, c.min.Add(image.Pt(30, 38))}
+
+		for y := 0; y < out.Height; y++ {
+			for x := 0; x < out.Width; x++ {
+				if !image.Pt(x, y).In(box) && pixel(out, x, y) != pixel(ref, x, y) {
+					t.Fatalf("position %d: pixel %d,%d outside the box %v changed", c.pos, x, y, box)
+				}
+			}
+		}
+		for _, p := range []struct {
+			pt   image.Point
+			text bool
+		}{
+			{box.Min, false},
+			{box.Max.Sub(image.Pt(1, 1)), false},
+			{glyphPixel(o, box, 0, 0, 0, 0), false}, // A: .###.
+			{glyphPixel(o, box, 0, 0, 1, 0), true},
+			{glyphPixel(o, box, 0, 0, 1, 0).Add(image.Pt(1, 1)), true},
+			{glyphPixel(o, box, 0, 1, 2, 6), true}, // T stem
+			{glyphPixel(o, box, 0, 1, 0, 6), false},
+			{glyphPixel(o, box, 1, 0, 4, 6), true},  // L base
+			{glyphPixel(o, box, 1, 1, 2, 3), false}, // past the end of the line
+		} {
+			want := blend(pixel(ref, p.pt.X, p.pt.Y), o.Background, uint32(o.Background.A))
+			if p.text {
+				want = blend(want, o.Color, uint32(o.Color.A))
+			}
+			if got := pixel(out, p.pt.X, p.pt.Y); got != want {
+				t.Errorf("position %d: pixel %v is %x, want %x (text %v)", c.pos, p.pt, got, want, p.text)
+			}
+		}
+	}
+}
+
+func TestOverlayText(t *testing.T) {
+	render := func(o *Overlay) []byte {
+		t.Helper()
+		return append([]byte(nil), next(t, frame.Process(source(at(300, 10), true), o)).Pix...)
+	}
+	// Characters outside printable ASCII are drawn as '?'.
+	if !bytes.Equal(render(newOverlay("é1\t")), render(newOverlay("?1?"))) {
+		t.Error("unprintable characters are not drawn as '?'")
+	}
+	// No background draws the text only.
+	o := newOverlay("-")
+	o.Background = color.NRGBA{}
+	o.Color = color.NRGBA{R: 0xFF, A: 0xFF}
+	out := next(t, frame.Process(source(at(300, 10), true), o))
+	ref := next(t, source(at(300, 10), true))
+	box := image.Rect(8, 8, 8+(cellWidth-1)*2+8, 8+(cellHeight-1)*2+8)
+	if got, want := pixel(out, box.Min.X, box.Min.Y), pixel(ref, box.Min.X, box.Min.Y); got != want {
+		t.Errorf("box corner is %x without a background, want %x", got, want)
+	}
+	if p := glyphPixel(o, box, 0, 0, 0, 3); pixel(out, p.X, p.Y) != [4]byte{0, 0, 0xFF, 0xFF} {
+		t.Errorf("dash pixel is %x", pixel(out, p.X, p.Y))
+	}
+	// A box extending past the frame is clipped.
+	o = newOverlay("a long line of text that does not fit")
+	o.Position = OverlayBottomRight
+	o.Background = color.NRGBA{R: 0xFF, A: 0xFF}
+	out = next(t, frame.Process(source(at(10, 10), true), o))
+	if got := pixel(out, 0, 231); got != [4]byte{0, 0, 0xFF, 0xFF} {
+		t.Errorf("clipped box pixel at the frame edge is %x", got)
+	}
+	// Empty text draws nothing.
+	out = next(t, frame.Process(source(at(300, 10), true), newOverlay("")))
+	if !bytes.Equal(out.Pix, ref.Pix) {
+		t.Error("empty text drew a box")
+	}
+}
+
+// TestOverlayUpdates runs text that changes every 300ms over a cursor passing
+// through the box. Every frame must equal a clean frame with the overlay drawn
+// from scratch, and the box must only be sent when it changed.
+func TestOverlayUpdates(t *testing.T) {
+	newTicker := func() *Overlay {
+		o := newOverlay("tick {tick}")
+		o.Position = OverlayTop
+		o.Margin = 50
+		o.Fields = map[string]func(*frame.Frame, string) string{
+			"tick": func(f *frame.Frame, _ string) string {
+				return strconv.Itoa(int(f.Time.Sub(start) / (300 * time.Millisecond)))
+			},
+		}
+		return o
+	}
+	track := synth.Circle(image.Pt(160, 120), 60, 2*time.Second)
+	o := newTicker()
+	p := frame.Process(source(track, true), o)
+	ref := source(track, true)
+	var prev []byte
+	var prevText string
+	quiet := 0
+	for i := 0; i < 25; i++ {
+		out := next(t, p)
+		want := next(t, ref).Clone()
+		want.Dirty = nil
+		newTicker().Apply(want)
+		if !bytes.Equal(out.Pix, want.Pix) {
+			t.Fatalf("frame %d differs from a clean frame with the overlay", i)
+		}
+		if prev != nil {
+			if r, ok := outsideDamage(out, prev); !ok {
+				t.Fatalf("frame %d changed pixel %v outside its damage %v", i, r, out.Damage())
+			}
+			if text := o.Expand(out); text == prevText && !touches(o.box, out.Damage()) {
+				quiet++
+			}
+		}
+		prev = append(prev[:0], out.Pix...)
+		prevText = o.Expand(out)
+	}
+	if quiet == 0 {
+		t.Error("the box was sent with every frame")
+	}
+}
+
+// TestOverlayMoves checks that moves touching the box are sent as damage.
+func TestOverlayMoves(t *testing.T) {
+	a := noise(64, 48)
+	b := a.Clone()
+	frame.CopyRect(b.Pix, b.Stride, a.Pix[a.PixOffset(0, 8):], a.Stride, image.Rect(0, 0, 64, 40))
+	b.Dirty = []image.Rectangle{image.Rect(0, 40, 64, 48)}
+	b.Moves = []frame.Move{{Src: image.Pt(0, 8), Dst: image.Rect(0, 0, 64, 40)}}
+	c := b.Clone()
+	frame.CopyRect(c.Pix[c.PixOffset(40, 30):], c.Stride, b.Pix[b.PixOffset(0, 30):], b.Stride, image.Rect(0, 0, 24, 18))
+	c.Dirty = []image.Rectangle{}
+	c.Moves = []frame.Move{{Src: image.Pt(0, 30), Dst: image.Rect(40, 30, 64, 48)}}
+
+	o := newOverlay("X")
+	o.Margin, o.Scale = 2, 1
+	p := frame.Process(&replay{a.Clone(), b.Clone(), c.Clone()}, o)
+	for i, src := range []*frame.Frame{a, b, c} {
+		out := next(t, p)
+		want := src.Clone()
+		want.Dirty = nil
+		ref := newOverlay("X")
+		ref.Margin, ref.Scale = 2, 1
+		ref.Apply(want)
+		if !bytes.Equal(out.Pix, want.Pix) {
+			t.Fatalf("frame %d differs from the reference", i)
+		}
+		switch i {
+		case 1:
+			if len(out.Moves) != 0 || !touches(o.box, out.Dirty) {
+				t.Errorf("scroll across the box: moves %v, dirty %v", out.Moves, out.Dirty)
+			}
+		case 2:
+			if len(out.Moves) != 1 || touches(o.box, out.Dirty) {
+				t.Errorf("move away from the box: moves %v, dirty %v", out.Moves, out.Dirty)
+			}
+		}
+	}
+}
+
+func TestOverlayNeedsProcess(t *testing.T) {
+	o := newOverlay("{seq}")
+	f := frame.New(100, 100)
+	if err := o.Apply(f); err != nil {
+		t.Fatalf("full frame: %v", err)
+	}
+	f.Dirty = []image.Rectangle{}
+	if err := o.Apply(f); err != nil {
+		t.Errorf("unchanged text: %v", err)
+	}
+	f.Seq++
+	if err := o.Apply(f); err != errOverlayRestore {
+		t.Errorf("changed text outside frame.Process: %v, want errOverlayRestore", err)
+	}
+}
@@ -0,0 +1,271 @@
+package effects
+
+import (
+	"errors"
+	"image"
+	"image/color"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+var errRedactRestore = errors.New("effects: redaction requires frames from frame.Process")
+
+// RedactMode selects how Redact hides a region.
+type RedactMode int
+
+const (
+	// RedactFill paints the region with a solid color.
+	RedactFill RedactMode = iota
+	// RedactPixelate replaces blocks of pixels by their average.
+	RedactPixelate
+	// RedactBlur box blurs the region. Only pixels inside the region are
+	// used, so nothing around it bleeds in.
+	RedactBlur
+)
+
+// Redact hides regions of frames, such as password managers or customer
+// data in support recordings. Regions are in frame coordinates. Put it
+// before a scaler, as hidden pixels are restored from the capture. Pixelate
+// and blur with small sizes may leave large text readable; use RedactFill
+// where that matters.
+//
+// A region is only redrawn when it appears, moves or its pixels change, and
+// is then marked dirty; regions that disappear are restored from the
+// capture and marked dirty too. This needs frames from frame.Process.
+type Redact struct {
+	Mode RedactMode
+	// Regions are hidden in every frame. They must not change while frames
+	// are processed; use Func for regions that move.
+	Regions []image.Rectangle
+	// Func, if set, returns more regions to hide in f, e.g. the windows of a
+	// password manager found by title. It must not modify f.
+	Func func(f *frame.Frame) []image.Rectangle
+	// Color is the RedactFill color. Its alpha is ignored.
+	Color color.NRGBA
+	// BlockSize is the RedactPixelate block edge, 16 if 0. Blocks are aligned
+	// to the frame, so they stay put when a region moves.
+	BlockSize int
+	// Radius is the RedactBlur radius, 12 if 0.
+	Radius int
+
+	prev []image.Rectangle
+	buf  []uint32
+}
+
+// NewRedact returns a stage hiding regions in the given mode, filling with
+// black.
+func NewRedact(mode RedactMode, regions ...image.Rectangle) *Redact {
+	return &Redact{Mode: mode, Regions: regions}
+}
+
+func (rd *Redact) Apply(f *frame.Frame) error {
+	regions := make([]image.Rectangle, 0, len(rd.Regions))
+	for _, r := range rd.Regions {
+		if r = r.Intersect(f.Rect()); !r.Empty() {
+			regions = append(regions, r)
+		}
+	}
+	if rd.Func != nil {
+		for _, r := range rd.Func(f) {
+			if r = r.Intersect(f.Rect()); !r.Empty() {
+				regions = append(regions, r)
+			}
+		}
+	}
+
+	var redraw []image.Rectangle
+	if f.Full() {
+		// Start from the capture, as on other frames. Without a processor
+		// the frame holds nothing else.
+		for _, r := range regions {
+			f.Restore(r)
+		}
+		redraw = regions
+	} else {
+		// Consumers applying moves themselves would copy pixels into or out
+		// of a region; send the moved regions as dirty instead.
+		for _, m := range f.Moves {
+			if touches(m.Dst, regions) || touches(m.Dst.Sub(m.Dst.Min).Add(m.Src), regions) {
+				for _, m := range f.Moves {
+					f.Dirty = append(f.Dirty, m.Dst)
+				}
+				f.Moves = nil
+				break
+			}
+		}
+		changed := f.Damage()
+		for _, r := range rd.prev {
+			if !contains(regions, r) {
+				changed = append(changed, r)
+			}
+		}
+		for _, r := range regions {
+			if !contains(rd.prev, r) {
+				changed = append(changed, r)
+			}
+		}
+		// Restoring a region uncovers its overlap with others, which then
+		// need redrawing too.
+		var restored []image.Rectangle
+		for _, r := range rd.prev {
+			if !contains(regions, r) {
+				restored = append(restored, r)
+			}
+		}
+		done := make([]bool, len(regions))
+		for more := true; more; {
+			more = false
+			for i, r := range regions {
+				if done[i] || !touches(r, changed) && !touches(r, restored) {
+					continue
+				}
+				done[i], more = true, true
+				restored = append(restored, r)
+			}
+		}
+		// Overlapping regions are drawn in order, as on a full frame.
+		for i, r := range regions {
+			if done[i] {
+				redraw = append(redraw, r)
+			}
+		}
+		for _, r := range restored {
+			if !f.Restore(r) {
+				return errRedactRestore
+			}
+		}
+	}
+	rd.prev = append(rd.prev[:0], regions...)
+
+	for _, r := range redraw {
+		switch rd.Mode {
+		case RedactPixelate:
+			rd.pixelate(f, r)
+		case RedactBlur:
+			rd.blur(f, r)
+		default:
+			fill(f, r, rd.Color)
+		}
+	}
+	return nil
+}
+
+func touches(r image.Rectangle, list []image.Rectangle) bool {
+	for _, o := range list {
+		if r.Overlaps(o) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []image.Rectangle, r image.Rectangle) bool {
+	for _, o := range list {
+		if o == r {
+			return true
+		}
+	}
+	return false
+}
+
+func fill(f *frame.Frame, r image.Rectangle, c color.NRGBA) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := f.Pix[y*f.Stride:]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			o := x * 4
+			row[o], row[o+1], row[o+2], row[o+3] = c.B, c.G, c.R, 0xFF
+		}
+	}
+}
+
+func (rd *Redact) pixelate(f *frame.Frame, r image.Rectangle) {
+	size := rd.BlockSize
+	if size <= 0 {
+		size = 16
+	}
+	for by := r.Min.Y / size * size; by < r.Max.Y; by += size {
+		for bx := r.Min.X / size * size; bx < r.Max.X; bx += size {
+			b := image.Rect(bx, by, bx+size, by+size).Intersect(r)
+			var sb, sg, sr uint32
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				row := f.Pix[y*f.Stride:]
+				for x := b.Min.X; x < b.Max.X; x++ {
+					o := x * 4
+					sb += uint32(row[o])
+					sg += uint32(row[o+1])
+					sr += uint32(row[o+2])
+				}
+			}
+			n := uint32(b.Dx() * b.Dy())
+			fill(f, b, color.NRGBA{R: byte((sr + n/2) / n), G: byte((sg + n/2) / n), B: byte((sb + n/2) / n)})
+		}
+	}
+}
+
+// blur box blurs r, horizontally then vertically, through a buffer of
+// per-channel values. Windows shrink at the region's edges.
+func (rd *Redact) blur(f *frame.Frame, r image.Rectangle) {
+	radius := rd.Radius
+	if radius <= 0 {
+		radius = 12
+	}
+	w, h := r.Dx(), r.Dy()
+	if cap(rd.buf) < w*h*3 {
+		rd.buf = make([]uint32, w*h*3)
+	}
+	buf := rd.buf[:w*h*3]
+
+	for y := 0; y < h; y++ {
+		row := f.Pix[(r.Min.Y+y)*f.Stride+r.Min.X*4:]
+		line := buf[y*w*3:]
+		var sum [3]uint32
+		for x := 0; x < min(radius, w); x++ {
+			for c := 0; c < 3; c++ {
+				sum[c] += uint32(row[x*4+c])
+			}
+		}
+		for x := 0; x < w; x++ {
+			if in := x + radius; in < w {
+				for c := 0; c < 3; c++ {
+					sum[c] += uint32(row[in*4+c])
+				}
+			}
+			if out := x - radius - 1; out >= 0 {
+				for c := 0; c < 3; c++ {
+					sum[c] -= uint32(row[out*4+c])
+				}
+			}
+			n := uint32(min(x+radius, w-1) - max(x-radius, 0) + 1)
+			for c := 0; c < 3; c++ {
+				line[x*3+c] = (sum[c] + n/2) / n
+			}
+		}
+	}
+
+	for x := 0; x < w; x++ {
+		var sum [3]uint32
+		for y := 0; y < min(radius, h); y++ {
+			for c := 0; c < 3; c++ {
+				sum[c] += buf[(y*w+x)*3+c]
+			}
+		}
+		for y := 0; y < h; y++ {
+			if in := y + radius; in < h {
+				for c := 0; c < 3; c++ {
+					sum[c] += buf[(in*w+x)*3+c]
+				}
+			}
+			if out := y - radius - 1; out >= 0 {
+				for c := 0; c < 3; c++ {
+					sum[c] -= buf[(out*w+x)*3+c]
+				}
+			}
+			n := uint32(min(y+radius, h-1) - max(y-radius, 0) + 1)
+			o := (r.Min.Y+y)*f.Stride + (r.Min.X+x)*4
+			for c := 0; c < 3; c++ {
+				f.Pix[o+c] = byte((sum[c] + n/2) / n)
+			}
+			f.Pix[o+3] = 0xFF
+		}
+	}
+}
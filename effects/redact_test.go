@@ -0,0 +1,278 @@
+package effects
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/synth"
+)
+
+// refPixelate is a plain implementation of RedactPixelate.
+func refPixelate(f *frame.Frame, r image.Rectangle, size int) {
+	for by := 0; by < f.Height; by += size {
+		for bx := 0; bx < f.Width; bx += size {
+			b := image.Rect(bx, by, bx+size, by+size).Intersect(r)
+			if b.Empty() {
+				continue
+			}
+			var sum [3]int
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					for c := 0; c < 3; c++ {
+						sum[c] += int(f.Pix[f.PixOffset(x, y)+c])
+					}
+				}
+			}
+			n := b.Dx() * b.Dy()
+			avg := color.NRGBA{B: byte((sum[0] + n/2) / n), G: byte((sum[1] + n/2) / n), R: byte((sum[2] + n/2) / n)}
+			fill(f, b, avg)
+		}
+	}
+}
+
+// refBlur is a plain implementation of RedactBlur: the mean of the pixels
+// within radius in r, along rows and then along columns.
+func refBlur(f *frame.Frame, r image.Rectangle, radius int) {
+	w, h := r.Dx(), r.Dy()
+	mean := func(get func(i int) int, i, n int) int {
+		lo, hi := max(i-radius, 0), min(i+radius, n-1)
+		sum := 0
+		for k := lo; k <= hi; k++ {
+			sum += get(k)
+		}
+		cnt := hi - lo + 1
+		return (sum + cnt/2) / cnt
+	}
+	rows := make([]int, w*h*3)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			for c := 0; c < 3; c++ {
+				rows[(y*w+x)*3+c] = mean(func(k int) int { return int(f.Pix[f.PixOffset(r.Min.X+k, r.Min.Y+y)+c]) }, x, w)
+			}
+		}
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			o := f.PixOffset(r.Min.X+x, r.Min.Y+y)
+			for c := 0; c < 3; c++ {
+				f.Pix[o+c] = byte(mean(func(k int) int { return rows[(k*w+x)*3+c] }, y, h))
+			}
+			f.Pix[o+3] = 0xFF
+		}
+	}
+}
+
+// refRedact applies rd's mode to regions of f from scratch.
+func refRedact(f *frame.Frame, rd *Redact, regions []image.Rectangle) {
+	for _, r := range regions {
+		r = r.Intersect(f.Rect())
+		switch rd.Mode {
+		case RedactPixelate:
+			refPixelate(f, r, max(rd.BlockSize, 1))
+		case RedactBlur:
+			refBlur(f, r, rd.Radius)
+		default:
+			fill(f, r, rd.Color)
+		}
+	}
+}
+
+// redactions are the modes under test, with sizes chosen so that blocks and
+// blur windows are clipped by the regions.
+func redactions() []*Redact {
+	return []*Redact{
+		{Mode: RedactFill, Color: color.NRGBA{R: 200, G: 10, B: 50}},
+		{Mode: RedactPixelate, BlockSize: 16},
+		{Mode: RedactPixelate, BlockSize: 7},
+		{Mode: RedactBlur, Radius: 12},
+		{Mode: RedactBlur, Radius: 3},
+	}
+}
+
+func TestRedact(t *testing.T) {
+	regions := []image.Rectangle{
+		image.Rect(30, 20, 110, 70),
+		image.Rect(90, 50, 130, 90), // overlaps the first
+		image.Rect(280, 200, 400, 300),
+	}
+	for _, rd := range redactions() {
+		rd.Regions = regions
+		out := next(t, frame.Process(source(at(100, 60), true), rd))
+		want := next(t, source(at(100, 60), true)).Clone()
+		refRedact(want, rd, regions)
+		if !bytes.Equal(out.Pix, want.Pix) {
+			t.Errorf("mode %d size %d/%d: frame differs from the reference", rd.Mode, rd.BlockSize, rd.Radius)
+		}
+	}
+
+	// The defaults: black fill, 16 pixel blocks, radius 12.
+	for _, c := range []struct {
+		rd, ref *Redact
+	}{
+		{NewRedact(RedactFill, regions...), &Redact{}},
+		{NewRedact(RedactPixelate, regions...), &Redact{Mode: RedactPixelate, BlockSize: 16}},
+		{NewRedact(RedactBlur, regions...), &Redact{Mode: RedactBlur, Radius: 12}},
+	} {
+		out := next(t, frame.Process(source(at(100, 60), true), c.rd))
+		want := next(t, source(at(100, 60), true)).Clone()
+		refRedact(want, c.ref, regions)
+		if !bytes.Equal(out.Pix, want.Pix) {
+			t.Errorf("mode %d with defaults: frame differs from the reference", c.rd.Mode)
+		}
+	}
+}
+
+// TestRedactMoving hides a region following the cursor, which comes and goes,
+// over a fixed one. Every frame must equal a clean frame redacted from scratch,
+// and pixels outside the damage must not change.
+func TestRedactMoving(t *testing.T) {
+	fixed := image.Rect(120, 90, 230, 160)
+	follow := func(f *frame.Frame) []image.Rectangle {
+		if f.Time.Sub(start)/(100*time.Millisecond)%4 == 3 {
+			return nil
+		}
+		return []image.Rectangle{image.Rect(f.Cursor.X-20, f.Cursor.Y-10, f.Cursor.X+30, f.Cursor.Y+25)}
+	}
+	track := synth.Circle(image.Pt(160, 120), 60, 2*time.Second)
+	for _, rd := range redactions() {
+		rd.Regions, rd.Func = []image.Rectangle{fixed}, follow
+		p := frame.Process(source(track, false), rd)
+		ref := source(track, false)
+		var prev []byte
+		for i := 0; i < 25; i++ {
+			out := next(t, p)
+			want := next(t, ref).Clone()
+			refRedact(want, rd, append([]image.Rectangle{fixed}, follow(want)...))
+			if !bytes.Equal(out.Pix, want.Pix) {
+				t.Fatalf("mode %d: frame %d differs from a clean frame redacted", rd.Mode, i)
+			}
+			if prev != nil {
+				if r, ok := outsideDamage(out, prev); !ok {
+					t.Fatalf("mode %d: frame %d changed pixel %v outside its damage %v", rd.Mode, i, r, out.Damage())
+				}
+			}
+			prev = append(prev[:0], out.Pix...)
+		}
+	}
+}
+
+// outsideDamage reports whether f differs from prev only within its damage,
+// returning the first pixel that does not.
+func outsideDamage(f *frame.Frame, prev []byte) (image.Point, bool) {
+	damage := f.Damage()
+	if damage == nil {
+		return image.Point{}, true
+	}
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			o := f.PixOffset(x, y)
+			if bytes.Equal(f.Pix[o:o+4], prev[o:o+4]) {
+				continue
+			}
+			if p := image.Pt(x, y); !touches(image.Rectangle{p, p.Add(image.Pt(1, 1))}, damage) {
+				return p, false
+			}
+		}
+	}
+	return image.Point{}, true
+}
+
+// replay is a source returning prepared frames.
+type replay []*frame.Frame
+
+func (r *replay) GetFrame(uint) (*frame.Frame, error) {
+	f := (*r)[0]
+	*r = (*r)[1:]
+	return f, nil
+}
+
+// noise returns an opaque frame of random pixels.
+func noise(w, h int) *frame.Frame {
+	f := frame.New(w, h)
+	rand.New(rand.NewSource(1)).Read(f.Pix)
+	for i := 3; i < len(f.Pix); i += 4 {
+		f.Pix[i] = 0xFF
+	}
+	return f
+}
+
+// TestRedactMoves checks that moves touching a region are sent as damage,
+// as a consumer applying them would copy hidden pixels.
+func TestRedactMoves(t *testing.T) {
+	a := noise(64, 48)
+	// Scroll everything up by 8 rows: the move crosses the region.
+	b := a.Clone()
+	frame.CopyRect(b.Pix, b.Stride, a.Pix[a.PixOffset(0, 8):], a.Stride, image.Rect(0, 0, 64, 40))
+	b.Dirty = []image.Rectangle{image.Rect(0, 40, 64, 48)}
+	b.Moves = []frame.Move{{Src: image.Pt(0, 8), Dst: image.Rect(0, 0, 64, 40)}}
+	// Copy a block far from the region: the move is kept.
+	c := b.Clone()
+	frame.CopyRect(c.Pix[c.PixOffset(40, 30):], c.Stride, b.Pix[b.PixOffset(0, 30):], b.Stride, image.Rect(0, 0, 24, 18))
+	c.Dirty = []image.Rectangle{}
+	c.Moves = []frame.Move{{Src: image.Pt(0, 30), Dst: image.Rect(40, 30, 64, 48)}}
+
+	region := image.Rect(10, 10, 30, 20)
+	p := frame.Process(&replay{a.Clone(), b.Clone(), c.Clone()}, NewRedact(RedactPixelate, region))
+	for i, src := range []*frame.Frame{a, b, c} {
+		out := next(t, p)
+		want := src.Clone()
+		refRedact(want, &Redact{Mode: RedactPixelate, BlockSize: 16}, []image.Rectangle{region})
+		if !bytes.Equal(out.Pix, want.Pix) {
+			t.Fatalf("frame %d differs from the reference", i)
+		}
+		switch i {
+		case 1:
+			if len(out.Moves) != 0 || !touches(region, out.Dirty) || !touches(image.Rect(0, 0, 64, 40), out.Dirty) {
+				t.Errorf("scroll across the region: moves %v, dirty %v", out.Moves, out.Dirty)
+			}
+		case 2:
+			if len(out.Moves) != 1 || touches(region, out.Dirty) {
+				t.Errorf("move away from the region: moves %v, dirty %v", out.Moves, out.Dirty)
+			}
+		}
+	}
+}
+
+// TestRedactOverlap changes pixels in one region only. Redrawing it restores
+// its overlap with the next region, which must be redrawn as well.
+func TestRedactOverlap(t *testing.T) {
+	regions := []image.Rectangle{image.Rect(10, 10, 40, 30), image.Rect(35, 25, 60, 45)}
+	a := noise(64, 48)
+	b := a.Clone()
+	for _, p := range []image.Point{{12, 12}, {14, 15}} {
+		b.Pix[b.PixOffset(p.X, p.Y)] ^= 0xFF
+	}
+	b.Dirty = []image.Rectangle{image.Rect(12, 12, 16, 16)}
+	for _, rd := range redactions() {
+		rd.Regions = regions
+		p := frame.Process(&replay{a.Clone(), b.Clone()}, rd)
+		next(t, p)
+		out := next(t, p)
+		want := b.Clone()
+		refRedact(want, rd, regions)
+		if !bytes.Equal(out.Pix, want.Pix) {
+			t.Errorf("mode %d: frame differs from the reference", rd.Mode)
+		}
+	}
+}
+
+func TestRedactNeedsProcess(t *testing.T) {
+	rd := NewRedact(RedactFill, image.Rect(10, 10, 20, 20))
+	f := frame.New(100, 100)
+	if err := rd.Apply(f); err != nil {
+		t.Fatalf("full frame: %v", err)
+	}
+	f.Dirty = []image.Rectangle{}
+	if err := rd.Apply(f); err != nil {
+		t.Errorf("unchanged region: %v", err)
+	}
+	f.Dirty = []image.Rectangle{image.Rect(15, 15, 30, 30)}
+	if err := rd.Apply(f); err != errRedactRestore {
+		t.Errorf("damaged region outside frame.Process: %v, want errRedactRestore", err)
+	}
+}
@@ -0,0 +1,230 @@
+package frame
+
+import (
+	"errors"
+	"image"
+	"sort"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/cursor"
+)
+
+// ErrNoImageYet is returned by sources when no new frame arrived before the timeout.
+var ErrNoImageYet = errors.New("no image yet")
+
+// Frame is a captured BGRA image together with the metadata of its capture.
+type Frame struct {
+	// Pix holds BGRA pixels, Stride bytes per row.
+	Pix    []byte
+	Width  int
+	Height int
+	Stride int
+
+	// Dirty lists regions whose pixels changed since the previous frame, not
+	// including move destinations. A nil Dirty means the whole frame changed.
+	Dirty []image.Rectangle
+	// Moves lists regions copied within the frame since the previous frame.
+	Moves []Move
+
+	Cursor cursor.State
+	// Time is when the frame was presented on the output.
+	Time time.Time
+	// Seq increases by one for every frame produced by a source.
+	Seq    uint64
+	Output string
+	// Bounds is the output position in desktop coordinates.
+	Bounds image.Rectangle
+	// Protected reports that the output showed protected content, such as
+	// DRM video, which the system masked out, usually as black.
+	Protected bool
+
+	// marks records every region drawn through AddDirty, even on full frames.
+	marks []image.Rectangle
+	// drawn is the record of the previous pipeline run, see DrawnOver.
+	drawn map[*byte][]image.Rectangle
+	// restore copies unprocessed pixels back into Pix, see Restore.
+	restore func(r image.Rectangle)
+}
+
+// Move describes a region copied from Src to Dst, like DuplicationMoveRect.
+type Move struct {
+	Src image.Point
+	Dst image.Rectangle
+}
+
+// New returns a frame with a tightly packed pixel buffer.
+func New(width, height int) *Frame {
+	return &Frame{
+		Pix:    make([]byte, width*height*4),
+		Width:  width,
+		Height: height,
+		Stride: width * 4,
+	}
+}
+
+// Rect returns the frame rectangle.
+func (f *Frame) Rect() image.Rectangle {
+	return image.Rect(0, 0, f.Width, f.Height)
+}
+
+// Full reports whether the whole frame must be treated as changed.
+func (f *Frame) Full() bool {
+	return f.Dirty == nil
+}
+
+// Damage returns every changed region including move destinations,
+// or nil if the whole frame changed.
+func (f *Frame) Damage() []image.Rectangle {
+	if f.Dirty == nil {
+		return nil
+	}
+	damage := make([]image.Rectangle, 0, len(f.Dirty)+len(f.Moves))
+	damage = append(damage, f.Dirty...)
+	for _, m := range f.Moves {
+		damage = append(damage, m.Dst)
+	}
+	return damage
+}
+
+// AddDirty marks r as changed. Stages drawing into Pix must call it for every
+// region they modify, so incremental consumers and buffer owners see the change.
+func (f *Frame) AddDirty(r image.Rectangle) {
+	r = r.Intersect(f.Rect())
+	if r.Empty() {
+		return
+	}
+	f.marks = append(f.marks, r)
+	if f.Dirty != nil {
+		f.Dirty = append(f.Dirty, r)
+	}
+}
+
+// SetFull marks the whole frame as changed.
+func (f *Frame) SetFull() {
+	f.marks = append(f.marks, f.Rect())
+	f.Dirty = nil
+	f.Moves = nil
+}
+
+// DrawnOver returns the regions of pix that in-place stages drew over during
+// the previous pipeline run. Stages that own an output buffer use it to
+// re-render those regions before stages after them draw again.
+func (f *Frame) DrawnOver(pix []byte) []image.Rectangle {
+	if len(pix) == 0 {
+		return nil
+	}
+	return f.drawn[&pix[0]]
+}
+
+// Restore copies the pixels of r from the unprocessed source frame into Pix,
+// discarding anything earlier stages drew there, and marks r dirty without
+// recording it as drawn over. Stages whose output depends on state other than
+// the frame (e.g. the cursor position) use it to re-render from clean pixels.
+// It reports false if the frame is not being run through a Processor.
+func (f *Frame) Restore(r image.Rectangle) bool {
+	if f.restore == nil {
+		return false
+	}
+	r = r.Intersect(f.Rect())
+	if r.Empty() {
+		return true
+	}
+	f.restore(r)
+	if f.Dirty != nil {
+		f.Dirty = append(f.Dirty, r)
+	}
+	return true
+}
+
+// PixOffset returns the index of the first byte of pixel (x, y) in Pix.
+func (f *Frame) PixOffset(x, y int) int {
+	return y*f.Stride + x*4
+}
+
+// Clone returns a deep copy of the frame with a tightly packed buffer.
+func (f *Frame) Clone() *Frame {
+	c := *f
+	c.Pix = make([]byte, f.Width*f.Height*4)
+	c.Stride = f.Width * 4
+	CopyRect(c.Pix, c.Stride, f.Pix, f.Stride, f.Rect())
+	if f.Dirty != nil {
+		c.Dirty = append([]image.Rectangle{}, f.Dirty...)
+	}
+	c.Moves = append([]Move(nil), f.Moves...)
+	c.marks = nil
+	c.drawn = nil
+	c.restore = nil
+	return &c
+}
+
+// CopyRect copies the pixels of r between two BGRA buffers of the same size.
+func CopyRect(dst []byte, dstStride int, src []byte, srcStride int, r image.Rectangle) {
+	rowBytes := r.Dx() * 4
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		copy(dst[y*dstStride+r.Min.X*4:][:rowBytes], src[y*srcStride+r.Min.X*4:])
+	}
+}
+
+// Disjoint splits rects into non-overlapping rectangles covering the same area,
+// so every pixel is visited once.
+func Disjoint(rects []image.Rectangle) []image.Rectangle {
+	ys := make([]int, 0, len(rects)*2)
+	for _, r := range rects {
+		if !r.Empty() {
+			ys = append(ys, r.Min.Y, r.Max.Y)
+		}
+	}
+	if len(ys) == 0 {
+		return nil
+	}
+	sort.Ints(ys)
+
+	var out []image.Rectangle
+	type span struct{ x0, x1 int }
+	var spans []span
+	for i := 0; i+1 < len(ys); i++ {
+		y0, y1 := ys[i], ys[i+1]
+		if y0 == y1 {
+			continue
+		}
+		spans = spans[:0]
+		for _, r := range rects {
+			if !r.Empty() && r.Min.Y <= y0 && r.Max.Y >= y1 {
+				spans = append(spans, span{r.Min.X, r.Max.X})
+			}
+		}
+		sort.Slice(spans, func(a, b int) bool { return spans[a].x0 < spans[b].x0 })
+		for j := 0; j < len(spans); {
+			x0, x1 := spans[j].x0, spans[j].x1
+			for j++; j < len(spans) && spans[j].x0 <= x1; j++ {
+				x1 = max(x1, spans[j].x1)
+			}
+			band := image.Rect(x0, y0, x1, y1)
+			// Extend the rectangle above when it covers the same columns.
+			if n := len(out); n > 0 && out[n-1].Max.Y == y0 && out[n-1].Min.X == x0 && out[n-1].Max.X == x1 {
+				out[n-1].Max.Y = y1
+				continue
+			}
+			out = append(out, band)
+		}
+	}
+	return out
+}
+
+// Source produces frames. The returned frame and its buffer are owned by the
+// source and stay valid until the next call to GetFrame.
+type Source interface {
+	GetFrame(timeoutMs uint) (*Frame, error)
+}
+
+// Stage processes a frame, usually by drawing into its buffer.
+type Stage interface {
+	Apply(f *Frame) error
+}
+
+// StageFunc adapts a function to the Stage interface.
+type StageFunc func(f *Frame) error
+
+func (fn StageFunc) Apply(f *Frame) error {
+	return fn(f)
+}
@@ -0,0 +1,157 @@
+package frame
+
+import (
+	"image"
+	"sync"
+)
+
+// Pipeline applies stages in order and records which buffer regions in-place
+// stages drew over, so buffer owners can restore them on the next run.
+type Pipeline struct {
+	stages []Stage
+	drawn  map[*byte][]image.Rectangle
+}
+
+// NewPipeline returns a pipeline running the given stages.
+func NewPipeline(stages ...Stage) *Pipeline {
+	return &Pipeline{stages: stages}
+}
+
+// Add appends stages to the pipeline.
+func (p *Pipeline) Add(stages ...Stage) {
+	p.stages = append(p.stages, stages...)
+}
+
+// Len returns the number of stages.
+func (p *Pipeline) Len() int {
+	return len(p.stages)
+}
+
+// Apply runs every stage on f. It stops at the first stage returning an error.
+func (p *Pipeline) Apply(f *Frame) error {
+	f.drawn = p.drawn
+	f.marks = f.marks[:0]
+	drawn := make(map[*byte][]image.Rectangle)
+	defer func() {
+		p.drawn = drawn
+		f.drawn = nil
+	}()
+
+	for _, s := range p.stages {
+		key := bufferKey(f.Pix)
+		start := len(f.marks)
+		err := s.Apply(f)
+		// A stage that switched to its own buffer rendered it completely,
+		// only stages drawing in place leave marks to restore.
+		if key != nil && bufferKey(f.Pix) == key && start <= len(f.marks) {
+			drawn[key] = append(drawn[key], f.marks[start:]...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DrawnOver returns the regions of pix that in-place stages drew over during
+// the last Apply.
+func (p *Pipeline) DrawnOver(pix []byte) []image.Rectangle {
+	key := bufferKey(pix)
+	if key == nil {
+		return nil
+	}
+	return p.drawn[key]
+}
+
+func bufferKey(pix []byte) *byte {
+	if len(pix) == 0 {
+		return nil
+	}
+	return &pix[0]
+}
+
+// Processor is a Source applying a pipeline to the frames of another source.
+// Frames are copied into a buffer owned by the processor, so the wrapped
+// source's buffer stays clean and only changed regions are copied.
+type Processor struct {
+	mu       sync.Mutex
+	src      Source
+	pipeline *Pipeline
+	buf      []byte
+	width    int
+	height   int
+	out      Frame
+}
+
+// Process returns a source that applies stages to the frames of src.
+func Process(src Source, stages ...Stage) *Processor {
+	return &Processor{
+		src:      src,
+		pipeline: NewPipeline(stages...),
+	}
+}
+
+// Use appends stages to the processor.
+func (p *Processor) Use(stages ...Stage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pipeline.Add(stages...)
+}
+
+// GetFrame returns the next frame of the wrapped source after running the stages.
+// A stage error discards the frame and is returned as is.
+func (p *Processor) GetFrame(timeoutMs uint) (*Frame, error) {
+	in, err := p.src.GetFrame(timeoutMs)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	full := in.Full()
+	if p.buf == nil || p.width != in.Width || p.height != in.Height {
+		p.buf = make([]byte, in.Width*in.Height*4)
+		p.width, p.height = in.Width, in.Height
+		full = true
+	}
+	restore := p.pipeline.DrawnOver(p.buf)
+
+	out := &p.out
+	*out = Frame{
+		Pix:       p.buf,
+		Width:     in.Width,
+		Height:    in.Height,
+		Stride:    in.Width * 4,
+		Moves:     append(out.Moves[:0], in.Moves...),
+		Cursor:    in.Cursor,
+		Time:      in.Time,
+		Seq:       in.Seq,
+		Output:    in.Output,
+		Bounds:    in.Bounds,
+		Protected: in.Protected,
+		marks:     out.marks,
+	}
+	out.restore = func(r image.Rectangle) {
+		CopyRect(out.Pix, out.Stride, in.Pix, in.Stride, r)
+	}
+	if full {
+		CopyRect(out.Pix, out.Stride, in.Pix, in.Stride, in.Rect())
+		out.Moves = out.Moves[:0]
+	} else {
+		out.Dirty = append(make([]image.Rectangle, 0, len(in.Dirty)+len(restore)), in.Dirty...)
+		for _, r := range in.Damage() {
+			CopyRect(out.Pix, out.Stride, in.Pix, in.Stride, r.Intersect(in.Rect()))
+		}
+		for _, r := range restore {
+			r = r.Intersect(in.Rect())
+			CopyRect(out.Pix, out.Stride, in.Pix, in.Stride, r)
+			out.Dirty = append(out.Dirty, r)
+		}
+	}
+
+	if err := p.pipeline.Apply(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,384 @@
+// Package jpegenc encodes BGRA frames as baseline JPEG without converting
+// them to an image.Image first.
+package jpegenc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Subsampling selects the chroma resolution.
+type Subsampling int
+
+const (
+	// Subsample444 keeps full chroma resolution, best for text and UI.
+	Subsample444 Subsampling = iota
+	// Subsample422 halves chroma horizontally.
+	Subsample422
+	// Subsample420 halves chroma in both directions, smallest output.
+	Subsample420
+)
+
+func (s Subsampling) String() string {
+	switch s {
+	case Subsample444:
+		return "4:4:4"
+	case Subsample422:
+		return "4:2:2"
+	case Subsample420:
+		return "4:2:0"
+	default:
+		return "unknown"
+	}
+}
+
+// DefaultQuality is used when Options.Quality is 0.
+const DefaultQuality = 85
+
+// Options configures the encoder. A nil *Options uses the defaults.
+type Options struct {
+	// Quality ranges from 1 to 100.
+	Quality     int
+	Subsampling Subsampling
+}
+
+// Encoder holds the scaled tables for one quality setting, so they can be
+// reused across frames. It is safe for concurrent use.
+type Encoder struct {
+	quality     int
+	subsampling Subsampling
+	quant       [2][64]byte
+	// divisors fold quantization and the AAN output scaling, natural order.
+	divisors [2][64]float32
+	huff     [4]huffLUT
+}
+
+// huffLUT maps a symbol to its code length (high byte) and code.
+type huffLUT [256]uint32
+
+// NewEncoder returns an encoder for the options.
+func NewEncoder(opts *Options) (*Encoder, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.Quality == 0 {
+		o.Quality = DefaultQuality
+	}
+	if o.Quality < 1 || o.Quality > 100 {
+		return nil, fmt.Errorf("jpegenc: quality %d out of range", o.Quality)
+	}
+	if o.Subsampling < Subsample444 || o.Subsampling > Subsample420 {
+		return nil, fmt.Errorf("jpegenc: unknown subsampling %d", o.Subsampling)
+	}
+
+	e := &Encoder{quality: o.Quality, subsampling: o.Subsampling}
+	scale := 200 - 2*o.Quality
+	if o.Quality < 50 {
+		scale = 5000 / o.Quality
+	}
+	for t := range e.quant {
+		for i, v := range baseQuant[t] {
+			q := (int(v)*scale + 50) / 100
+			e.quant[t][i] = byte(min(max(q, 1), 255))
+			row, col := i/8, i%8
+			e.divisors[t][i] = float32(1 / (float64(e.quant[t][i]) * aanScale[row] * aanScale[col] * 8))
+		}
+	}
+	for i, spec := range stdHuffman {
+		code, k := uint32(0), 0
+		for n, count := range spec.count {
+			for j := 0; j < int(count); j++ {
+				e.huff[i][spec.value[k]] = uint32(n+1)<<24 | code
+				code++
+				k++
+			}
+			code <<= 1
+		}
+	}
+	return e, nil
+}
+
+// aanScale are the output scale factors of the AAN forward DCT.
+var aanScale = func() [8]float64 {
+	var s [8]float64
+	s[0] = 1
+	for k := 1; k < 8; k++ {
+		s[k] = math.Cos(float64(k)*math.Pi/16) * math.Sqrt2
+	}
+	return s
+}()
+
+// Encode writes the width x height BGRA image in pix as JPEG.
+func Encode(w io.Writer, pix []byte, width, height, stride int, opts *Options) error {
+	e, err := NewEncoder(opts)
+	if err != nil {
+		return err
+	}
+	return e.Encode(w, pix, width, height, stride)
+}
+
+// Encode writes the width x height BGRA image in pix as JPEG.
+func (e *Encoder) Encode(w io.Writer, pix []byte, width, height, stride int) error {
+	if width <= 0 || height <= 0 || width > 0xFFFF || height > 0xFFFF {
+		return fmt.Errorf("jpegenc: invalid image size %dx%d", width, height)
+	}
+	if len(pix) < (height-1)*stride+width*4 {
+		return fmt.Errorf("jpegenc: buffer too small for %dx%d", width, height)
+	}
+
+	bw := bufio.NewWriterSize(w, 64*1024)
+	e.writeHeaders(bw, width, height)
+
+	hs, vs := 1, 1
+	switch e.subsampling {
+	case Subsample422:
+		hs = 2
+	case Subsample420:
+		hs, vs = 2, 2
+	}
+	mcuW, mcuH := 8*hs, 8*vs
+
+	s := scanWriter{w: bw}
+	var prevDC [3]int
+	var y [4][64]float32
+	var cb, cr [64]float32
+	var mcu [16 * 16 * 3]float32
+
+	for my := 0; my < height; my += mcuH {
+		for mx := 0; mx < width; mx += mcuW {
+			// Convert the MCU to YCbCr, replicating edge pixels.
+			for j := 0; j < mcuH; j++ {
+				row := pix[min(my+j, height-1)*stride:]
+				for i := 0; i < mcuW; i++ {
+					p := row[min(mx+i, width-1)*4:]
+					b, g, r := float32(p[0]), float32(p[1]), float32(p[2])
+					o := (j*mcuW + i) * 3
+					mcu[o] = 0.299*r + 0.587*g + 0.114*b - 128
+					mcu[o+1] = -0.168736*r - 0.331264*g + 0.5*b
+					mcu[o+2] = 0.5*r - 0.418688*g - 0.081312*b
+				}
+			}
+
+			for by := 0; by < vs; by++ {
+				for bx := 0; bx < hs; bx++ {
+					blk := &y[by*hs+bx]
+					for j := 0; j < 8; j++ {
+						for i := 0; i < 8; i++ {
+							blk[j*8+i] = mcu[((by*8+j)*mcuW+bx*8+i)*3]
+						}
+					}
+				}
+			}
+			// Average each hs x vs group of chroma samples.
+			inv := 1 / float32(hs*vs)
+			for j := 0; j < 8; j++ {
+				for i := 0; i < 8; i++ {
+					var sb, sr float32
+					for dy := 0; dy < vs; dy++ {
+						for dx := 0; dx < hs; dx++ {
+							o := ((j*vs+dy)*mcuW + i*hs + dx) * 3
+							sb += mcu[o+1]
+							sr += mcu[o+2]
+						}
+					}
+					cb[j*8+i] = sb * inv
+					cr[j*8+i] = sr * inv
+				}
+			}
+
+			for k := 0; k < hs*vs; k++ {
+				prevDC[0] = e.writeBlock(&s, &y[k], 0, prevDC[0])
+			}
+			prevDC[1] = e.writeBlock(&s, &cb, 1, prevDC[1])
+			prevDC[2] = e.writeBlock(&s, &cr, 1, prevDC[2])
+			if s.err != nil {
+				return s.err
+			}
+		}
+	}
+	s.pad()
+	if s.err != nil {
+		return s.err
+	}
+	if _, err := bw.Write([]byte{0xFF, 0xD9}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (e *Encoder) writeHeaders(w *bufio.Writer, width, height int) {
+	segment := func(marker byte, data []byte) {
+		w.Write([]byte{0xFF, marker, byte((len(data) + 2) >> 8), byte(len(data) + 2)})
+		w.Write(data)
+	}
+	w.Write([]byte{0xFF, 0xD8})
+	segment(0xE0, []byte{'J', 'F', 'I', 'F', 0, 1, 1, 0, 0, 1, 0, 1, 0, 0})
+
+	dqt := make([]byte, 0, 2*65)
+	for t := range e.quant {
+		dqt = append(dqt, byte(t))
+		for _, n := range zigzag {
+			dqt = append(dqt, e.quant[t][n])
+		}
+	}
+	segment(0xDB, dqt)
+
+	sampling := byte(0x11)
+	switch e.subsampling {
+	case Subsample422:
+		sampling = 0x21
+	case Subsample420:
+		sampling = 0x22
+	}
+	segment(0xC0, []byte{
+		8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), 3,
+		1, sampling, 0,
+		2, 0x11, 1,
+		3, 0x11, 1,
+	})
+
+	var dht []byte
+	for i, spec := range stdHuffman {
+		// Class (DC=0, AC=1) in the high nibble, table id in the low nibble.
+		dht = append(dht, byte((i%2)<<4|i/2))
+		dht = append(dht, spec.count[:]...)
+		dht = append(dht, spec.value...)
+	}
+	segment(0xC4, dht)
+
+	segment(0xDA, []byte{3, 1, 0x00, 2, 0x11, 3, 0x11, 0, 63, 0})
+}
+
+// writeBlock transforms, quantizes and entropy codes one block, returning its DC value.
+func (e *Encoder) writeBlock(s *scanWriter, blk *[64]float32, table, prevDC int) int {
+	fdct(blk)
+	div := &e.divisors[table]
+	var q [64]int32
+	for i := range q {
+		v := blk[zigzag[i]] * div[zigzag[i]]
+		if v < 0 {
+			q[i] = int32(v - 0.5)
+		} else {
+			q[i] = int32(v + 0.5)
+		}
+	}
+
+	dcTable, acTable := &e.huff[table*2], &e.huff[table*2+1]
+	dc := int(q[0])
+	s.emitValue(dcTable, 0, int32(dc-prevDC))
+
+	run := 0
+	for i := 1; i < 64; i++ {
+		if q[i] == 0 {
+			run++
+			continue
+		}
+		for run > 15 {
+			s.emitCode(acTable[0xF0])
+			run -= 16
+		}
+		s.emitValue(acTable, run, q[i])
+		run = 0
+	}
+	if run > 0 {
+		s.emitCode(acTable[0x00])
+	}
+	return dc
+}
+
+// fdct is the AAN float forward DCT; outputs are scaled by aanScale and 8.
+func fdct(d *[64]float32) {
+	for pass := 0; pass < 2; pass++ {
+		step, next := 1, 8
+		if pass == 1 {
+			step, next = 8, 1
+		}
+		for k := 0; k < 8; k++ {
+			o := k * next
+			d0, d1, d2, d3 := d[o], d[o+step], d[o+2*step], d[o+3*step]
+			d4, d5, d6, d7 := d[o+4*step], d[o+5*step], d[o+6*step], d[o+7*step]
+
+			tmp0, tmp7 := d0+d7, d0-d7
+			tmp1, tmp6 := d1+d6, d1-d6
+			tmp2, tmp5 := d2+d5, d2-d5
+			tmp3, tmp4 := d3+d4, d3-d4
+
+			tmp10, tmp13 := tmp0+tmp3, tmp0-tmp3
+			tmp11, tmp12 := tmp1+tmp2, tmp1-tmp2
+			d[o] = tmp10 + tmp11
+			d[o+4*step] = tmp10 - tmp11
+			z1 := (tmp12 + tmp13) * 0.707106781
+			d[o+2*step] = tmp13 + z1
+			d[o+6*step] = tmp13 - z1
+
+			tmp10 = tmp4 + tmp5
+			tmp11 = tmp5 + tmp6
+			tmp12 = tmp6 + tmp7
+			z5 := (tmp10 - tmp12) * 0.382683433
+			z2 := 0.541196100*tmp10 + z5
+			z4 := 1.306562965*tmp12 + z5
+			z3 := tmp11 * 0.707106781
+			z11, z13 := tmp7+z3, tmp7-z3
+			d[o+5*step] = z13 + z2
+			d[o+3*step] = z13 - z2
+			d[o+step] = z11 + z4
+			d[o+7*step] = z11 - z4
+		}
+	}
+}
+
+// scanWriter packs entropy-coded bits, stuffing a zero after every 0xFF byte.
+type scanWriter struct {
+	w     *bufio.Writer
+	bits  uint32
+	nBits uint32
+	err   error
+}
+
+func (s *scanWriter) emit(bits, n uint32) {
+	n += s.nBits
+	bits <<= 32 - n
+	bits |= s.bits
+	for n >= 8 {
+		b := byte(bits >> 24)
+		if s.err == nil {
+			s.err = s.w.WriteByte(b)
+			if b == 0xFF && s.err == nil {
+				s.err = s.w.WriteByte(0)
+			}
+		}
+		bits <<= 8
+		n -= 8
+	}
+	s.bits, s.nBits = bits, n
+}
+
+func (s *scanWriter) emitCode(code uint32) {
+	s.emit(code&0xFFFF, code>>24)
+}
+
+// emitValue writes the symbol for run and the magnitude category of v,
+// followed by the value bits.
+func (s *scanWriter) emitValue(table *huffLUT, run int, v int32) {
+	a, b := v, v
+	if a < 0 {
+		a, b = -v, v-1
+	}
+	size := uint32(0)
+	for a > 0 {
+		size++
+		a >>= 1
+	}
+	s.emitCode(table[uint32(run)<<4|size])
+	if size > 0 {
+		s.emit(uint32(b)&(1<<size-1), size)
+	}
+}
+
+// pad fills the last byte with one bits.
+func (s *scanWriter) pad() {
+	s.emit(0x7F, 7)
+}
@@ -0,0 +1,173 @@
+package jpegenc
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// testImage returns a width x height BGRA image with stride bytes per row:
+// smooth gradients, optionally with a flat square of a different hue in the
+// middle.
+func testImage(width, height, stride int, square bool) []byte {
+	pix := make([]byte, stride*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := []byte{byte(x * 3), byte(y * 3), byte(128 + x - y), 0xFF}
+			if square && x > width/3 && x < 2*width/3 && y > height/3 && y < 2*height/3 {
+				p = []byte{40, 160, 220, 0xFF}
+			}
+			copy(pix[y*stride+x*4:], p)
+		}
+	}
+	return pix
+}
+
+// meanError returns the mean and maximum channel difference between the
+// decoded image and the BGRA pixels.
+func meanError(img image.Image, pix []byte, width, height, stride int) (float64, int) {
+	sum, worst := 0, 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := pix[y*stride+x*4:]
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			for i, v := range []byte{c.B, c.G, c.R} {
+				d := int(v) - int(p[i])
+				if d < 0 {
+					d = -d
+				}
+				sum += d
+				worst = max(worst, d)
+			}
+		}
+	}
+	return float64(sum) / float64(width*height*3), worst
+}
+
+// segment returns the payload of the first marker segment in a JPEG file.
+func segment(t *testing.T, b []byte, marker byte) []byte {
+	t.Helper()
+	for i := 2; i+4 <= len(b) && b[i] == 0xFF; {
+		n := int(b[i+2])<<8 | int(b[i+3])
+		if b[i+1] == marker {
+			return b[i+4 : i+2+n]
+		}
+		if b[i+1] == 0xDA {
+			break
+		}
+		i += 2 + n
+	}
+	t.Fatalf("no %02X segment", marker)
+	return nil
+}
+
+func TestEncode(t *testing.T) {
+	sizes := []struct{ width, height, stride int }{
+		{1, 1, 4},
+		{8, 8, 32},
+		{17, 9, 17*4 + 8},
+		{67, 45, 67 * 4},
+	}
+	for _, sub := range []Subsampling{Subsample444, Subsample422, Subsample420} {
+		for _, sz := range sizes {
+			// Subsampled chroma cannot follow the square's hard edges.
+			pix := testImage(sz.width, sz.height, sz.stride, sub == Subsample444)
+			var buf bytes.Buffer
+			if err := Encode(&buf, pix, sz.width, sz.height, sz.stride, &Options{Quality: 95, Subsampling: sub}); err != nil {
+				t.Fatal(err)
+			}
+			sof := segment(t, buf.Bytes(), 0xC0)
+			if want := []byte{0x11, 0x21, 0x22}[sub]; sof[7] != want || sof[10] != 0x11 || sof[13] != 0x11 {
+				t.Errorf("%v: sampling factors %02x %02x %02x", sub, sof[7], sof[10], sof[13])
+			}
+			img, err := jpeg.Decode(&buf)
+			if err != nil {
+				t.Fatalf("%v %dx%d: %v", sub, sz.width, sz.height, err)
+			}
+			if b := img.Bounds(); b != image.Rect(0, 0, sz.width, sz.height) {
+				t.Fatalf("%v: decoded bounds %v", sub, b)
+			}
+			if mean, worst := meanError(img, pix, sz.width, sz.height, sz.stride); mean > 3 || worst > 40 {
+				t.Errorf("%v %dx%d: mean error %.2f, worst %d", sub, sz.width, sz.height, mean, worst)
+			}
+		}
+	}
+}
+
+func TestQuality(t *testing.T) {
+	noise := make([]byte, 64*64*4)
+	rand.New(rand.NewSource(1)).Read(noise)
+	prevSize, prevErr := 0, 1e9
+	for _, q := range []int{10, 50, 90, 100} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, noise, 64, 64, 64*4, &Options{Quality: q}); err != nil {
+			t.Fatal(err)
+		}
+		size := buf.Len()
+		img, err := jpeg.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mean, _ := meanError(img, noise, 64, 64, 64*4)
+		if size <= prevSize || mean >= prevErr {
+			t.Errorf("quality %d: %d bytes, mean error %.1f after %d bytes, %.1f", q, size, mean, prevSize, prevErr)
+		}
+		prevSize, prevErr = size, mean
+	}
+
+	// Quality 50 uses the tables of the JPEG specification as they are.
+	var buf bytes.Buffer
+	Encode(&buf, noise, 8, 8, 64*4, &Options{Quality: 50})
+	dqt := segment(t, buf.Bytes(), 0xDB)
+	for tbl := 0; tbl < 2; tbl++ {
+		if dqt[tbl*65] != byte(tbl) {
+			t.Fatalf("table %d has id %d", tbl, dqt[tbl*65])
+		}
+		for i, n := range zigzag {
+			if v := dqt[tbl*65+1+i]; v != baseQuant[tbl][n] {
+				t.Errorf("table %d entry %d is %d, want %d", tbl, n, v, baseQuant[tbl][n])
+			}
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, opts := range []*Options{{Quality: -1}, {Quality: 101}, {Subsampling: 3}, {Subsampling: -1}} {
+		if _, err := NewEncoder(opts); err == nil {
+			t.Errorf("NewEncoder accepted %+v", *opts)
+		}
+	}
+	pix := make([]byte, 16*16*4)
+	for _, sz := range []struct{ width, height, stride int }{{0, 16, 64}, {16, -1, 64}, {0x10000, 1, 0x40000}, {16, 17, 64}} {
+		if err := Encode(&bytes.Buffer{}, pix, sz.width, sz.height, sz.stride, nil); err == nil {
+			t.Errorf("encoded %dx%d from %d bytes", sz.width, sz.height, len(pix))
+		}
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	e, err := NewEncoder(&Options{Subsampling: Subsample420})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pix := testImage(40, 30, 160, true)
+	var want bytes.Buffer
+	e.Encode(&want, pix, 40, 30, 160)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf bytes.Buffer
+			if err := e.Encode(&buf, pix, 40, 30, 160); err != nil || !bytes.Equal(buf.Bytes(), want.Bytes()) {
+				t.Errorf("concurrent encode differs: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,401 @@
+// Package mjpeg serves frames from a source as a Motion-JPEG stream over HTTP.
+package mjpeg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/jpegenc"
+)
+
+// DefaultFPS is the capture rate used when Options.FPS is 0.
+const DefaultFPS = 30
+
+// Options configures a Server. A nil *Options uses the defaults.
+type Options struct {
+	// FPS is the highest frame rate a client can ask for. Defaults to DefaultFPS.
+	FPS int
+	// Quality is the JPEG quality for clients that do not ask for one.
+	// 0 means jpegenc.DefaultQuality.
+	Quality     int
+	Subsampling jpegenc.Subsampling
+}
+
+// Server is an http.Handler streaming the frames of a source as
+// multipart/x-mixed-replace JPEG, which browsers show in an <img> tag.
+//
+// Requests whose path ends in "snapshot" or "snapshot.jpg" get a single JPEG;
+// all others get the stream. Both accept the query parameters "fps" (stream
+// only, may be fractional) and "quality" (1 to 100).
+//
+// The source is only read while clients are connected, by a single goroutine
+// running at the highest rate any client asked for. Each frame is encoded
+// once per distinct quality, however many clients watch it.
+type Server struct {
+	src  frame.Source
+	opts Options
+
+	mu       sync.Mutex
+	clients  map[*client]struct{}
+	running  bool
+	encoders map[int]*jpegenc.Encoder
+	// jpegs holds the current frame encoded at the qualities clients asked
+	// for. It is replaced, never modified, when a frame is encoded.
+	jpegs map[int][]byte
+	seq   uint64
+	err   error
+	// update is closed and replaced whenever jpegs or err change.
+	update chan struct{}
+
+	// Owned by the capture goroutine. The canvas is kept while capture is
+	// stopped: sources report the damage accumulated meanwhile with the next
+	// frame, and an idle source sends none at all.
+	canvas        []byte
+	width, height int
+}
+
+type client struct {
+	quality int
+	fps     float64
+}
+
+// New returns a server streaming the frames of src. The server becomes the
+// only reader of src.
+func New(src frame.Source, opts *Options) (*Server, error) {
+	s := &Server{
+		src:      src,
+		clients:  make(map[*client]struct{}),
+		encoders: make(map[int]*jpegenc.Encoder),
+		update:   make(chan struct{}),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.FPS <= 0 {
+		s.opts.FPS = DefaultFPS
+	}
+	if s.opts.Quality == 0 {
+		s.opts.Quality = jpegenc.DefaultQuality
+	}
+	// Validates quality and subsampling.
+	if _, err := s.encoder(s.opts.Quality); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Server) encoder(quality int) (*jpegenc.Encoder, error) {
+	if e, ok := s.encoders[quality]; ok {
+		return e, nil
+	}
+	e, err := jpegenc.NewEncoder(&jpegenc.Options{Quality: quality, Subsampling: s.opts.Subsampling})
+	if err != nil {
+		return nil, err
+	}
+	s.encoders[quality] = e
+	return e, nil
+}
+
+// Clients returns the number of connected stream and snapshot clients.
+func (s *Server) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path.Base(r.URL.Path) {
+	case "snapshot", "snapshot.jpg":
+		s.ServeSnapshot(w, r)
+	default:
+		s.ServeStream(w, r)
+	}
+}
+
+// parseQuery returns the client settings from the request's query parameters.
+func (s *Server) parseQuery(r *http.Request) (*client, error) {
+	c := &client{quality: s.opts.Quality, fps: float64(s.opts.FPS)}
+	q := r.URL.Query()
+	if v := q.Get("quality"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			return nil, fmt.Errorf("invalid quality %q", v)
+		}
+		c.quality = n
+	}
+	if v := q.Get("fps"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(n > 0) {
+			return nil, fmt.Errorf("invalid fps %q", v)
+		}
+		c.fps = min(n, float64(s.opts.FPS))
+	}
+	return c, nil
+}
+
+// ServeStream streams frames until the client disconnects or the source fails.
+func (s *Server) ServeStream(w http.ResponseWriter, r *http.Request) {
+	c, err := s.parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	s.join(c)
+	defer s.leave(c)
+
+	mw := multipart.NewWriter(w)
+	h := w.Header()
+	h.Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+	h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	h.Set("Pragma", "no-cache")
+
+	interval := time.Duration(float64(time.Second) / c.fps)
+	var seq uint64
+	for {
+		img, n, err := s.wait(r.Context(), c.quality, seq)
+		if err != nil {
+			// Headers are already sent once a part was written; ending the
+			// response is all that is left.
+			if seq == 0 && r.Context().Err() == nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			}
+			return
+		}
+		seq = n
+		next := time.Now().Add(interval)
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":   {"image/jpeg"},
+			"Content-Length": {strconv.Itoa(len(img))},
+		})
+		if err != nil {
+			return
+		}
+		if _, err := part.Write(img); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		// Pace the client; frames captured in between are skipped.
+		if wait := time.Until(next); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-r.Context().Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+		}
+	}
+}
+
+// ServeSnapshot responds with the current frame as a single JPEG.
+func (s *Server) ServeSnapshot(w http.ResponseWriter, r *http.Request) {
+	c, err := s.parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.join(c)
+	img, _, err := s.wait(r.Context(), c.quality, 0)
+	s.leave(c)
+	if err != nil {
+		if r.Context().Err() == nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "image/jpeg")
+	h.Set("Content-Length", strconv.Itoa(len(img)))
+	h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Write(img)
+}
+
+// join registers a client and starts capturing if it is the first one.
+func (s *Server) join(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c] = struct{}{}
+	if !s.running {
+		s.running = true
+		s.err = nil
+		go s.capture()
+	}
+}
+
+func (s *Server) leave(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, c)
+}
+
+// wait returns the current frame at the given quality once its sequence
+// number is past after.
+func (s *Server) wait(ctx context.Context, quality int, after uint64) ([]byte, uint64, error) {
+	for {
+		s.mu.Lock()
+		img, ok := s.jpegs[quality]
+		seq, err, update := s.seq, s.err, s.update
+		s.mu.Unlock()
+		if ok && seq > after {
+			return img, seq, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-update:
+		}
+	}
+}
+
+// notify wakes the waiting clients. The caller holds s.mu.
+func (s *Server) notify() {
+	close(s.update)
+	s.update = make(chan struct{})
+}
+
+// errNoClients ends the capture goroutine.
+var errNoClients = errors.New("mjpeg: no clients")
+
+// capture reads the source while clients are connected.
+func (s *Server) capture() {
+	for {
+		interval, qualities, err := s.demand()
+		if err != nil {
+			return
+		}
+		timeoutMs := uint(interval / time.Millisecond)
+		f, err := s.src.GetFrame(timeoutMs)
+		// Pace from the frame's arrival rather than a fixed clock, which would
+		// drift against the source's own rate and drop frames.
+		next := time.Now().Add(interval)
+		got := err == nil
+		switch {
+		case got:
+			s.store(f)
+			err = s.encode(qualities, true)
+		case errors.Is(err, frame.ErrNoImageYet):
+			// Clients that joined since the last frame still need it at
+			// their quality.
+			err = s.encode(qualities, false)
+		}
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.running = false
+			s.notify()
+			s.mu.Unlock()
+			return
+		}
+
+		// After ErrNoImageYet the source already waited a full interval.
+		if got {
+			time.Sleep(time.Until(next))
+		}
+	}
+}
+
+// demand returns the capture interval and the qualities clients ask for. It
+// returns errNoClients, and marks capture as stopped, when nobody is left.
+func (s *Server) demand() (time.Duration, []int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.clients) == 0 {
+		s.running = false
+		s.jpegs = nil
+		return 0, nil, errNoClients
+	}
+	fps := 0.0
+	seen := make(map[int]bool)
+	var qualities []int
+	for c := range s.clients {
+		fps = max(fps, c.fps)
+		if !seen[c.quality] {
+			seen[c.quality] = true
+			qualities = append(qualities, c.quality)
+		}
+	}
+	return time.Duration(float64(time.Second) / fps), qualities, nil
+}
+
+// store updates the server's copy of the frame. Only the damaged regions are
+// copied, so the copy stays valid after the source reuses its buffer.
+func (s *Server) store(f *frame.Frame) {
+	if s.canvas == nil || s.width != f.Width || s.height != f.Height {
+		s.width, s.height = f.Width, f.Height
+		s.canvas = make([]byte, f.Width*f.Height*4)
+		frame.CopyRect(s.canvas, f.Width*4, f.Pix, f.Stride, f.Rect())
+		return
+	}
+	damage := f.Damage()
+	if damage == nil {
+		damage = []image.Rectangle{f.Rect()}
+	}
+	for _, r := range damage {
+		frame.CopyRect(s.canvas, f.Width*4, f.Pix, f.Stride, r.Intersect(f.Rect()))
+	}
+}
+
+// encode encodes the canvas at the given qualities. For a new frame all of
+// them are encoded and the sequence number advances; otherwise only those
+// missing from the current frame are added.
+func (s *Server) encode(qualities []int, fresh bool) error {
+	if s.canvas == nil {
+		return nil
+	}
+	s.mu.Lock()
+	old := s.jpegs
+	s.mu.Unlock()
+
+	jpegs := make(map[int][]byte, len(qualities))
+	added := false
+	for _, q := range qualities {
+		if !fresh {
+			if img, ok := old[q]; ok {
+				jpegs[q] = img
+				continue
+			}
+		}
+		s.mu.Lock()
+		e, err := s.encoder(q)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := e.Encode(&buf, s.canvas, s.width, s.height, s.width*4); err != nil {
+			return err
+		}
+		jpegs[q] = buf.Bytes()
+		added = true
+	}
+	if !added {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jpegs = jpegs
+	if fresh {
+		s.seq++
+	}
+	s.notify()
+	return nil
+}
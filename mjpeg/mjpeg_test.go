@@ -0,0 +1,158 @@
+package mjpeg
+
+import (
+	"bytes"
+	"context"
+	"image/jpeg"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/synth"
+)
+
+func newTestServer(t *testing.T, opts synth.Options) *httptest.Server {
+	t.Helper()
+	s, err := New(synth.New(opts), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func get(t *testing.T, url string) *http.Response {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// waitIdle waits until the server has no clients and capture has stopped.
+func waitIdle(t *testing.T, ts *httptest.Server) {
+	t.Helper()
+	s := ts.Config.Handler.(*Server)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.Lock()
+		running := s.running
+		s.mu.Unlock()
+		if !running {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("capture did not stop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// nextPart returns the body of the next part of a stream. It reads exactly
+// Content-Length bytes: the closing boundary only follows with the next frame.
+func nextPart(t *testing.T, mr *multipart.Reader) []byte {
+	t.Helper()
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("reading part: %v", err)
+	}
+	if ct := part.Header.Get("Content-Type"); ct != "image/jpeg" {
+		t.Fatalf("part Content-Type %q", ct)
+	}
+	n, err := strconv.Atoi(part.Header.Get("Content-Length"))
+	if err != nil {
+		t.Fatalf("part Content-Length: %v", err)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(part, data); err != nil {
+		t.Fatalf("reading part: %v", err)
+	}
+	return data
+}
+
+func checkJPEG(t *testing.T, data []byte, width, height int) {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decoding JPEG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != width || b.Dy() != height {
+		t.Fatalf("JPEG is %dx%d, want %dx%d", b.Dx(), b.Dy(), width, height)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	// A static source only sends its first frame, like an idle desktop, so
+	// later snapshots must be served from the kept canvas.
+	ts := newTestServer(t, synth.Options{Width: 64, Height: 48, Static: true})
+	for i := 0; i < 3; i++ {
+		resp := get(t, ts.URL+"/snapshot.jpg?quality=70")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("snapshot %d: status %s", i, resp.Status)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "image/jpeg" {
+			t.Fatalf("snapshot %d: Content-Type %q", i, ct)
+		}
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("snapshot %d: %v", i, err)
+		}
+		checkJPEG(t, data, 64, 48)
+		resp.Body.Close()
+		waitIdle(t, ts)
+	}
+}
+
+func TestSnapshotBadQuery(t *testing.T) {
+	ts := newTestServer(t, synth.Options{Width: 64, Height: 48})
+	for _, q := range []string{"quality=0", "quality=101", "quality=x", "fps=0", "fps=-1"} {
+		resp := get(t, ts.URL+"/snapshot?"+q)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %s, want 400", q, resp.Status)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	ts := newTestServer(t, synth.Options{Width: 64, Height: 48, FPS: 60})
+	resp := get(t, ts.URL+"/stream?fps=30")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %s", resp.Status)
+	}
+	mt, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/x-mixed-replace" {
+		t.Fatalf("Content-Type %q", resp.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for i := 0; i < 3; i++ {
+		checkJPEG(t, nextPart(t, mr), 64, 48)
+	}
+}
+
+func TestStreamReconnect(t *testing.T) {
+	ts := newTestServer(t, synth.Options{Width: 64, Height: 48, Static: true})
+	for i := 0; i < 2; i++ {
+		resp := get(t, ts.URL+"/stream")
+		_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkJPEG(t, nextPart(t, multipart.NewReader(resp.Body, params["boundary"])), 64, 48)
+		resp.Body.Close()
+		waitIdle(t, ts)
+	}
+}
@@ -0,0 +1,201 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// startBox writes a box header with a placeholder size and returns the
+// box's position for endBox.
+func startBox(b *bytes.Buffer, typ string) int {
+	at := b.Len()
+	put32(b, 0)
+	b.WriteString(typ)
+	return at
+}
+
+func startFullBox(b *bytes.Buffer, typ string, version uint8, flags uint32) int {
+	at := startBox(b, typ)
+	put32(b, uint32(version)<<24|flags)
+	return at
+}
+
+func endBox(b *bytes.Buffer, at int) {
+	binary.BigEndian.PutUint32(b.Bytes()[at:], uint32(b.Len()-at))
+}
+
+func put16(b *bytes.Buffer, v uint16) {
+	b.Write(binary.BigEndian.AppendUint16(nil, v))
+}
+
+func put32(b *bytes.Buffer, v uint32) {
+	b.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func put64(b *bytes.Buffer, v uint64) {
+	b.Write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+// unityMatrix is the identity transformation of mvhd and tkhd.
+var unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+// writeInit writes ftyp and moov for a single video track without samples;
+// the samples follow in fragments.
+func writeInit(b *bytes.Buffer, codec Codec, width, height int, sampleEntry []byte) {
+	ftyp := startBox(b, "ftyp")
+	b.WriteString("isom")
+	put32(b, 0x200)
+	b.WriteString("isomiso5iso6mp41")
+	if codec == H264 {
+		b.WriteString("avc1")
+	}
+	endBox(b, ftyp)
+
+	moov := startBox(b, "moov")
+	mvhd := startFullBox(b, "mvhd", 0, 0)
+	put32(b, 0) // creation time
+	put32(b, 0) // modification time
+	put32(b, 1000)
+	put32(b, 0) // duration, unknown for fragmented files
+	put32(b, 0x00010000)
+	put16(b, 0x0100)
+	b.Write(make([]byte, 10))
+	for _, v := range unityMatrix {
+		put32(b, v)
+	}
+	b.Write(make([]byte, 24))
+	put32(b, 2) // next track ID
+	endBox(b, mvhd)
+
+	trak := startBox(b, "trak")
+	tkhd := startFullBox(b, "tkhd", 0, 3) // enabled, in movie
+	put32(b, 0)
+	put32(b, 0)
+	put32(b, 1) // track ID
+	put32(b, 0)
+	put32(b, 0) // duration
+	b.Write(make([]byte, 8))
+	put16(b, 0) // layer
+	put16(b, 0) // alternate group
+	put16(b, 0) // volume
+	put16(b, 0)
+	for _, v := range unityMatrix {
+		put32(b, v)
+	}
+	put32(b, uint32(width)<<16)
+	put32(b, uint32(height)<<16)
+	endBox(b, tkhd)
+
+	mdia := startBox(b, "mdia")
+	mdhd := startFullBox(b, "mdhd", 0, 0)
+	put32(b, 0)
+	put32(b, 0)
+	put32(b, timescale)
+	put32(b, 0)
+	put16(b, 0x55C4) // "und"
+	put16(b, 0)
+	endBox(b, mdhd)
+	hdlr := startFullBox(b, "hdlr", 0, 0)
+	put32(b, 0)
+	b.WriteString("vide")
+	b.Write(make([]byte, 12))
+	b.WriteString("VideoHandler\x00")
+	endBox(b, hdlr)
+
+	minf := startBox(b, "minf")
+	vmhd := startFullBox(b, "vmhd", 0, 1)
+	b.Write(make([]byte, 8))
+	endBox(b, vmhd)
+	dinf := startBox(b, "dinf")
+	dref := startFullBox(b, "dref", 0, 0)
+	put32(b, 1)
+	url := startFullBox(b, "url ", 0, 1) // data in this file
+	endBox(b, url)
+	endBox(b, dref)
+	endBox(b, dinf)
+
+	stbl := startBox(b, "stbl")
+	stsd := startFullBox(b, "stsd", 0, 0)
+	put32(b, 1)
+	b.Write(sampleEntry)
+	endBox(b, stsd)
+	for _, typ := range []string{"stts", "stsc", "stco"} {
+		at := startFullBox(b, typ, 0, 0)
+		put32(b, 0)
+		endBox(b, at)
+	}
+	stsz := startFullBox(b, "stsz", 0, 0)
+	put32(b, 0)
+	put32(b, 0)
+	endBox(b, stsz)
+	endBox(b, stbl)
+	endBox(b, minf)
+	endBox(b, mdia)
+	endBox(b, trak)
+
+	mvex := startBox(b, "mvex")
+	trex := startFullBox(b, "trex", 0, 0)
+	put32(b, 1) // track ID
+	put32(b, 1) // sample description index
+	put32(b, 0)
+	put32(b, 0)
+	put32(b, 0)
+	endBox(b, trex)
+	endBox(b, mvex)
+	endBox(b, moov)
+}
+
+// startVisualEntry writes the fields common to visual sample entries.
+func startVisualEntry(b *bytes.Buffer, typ string, width, height int) int {
+	at := startBox(b, typ)
+	b.Write(make([]byte, 6))
+	put16(b, 1) // data reference index
+	b.Write(make([]byte, 16))
+	put16(b, uint16(width))
+	put16(b, uint16(height))
+	put32(b, 0x00480000) // 72 dpi
+	put32(b, 0x00480000)
+	put32(b, 0)
+	put16(b, 1) // frame count
+	b.Write(make([]byte, 32))
+	put16(b, 0x0018)
+	put16(b, 0xFFFF)
+	return at
+}
+
+// writeMJPEGEntry describes JPEG samples the way MPEG-4 Systems does: an
+// mp4v entry whose decoder config names object type 0x6C, ISO/IEC 10918-1.
+func writeMJPEGEntry(b *bytes.Buffer, width, height int) {
+	at := startVisualEntry(b, "mp4v", width, height)
+	esds := startFullBox(b, "esds", 0, 0)
+	// ES_Descriptor with a DecoderConfigDescriptor and an SLConfigDescriptor.
+	b.Write([]byte{0x03, 3 + 15 + 3, 0, 1, 0})
+	b.Write([]byte{0x04, 13, 0x6C, 0x11, 0, 0, 0})
+	put32(b, 0) // max bitrate
+	put32(b, 0) // average bitrate
+	b.Write([]byte{0x06, 1, 2})
+	endBox(b, esds)
+	endBox(b, at)
+}
+
+func writeAVCEntry(b *bytes.Buffer, s *sps, spsNAL, ppsNAL []byte) {
+	at := startVisualEntry(b, "avc1", s.width, s.height)
+	avcC := startBox(b, "avcC")
+	b.Write([]byte{1, s.profile, s.compat, s.level, 0xFF, 0xE1})
+	put16(b, uint16(len(spsNAL)))
+	b.Write(spsNAL)
+	b.WriteByte(1)
+	put16(b, uint16(len(ppsNAL)))
+	b.Write(ppsNAL)
+	switch s.profile {
+	case 100, 110, 122, 144:
+		b.Write([]byte{
+			0xFC | byte(s.chromaFormat),
+			0xF8 | byte(s.bitDepthLuma-8),
+			0xF8 | byte(s.bitDepthChroma-8),
+			0,
+		})
+	}
+	endBox(b, avcC)
+	endBox(b, at)
+}
@@ -0,0 +1,202 @@
+package mp4
+
+import (
+	"bytes"
+	"errors"
+)
+
+// H.264 NAL unit types used by the muxer.
+const (
+	nalIDR = 5
+	nalSPS = 7
+	nalPPS = 8
+	nalAUD = 9
+)
+
+// splitAnnexB returns the NAL units of an Annex B byte stream, without start
+// codes.
+func splitAnnexB(b []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); {
+		if b[i] == 0 && b[i+1] == 0 && b[i+2] == 1 {
+			if start >= 0 {
+				nals = appendNAL(nals, b[start:i])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 {
+		nals = appendNAL(nals, b[start:])
+	}
+	return nals
+}
+
+// appendNAL adds n without the zero bytes that belong to the next start code.
+func appendNAL(nals [][]byte, n []byte) [][]byte {
+	n = bytes.TrimRight(n, "\x00")
+	if len(n) == 0 {
+		return nals
+	}
+	return append(nals, n)
+}
+
+// sps holds the fields of a sequence parameter set the muxer needs.
+type sps struct {
+	profile, compat, level uint8
+	chromaFormat           uint
+	bitDepthLuma           uint
+	bitDepthChroma         uint
+	width, height          int
+}
+
+var errBadSPS = errors.New("mp4: invalid H.264 sequence parameter set")
+
+// parseSPS decodes a sequence parameter set NAL unit, header included.
+func parseSPS(nal []byte) (*sps, error) {
+	if len(nal) < 4 {
+		return nil, errBadSPS
+	}
+	s := &sps{profile: nal[1], compat: nal[2], level: nal[3], chromaFormat: 1, bitDepthLuma: 8, bitDepthChroma: 8}
+	r := &bitReader{b: unescapeRBSP(nal[4:])}
+	r.ue() // seq_parameter_set_id
+	switch s.profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		s.chromaFormat = r.ue()
+		if s.chromaFormat == 3 {
+			r.bit() // separate_colour_plane_flag
+		}
+		s.bitDepthLuma = r.ue() + 8
+		s.bitDepthChroma = r.ue() + 8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		if r.bit() == 1 {
+			n := 8
+			if s.chromaFormat == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if r.bit() == 1 {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					skipScalingList(r, size)
+				}
+			}
+		}
+	}
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit()
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue() // max_num_ref_frames
+	r.bit()
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.bit())
+	if frameMbsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+	s.width = widthMbs * 16
+	s.height = (2 - frameMbsOnly) * heightMapUnits * 16
+	if r.bit() == 1 {
+		cropX, cropY := 1, 2-frameMbsOnly
+		switch s.chromaFormat {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX = 2
+		}
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		s.width -= cropX * (left + right)
+		s.height -= cropY * (top + bottom)
+	}
+	if r.err != nil || s.width <= 0 || s.height <= 0 || s.width > 0xFFFF || s.height > 0xFFFF {
+		return nil, errBadSPS
+	}
+	return s, nil
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := 8, 8
+	for j := 0; j < size && r.err == nil; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// unescapeRBSP removes emulation prevention bytes.
+func unescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) bit() uint {
+	if r.pos >= len(r.b)*8 {
+		r.err = errBadSPS
+		return 0
+	}
+	v := uint(r.b[r.pos/8]>>(7-r.pos%8)) & 1
+	r.pos++
+	return v
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bit() == 0 && r.err == nil {
+		if zeros++; zeros > 31 {
+			r.err = errBadSPS
+			return 0
+		}
+	}
+	v := uint(1)
+	for i := 0; i < zeros; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v - 1
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v&1 == 1 {
+		return int(v+1) / 2
+	}
+	return -int(v / 2)
+}
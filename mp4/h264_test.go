@@ -0,0 +1,232 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// bitWriter builds RBSP bit strings.
+type bitWriter struct {
+	b []byte
+	n int
+}
+
+func (w *bitWriter) bit(v uint) {
+	if w.n%8 == 0 {
+		w.b = append(w.b, 0)
+	}
+	w.b[len(w.b)-1] |= byte(v&1) << (7 - w.n%8)
+	w.n++
+}
+
+func (w *bitWriter) ue(v uint) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	for i := 0; i < n; i++ {
+		w.bit(0)
+	}
+	for i := n; i >= 0; i-- {
+		w.bit(v >> i)
+	}
+}
+
+// spsNAL returns a sequence parameter set for a progressive 4:2:0 picture of
+// width x height, cropped from whole macroblocks.
+func spsNAL(profile uint8, width, height int) []byte {
+	var w bitWriter
+	w.ue(0) // seq_parameter_set_id
+	if profile == 100 {
+		w.ue(1) // chroma_format_idc
+		w.ue(0)
+		w.ue(0)
+		w.bit(0)
+		w.bit(0) // no scaling matrix
+	}
+	w.ue(0)  // log2_max_frame_num_minus4
+	w.ue(0)  // pic_order_cnt_type
+	w.ue(0)  // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(1)  // max_num_ref_frames
+	w.bit(0) // gaps_in_frame_num_value_allowed_flag
+	mbw, mbh := (width+15)/16, (height+15)/16
+	w.ue(uint(mbw - 1))
+	w.ue(uint(mbh - 1))
+	w.bit(1) // frame_mbs_only_flag
+	w.bit(1) // direct_8x8_inference_flag
+	if mbw*16 != width || mbh*16 != height {
+		w.bit(1)
+		w.ue(0)
+		w.ue(uint(mbw*16-width) / 2)
+		w.ue(0)
+		w.ue(uint(mbh*16-height) / 2)
+	} else {
+		w.bit(0)
+	}
+	w.bit(0) // vui_parameters_present_flag
+	w.bit(1) // rbsp_stop_one_bit
+	return append([]byte{0x67, profile, 0xC0, 30}, w.b...)
+}
+
+var (
+	pps   = []byte{0x68, 0xCE, 0x3C, 0x80}
+	aud   = []byte{0x09, 0xF0}
+	idr   = []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+	slice = []byte{0x41, 0x9A, 0x02}
+)
+
+// annexB joins NAL units with alternating 4 and 3 byte start codes.
+func annexB(nals ...[]byte) []byte {
+	var b []byte
+	for i, n := range nals {
+		if i%2 == 0 {
+			b = append(b, 0)
+		}
+		b = append(append(b, 0, 0, 1), n...)
+	}
+	return b
+}
+
+// avcc returns NAL units with 4 byte length prefixes, as MP4 samples hold them.
+func avcc(nals ...[]byte) []byte {
+	var b []byte
+	for _, n := range nals {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(n)))
+		b = append(b, n...)
+	}
+	return b
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	for _, c := range []struct {
+		in   []byte
+		want [][]byte
+	}{
+		{nil, nil},
+		{[]byte{0x65, 1, 2}, nil},
+		{annexB(aud, idr), [][]byte{aud, idr}},
+		{annexB(pps, slice), [][]byte{pps, slice}},
+		// Trailing zeros and empty NAL units are dropped.
+		{append(annexB(idr, []byte{}), 0, 0), [][]byte{idr}},
+	} {
+		if got := splitAnnexB(c.in); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("splitAnnexB(% x) = % x, want % x", c.in, got, c.want)
+		}
+	}
+}
+
+func TestParseSPS(t *testing.T) {
+	for _, c := range []struct {
+		profile       uint8
+		width, height int
+	}{
+		{66, 1920, 1080},
+		{66, 640, 360},
+		{100, 2560, 1440},
+		{100, 1366, 768},
+		{77, 16, 16},
+	} {
+		s, err := parseSPS(spsNAL(c.profile, c.width, c.height))
+		if err != nil {
+			t.Fatalf("profile %d %dx%d: %v", c.profile, c.width, c.height, err)
+		}
+		if s.width != c.width || s.height != c.height || s.profile != c.profile || s.level != 30 || s.chromaFormat != 1 || s.bitDepthLuma != 8 {
+			t.Errorf("profile %d %dx%d: parsed %+v", c.profile, c.width, c.height, *s)
+		}
+	}
+	for _, nal := range [][]byte{nil, {0x67, 66, 0}, spsNAL(66, 640, 360)[:5]} {
+		if _, err := parseSPS(nal); err == nil {
+			t.Errorf("parsed % x", nal)
+		}
+	}
+	// Emulation prevention bytes are removed before parsing.
+	if got := unescapeRBSP([]byte{1, 0, 0, 3, 0, 0, 0, 3, 1}); !bytes.Equal(got, []byte{1, 0, 0, 0, 0, 0, 1}) {
+		t.Errorf("unescaped % x", got)
+	}
+}
+
+func TestH264(t *testing.T) {
+	for _, profile := range []uint8{66, 100} {
+		sps := spsNAL(profile, 1366, 768)
+		var buf bytes.Buffer
+		w, err := New(&buf, &Options{Codec: H264, FragmentDuration: 100 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteFrame(testFrame(0, 0)); err == nil {
+			t.Error("wrote a frame to an H.264 file")
+		}
+		aus := []struct {
+			au []byte
+			ms int
+		}{
+			{annexB(aud, slice), 0},         // before the first keyframe: dropped
+			{annexB(aud, sps, pps, idr), 0}, // 0
+			{annexB(aud, slice), 40},
+			{annexB(slice), 80},
+			{annexB(slice), 120}, // too late to end the fragment without a keyframe
+			{annexB(idr), 160},   // starts the second fragment
+			{annexB(slice), 200},
+		}
+		for _, a := range aus {
+			if err := w.WriteH264(a.au, start.Add(time.Duration(a.ms)*time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.WriteH264(annexB(spsNAL(profile, 1280, 720), pps, idr), start.Add(time.Second)); err != ErrSizeChanged {
+			t.Errorf("new size: %v, want ErrSizeChanged", err)
+		}
+		if err := w.WriteH264(annexB(aud), start.Add(time.Second)); err == nil {
+			t.Error("wrote an empty access unit")
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if s := w.Stats(); s != (Stats{Frames: 6, Fragments: 2, Dropped: 1}) {
+			t.Errorf("profile %d: stats %+v", profile, s)
+		}
+
+		file := buf.Bytes()
+		boxes := parseBoxes(t, file, 0)
+		if ftyp := find(t, boxes, "ftyp").data; !bytes.HasSuffix(ftyp, []byte("avc1")) {
+			t.Errorf("ftyp % x", ftyp)
+		}
+		stsd := find(t, boxes, "moov", "trak", "mdia", "minf", "stbl", "stsd").data
+		entry := parseBoxes(t, stsd[8:], 0)[0]
+		if entry.typ != "avc1" || binary.BigEndian.Uint16(entry.data[24:]) != 1366 || binary.BigEndian.Uint16(entry.data[26:]) != 768 {
+			t.Fatalf("sample entry %q % x", entry.typ, entry.data[:28])
+		}
+		want := append([]byte{1, profile, 0xC0, 30, 0xFF, 0xE1}, byte(len(sps)>>8), byte(len(sps)))
+		want = append(append(want, sps...), 1, 0, byte(len(pps)))
+		want = append(want, pps...)
+		if profile == 100 {
+			want = append(want, 0xFD, 0xF8, 0xF8, 0)
+		}
+		if avcC := parseBoxes(t, entry.data[78:], 0)[0]; avcC.typ != "avcC" || !bytes.Equal(avcC.data, want) {
+			t.Errorf("profile %d: avcC % x, want % x", profile, avcC.data, want)
+		}
+
+		frags := readFragments(t, file, boxes)
+		if len(frags) != 2 || len(frags[0].samples) != 4 || len(frags[1].samples) != 2 {
+			t.Fatalf("profile %d: %d fragments", profile, len(frags))
+		}
+		samples := append(frags[0].samples, frags[1].samples...)
+		wantData := [][]byte{avcc(sps, pps, idr), avcc(slice), avcc(slice), avcc(slice), avcc(idr), avcc(slice)}
+		for i, s := range samples {
+			sync := i == 0 || i == 4
+			if wantFlags := map[bool]int{true: 0x02000000, false: 0x01010000}[sync]; s.flags != wantFlags {
+				t.Errorf("sample %d flags %x, want %x", i, s.flags, wantFlags)
+			}
+			if !bytes.Equal(s.data, wantData[i]) {
+				t.Errorf("sample %d is % x, want % x", i, s.data, wantData[i])
+			}
+			if s.dts != i*40*timescale/1000 {
+				t.Errorf("sample %d at %d", i, s.dts)
+			}
+		}
+	}
+}
@@ -0,0 +1,375 @@
+// Package mp4 writes fragmented MP4 files carrying Motion-JPEG encoded from
+// captured frames, or an H.264 stream encoded elsewhere. Fragmented files are
+// playable while they are written and survive an interrupted recording up to
+// the last complete fragment.
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/jpegenc"
+)
+
+// Codec is the video codec of a file.
+type Codec int
+
+const (
+	// MJPEG encodes frames passed to WriteFrame as JPEG.
+	MJPEG Codec = iota
+	// H264 stores access units passed to WriteH264.
+	H264
+)
+
+// timescale is the track clock, in ticks per second.
+const timescale = 90000
+
+// DefaultFragmentDuration is used when Options.FragmentDuration is 0.
+const DefaultFragmentDuration = time.Second
+
+// ErrSizeChanged is returned for a frame whose size differs from the first
+// frame's. Start a new file to change resolution.
+var ErrSizeChanged = errors.New("mp4: frame size changed")
+
+// Options configures a Writer. A nil *Options writes MJPEG with the defaults.
+type Options struct {
+	Codec Codec
+	// Quality and Subsampling apply to MJPEG. Quality is
+	// jpegenc.DefaultQuality if 0.
+	Quality     int
+	Subsampling jpegenc.Subsampling
+	// FragmentDuration is the length of the fragments. H.264 fragments start
+	// at keyframes, so they last at least this long.
+	FragmentDuration time.Duration
+}
+
+// Stats counts samples.
+type Stats struct {
+	Frames    int64
+	Fragments int64
+	// Dropped counts H.264 access units before the first keyframe with
+	// parameter sets, which cannot be decoded.
+	Dropped int64
+}
+
+type sample struct {
+	data []byte
+	dts  int64
+	sync bool
+}
+
+type fragmentRef struct {
+	time   int64
+	offset int64
+}
+
+// Writer writes a fragmented MP4 file. Samples are timed by their capture
+// timestamps, so the file plays at the pace the screen changed.
+type Writer struct {
+	w    *bufio.Writer
+	opts Options
+	enc  *jpegenc.Encoder
+	jpeg bytes.Buffer
+
+	off           int64
+	started       bool
+	width, height int
+	start         time.Time
+	lastDTS       int64
+
+	pending   []sample
+	fragments []fragmentRef
+	seq       uint32
+	stats     Stats
+	err       error
+	closed    bool
+}
+
+// New returns a writer emitting an MP4 file to w. The init segment is written
+// with the first frame.
+func New(w io.Writer, opts *Options) (*Writer, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.FragmentDuration <= 0 {
+		o.FragmentDuration = DefaultFragmentDuration
+	}
+	mw := &Writer{w: bufio.NewWriterSize(w, 1<<20), opts: o}
+	switch o.Codec {
+	case MJPEG:
+		enc, err := jpegenc.NewEncoder(&jpegenc.Options{Quality: o.Quality, Subsampling: o.Subsampling})
+		if err != nil {
+			return nil, err
+		}
+		mw.enc = enc
+	case H264:
+	default:
+		return nil, errors.New("mp4: unknown codec")
+	}
+	return mw, nil
+}
+
+// WriteFrame encodes f as JPEG and adds it at f.Time, or now if f has none.
+// It is only valid for MJPEG.
+func (mw *Writer) WriteFrame(f *frame.Frame) error {
+	if err := mw.check(MJPEG); err != nil {
+		return err
+	}
+	if !mw.started {
+		if f.Width <= 0 || f.Height <= 0 || f.Width > 0xFFFF || f.Height > 0xFFFF {
+			return errors.New("mp4: invalid frame size")
+		}
+		var sd bytes.Buffer
+		writeMJPEGEntry(&sd, f.Width, f.Height)
+		if err := mw.begin(f.Width, f.Height, sd.Bytes()); err != nil {
+			return err
+		}
+	} else if f.Width != mw.width || f.Height != mw.height {
+		return ErrSizeChanged
+	}
+	mw.jpeg.Reset()
+	if err := mw.enc.Encode(&mw.jpeg, f.Pix, f.Width, f.Height, f.Stride); err != nil {
+		return err
+	}
+	return mw.add(append([]byte(nil), mw.jpeg.Bytes()...), f.Time, true)
+}
+
+// WriteH264 adds one access unit in Annex B format (NAL units with start
+// codes) at time t, or now if t is zero. Access units are expected in decode
+// order without B-frames, as low latency encoders produce them; the first
+// one kept is a keyframe carrying SPS and PPS. It is only valid for H264.
+func (mw *Writer) WriteH264(au []byte, t time.Time) error {
+	if err := mw.check(H264); err != nil {
+		return err
+	}
+	nals := splitAnnexB(au)
+	var spsNAL, ppsNAL []byte
+	sync := false
+	data := make([]byte, 0, len(au)+16)
+	for _, n := range nals {
+		switch n[0] & 0x1F {
+		case nalAUD:
+			continue
+		case nalSPS:
+			spsNAL = n
+		case nalPPS:
+			ppsNAL = n
+		case nalIDR:
+			sync = true
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(n)))
+		data = append(data, n...)
+	}
+	if len(data) == 0 {
+		return errors.New("mp4: empty access unit")
+	}
+
+	if spsNAL != nil {
+		s, err := parseSPS(spsNAL)
+		if err != nil {
+			return err
+		}
+		if mw.started && (s.width != mw.width || s.height != mw.height) {
+			return ErrSizeChanged
+		}
+		if !mw.started && sync && ppsNAL != nil {
+			var sd bytes.Buffer
+			writeAVCEntry(&sd, s, spsNAL, ppsNAL)
+			if err := mw.begin(s.width, s.height, sd.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	if !mw.started {
+		mw.stats.Dropped++
+		return nil
+	}
+	return mw.add(data, t, sync)
+}
+
+func (mw *Writer) check(c Codec) error {
+	switch {
+	case mw.err != nil:
+		return mw.err
+	case mw.closed:
+		return errors.New("mp4: writer is closed")
+	case mw.opts.Codec != c:
+		return errors.New("mp4: wrong method for codec")
+	}
+	return nil
+}
+
+// begin writes the init segment.
+func (mw *Writer) begin(width, height int, sampleEntry []byte) error {
+	mw.width, mw.height = width, height
+	mw.started = true
+	var b bytes.Buffer
+	writeInit(&b, mw.opts.Codec, width, height, sampleEntry)
+	return mw.write(b.Bytes())
+}
+
+// add queues a sample, writing the current fragment first if s starts a
+// new one.
+func (mw *Writer) add(data []byte, t time.Time, sync bool) error {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	if mw.stats.Frames == 0 {
+		mw.start = t
+	}
+	dts := int64(t.Sub(mw.start)) * timescale / int64(time.Second)
+	if mw.stats.Frames > 0 && dts <= mw.lastDTS {
+		// Keep decode times increasing even if timestamps do not.
+		dts = mw.lastDTS + 1
+	}
+	mw.lastDTS = dts
+	if sync && len(mw.pending) > 0 &&
+		time.Duration(dts-mw.pending[0].dts)*time.Second/timescale >= mw.opts.FragmentDuration {
+		if err := mw.flushFragment(dts); err != nil {
+			return err
+		}
+	}
+	mw.pending = append(mw.pending, sample{data: data, dts: dts, sync: sync})
+	mw.stats.Frames++
+	return nil
+}
+
+// flushFragment writes the pending samples as one fragment. end is the decode
+// time after the last sample, which gives its duration.
+func (mw *Writer) flushFragment(end int64) error {
+	mw.seq++
+	samples := mw.pending
+	var moof bytes.Buffer
+	m := startBox(&moof, "moof")
+	mf := startFullBox(&moof, "mfhd", 0, 0)
+	put32(&moof, mw.seq)
+	endBox(&moof, mf)
+	traf := startBox(&moof, "traf")
+	tf := startFullBox(&moof, "tfhd", 0, 0x020000) // default-base-is-moof
+	put32(&moof, 1)
+	endBox(&moof, tf)
+	td := startFullBox(&moof, "tfdt", 1, 0)
+	put64(&moof, uint64(samples[0].dts))
+	endBox(&moof, td)
+	tr := startFullBox(&moof, "trun", 0, 0x000701) // data offset, duration, size, flags
+	put32(&moof, uint32(len(samples)))
+	dataOffset := moof.Len()
+	put32(&moof, 0)
+	size := 0
+	for i, s := range samples {
+		next := end
+		if i+1 < len(samples) {
+			next = samples[i+1].dts
+		}
+		put32(&moof, uint32(next-s.dts))
+		put32(&moof, uint32(len(s.data)))
+		if s.sync {
+			put32(&moof, 0x02000000) // depends on no other sample
+		} else {
+			put32(&moof, 0x01010000) // depends on others, not a sync sample
+		}
+		size += len(s.data)
+	}
+	endBox(&moof, tr)
+	endBox(&moof, traf)
+	endBox(&moof, m)
+	binary.BigEndian.PutUint32(moof.Bytes()[dataOffset:], uint32(moof.Len()+8))
+
+	mw.fragments = append(mw.fragments, fragmentRef{time: samples[0].dts, offset: mw.off})
+	if err := mw.write(moof.Bytes()); err != nil {
+		return err
+	}
+	hdr := binary.BigEndian.AppendUint32(nil, uint32(8+size))
+	if err := mw.write(append(hdr, "mdat"...)); err != nil {
+		return err
+	}
+	for _, s := range samples {
+		if err := mw.write(s.data); err != nil {
+			return err
+		}
+	}
+	for i := range mw.pending {
+		mw.pending[i].data = nil
+	}
+	mw.pending = mw.pending[:0]
+	mw.stats.Fragments++
+	return nil
+}
+
+func (mw *Writer) write(b []byte) error {
+	n, err := mw.w.Write(b)
+	mw.off += int64(n)
+	if err != nil {
+		mw.err = err
+	}
+	return err
+}
+
+// Flush writes buffered data to the underlying writer. Samples of the
+// fragment in progress are written when it ends.
+func (mw *Writer) Flush() error {
+	if mw.err != nil {
+		return mw.err
+	}
+	if err := mw.w.Flush(); err != nil {
+		mw.err = err
+	}
+	return mw.err
+}
+
+// Stats returns the sample counters.
+func (mw *Writer) Stats() Stats {
+	return mw.stats
+}
+
+// Close writes the last fragment and a random access index. The underlying
+// writer is not closed.
+func (mw *Writer) Close() error {
+	if mw.closed {
+		return mw.err
+	}
+	mw.closed = true
+	if mw.err != nil {
+		return mw.err
+	}
+	if !mw.started {
+		return errors.New("mp4: no frames written")
+	}
+	if n := len(mw.pending); n > 0 {
+		// The last sample lasts as long as the one before it.
+		last := int64(timescale / 30)
+		if n > 1 {
+			last = mw.pending[n-1].dts - mw.pending[n-2].dts
+		}
+		if err := mw.flushFragment(mw.pending[n-1].dts + last); err != nil {
+			return err
+		}
+	}
+
+	var b bytes.Buffer
+	mfra := startBox(&b, "mfra")
+	tfra := startFullBox(&b, "tfra", 1, 0)
+	put32(&b, 1)
+	put32(&b, 0) // 1 byte traf, trun and sample numbers
+	put32(&b, uint32(len(mw.fragments)))
+	for _, f := range mw.fragments {
+		put64(&b, uint64(f.time))
+		put64(&b, uint64(f.offset))
+		b.Write([]byte{1, 1, 1})
+	}
+	endBox(&b, tfra)
+	mfro := startFullBox(&b, "mfro", 0, 0)
+	put32(&b, uint32(b.Len()-mfra+4))
+	endBox(&b, mfro)
+	endBox(&b, mfra)
+	if err := mw.write(b.Bytes()); err != nil {
+		return err
+	}
+	return mw.Flush()
+}
@@ -0,0 +1,319 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"image/jpeg"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+var start = time.Unix(1700000000, 0)
+
+// box is an ISO BMFF box. off is the file offset of its header.
+type box struct {
+	typ  string
+	off  int
+	data []byte
+	sub  []*box
+}
+
+// containers are the boxes holding only other boxes.
+var containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true, "dinf": true,
+	"stbl": true, "mvex": true, "moof": true, "traf": true, "mfra": true,
+}
+
+// parseBoxes returns the boxes in b, descending into containers.
+func parseBoxes(t *testing.T, b []byte, base int) []*box {
+	t.Helper()
+	var boxes []*box
+	for i := 0; i < len(b); {
+		if i+8 > len(b) {
+			t.Fatalf("truncated box header at %d", base+i)
+		}
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		if n < 8 || i+n > len(b) {
+			t.Fatalf("box %q at %d: size %d", b[i+4:i+8], base+i, n)
+		}
+		bx := &box{typ: string(b[i+4 : i+8]), off: base + i, data: b[i+8 : i+n]}
+		if containers[bx.typ] {
+			bx.sub = parseBoxes(t, bx.data, base+i+8)
+		}
+		boxes = append(boxes, bx)
+		i += n
+	}
+	return boxes
+}
+
+// find returns the first box along path.
+func find(t *testing.T, boxes []*box, path ...string) *box {
+	t.Helper()
+	for _, bx := range boxes {
+		if bx.typ == path[0] {
+			if len(path) == 1 {
+				return bx
+			}
+			return find(t, bx.sub, path[1:]...)
+		}
+	}
+	t.Fatalf("no %q box", path[0])
+	return nil
+}
+
+func u32(b []byte, at int) int { return int(binary.BigEndian.Uint32(b[at:])) }
+
+// track is a sample read back from the fragments.
+type track struct {
+	data  []byte
+	dts   int
+	dur   int
+	flags int
+}
+
+// fragment is a moof and the samples its trun describes.
+type fragment struct {
+	seq, off int
+	samples  []track
+}
+
+// readFragments checks the moof and mdat pairs of a file and returns their
+// samples.
+func readFragments(t *testing.T, file []byte, boxes []*box) []fragment {
+	t.Helper()
+	var frags []fragment
+	for i, bx := range boxes {
+		if bx.typ != "moof" {
+			continue
+		}
+		mdat := boxes[i+1]
+		if mdat.typ != "mdat" {
+			t.Fatalf("moof at %d is followed by %q", bx.off, mdat.typ)
+		}
+		frag := fragment{seq: u32(find(t, bx.sub, "mfhd").data, 4), off: bx.off}
+		if tfhd := find(t, bx.sub, "traf", "tfhd").data; u32(tfhd, 0) != 0x020000 || u32(tfhd, 4) != 1 {
+			t.Fatalf("tfhd % x", tfhd)
+		}
+		tfdt := find(t, bx.sub, "traf", "tfdt").data
+		dts := int(binary.BigEndian.Uint64(tfdt[4:]))
+		trun := find(t, bx.sub, "traf", "trun").data
+		if u32(trun, 0) != 0x000701 {
+			t.Fatalf("trun flags %x", u32(trun, 0))
+		}
+		// The data offset is relative to the moof and lands on the mdat
+		// payload, which holds exactly the samples.
+		at, total := bx.off+u32(trun, 8), 0
+		if at != mdat.off+8 {
+			t.Fatalf("trun data offset points at %d, mdat payload is at %d", at, mdat.off+8)
+		}
+		for k := 0; k < u32(trun, 4); k++ {
+			e := trun[12+k*12:]
+			s := track{dts: dts, dur: u32(e, 0), flags: u32(e, 8)}
+			s.data = file[at : at+u32(e, 4)]
+			frag.samples = append(frag.samples, s)
+			dts += s.dur
+			at += len(s.data)
+			total += len(s.data)
+		}
+		if total != len(mdat.data) {
+			t.Fatalf("samples hold %d bytes, mdat %d", total, len(mdat.data))
+		}
+		frags = append(frags, frag)
+	}
+	return frags
+}
+
+// testFrame returns a gradient frame whose color depends on i, taken at ms.
+func testFrame(i, ms int) *frame.Frame {
+	f := frame.New(48, 32)
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			copy(f.Pix[f.PixOffset(x, y):], []byte{byte(x * 4), byte(y * 6), byte(i * 20), 0xFF})
+		}
+	}
+	f.Time = start.Add(time.Duration(ms) * time.Millisecond)
+	return f
+}
+
+func checkJPEG(t *testing.T, data []byte, f *frame.Frame) {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != f.Rect() {
+		t.Fatalf("JPEG bounds %v, want %v", img.Bounds(), f.Rect())
+	}
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			p := f.Pix[f.PixOffset(x, y):]
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			for k, v := range []byte{c.B, c.G, c.R} {
+				if d := int(v) - int(p[k]); d < -12 || d > 12 {
+					t.Fatalf("pixel %d,%d is %v, want % x", x, y, c, p[:3])
+				}
+			}
+		}
+	}
+}
+
+func TestMJPEG(t *testing.T) {
+	var frames []*frame.Frame
+	for i := 0; i < 12; i++ {
+		frames = append(frames, testFrame(i, i*100))
+	}
+	var buf bytes.Buffer
+	w, err := New(&buf, &Options{Quality: 95, FragmentDuration: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range frames {
+		if err := w.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := w.Stats(); s != (Stats{Frames: 12, Fragments: 3}) {
+		t.Errorf("stats %+v", s)
+	}
+
+	file := buf.Bytes()
+	boxes := parseBoxes(t, file, 0)
+	if ftyp := find(t, boxes, "ftyp").data; string(ftyp[:4]) != "isom" || boxes[0].typ != "ftyp" {
+		t.Errorf("ftyp % x", ftyp)
+	}
+	tkhd := find(t, boxes, "moov", "trak", "tkhd").data
+	if u32(tkhd, 12) != 1 || u32(tkhd, 76) != 48<<16 || u32(tkhd, 80) != 32<<16 {
+		t.Errorf("tkhd % x", tkhd)
+	}
+	if mdhd := find(t, boxes, "moov", "trak", "mdia", "mdhd").data; u32(mdhd, 12) != timescale {
+		t.Errorf("timescale %d", u32(mdhd, 12))
+	}
+	if hdlr := find(t, boxes, "moov", "trak", "mdia", "hdlr").data; string(hdlr[8:12]) != "vide" {
+		t.Errorf("handler %q", hdlr[8:12])
+	}
+	stsd := find(t, boxes, "moov", "trak", "mdia", "minf", "stbl", "stsd").data
+	entry := parseBoxes(t, stsd[8:], 0)[0]
+	if entry.typ != "mp4v" || binary.BigEndian.Uint16(entry.data[24:]) != 48 || binary.BigEndian.Uint16(entry.data[26:]) != 32 {
+		t.Fatalf("sample entry %q % x", entry.typ, entry.data[:28])
+	}
+	esds := parseBoxes(t, entry.data[78:], 0)[0]
+	// The decoder config names ISO/IEC 10918-1 as the object type.
+	if i := bytes.IndexByte(esds.data, 0x04); esds.typ != "esds" || i < 0 || esds.data[i+2] != 0x6C {
+		t.Errorf("esds % x", esds.data)
+	}
+
+	frags := readFragments(t, file, boxes)
+	if len(frags) != 3 {
+		t.Fatalf("%d fragments, want 3", len(frags))
+	}
+	var samples []track
+	for i, fr := range frags {
+		if fr.seq != i+1 {
+			t.Errorf("fragment %d has sequence number %d", i, fr.seq)
+		}
+		samples = append(samples, fr.samples...)
+	}
+	for i, s := range samples {
+		if want := i * timescale / 10; s.dts != want || s.dur != timescale/10 || s.flags != 0x02000000 {
+			t.Errorf("sample %d at %d for %d flags %x, want %d for %d", i, s.dts, s.dur, s.flags, want, timescale/10)
+		}
+		checkJPEG(t, s.data, frames[i])
+	}
+
+	// The random access index names every fragment, and mfro gives the
+	// size of mfra from the end of the file.
+	mfra := boxes[len(boxes)-1]
+	if mfra.typ != "mfra" || u32(file, len(file)-4) != 8+len(mfra.data) {
+		t.Fatalf("file ends with %q, mfro %d", mfra.typ, u32(file, len(file)-4))
+	}
+	tfra := find(t, mfra.sub, "tfra").data
+	if u32(tfra, 0) != 1<<24 || u32(tfra, 4) != 1 || u32(tfra, 12) != len(frags) {
+		t.Fatalf("tfra % x", tfra[:16])
+	}
+	for i, fr := range frags {
+		e := tfra[16+i*19:]
+		if int(binary.BigEndian.Uint64(e)) != fr.samples[0].dts || int(binary.BigEndian.Uint64(e[8:])) != fr.off {
+			t.Errorf("tfra entry %d: % x", i, e[:19])
+		}
+	}
+}
+
+// TestTimestamps checks that decode times keep increasing when capture
+// timestamps do not.
+func TestTimestamps(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := New(&buf, nil)
+	for _, ms := range []int{0, 50, 50, 20, 100} {
+		w.WriteFrame(testFrame(0, ms))
+	}
+	w.Close()
+	frags := readFragments(t, buf.Bytes(), parseBoxes(t, buf.Bytes(), 0))
+	var dts []int
+	for _, s := range frags[0].samples {
+		dts = append(dts, s.dts)
+	}
+	want := []int{0, 4500, 4501, 4502, 9000}
+	for i := range want {
+		if i >= len(dts) || dts[i] != want[i] {
+			t.Fatalf("decode times %v, want %v", dts, want)
+		}
+	}
+	// The last sample lasts as long as the gap before it.
+	if d := frags[0].samples[4].dur; d != 4498 {
+		t.Errorf("last sample lasts %d", d)
+	}
+}
+
+// TestFlush checks that completed fragments are readable before Close.
+func TestFlush(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := New(&buf, &Options{FragmentDuration: 200 * time.Millisecond})
+	for i := 0; i < 5; i++ {
+		w.WriteFrame(testFrame(i, i*100))
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	boxes := parseBoxes(t, buf.Bytes(), 0)
+	frags := readFragments(t, buf.Bytes(), boxes)
+	if len(frags) != 2 || len(frags[0].samples) != 2 || len(frags[1].samples) != 2 {
+		t.Fatalf("%d fragments before Close", len(frags))
+	}
+	if boxes[len(boxes)-1].typ != "mdat" {
+		t.Errorf("flushed file ends with %q", boxes[len(boxes)-1].typ)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, &Options{Codec: 5}); err == nil {
+		t.Error("New accepted an unknown codec")
+	}
+	if _, err := New(&bytes.Buffer{}, &Options{Quality: 101}); err == nil {
+		t.Error("New accepted quality 101")
+	}
+	w, _ := New(&bytes.Buffer{}, nil)
+	if err := w.Close(); err == nil {
+		t.Error("closed a file without frames")
+	}
+	w, _ = New(&bytes.Buffer{}, nil)
+	if err := w.WriteH264([]byte{0, 0, 1, 0x65, 0x88}, start); err == nil {
+		t.Error("wrote H.264 to an MJPEG file")
+	}
+	if err := w.WriteFrame(frame.New(0, 4)); err == nil {
+		t.Error("wrote an empty frame")
+	}
+	w.WriteFrame(testFrame(0, 0))
+	if err := w.WriteFrame(frame.New(48, 33)); err != ErrSizeChanged {
+		t.Errorf("resized frame: %v, want ErrSizeChanged", err)
+	}
+	w.Close()
+	if err := w.WriteFrame(testFrame(1, 100)); err == nil {
+		t.Error("wrote a frame after Close")
+	}
+}
@@ -0,0 +1,79 @@
+//go:build windows
+
+package dda
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/shinkar94/godesktopdup/disp"
+	resultcode "github.com/shinkar94/godesktopdup/errors"
+	"golang.org/x/sys/windows"
+)
+
+// OutputInfo describes a display output.
+type OutputInfo struct {
+	// Adapter is the index of the graphics adapter. New captures outputs of
+	// adapter 0, the default one.
+	Adapter     int
+	AdapterName string
+	// Index is the output's index on its adapter, as passed to New.
+	Index int
+	// Name is the device name, e.g. \\.\DISPLAY1.
+	Name string
+	// Bounds is the position in desktop coordinates.
+	Bounds   image.Rectangle
+	Attached bool
+}
+
+// Outputs lists the outputs of every adapter without duplicating them.
+func Outputs() ([]OutputInfo, error) {
+	var factory *disp.Factory1
+	if err := disp.CreateDXGIFactory1(&factory); err != nil {
+		return nil, fmt.Errorf("failed to create DXGI factory: %w", err)
+	}
+	defer factory.Release()
+
+	var list []OutputInfo
+	for a := uint32(0); ; a++ {
+		var adapter *disp.Adapter1
+		hr := resultcode.ResultCode(factory.EnumAdapters1(a, &adapter))
+		if hr == resultcode.ErrorNotFound {
+			break
+		}
+		if hr.Failed() {
+			return nil, fmt.Errorf("failed at factory.EnumAdapters1. %w", hr)
+		}
+		var adesc disp.AdapterDesc1
+		adapter.GetDesc1(&adesc)
+		adapterName := windows.UTF16ToString(adesc.Description[:])
+
+		for o := uint32(0); ; o++ {
+			var output *disp.Output
+			hr := resultcode.ResultCode(adapter.EnumOutputs(o, &output))
+			if hr == resultcode.ErrorNotFound {
+				break
+			}
+			if hr.Failed() {
+				adapter.Release()
+				return nil, fmt.Errorf("failed at adapter.EnumOutputs. %w", hr)
+			}
+			info := OutputInfo{Adapter: int(a), AdapterName: adapterName, Index: int(o)}
+			var output5 *disp.Output5
+			if hr := resultcode.ResultCode(output.QueryInterface(disp.IID_Output5, &output5)); !hr.Failed() {
+				var desc disp.OutputDesc
+				if hr := resultcode.ResultCode(output5.GetDesc(&desc)); !hr.Failed() {
+					c := desc.DesktopCoordinates
+					info.Name = windows.UTF16ToString(desc.DeviceName[:])
+					info.Bounds = image.Rect(int(c.Left), int(c.Top), int(c.Right), int(c.Bottom))
+					info.Attached = desc.AttachedToDesktop != 0
+				}
+				output5.Release()
+			}
+			output.Release()
+			list = append(list, info)
+		}
+		adapter.Release()
+	}
+	return list, nil
+}
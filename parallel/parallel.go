@@ -0,0 +1,150 @@
+// Package parallel splits pixel work across a bounded set of goroutines.
+package parallel
+
+import (
+	"image"
+	"runtime"
+	"sync"
+)
+
+// DefaultThreshold is the work size, in pixels, below which a Pool stays on
+// the calling goroutine. Smaller copies finish before goroutines could help.
+const DefaultThreshold = 256 * 1024
+
+// Pool runs work on a fixed number of long-lived workers, started with the
+// first call that splits work. Work is only handed to idle workers; anything
+// else runs on the calling goroutine, so calls never block on each other and
+// may be nested. Close stops the workers.
+type Pool struct {
+	workers   int
+	threshold int
+
+	once sync.Once
+	// mu guards tasks against Close; senders hold it for reading.
+	mu     sync.RWMutex
+	tasks  chan func()
+	closed bool
+}
+
+// Default is a pool with one worker per CPU.
+var Default = New(0, DefaultThreshold)
+
+// New returns a pool running up to workers goroutines, including the caller.
+// workers <= 0 means GOMAXPROCS. Work smaller than threshold pixels runs
+// single-threaded; threshold < 0 disables that.
+func New(workers, threshold int) *Pool {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &Pool{workers: workers, threshold: threshold}
+}
+
+// Workers returns the number of goroutines the pool may use for one call.
+func (p *Pool) Workers() int {
+	return p.workers
+}
+
+func (p *Pool) start() {
+	p.tasks = make(chan func())
+	for i := 1; i < p.workers; i++ {
+		go func() {
+			for task := range p.tasks {
+				task()
+			}
+		}()
+	}
+}
+
+// Close stops the workers once they finish their current work. Later calls
+// run on the calling goroutine. Close may be called more than once.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	if p.tasks != nil {
+		close(p.tasks)
+	}
+}
+
+// run executes the tasks, handing them to idle workers where possible.
+func (p *Pool) run(tasks []func()) {
+	if len(tasks) == 1 {
+		tasks[0]()
+		return
+	}
+	var wg sync.WaitGroup
+	local := tasks[:1:1]
+	p.mu.RLock()
+	if p.closed {
+		local = tasks
+	} else {
+		p.once.Do(p.start)
+		for _, task := range tasks[1:] {
+			task := task
+			wg.Add(1)
+			select {
+			case p.tasks <- func() {
+				defer wg.Done()
+				task()
+			}:
+			default:
+				wg.Done()
+				local = append(local, task)
+			}
+		}
+	}
+	// Tasks left to the caller run unlocked, as they may call the pool.
+	p.mu.RUnlock()
+	for _, task := range local {
+		task()
+	}
+	wg.Wait()
+}
+
+// split returns how many parts work of the given size should be split into.
+func (p *Pool) split(pixels, parts int) int {
+	if p.workers <= 1 || (p.threshold >= 0 && pixels < p.threshold) {
+		return 1
+	}
+	return max(1, min(p.workers, parts))
+}
+
+// Rows calls fn for consecutive row bands covering [0, rows), where each row
+// holds rowPixels pixels. Bands run concurrently and must not share output.
+func (p *Pool) Rows(rows, rowPixels int, fn func(lo, hi int)) {
+	n := p.split(rows*rowPixels, rows)
+	if n <= 1 {
+		if rows > 0 {
+			fn(0, rows)
+		}
+		return
+	}
+	tasks := make([]func(), n)
+	for i := range tasks {
+		lo, hi := rows*i/n, rows*(i+1)/n
+		tasks[i] = func() { fn(lo, hi) }
+	}
+	p.run(tasks)
+}
+
+// Tiles calls fn for tiles of at most size x size pixels covering r. Tiles are
+// grouped into one contiguous run of tile rows per worker, so each worker
+// stays within a band of the destination.
+func (p *Pool) Tiles(r image.Rectangle, size int, fn func(tile image.Rectangle)) {
+	if r.Empty() {
+		return
+	}
+	tileRows := (r.Dy() + size - 1) / size
+	p.Rows(tileRows, r.Dx()*size, func(lo, hi int) {
+		for ty := lo; ty < hi; ty++ {
+			y0 := r.Min.Y + ty*size
+			y1 := min(y0+size, r.Max.Y)
+			for x0 := r.Min.X; x0 < r.Max.X; x0 += size {
+				fn(image.Rect(x0, y0, min(x0+size, r.Max.X), y1))
+			}
+		}
+	})
+}
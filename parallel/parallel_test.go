@@ -0,0 +1,129 @@
+package parallel
+
+import (
+	"fmt"
+	"image"
+	"sync"
+	"testing"
+)
+
+// sizes are the output resolutions the copies are tuned for.
+var sizes = []struct {
+	name          string
+	width, height int
+}{
+	{"1080p", 1920, 1080},
+	{"1440p", 2560, 1440},
+	{"4K", 3840, 2160},
+}
+
+func TestRows(t *testing.T) {
+	for _, workers := range []int{1, 3, 8} {
+		p := New(workers, -1)
+		seen := make([]int, 1001)
+		var mu sync.Mutex
+		p.Rows(len(seen), 1, func(lo, hi int) {
+			mu.Lock()
+			defer mu.Unlock()
+			for i := lo; i < hi; i++ {
+				seen[i]++
+			}
+		})
+		for i, n := range seen {
+			if n != 1 {
+				t.Fatalf("%d workers: row %d visited %d times", workers, i, n)
+			}
+		}
+		p.Close()
+	}
+}
+
+func TestTiles(t *testing.T) {
+	p := New(4, -1)
+	defer p.Close()
+	r := image.Rect(3, 5, 203, 130)
+	seen := make(map[image.Point]int)
+	var mu sync.Mutex
+	p.Tiles(r, 32, func(tile image.Rectangle) {
+		if tile.Dx() > 32 || tile.Dy() > 32 || !tile.In(r) {
+			t.Errorf("tile %v", tile)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for y := tile.Min.Y; y < tile.Max.Y; y++ {
+			for x := tile.Min.X; x < tile.Max.X; x++ {
+				seen[image.Pt(x, y)]++
+			}
+		}
+	})
+	if len(seen) != r.Dx()*r.Dy() {
+		t.Fatalf("tiles cover %d pixels, want %d", len(seen), r.Dx()*r.Dy())
+	}
+	for pt, n := range seen {
+		if n != 1 {
+			t.Fatalf("pixel %v visited %d times", pt, n)
+		}
+	}
+}
+
+func TestClosed(t *testing.T) {
+	p := New(4, -1)
+	p.Rows(100, 1, func(lo, hi int) {})
+	p.Close()
+	p.Close()
+	n := 0
+	p.Rows(100, 1, func(lo, hi int) { n += hi - lo })
+	if n != 100 {
+		t.Fatalf("closed pool covered %d rows, want 100", n)
+	}
+}
+
+// copyRows copies rows from src into a tightly packed dst the way full-frame
+// captures do: in one copy per band when the strides match, row by row
+// otherwise.
+func copyRows(p *Pool, dst, src []byte, width, height, srcStride int) {
+	rowBytes := width * 4
+	if srcStride == rowBytes {
+		p.Rows(height, width, func(lo, hi int) {
+			copy(dst[lo*rowBytes:hi*rowBytes], src[lo*rowBytes:hi*rowBytes])
+		})
+		return
+	}
+	p.Rows(height, width, func(lo, hi int) {
+		for y := lo; y < hi; y++ {
+			copy(dst[y*rowBytes:][:rowBytes], src[y*srcStride:])
+		}
+	})
+}
+
+func BenchmarkFullFrameCopy(b *testing.B) {
+	serial := New(1, DefaultThreshold)
+	defer serial.Close()
+	for _, sz := range sizes {
+		dst := make([]byte, sz.width*4*sz.height)
+		for _, layout := range []struct {
+			name   string
+			stride int
+		}{
+			{"tight", sz.width * 4},
+			// Mapped surfaces pad rows; add a step even when rows are 256-aligned.
+			{"padded", (sz.width*4+255)&^255 + 256},
+		} {
+			src := make([]byte, layout.stride*sz.height)
+			for _, mode := range []struct {
+				name string
+				pool *Pool
+			}{
+				{"serial", serial},
+				{"parallel", Default},
+			} {
+				b.Run(fmt.Sprintf("%s/%s/%s", sz.name, layout.name, mode.name), func(b *testing.B) {
+					b.SetBytes(int64(len(dst)))
+					for i := 0; i < b.N; i++ {
+						copyRows(mode.pool, dst, src, sz.width, sz.height, layout.stride)
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,351 @@
+// Package pngenc encodes BGRA frames as PNG without converting them to an
+// image.Image first.
+package pngenc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+)
+
+// CompressionLevel selects the zlib effort. Values 1 to 9 select the zlib
+// level directly.
+type CompressionLevel int
+
+const (
+	DefaultCompression CompressionLevel = 0
+	NoCompression      CompressionLevel = -1
+	BestSpeed          CompressionLevel = -2
+	BestCompression    CompressionLevel = -3
+)
+
+// Signature starts every PNG file.
+const Signature = "\x89PNG\r\n\x1a\n"
+
+// maxIDAT is the payload size at which Encode starts a new IDAT chunk.
+const maxIDAT = 256 * 1024
+
+// Text is a tEXt chunk. Keyword must be 1 to 79 Latin-1 characters.
+type Text struct {
+	Keyword string
+	Value   string
+}
+
+// Options configures the encoder. A nil *Options uses the defaults.
+type Options struct {
+	Level CompressionLevel
+	// Alpha keeps the alpha channel. Captured frames are opaque, so by
+	// default pixels are written as RGB.
+	Alpha bool
+	Text  []Text
+}
+
+func (o *Options) orDefault() *Options {
+	if o == nil {
+		return &Options{}
+	}
+	return o
+}
+
+func (l CompressionLevel) zlibLevel() int {
+	switch {
+	case l == NoCompression:
+		return zlib.NoCompression
+	case l == BestSpeed:
+		return zlib.BestSpeed
+	case l == BestCompression:
+		return zlib.BestCompression
+	case l >= 1 && l <= 9:
+		return int(l)
+	default:
+		return zlib.DefaultCompression
+	}
+}
+
+// Encode writes the width x height BGRA image in pix as PNG.
+func Encode(w io.Writer, pix []byte, width, height, stride int, opts *Options) error {
+	opts = opts.orDefault()
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("pngenc: invalid image size %dx%d", width, height)
+	}
+	if len(pix) < (height-1)*stride+width*4 {
+		return fmt.Errorf("pngenc: buffer too small for %dx%d", width, height)
+	}
+
+	bw := bufio.NewWriterSize(w, 64*1024)
+	if _, err := io.WriteString(bw, Signature); err != nil {
+		return err
+	}
+	if err := WriteChunk(bw, "IHDR", Header(width, height, opts.Alpha)); err != nil {
+		return err
+	}
+	for _, t := range opts.Text {
+		data, err := TextChunk(t)
+		if err != nil {
+			return err
+		}
+		if err := WriteChunk(bw, "tEXt", data); err != nil {
+			return err
+		}
+	}
+
+	cw := &chunkWriter{w: bw, typ: "IDAT"}
+	if err := compress(cw, pix, stride, image.Rect(0, 0, width, height), opts); err != nil {
+		return err
+	}
+	if err := cw.Flush(); err != nil {
+		return err
+	}
+	if err := WriteChunk(bw, "IEND", nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// WriteChunk writes one chunk with its length and CRC.
+func WriteChunk(w io.Writer, typ string, data []byte) error {
+	if len(typ) != 4 {
+		return fmt.Errorf("pngenc: invalid chunk type %q", typ)
+	}
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)))
+	copy(hdr[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(data)
+	var tail [4]byte
+	binary.BigEndian.PutUint32(tail[:], crc.Sum32())
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	_, err := w.Write(tail[:])
+	return err
+}
+
+// Header returns the IHDR payload for an 8-bit RGB or RGBA image.
+func Header(width, height int, alpha bool) []byte {
+	b := make([]byte, 13)
+	binary.BigEndian.PutUint32(b[0:], uint32(width))
+	binary.BigEndian.PutUint32(b[4:], uint32(height))
+	b[8] = 8
+	b[9] = 2
+	if alpha {
+		b[9] = 6
+	}
+	return b
+}
+
+// TextChunk returns the tEXt payload for t.
+func TextChunk(t Text) ([]byte, error) {
+	if len(t.Keyword) == 0 || len(t.Keyword) > 79 {
+		return nil, fmt.Errorf("pngenc: invalid tEXt keyword %q", t.Keyword)
+	}
+	for _, s := range []string{t.Keyword, t.Value} {
+		if bytes.IndexByte([]byte(s), 0) >= 0 {
+			return nil, errors.New("pngenc: tEXt contains NUL")
+		}
+	}
+	return append(append([]byte(t.Keyword), 0), latin1(t.Value)...), nil
+}
+
+// latin1 converts s to Latin-1, replacing characters outside it with '?'.
+func latin1(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xFF {
+			r = '?'
+		}
+		b = append(b, byte(r))
+	}
+	return b
+}
+
+// ImageData returns the zlib stream of the filtered rows of r, as stored in
+// IDAT or, for animations, fdAT chunks.
+func ImageData(pix []byte, stride int, r image.Rectangle, opts *Options) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := compress(&buf, pix, stride, r, opts.orDefault()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func compress(w io.Writer, pix []byte, stride int, r image.Rectangle, opts *Options) error {
+	zw, err := zlib.NewWriterLevel(w, opts.Level.zlibLevel())
+	if err != nil {
+		return err
+	}
+	bpp := 3
+	if opts.Alpha {
+		bpp = 4
+	}
+	n := r.Dx() * bpp
+	prev := make([]byte, n+1)
+	cur := make([]byte, n+1)
+	var scratch [5][]byte
+	for i := range scratch {
+		scratch[i] = make([]byte, n+1)
+	}
+
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		src := pix[y*stride+r.Min.X*4:]
+		row := cur[1:]
+		if bpp == 4 {
+			for x, o := 0, 0; o < n; x, o = x+4, o+4 {
+				row[o], row[o+1], row[o+2], row[o+3] = src[x+2], src[x+1], src[x], src[x+3]
+			}
+		} else {
+			for x, o := 0, 0; o < n; x, o = x+4, o+3 {
+				row[o], row[o+1], row[o+2] = src[x+2], src[x+1], src[x]
+			}
+		}
+
+		var out []byte
+		switch opts.Level {
+		case NoCompression:
+			cur[0] = filterNone
+			out = cur
+		case BestSpeed:
+			out = scratch[filterSub]
+			filterRow(out, cur, prev, bpp, filterSub)
+		default:
+			out = bestFilter(&scratch, cur, prev, bpp)
+		}
+		if _, err := zw.Write(out); err != nil {
+			return err
+		}
+		prev, cur = cur, prev
+	}
+	return zw.Close()
+}
+
+const (
+	filterNone = iota
+	filterSub
+	filterUp
+	filterAverage
+	filterPaeth
+)
+
+// bestFilter applies every filter and returns the row with the smallest sum
+// of absolute values, the heuristic recommended by the PNG specification.
+func bestFilter(scratch *[5][]byte, cur, prev []byte, bpp int) []byte {
+	best, bestSum := 0, -1
+	for ft := filterNone; ft <= filterPaeth; ft++ {
+		filterRow(scratch[ft], cur, prev, bpp, ft)
+		sum := 0
+		for _, v := range scratch[ft][1:] {
+			if v < 0x80 {
+				sum += int(v)
+			} else {
+				sum += 0x100 - int(v)
+			}
+			if bestSum >= 0 && sum >= bestSum {
+				break
+			}
+		}
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = ft, sum
+		}
+	}
+	return scratch[best]
+}
+
+// filterRow writes filter type ft applied to cur (above: prev) into out.
+// Index 0 of every row holds the filter type byte.
+func filterRow(out, cur, prev []byte, bpp, ft int) {
+	out[0] = byte(ft)
+	c, p, o := cur[1:], prev[1:], out[1:]
+	switch ft {
+	case filterNone:
+		copy(o, c)
+	case filterSub:
+		copy(o[:bpp], c[:bpp])
+		for i := bpp; i < len(c); i++ {
+			o[i] = c[i] - c[i-bpp]
+		}
+	case filterUp:
+		for i := range c {
+			o[i] = c[i] - p[i]
+		}
+	case filterAverage:
+		for i := 0; i < bpp; i++ {
+			o[i] = c[i] - p[i]/2
+		}
+		for i := bpp; i < len(c); i++ {
+			o[i] = c[i] - byte((int(c[i-bpp])+int(p[i]))/2)
+		}
+	case filterPaeth:
+		for i := 0; i < bpp; i++ {
+			o[i] = c[i] - p[i]
+		}
+		for i := bpp; i < len(c); i++ {
+			o[i] = c[i] - paeth(c[i-bpp], p[i], p[i-bpp])
+		}
+	}
+}
+
+func paeth(a, b, c byte) byte {
+	pc := int(c)
+	pa := int(b) - pc
+	pb := int(a) - pc
+	pcd := pa + pb
+	if pa < 0 {
+		pa = -pa
+	}
+	if pb < 0 {
+		pb = -pb
+	}
+	if pcd < 0 {
+		pcd = -pcd
+	}
+	if pa <= pb && pa <= pcd {
+		return a
+	}
+	if pb <= pcd {
+		return b
+	}
+	return c
+}
+
+// chunkWriter splits a stream into chunks of at most maxIDAT bytes.
+type chunkWriter struct {
+	w   io.Writer
+	typ string
+	buf []byte
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		k := min(len(p), maxIDAT-len(cw.buf))
+		cw.buf = append(cw.buf, p[:k]...)
+		p = p[k:]
+		if len(cw.buf) == maxIDAT {
+			if err := cw.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush writes buffered data as a chunk.
+func (cw *chunkWriter) Flush() error {
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	err := WriteChunk(cw.w, cw.typ, cw.buf)
+	cw.buf = cw.buf[:0]
+	return err
+}
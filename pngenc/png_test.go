@@ -0,0 +1,186 @@
+package pngenc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// testImage returns a width x height BGRA image with stride bytes per row.
+// The left half is noise, the right half a gradient, and the padding after
+// each row is garbage the encoder must skip.
+func testImage(width, height, stride int) []byte {
+	pix := make([]byte, stride*height)
+	rand.New(rand.NewSource(int64(width))).Read(pix)
+	for y := 0; y < height; y++ {
+		for x := width / 2; x < width; x++ {
+			copy(pix[y*stride+x*4:], []byte{byte(x), byte(y), byte(x + y), byte(255 - x)})
+		}
+	}
+	return pix
+}
+
+// checkPixels fails unless img holds the BGRA pixels, with alpha only if kept.
+func checkPixels(t *testing.T, img image.Image, pix []byte, width, height, stride int, alpha bool) {
+	t.Helper()
+	if b := img.Bounds(); b != image.Rect(0, 0, width, height) {
+		t.Fatalf("decoded bounds %v, want %dx%d", b, width, height)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := pix[y*stride+x*4:]
+			want := color.NRGBA{R: p[2], G: p[1], B: p[0], A: 0xFF}
+			if alpha {
+				want.A = p[3]
+			}
+			if got := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA); got != want {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+type chunk struct {
+	typ  string
+	data []byte
+}
+
+// chunks splits a PNG file into its chunks, checking the signature and CRCs.
+func chunks(t *testing.T, b []byte) []chunk {
+	t.Helper()
+	if !bytes.HasPrefix(b, []byte(Signature)) {
+		t.Fatal("missing PNG signature")
+	}
+	b = b[len(Signature):]
+	var cs []chunk
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("%d trailing bytes", len(b))
+		}
+		n := int(binary.BigEndian.Uint32(b))
+		c := chunk{typ: string(b[4:8]), data: b[8 : 8+n]}
+		if crc := binary.BigEndian.Uint32(b[8+n:]); crc != crc32.ChecksumIEEE(b[4:8+n]) {
+			t.Fatalf("%s chunk: bad CRC", c.typ)
+		}
+		cs = append(cs, c)
+		b = b[12+n:]
+	}
+	return cs
+}
+
+func TestEncode(t *testing.T) {
+	levels := []CompressionLevel{DefaultCompression, NoCompression, BestSpeed, BestCompression, 1, 9}
+	sizes := []struct{ width, height, stride int }{
+		{1, 1, 4},
+		{37, 21, 37*4 + 12},
+		{64, 3, 64 * 4},
+	}
+	for _, level := range levels {
+		for _, alpha := range []bool{false, true} {
+			for _, sz := range sizes {
+				pix := testImage(sz.width, sz.height, sz.stride)
+				var buf bytes.Buffer
+				if err := Encode(&buf, pix, sz.width, sz.height, sz.stride, &Options{Level: level, Alpha: alpha}); err != nil {
+					t.Fatal(err)
+				}
+				img, err := png.Decode(&buf)
+				if err != nil {
+					t.Fatalf("level %d alpha %v %dx%d: %v", level, alpha, sz.width, sz.height, err)
+				}
+				checkPixels(t, img, pix, sz.width, sz.height, sz.stride, alpha)
+			}
+		}
+	}
+}
+
+func TestChunks(t *testing.T) {
+	// Uncompressed noise needs several IDAT chunks.
+	pix := testImage(600, 400, 600*4)
+	var buf bytes.Buffer
+	text := []Text{{"Title", "screen"}, {"Comment", "café 日本"}}
+	if err := Encode(&buf, pix, 600, 400, 600*4, &Options{Level: NoCompression, Text: text}); err != nil {
+		t.Fatal(err)
+	}
+	cs := chunks(t, buf.Bytes())
+	var types []string
+	for _, c := range cs {
+		if len(types) == 0 || types[len(types)-1] != c.typ {
+			types = append(types, c.typ)
+		}
+		if c.typ == "IDAT" && len(c.data) > maxIDAT {
+			t.Errorf("IDAT chunk of %d bytes", len(c.data))
+		}
+	}
+	if got := strings.Join(types, " "); got != "IHDR tEXt IDAT IEND" {
+		t.Errorf("chunk order %s", got)
+	}
+	if n := len(cs) - 4; n < 3 {
+		t.Errorf("%d IDAT chunks for 720 KB of pixels", n)
+	}
+	if !bytes.Equal(cs[0].data, []byte{0, 0, 2, 0x58, 0, 0, 1, 0x90, 8, 2, 0, 0, 0}) {
+		t.Errorf("IHDR % x", cs[0].data)
+	}
+	if want := "Title\x00screen"; string(cs[1].data) != want {
+		t.Errorf("first tEXt %q, want %q", cs[1].data, want)
+	}
+	if want := "Comment\x00caf\xe9 ??"; string(cs[2].data) != want {
+		t.Errorf("second tEXt %q, want %q", cs[2].data, want)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPixels(t, img, pix, 600, 400, 600*4, false)
+}
+
+// TestImageData builds a PNG of a region from Header and ImageData, as the
+// APNG writer does for frames.
+func TestImageData(t *testing.T) {
+	pix := testImage(50, 40, 50*4)
+	r := image.Rect(7, 5, 30, 33)
+	for _, alpha := range []bool{false, true} {
+		data, err := ImageData(pix, 50*4, r, &Options{Alpha: alpha})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		buf.WriteString(Signature)
+		WriteChunk(&buf, "IHDR", Header(r.Dx(), r.Dy(), alpha))
+		WriteChunk(&buf, "IDAT", data)
+		WriteChunk(&buf, "IEND", nil)
+		img, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPixels(t, img, pix[r.Min.Y*50*4+r.Min.X*4:], r.Dx(), r.Dy(), 50*4, alpha)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	pix := make([]byte, 10*10*4)
+	for _, c := range []struct {
+		name                  string
+		width, height, stride int
+		opts                  *Options
+	}{
+		{"zero width", 0, 10, 40, nil},
+		{"negative height", 10, -1, 40, nil},
+		{"short buffer", 10, 11, 40, nil},
+		{"empty keyword", 10, 10, 40, &Options{Text: []Text{{"", "x"}}}},
+		{"long keyword", 10, 10, 40, &Options{Text: []Text{{strings.Repeat("k", 80), "x"}}}},
+		{"NUL in value", 10, 10, 40, &Options{Text: []Text{{"Title", "a\x00b"}}}},
+	} {
+		if err := Encode(&bytes.Buffer{}, pix, c.width, c.height, c.stride, c.opts); err == nil {
+			t.Errorf("%s: encoded", c.name)
+		}
+	}
+	if err := WriteChunk(&bytes.Buffer{}, "IDATA", nil); err == nil {
+		t.Error("WriteChunk accepted a five letter type")
+	}
+}
@@ -0,0 +1,181 @@
+// Package protect applies a policy to frames in which the system masked out
+// protected content, such as DRM video, and counts them for compliance
+// reports. Desktop Duplication shows such content as black and flags the
+// frame (frame.Frame.Protected); without a policy recordings silently contain
+// black rectangles.
+package protect
+
+import (
+	"errors"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+var errNoRestore = errors.New("protect: placeholder requires frames from frame.Process")
+
+// Action is what a Monitor does with protected frames.
+type Action int
+
+const (
+	// Pass leaves protected frames as they are.
+	Pass Action = iota
+	// Placeholder replaces protected frames by a striped pattern, so it is
+	// clear the content was withheld rather than black.
+	Placeholder
+	// Drop discards protected frames: Apply returns frame.ErrNoImageYet,
+	// which frame.Process passes on, and the next frame is marked full.
+	Drop
+)
+
+// Event reports that protected content appeared or disappeared.
+type Event struct {
+	Protected bool
+	Time      time.Time
+	Seq       uint64
+	Output    string
+}
+
+// Options configures a Monitor. A nil *Options passes frames and only counts.
+type Options struct {
+	Action Action
+	// OnChange, if set, is called on the capture goroutine whenever protected
+	// content appears or disappears. It must not block.
+	OnChange func(Event)
+}
+
+// Stats counts frames for compliance reports.
+type Stats struct {
+	Frames    int64
+	Protected int64
+	// Replaced and Dropped count protected frames handled by the action.
+	Replaced int64
+	Dropped  int64
+	// Intervals is the number of times protected content appeared.
+	Intervals int64
+	// Duration is the total time protected content was shown, up to the last
+	// frame.
+	Duration time.Duration
+	// First and Last are the times of the first and last protected frames.
+	First, Last time.Time
+}
+
+// Monitor is a frame.Stage applying an Action to protected frames. Put it
+// first in frame.Process, so later stages do not draw over the placeholder.
+type Monitor struct {
+	opts Options
+
+	mu        sync.Mutex
+	stats     Stats
+	protected bool
+	start     time.Time
+	// dropped makes the next passed frame full, as consumers missed the
+	// damage of the dropped ones.
+	dropped bool
+}
+
+// New returns a Monitor.
+func New(opts *Options) *Monitor {
+	m := &Monitor{}
+	if opts != nil {
+		m.opts = *opts
+	}
+	return m
+}
+
+func (m *Monitor) Apply(f *frame.Frame) error {
+	m.mu.Lock()
+	changed := f.Protected != m.protected
+	m.count(f)
+	m.mu.Unlock()
+	if changed && m.opts.OnChange != nil {
+		m.opts.OnChange(Event{Protected: f.Protected, Time: f.Time, Seq: f.Seq, Output: f.Output})
+	}
+
+	if !f.Protected || m.opts.Action == Pass {
+		m.passed(f)
+		return nil
+	}
+	switch m.opts.Action {
+	case Drop:
+		m.mu.Lock()
+		m.stats.Dropped++
+		m.dropped = true
+		m.mu.Unlock()
+		return frame.ErrNoImageYet
+	case Placeholder:
+		// Probe whether the pattern can be undone on the next frame.
+		if !f.Restore(image.Rectangle{}) {
+			return errNoRestore
+		}
+		m.passed(f)
+		drawPattern(f)
+		f.SetFull()
+		m.mu.Lock()
+		m.stats.Replaced++
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+// count updates the counters for f. The caller holds m.mu.
+func (m *Monitor) count(f *frame.Frame) {
+	s := &m.stats
+	s.Frames++
+	switch {
+	case f.Protected && !m.protected:
+		s.Intervals++
+		m.start = f.Time
+		if s.First.IsZero() {
+			s.First = f.Time
+		}
+	case !f.Protected && m.protected:
+		s.Duration += f.Time.Sub(m.start)
+	}
+	if f.Protected {
+		s.Protected++
+		s.Last = f.Time
+	}
+	m.protected = f.Protected
+}
+
+// passed marks f full if frames were dropped before it.
+func (m *Monitor) passed(f *frame.Frame) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dropped {
+		f.SetFull()
+		m.dropped = false
+	}
+}
+
+// Stats returns the counters. It is safe to call while frames are processed.
+func (m *Monitor) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.stats
+	if m.protected {
+		s.Duration += s.Last.Sub(m.start)
+	}
+	return s
+}
+
+// stripe is the width of the placeholder's diagonal stripes.
+const stripe = 24
+
+// drawPattern fills f with grey diagonal stripes.
+func drawPattern(f *frame.Frame) {
+	for y := 0; y < f.Height; y++ {
+		row := f.Pix[y*f.Stride:]
+		for x := 0; x < f.Width; x++ {
+			v := byte(0x30)
+			if (x+y)/stripe%2 == 0 {
+				v = 0x48
+			}
+			o := x * 4
+			row[o], row[o+1], row[o+2], row[o+3] = v, v, v, 0xFF
+		}
+	}
+}
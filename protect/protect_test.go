@@ -0,0 +1,210 @@
+package protect
+
+import (
+	"bytes"
+	"image"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+var start = time.Unix(1700000000, 0)
+
+// protected marks the frames, 100ms apart, in which content is masked.
+var protected = []bool{false, true, true, false, true, false, false}
+
+// masked is where the system blacks out protected content.
+var masked = image.Rect(10, 10, 30, 20)
+
+// replay is a source returning prepared frames.
+type replay []*frame.Frame
+
+func (r *replay) GetFrame(uint) (*frame.Frame, error) {
+	f := (*r)[0]
+	*r = (*r)[1:]
+	return f, nil
+}
+
+// capture returns frames of a noisy screen in which one pixel of the top row
+// changes per frame and protected frames show masked as black.
+func capture() []*frame.Frame {
+	base := frame.New(48, 32)
+	rand.New(rand.NewSource(1)).Read(base.Pix)
+	for i := 3; i < len(base.Pix); i += 4 {
+		base.Pix[i] = 0xFF
+	}
+	var frames []*frame.Frame
+	for i, p := range protected {
+		f := base.Clone()
+		f.Pix[f.PixOffset(i, 0)] ^= 0xFF
+		if p {
+			for y := masked.Min.Y; y < masked.Max.Y; y++ {
+				for x := masked.Min.X; x < masked.Max.X; x++ {
+					copy(f.Pix[f.PixOffset(x, y):], []byte{0, 0, 0, 0xFF})
+				}
+			}
+		}
+		if i > 0 {
+			f.Dirty = []image.Rectangle{image.Rect(0, 0, 8, 1), masked}
+		}
+		f.Protected = p
+		f.Seq = uint64(i + 1)
+		f.Time = start.Add(time.Duration(i) * 100 * time.Millisecond)
+		f.Output = `\\.\DISPLAY1`
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+func ms(n int) time.Time { return start.Add(time.Duration(n) * time.Millisecond) }
+
+// isPattern reports whether f shows the placeholder stripes.
+func isPattern(f *frame.Frame) bool {
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			v := byte(0x30)
+			if (x+y)/stripe%2 == 0 {
+				v = 0x48
+			}
+			if !bytes.Equal(f.Pix[f.PixOffset(x, y):][:4], []byte{v, v, v, 0xFF}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestActions(t *testing.T) {
+	want := Stats{
+		Frames: 7, Protected: 3, Intervals: 2,
+		Duration: 300 * time.Millisecond,
+		First:    ms(100), Last: ms(400),
+	}
+	for _, action := range []Action{Pass, Placeholder, Drop} {
+		var events []Event
+		m := New(&Options{Action: action, OnChange: func(e Event) { events = append(events, e) }})
+		frames := capture()
+		src := make(replay, len(frames))
+		for i, f := range frames {
+			src[i] = f.Clone()
+		}
+		p := frame.Process(&src, m)
+		wasProtected := false
+		for i, in := range frames {
+			out, err := p.GetFrame(0)
+			switch {
+			case action == Drop && in.Protected:
+				if err != frame.ErrNoImageYet {
+					t.Errorf("drop: frame %d: %v, want frame.ErrNoImageYet", i, err)
+				}
+			case err != nil:
+				t.Fatalf("action %d: frame %d: %v", action, i, err)
+			case action == Placeholder && in.Protected:
+				if !isPattern(out) || !out.Full() {
+					t.Errorf("placeholder: frame %d is not a full frame of stripes", i)
+				}
+			default:
+				if !bytes.Equal(out.Pix, in.Pix) {
+					t.Errorf("action %d: frame %d differs from the capture", action, i)
+				}
+				// The frame after a placeholder or a dropped frame must be
+				// sent whole.
+				if action != Pass && wasProtected && !out.Full() && !covers(out.Damage(), in.Rect()) {
+					t.Errorf("action %d: frame %d after protected content has damage %v", action, i, out.Damage())
+				}
+			}
+			wasProtected = in.Protected
+		}
+
+		w := want
+		switch action {
+		case Placeholder:
+			w.Replaced = 3
+		case Drop:
+			w.Dropped = 3
+		}
+		if s := m.Stats(); s != w {
+			t.Errorf("action %d: stats %+v, want %+v", action, s, w)
+		}
+		wantEvents := []Event{
+			{true, ms(100), 2, `\\.\DISPLAY1`},
+			{false, ms(300), 4, `\\.\DISPLAY1`},
+			{true, ms(400), 5, `\\.\DISPLAY1`},
+			{false, ms(500), 6, `\\.\DISPLAY1`},
+		}
+		if !reflect.DeepEqual(events, wantEvents) {
+			t.Errorf("action %d: events %v, want %v", action, events, wantEvents)
+		}
+	}
+}
+
+// covers reports whether the rectangles in list cover r.
+func covers(list []image.Rectangle, r image.Rectangle) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p := image.Pt(x, y)
+			in := false
+			for _, o := range list {
+				if p.In(o) {
+					in = true
+					break
+				}
+			}
+			if !in {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// TestOngoing checks that Stats counts an interval still in progress up to
+// its last frame.
+func TestOngoing(t *testing.T) {
+	m := New(nil)
+	for _, f := range capture()[:3] {
+		if err := m.Apply(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := m.Stats(); s.Duration != 100*time.Millisecond || s.Intervals != 1 || s.Last != ms(200) {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestPlaceholderNeedsProcess(t *testing.T) {
+	m := New(&Options{Action: Placeholder})
+	f := capture()[1]
+	if err := m.Apply(f); err != errNoRestore {
+		t.Errorf("protected frame outside frame.Process: %v, want errNoRestore", err)
+	}
+	if err := m.Apply(capture()[0]); err != nil {
+		t.Errorf("unprotected frame: %v", err)
+	}
+}
+
+// TestConcurrentStats reads the counters while frames are processed.
+func TestConcurrentStats(t *testing.T) {
+	m := New(&Options{Action: Drop})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			m.Stats()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		for _, f := range capture() {
+			m.Apply(f)
+		}
+	}
+	wg.Wait()
+	if s := m.Stats(); s.Frames != 140 || s.Dropped != 60 {
+		t.Errorf("stats %+v", s)
+	}
+}
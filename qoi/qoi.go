@@ -0,0 +1,315 @@
+// Package qoi encodes and decodes BGRA frames in the QOI ("Quite OK Image")
+// format, a lossless format that compresses screen content at close to copy
+// speed.
+package qoi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+const (
+	magic      = "qoif"
+	headerSize = 14
+	// maxPixels bounds decoded images to protect against corrupt headers.
+	maxPixels = 400_000_000
+
+	opIndex = 0x00
+	opDiff  = 0x40
+	opLuma  = 0x80
+	opRun   = 0xC0
+	opRGB   = 0xFE
+	opRGBA  = 0xFF
+	opMask  = 0xC0
+)
+
+var endMarker = []byte{0, 0, 0, 0, 0, 0, 0, 1}
+
+// ErrInvalid is returned for data that is not valid QOI.
+var ErrInvalid = errors.New("qoi: invalid data")
+
+// Options configures the encoder. A nil *Options uses the defaults.
+type Options struct {
+	// Alpha keeps the alpha channel. Captured frames are opaque, so by
+	// default alpha is written as 255 and the header declares 3 channels.
+	Alpha bool
+}
+
+// Header is the QOI file header.
+type Header struct {
+	Width, Height int
+	Channels      uint8
+	// Colorspace is 0 for sRGB with linear alpha, 1 for all channels linear.
+	Colorspace uint8
+}
+
+func init() {
+	image.RegisterFormat("qoi", magic, DecodeImage, DecodeConfig)
+}
+
+// rgba is a pixel packed as r<<24 | g<<16 | b<<8 | a.
+type rgba uint32
+
+func (p rgba) hash() int {
+	r, g, b, a := p>>24, p>>16&0xFF, p>>8&0xFF, p&0xFF
+	return int((r*3 + g*5 + b*7 + a*11) % 64)
+}
+
+// state is the encoder or decoder state carried from pixel to pixel.
+type state struct {
+	index [64]rgba
+	prev  rgba
+	run   int
+}
+
+func (s *state) reset() {
+	*s = state{prev: 0xFF}
+}
+
+// Encode writes the width x height BGRA image in pix as QOI.
+func Encode(w io.Writer, pix []byte, width, height, stride int, opts *Options) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("qoi: invalid image size %dx%d", width, height)
+	}
+	if len(pix) < (height-1)*stride+width*4 {
+		return fmt.Errorf("qoi: buffer too small for %dx%d", width, height)
+	}
+	alpha := opts != nil && opts.Alpha
+	channels := uint8(3)
+	if alpha {
+		channels = 4
+	}
+
+	bw := bufio.NewWriterSize(w, 64*1024)
+	bw.Write(appendHeader(nil, Header{Width: width, Height: height, Channels: channels}))
+	var s state
+	s.reset()
+	buf := make([]byte, 0, width*5+1)
+	for y := 0; y < height; y++ {
+		buf = s.appendPixels(buf[:0], pix[y*stride:y*stride+width*4], alpha)
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	bw.Write(s.flush(nil))
+	bw.Write(endMarker)
+	return bw.Flush()
+}
+
+func appendHeader(b []byte, h Header) []byte {
+	b = append(b, magic...)
+	b = binary.BigEndian.AppendUint32(b, uint32(h.Width))
+	b = binary.BigEndian.AppendUint32(b, uint32(h.Height))
+	return append(b, h.Channels, h.Colorspace)
+}
+
+// appendPixels appends the chunks for a run of BGRA pixels. A pending run is
+// kept in s, so consecutive calls continue the same stream; call flush at the end.
+func (s *state) appendPixels(dst, pix []byte, alpha bool) []byte {
+	for i := 0; i+3 < len(pix); i += 4 {
+		a := byte(0xFF)
+		if alpha {
+			a = pix[i+3]
+		}
+		px := rgba(pix[i+2])<<24 | rgba(pix[i+1])<<16 | rgba(pix[i])<<8 | rgba(a)
+		if px == s.prev {
+			s.run++
+			if s.run == 62 {
+				dst = append(dst, opRun|61)
+				s.run = 0
+			}
+			continue
+		}
+		if s.run > 0 {
+			dst = append(dst, opRun|byte(s.run-1))
+			s.run = 0
+		}
+
+		h := px.hash()
+		if s.index[h] == px {
+			dst = append(dst, opIndex|byte(h))
+			s.prev = px
+			continue
+		}
+		s.index[h] = px
+
+		if byte(px) == byte(s.prev) {
+			dr := int8(byte(px>>24) - byte(s.prev>>24))
+			dg := int8(byte(px>>16) - byte(s.prev>>16))
+			db := int8(byte(px>>8) - byte(s.prev>>8))
+			drg, dbg := dr-dg, db-dg
+			switch {
+			case dr >= -2 && dr <= 1 && dg >= -2 && dg <= 1 && db >= -2 && db <= 1:
+				dst = append(dst, opDiff|byte(dr+2)<<4|byte(dg+2)<<2|byte(db+2))
+			case dg >= -32 && dg <= 31 && drg >= -8 && drg <= 7 && dbg >= -8 && dbg <= 7:
+				dst = append(dst, opLuma|byte(dg+32), byte(drg+8)<<4|byte(dbg+8))
+			default:
+				dst = append(dst, opRGB, byte(px>>24), byte(px>>16), byte(px>>8))
+			}
+		} else {
+			dst = append(dst, opRGBA, byte(px>>24), byte(px>>16), byte(px>>8), byte(px))
+		}
+		s.prev = px
+	}
+	return dst
+}
+
+// flush appends the pending run, if any.
+func (s *state) flush(dst []byte) []byte {
+	if s.run > 0 {
+		dst = append(dst, opRun|byte(s.run-1))
+		s.run = 0
+	}
+	return dst
+}
+
+// readPixels decodes chunks from src into the BGRA pixels of dst, returning the
+// number of bytes consumed. A run may continue into the next call.
+func (s *state) readPixels(dst, src []byte) (int, error) {
+	n := 0
+	for i := 0; i+3 < len(dst); i += 4 {
+		if s.run > 0 {
+			s.run--
+		} else {
+			if n >= len(src) {
+				return n, ErrInvalid
+			}
+			b := src[n]
+			n++
+			px := s.prev
+			switch {
+			case b == opRGB:
+				if n+3 > len(src) {
+					return n, ErrInvalid
+				}
+				px = rgba(src[n])<<24 | rgba(src[n+1])<<16 | rgba(src[n+2])<<8 | px&0xFF
+				n += 3
+			case b == opRGBA:
+				if n+4 > len(src) {
+					return n, ErrInvalid
+				}
+				px = rgba(src[n])<<24 | rgba(src[n+1])<<16 | rgba(src[n+2])<<8 | rgba(src[n+3])
+				n += 4
+			case b&opMask == opIndex:
+				px = s.index[b]
+			case b&opMask == opDiff:
+				r := byte(px>>24) + (b>>4&3 - 2)
+				g := byte(px>>16) + (b>>2&3 - 2)
+				bl := byte(px>>8) + (b&3 - 2)
+				px = rgba(r)<<24 | rgba(g)<<16 | rgba(bl)<<8 | px&0xFF
+			case b&opMask == opLuma:
+				if n >= len(src) {
+					return n, ErrInvalid
+				}
+				dg := b&0x3F - 32
+				b2 := src[n]
+				n++
+				r := byte(px>>24) + dg + (b2>>4 - 8)
+				g := byte(px>>16) + dg
+				bl := byte(px>>8) + dg + (b2&0xF - 8)
+				px = rgba(r)<<24 | rgba(g)<<16 | rgba(bl)<<8 | px&0xFF
+			default:
+				s.run = int(b & 0x3F)
+			}
+			s.index[px.hash()] = px
+			s.prev = px
+		}
+		p := s.prev
+		dst[i], dst[i+1], dst[i+2], dst[i+3] = byte(p>>8), byte(p>>16), byte(p>>24), byte(p)
+	}
+	return n, nil
+}
+
+// DecodeHeader reads the QOI header.
+func DecodeHeader(r io.Reader) (Header, error) {
+	var b [headerSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return Header{}, err
+	}
+	return parseHeader(b[:])
+}
+
+func parseHeader(b []byte) (Header, error) {
+	if string(b[:4]) != magic {
+		return Header{}, ErrInvalid
+	}
+	h := Header{
+		Width:      int(binary.BigEndian.Uint32(b[4:])),
+		Height:     int(binary.BigEndian.Uint32(b[8:])),
+		Channels:   b[12],
+		Colorspace: b[13],
+	}
+	if !validSize(h.Width, h.Height) || (h.Channels != 3 && h.Channels != 4) || h.Colorspace > 1 {
+		return Header{}, ErrInvalid
+	}
+	return h, nil
+}
+
+// validSize reports whether an image of the given size may be decoded. Each
+// side is checked first so the product cannot overflow.
+func validSize(width, height int) bool {
+	return width > 0 && height > 0 && width <= maxPixels && height <= maxPixels &&
+		width*height <= maxPixels
+}
+
+// fits reports whether n bytes of chunks can hold width x height pixels, so
+// corrupt sizes are rejected before the image is allocated. A chunk byte
+// covers at most 62 pixels.
+func fits(width, height, n int) bool {
+	return width*height <= n*62
+}
+
+// Decode reads a QOI image into a frame with a tightly packed BGRA buffer.
+func Decode(r io.Reader) (*frame.Frame, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < headerSize+len(endMarker) {
+		return nil, ErrInvalid
+	}
+	h, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if !fits(h.Width, h.Height, len(data)-headerSize) {
+		return nil, ErrInvalid
+	}
+	f := frame.New(h.Width, h.Height)
+	var s state
+	s.reset()
+	if _, err := s.readPixels(f.Pix, data[headerSize:]); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// DecodeImage reads a QOI image as an *image.NRGBA. It is registered with
+// the image package, so image.Decode handles QOI files.
+func DecodeImage(r io.Reader) (image.Image, error) {
+	f, err := Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	img := &image.NRGBA{Pix: f.Pix, Stride: f.Stride, Rect: f.Rect()}
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+2] = img.Pix[i+2], img.Pix[i]
+	}
+	return img, nil
+}
+
+// DecodeConfig returns the size and color model of a QOI image.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	h, err := DecodeHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: h.Width, Height: h.Height}, nil
+}
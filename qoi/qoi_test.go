@@ -0,0 +1,226 @@
+package qoi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// testImage returns a width x height BGRA image with rows padded to stride.
+// Its rows cycle through content that exercises every chunk type: a plain
+// color (runs), a gentle gradient (diffs), a steep one (luma), noise (RGB),
+// two alternating colors (index) and changing alpha (RGBA). The padding is
+// filled with garbage the encoder must skip.
+func testImage(width, height, stride int) []byte {
+	rnd := rand.New(rand.NewSource(int64(width*height + stride)))
+	pix := make([]byte, (height-1)*stride+width*4)
+	rnd.Read(pix)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var p [4]byte
+			switch y % 6 {
+			case 0:
+				p = [4]byte{0x20, 0x40, 0x60, 0xFF}
+			case 1:
+				p = [4]byte{byte(x), byte(x), byte(x / 2), 0xFF}
+			case 2:
+				p = [4]byte{byte(x * 10), byte(x * 12), byte(x * 14), 0xFF}
+			case 3:
+				p = [4]byte{byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256)), 0xFF}
+			case 4:
+				p = [4]byte{0xFF, 0, byte(x % 2 * 0xFF), 0xFF}
+			case 5:
+				p = [4]byte{byte(x), 0x80, 0x10, byte(x * 3)}
+			}
+			copy(pix[y*stride+x*4:], p[:])
+		}
+	}
+	return pix
+}
+
+// chunkOps counts the chunks of each kind in encoded data, keyed by their
+// tag, and the runs of the longest length.
+func chunkOps(t *testing.T, data []byte) (map[byte]int, int) {
+	t.Helper()
+	ops := make(map[byte]int)
+	fullRuns := 0
+	for i := headerSize; i < len(data)-len(endMarker); {
+		b := data[i]
+		switch {
+		case b == opRGB:
+			ops[opRGB]++
+			i += 4
+		case b == opRGBA:
+			ops[opRGBA]++
+			i += 5
+		case b&opMask == opLuma:
+			ops[opLuma]++
+			i += 2
+		default:
+			ops[b&opMask]++
+			if b == opRun|61 {
+				fullRuns++
+			}
+			i++
+		}
+	}
+	if !bytes.Equal(data[len(data)-len(endMarker):], endMarker) {
+		t.Fatal("missing end marker")
+	}
+	return ops, fullRuns
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		width, height, stride int
+		alpha                 bool
+	}{
+		{1, 1, 4, false},
+		{3, 5, 12, true},
+		{131, 7, 131 * 4, false},
+		{131, 13, 131*4 + 12, true},
+		{200, 12, 200*4 + 4, false},
+	} {
+		pix := testImage(c.width, c.height, c.stride)
+		var buf bytes.Buffer
+		if err := Encode(&buf, pix, c.width, c.height, c.stride, &Options{Alpha: c.alpha}); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		h, err := DecodeHeader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		channels := uint8(3)
+		if c.alpha {
+			channels = 4
+		}
+		if h != (Header{Width: c.width, Height: c.height, Channels: channels}) {
+			t.Errorf("%dx%d: header %+v", c.width, c.height, h)
+		}
+
+		f, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%dx%d: %v", c.width, c.height, err)
+		}
+		if f.Width != c.width || f.Height != c.height {
+			t.Fatalf("decoded %dx%d, want %dx%d", f.Width, f.Height, c.width, c.height)
+		}
+		for y := 0; y < c.height; y++ {
+			want := append([]byte(nil), pix[y*c.stride:y*c.stride+c.width*4]...)
+			if !c.alpha {
+				for i := 3; i < len(want); i += 4 {
+					want[i] = 0xFF
+				}
+			}
+			if got := f.Pix[y*f.Stride : y*f.Stride+c.width*4]; !bytes.Equal(got, want) {
+				t.Fatalf("%dx%d alpha %v: row %d differs", c.width, c.height, c.alpha, y)
+			}
+		}
+
+		if c.width < 131 {
+			continue
+		}
+		ops, fullRuns := chunkOps(t, data)
+		for op, name := range map[byte]string{opIndex: "index", opDiff: "diff", opLuma: "luma", opRun: "run", opRGB: "RGB"} {
+			if ops[op] == 0 {
+				t.Errorf("%dx%d: no %s chunks", c.width, c.height, name)
+			}
+		}
+		if c.alpha && ops[opRGBA] == 0 {
+			t.Errorf("%dx%d: no RGBA chunks", c.width, c.height)
+		}
+		if !c.alpha && ops[opRGBA] != 0 {
+			t.Errorf("%dx%d: RGBA chunks without alpha", c.width, c.height)
+		}
+		if fullRuns == 0 {
+			t.Errorf("%dx%d: no run split at 62 pixels", c.width, c.height)
+		}
+	}
+}
+
+func TestDecodeImage(t *testing.T) {
+	pix := []byte{0x10, 0x20, 0x30, 0xFF, 0x40, 0x50, 0x60, 0x80}
+	var buf bytes.Buffer
+	if err := Encode(&buf, pix, 2, 1, 8, &Options{Alpha: true}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, name, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil || name != "qoi" || cfg.Width != 2 || cfg.Height != 1 || cfg.ColorModel != color.NRGBAModel {
+		t.Fatalf("DecodeConfig: %+v %q %v", cfg, name, err)
+	}
+	img, _, err := image.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := img.At(1, 0), (color.NRGBA{0x60, 0x50, 0x40, 0x80}); got != want {
+		t.Errorf("pixel 1,0 is %v, want %v", got, want)
+	}
+}
+
+func TestEncodeInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, make([]byte, 16), 0, 4, 4, nil); err == nil {
+		t.Error("empty image encoded")
+	}
+	if err := Encode(&buf, make([]byte, 15), 2, 2, 8, nil); err == nil {
+		t.Error("short buffer encoded")
+	}
+}
+
+func header(width, height uint32, channels, colorspace byte) []byte {
+	b := []byte(magic)
+	b = binary.BigEndian.AppendUint32(b, width)
+	b = binary.BigEndian.AppendUint32(b, height)
+	return append(b, channels, colorspace)
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	var valid bytes.Buffer
+	Encode(&valid, testImage(9, 6, 36), 9, 6, 36, nil)
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad magic", append([]byte("qoiF"), valid.Bytes()[4:]...)},
+		{"zero width", append(header(0, 1, 3, 0), endMarker...)},
+		{"too many pixels", append(header(40000, 40000, 3, 0), endMarker...)},
+		{"overflowing size", append(header(0xFFFFFFFF, 0xFFFFFFFF, 3, 0), endMarker...)},
+		{"bad channels", append(header(1, 1, 5, 0), endMarker...)},
+		{"bad colorspace", append(header(1, 1, 3, 2), endMarker...)},
+		{"truncated", valid.Bytes()[:valid.Len()/2]},
+		{"truncated RGB", append(header(1, 1, 3, 0), opRGB, 1)},
+		{"truncated luma", append(header(1, 1, 3, 0), opLuma)},
+	} {
+		if _, err := Decode(bytes.NewReader(c.data)); err == nil {
+			t.Errorf("%s: Decode succeeded", c.name)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, alpha := range []bool{false, true} {
+		var buf bytes.Buffer
+		Encode(&buf, testImage(70, 6, 70*4), 70, 6, 70*4, &Options{Alpha: alpha})
+		f.Add(buf.Bytes())
+	}
+	f.Add(append(header(2, 2, 4, 1), opRun|3, 0, 0, 0, 0, 0, 0, 0, 1))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fr, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		h, err := DecodeHeader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Decode succeeded but DecodeHeader failed: %v", err)
+		}
+		if fr.Width != h.Width || fr.Height != h.Height || len(fr.Pix) != h.Width*h.Height*4 {
+			t.Fatalf("header %+v, decoded %dx%d with %d bytes", h, fr.Width, fr.Height, len(fr.Pix))
+		}
+	})
+}
@@ -0,0 +1,349 @@
+package qoi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// A stream is a sequence of frames where each frame stores only the tiles that
+// changed since the previous one:
+//
+//	header:   "QOIS" version:u8 tileSize:u16
+//	keyframe: 'K' seq:u64 time:i64 width:u32 height:u32 len:u32 chunks
+//	delta:    'D' seq:u64 time:i64 tiles:u32 { index:u32 len:u32 chunks }
+//
+// Integers are big endian, time is Unix nanoseconds (0 if unknown) and chunks
+// are QOI chunks without header or end marker. Every keyframe and every tile
+// starts from a fresh QOI state, so tiles decode independently.
+const (
+	streamMagic   = "QOIS"
+	streamVersion = 1
+
+	recordKey   = 'K'
+	recordDelta = 'D'
+)
+
+// DefaultTileSize is the edge of the tiles compared and stored by a Stream.
+const DefaultTileSize = 64
+
+// StreamOptions configures a StreamWriter. A nil *StreamOptions uses the defaults.
+type StreamOptions struct {
+	TileSize int
+	// KeyframeInterval writes a full frame every n frames so readers can start
+	// from it. 0 writes keyframes only at the start and on size changes.
+	KeyframeInterval int
+	Alpha            bool
+}
+
+// StreamWriter writes frames as dirty-tile deltas against the previous frame.
+type StreamWriter struct {
+	w    *bufio.Writer
+	opts StreamOptions
+
+	started       bool
+	width, height int
+	prev          []byte
+	sinceKey      int
+	buf           []byte
+}
+
+// NewStreamWriter returns a writer emitting a stream to w.
+func NewStreamWriter(w io.Writer, opts *StreamOptions) *StreamWriter {
+	var o StreamOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.TileSize <= 0 || o.TileSize > 0xFFFF {
+		o.TileSize = DefaultTileSize
+	}
+	return &StreamWriter{w: bufio.NewWriterSize(w, 256*1024), opts: o}
+}
+
+// WriteFrame appends f. Only tiles within f.Damage() are compared against the
+// previous frame, and only those that differ are encoded.
+func (sw *StreamWriter) WriteFrame(f *frame.Frame) error {
+	if !sw.started {
+		hdr := append([]byte(streamMagic), streamVersion)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(sw.opts.TileSize))
+		if _, err := sw.w.Write(hdr); err != nil {
+			return err
+		}
+		sw.started = true
+	}
+
+	key := f.Width != sw.width || f.Height != sw.height ||
+		(sw.opts.KeyframeInterval > 0 && sw.sinceKey >= sw.opts.KeyframeInterval)
+	rec := append(sw.buf[:0], recordDelta)
+	if key {
+		rec[0] = recordKey
+	}
+	rec = binary.BigEndian.AppendUint64(rec, f.Seq)
+	rec = binary.BigEndian.AppendUint64(rec, uint64(unixNano(f.Time)))
+
+	if key {
+		sw.width, sw.height = f.Width, f.Height
+		sw.prev = make([]byte, f.Width*f.Height*4)
+		frame.CopyRect(sw.prev, f.Width*4, f.Pix, f.Stride, f.Rect())
+		sw.sinceKey = 0
+
+		rec = binary.BigEndian.AppendUint32(rec, uint32(f.Width))
+		rec = binary.BigEndian.AppendUint32(rec, uint32(f.Height))
+		rec = binary.BigEndian.AppendUint32(rec, 0)
+		start := len(rec)
+		var s state
+		s.reset()
+		for y := 0; y < f.Height; y++ {
+			rec = s.appendPixels(rec, f.Pix[y*f.Stride:y*f.Stride+f.Width*4], sw.opts.Alpha)
+		}
+		rec = s.flush(rec)
+		binary.BigEndian.PutUint32(rec[start-4:], uint32(len(rec)-start))
+	} else {
+		sw.sinceKey++
+		countAt := len(rec)
+		rec = binary.BigEndian.AppendUint32(rec, 0)
+		count := 0
+		for _, t := range sw.changedTiles(f) {
+			rec = binary.BigEndian.AppendUint32(rec, uint32(t))
+			rec = binary.BigEndian.AppendUint32(rec, 0)
+			start := len(rec)
+			r := tileRect(t, sw.opts.TileSize, sw.width, sw.height)
+			var s state
+			s.reset()
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				rec = s.appendPixels(rec, f.Pix[y*f.Stride+r.Min.X*4:y*f.Stride+r.Max.X*4], sw.opts.Alpha)
+			}
+			rec = s.flush(rec)
+			binary.BigEndian.PutUint32(rec[start-4:], uint32(len(rec)-start))
+			frame.CopyRect(sw.prev, sw.width*4, f.Pix, f.Stride, r)
+			count++
+		}
+		binary.BigEndian.PutUint32(rec[countAt:], uint32(count))
+	}
+
+	sw.buf = rec
+	_, err := sw.w.Write(rec)
+	return err
+}
+
+// changedTiles returns the tiles touched by the damage of f whose pixels
+// differ from the previous frame.
+func (sw *StreamWriter) changedTiles(f *frame.Frame) []int {
+	ts := sw.opts.TileSize
+	cols := (sw.width + ts - 1) / ts
+	rows := (sw.height + ts - 1) / ts
+	candidate := make([]bool, cols*rows)
+	damage := f.Damage()
+	if damage == nil {
+		damage = []image.Rectangle{f.Rect()}
+	}
+	for _, d := range damage {
+		d = d.Intersect(f.Rect())
+		if d.Empty() {
+			continue
+		}
+		for ty := d.Min.Y / ts; ty <= (d.Max.Y-1)/ts; ty++ {
+			for tx := d.Min.X / ts; tx <= (d.Max.X-1)/ts; tx++ {
+				candidate[ty*cols+tx] = true
+			}
+		}
+	}
+
+	var tiles []int
+	stride := sw.width * 4
+	for t, ok := range candidate {
+		if !ok {
+			continue
+		}
+		r := tileRect(t, ts, sw.width, sw.height)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			if !bytes.Equal(f.Pix[y*f.Stride+r.Min.X*4:y*f.Stride+r.Max.X*4], sw.prev[y*stride+r.Min.X*4:y*stride+r.Max.X*4]) {
+				tiles = append(tiles, t)
+				break
+			}
+		}
+	}
+	return tiles
+}
+
+// Flush writes buffered data to the underlying writer.
+func (sw *StreamWriter) Flush() error {
+	return sw.w.Flush()
+}
+
+func tileRect(t, size, width, height int) image.Rectangle {
+	cols := (width + size - 1) / size
+	x, y := t%cols*size, t/cols*size
+	return image.Rect(x, y, min(x+size, width), min(y+size, height))
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// StreamReader decodes a stream written by StreamWriter.
+type StreamReader struct {
+	r        *bufio.Reader
+	tileSize int
+	f        frame.Frame
+	started  bool
+	buf      []byte
+	tile     []byte
+}
+
+// NewStreamReader returns a reader for the stream in r.
+func NewStreamReader(r io.Reader) *StreamReader {
+	return &StreamReader{r: bufio.NewReaderSize(r, 256*1024)}
+}
+
+// Next decodes the next frame. The frame and its buffer are reused by the
+// following call. Dirty lists the tiles that changed; it is nil for keyframes.
+// At the end of the stream Next returns io.EOF.
+func (sr *StreamReader) Next() (*frame.Frame, error) {
+	if !sr.started {
+		var hdr [7]byte
+		if _, err := io.ReadFull(sr.r, hdr[:]); err != nil {
+			return nil, err
+		}
+		if string(hdr[:4]) != streamMagic || hdr[4] != streamVersion {
+			return nil, ErrInvalid
+		}
+		sr.tileSize = int(binary.BigEndian.Uint16(hdr[5:]))
+		if sr.tileSize == 0 {
+			return nil, ErrInvalid
+		}
+		sr.started = true
+	}
+
+	var rec [17]byte
+	if _, err := io.ReadFull(sr.r, rec[:]); err != nil {
+		return nil, err
+	}
+	f := &sr.f
+	f.Seq = binary.BigEndian.Uint64(rec[1:])
+	f.Time = time.Time{}
+	if ns := int64(binary.BigEndian.Uint64(rec[9:])); ns != 0 {
+		f.Time = time.Unix(0, ns)
+	}
+
+	switch rec[0] {
+	case recordKey:
+		var dims [12]byte
+		if err := sr.readFull(dims[:]); err != nil {
+			return nil, err
+		}
+		w := int(binary.BigEndian.Uint32(dims[0:]))
+		h := int(binary.BigEndian.Uint32(dims[4:]))
+		if !validSize(w, h) {
+			return nil, ErrInvalid
+		}
+		data, err := sr.readChunks(int(binary.BigEndian.Uint32(dims[8:])))
+		if err != nil {
+			return nil, err
+		}
+		if !fits(w, h, len(data)) {
+			return nil, ErrInvalid
+		}
+		if w != f.Width || h != f.Height {
+			*f = frame.Frame{Pix: make([]byte, w*h*4), Width: w, Height: h, Stride: w * 4, Seq: f.Seq, Time: f.Time}
+		}
+		var s state
+		s.reset()
+		if _, err := s.readPixels(f.Pix, data); err != nil {
+			return nil, err
+		}
+		f.Dirty = nil
+		return f, nil
+
+	case recordDelta:
+		if f.Pix == nil {
+			return nil, errors.New("qoi: stream does not start with a keyframe")
+		}
+		var n [4]byte
+		if err := sr.readFull(n[:]); err != nil {
+			return nil, err
+		}
+		count := int(binary.BigEndian.Uint32(n[:]))
+		tiles := (f.Width + sr.tileSize - 1) / sr.tileSize * ((f.Height + sr.tileSize - 1) / sr.tileSize)
+		if count > tiles {
+			return nil, ErrInvalid
+		}
+		f.Dirty = f.Dirty[:0]
+		if f.Dirty == nil {
+			f.Dirty = []image.Rectangle{}
+		}
+		for i := 0; i < count; i++ {
+			var th [8]byte
+			if err := sr.readFull(th[:]); err != nil {
+				return nil, err
+			}
+			t := int(binary.BigEndian.Uint32(th[:]))
+			if t >= tiles {
+				return nil, ErrInvalid
+			}
+			data, err := sr.readChunks(int(binary.BigEndian.Uint32(th[4:])))
+			if err != nil {
+				return nil, err
+			}
+			r := tileRect(t, sr.tileSize, f.Width, f.Height)
+			if cap(sr.tile) < r.Dx()*r.Dy()*4 {
+				sr.tile = make([]byte, sr.tileSize*sr.tileSize*4)
+			}
+			pix := sr.tile[:r.Dx()*r.Dy()*4]
+			var s state
+			s.reset()
+			if _, err := s.readPixels(pix, data); err != nil {
+				return nil, err
+			}
+			frame.CopyRect(f.Pix[r.Min.Y*f.Stride+r.Min.X*4:], f.Stride, pix, r.Dx()*4, image.Rect(0, 0, r.Dx(), r.Dy()))
+			f.Dirty = append(f.Dirty, r)
+		}
+		return f, nil
+
+	default:
+		return nil, fmt.Errorf("qoi: unknown stream record %q", rec[0])
+	}
+}
+
+// readFull reads len(b) bytes, treating a clean end of input as truncation.
+func (sr *StreamReader) readFull(b []byte) error {
+	if _, err := io.ReadFull(sr.r, b); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+func (sr *StreamReader) readChunks(n int) ([]byte, error) {
+	if n < 0 || n > maxPixels*5 {
+		return nil, ErrInvalid
+	}
+	if n <= cap(sr.buf) {
+		b := sr.buf[:n]
+		return b, sr.readFull(b)
+	}
+	// Grow with the data actually read, so a corrupt length fails at the end
+	// of the input instead of allocating up front.
+	var b bytes.Buffer
+	b.Grow(min(n, 1<<20))
+	if _, err := io.CopyN(&b, sr.r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	sr.buf = b.Bytes()
+	return sr.buf, nil
+}
@@ -0,0 +1,187 @@
+package qoi
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// streamFrames returns frames of a changing screen. Some report damage wider
+// than what changed, some report damage that changed nothing, and the size
+// changes midway.
+func streamFrames() []*frame.Frame {
+	rnd := rand.New(rand.NewSource(1))
+	f := frame.New(150, 100)
+	rnd.Read(f.Pix)
+	f.Seq, f.Time = 1, time.Unix(1700000000, 0)
+	frames := []*frame.Frame{f.Clone()}
+	paint := func(r image.Rectangle, v byte) {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			row := f.Pix[y*f.Stride+r.Min.X*4 : y*f.Stride+r.Max.X*4]
+			for i := range row {
+				row[i] = v + byte(i)
+			}
+		}
+	}
+	next := func(dirty ...image.Rectangle) {
+		f.Seq++
+		f.Time = f.Time.Add(time.Second / 30)
+		f.Dirty = dirty
+		frames = append(frames, f.Clone())
+	}
+
+	paint(image.Rect(10, 10, 20, 20), 1)
+	next(image.Rect(10, 10, 20, 20))
+	// Damage spanning tiles of which only one changed.
+	paint(image.Rect(130, 90, 150, 100), 2)
+	next(image.Rect(0, 0, 150, 100))
+	// Damage without change.
+	next(image.Rect(60, 60, 70, 70))
+	// No damage reported: the whole frame is compared.
+	paint(image.Rect(64, 0, 65, 1), 3)
+	next()
+
+	g := frame.New(33, 17)
+	rnd.Read(g.Pix)
+	g.Seq = f.Seq + 1
+	frames = append(frames, g.Clone())
+	return frames
+}
+
+func TestStream(t *testing.T) {
+	for _, opts := range []*StreamOptions{nil, {TileSize: 16, KeyframeInterval: 2, Alpha: true}} {
+		frames := streamFrames()
+		var buf bytes.Buffer
+		w := NewStreamWriter(&buf, opts)
+		for _, f := range frames {
+			if err := w.WriteFrame(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewStreamReader(&buf)
+		for i, want := range frames {
+			got, err := r.Next()
+			if err != nil {
+				t.Fatalf("frame %d: %v", i, err)
+			}
+			if got.Seq != want.Seq || !got.Time.Equal(want.Time) || got.Width != want.Width || got.Height != want.Height {
+				t.Fatalf("frame %d: seq %d %v %dx%d", i, got.Seq, got.Time, got.Width, got.Height)
+			}
+			for y := 0; y < want.Height; y++ {
+				gr := got.Pix[y*got.Stride : y*got.Stride+want.Width*4]
+				wr := want.Pix[y*want.Stride : y*want.Stride+want.Width*4]
+				if opts == nil {
+					// Without alpha the reader gets opaque pixels.
+					wr = append([]byte(nil), wr...)
+					for j := 3; j < len(wr); j += 4 {
+						wr[j] = 0xFF
+					}
+				}
+				if !bytes.Equal(gr, wr) {
+					t.Fatalf("frame %d: row %d differs", i, y)
+				}
+			}
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Errorf("after the last frame: %v, want io.EOF", err)
+		}
+	}
+}
+
+func TestStreamTiles(t *testing.T) {
+	frames := streamFrames()
+	var buf bytes.Buffer
+	w := NewStreamWriter(&buf, &StreamOptions{TileSize: 64})
+	for _, f := range frames {
+		w.WriteFrame(f)
+	}
+	w.Flush()
+
+	want := [][]image.Rectangle{
+		nil,
+		{image.Rect(0, 0, 64, 64)},
+		{image.Rect(128, 64, 150, 100)},
+		{},
+		{image.Rect(64, 0, 128, 64)},
+		nil,
+	}
+	r := NewStreamReader(&buf)
+	for i, tiles := range want {
+		f, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(f.Dirty, tiles) {
+			t.Errorf("frame %d: tiles %v, want %v", i, f.Dirty, tiles)
+		}
+	}
+}
+
+func TestStreamInvalid(t *testing.T) {
+	var valid bytes.Buffer
+	w := NewStreamWriter(&valid, nil)
+	for _, f := range streamFrames()[:3] {
+		w.WriteFrame(f)
+	}
+	w.Flush()
+	data := valid.Bytes()
+
+	delta := append([]byte(streamMagic), streamVersion, 0, 64, recordDelta)
+	delta = append(delta, make([]byte, 20)...)
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"bad magic", append([]byte("QOIX"), data[4:]...)},
+		{"bad version", append([]byte(streamMagic), 9, 0, 64)},
+		{"zero tile size", append(append([]byte(streamMagic), streamVersion, 0, 0), data[7:]...)},
+		{"delta first", delta},
+		{"truncated", data[:len(data)-3]},
+	} {
+		r := NewStreamReader(bytes.NewReader(c.data))
+		var err error
+		for err == nil {
+			_, err = r.Next()
+		}
+		if err == io.EOF {
+			t.Errorf("%s: read to the end", c.name)
+		}
+	}
+}
+
+func FuzzStream(f *testing.F) {
+	var buf bytes.Buffer
+	w := NewStreamWriter(&buf, &StreamOptions{TileSize: 16})
+	for _, fr := range streamFrames() {
+		w.WriteFrame(fr)
+	}
+	w.Flush()
+	f.Add(buf.Bytes())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewStreamReader(bytes.NewReader(data))
+		for i := 0; i < 100; i++ {
+			fr, err := r.Next()
+			if err != nil {
+				return
+			}
+			if len(fr.Pix) != fr.Height*fr.Stride {
+				t.Fatalf("%dx%d frame with %d bytes", fr.Width, fr.Height, len(fr.Pix))
+			}
+			for _, d := range fr.Dirty {
+				if !d.In(fr.Rect()) {
+					t.Fatalf("tile %v outside %v", d, fr.Rect())
+				}
+			}
+		}
+	})
+}
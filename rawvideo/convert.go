@@ -0,0 +1,82 @@
+package rawvideo
+
+import (
+	"image"
+	"math"
+)
+
+// yuvCoeffs are fixed point (16 bit) factors for converting 8 bit BGR to
+// Y'CbCr with a given matrix and range.
+type yuvCoeffs struct {
+	yR, yG, yB    int32
+	cbR, cbG, cbB int32
+	crR, crG, crB int32
+	yOff          int32
+}
+
+func newCoeffs(m Matrix, full bool) *yuvCoeffs {
+	kr, kb := 0.2126, 0.0722
+	if m == BT601 {
+		kr, kb = 0.299, 0.114
+	}
+	kg := 1 - kr - kb
+	ys, cs, off := 219.0/255, 224.0/255, 16.0
+	if full {
+		ys, cs, off = 1, 1, 0
+	}
+	fix := func(v float64) int32 { return int32(math.Round(v * 65536)) }
+	cb := cs / (2 * (1 - kb))
+	cr := cs / (2 * (1 - kr))
+	return &yuvCoeffs{
+		yR: fix(kr * ys), yG: fix(kg * ys), yB: fix(kb * ys),
+		cbR: fix(-kr * cb), cbG: fix(-kg * cb), cbB: fix((1 - kb) * cb),
+		crR: fix((1 - kr) * cr), crG: fix(-kg * cr), crB: fix(-kb * cr),
+		yOff: int32(off),
+	}
+}
+
+func clamp8(v int32) byte {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
+
+// convertLuma writes the Y' plane of region r.
+func (c *yuvCoeffs) convertLuma(y []byte, yStride int, pix []byte, stride int, r image.Rectangle) {
+	for row := r.Min.Y; row < r.Max.Y; row++ {
+		src := pix[row*stride+r.Min.X*4 : row*stride+r.Max.X*4]
+		dst := y[row*yStride+r.Min.X:]
+		for i := 0; i < len(src); i += 4 {
+			b, g, rr := int32(src[i]), int32(src[i+1]), int32(src[i+2])
+			dst[i/4] = clamp8(c.yOff + (c.yR*rr+c.yG*g+c.yB*b+1<<15)>>16)
+		}
+	}
+}
+
+// convertChroma writes the 4:2:0 chroma of region r, whose corners must be
+// even (or at the frame edge). Each sample averages a 2x2 block, so samples
+// sit at the block center. A sample lands at cy*cStride + cx*step in u and v,
+// which covers planar (step 1) and interleaved NV12 (step 2, v = u[1:]) planes.
+func (c *yuvCoeffs) convertChroma(u, v []byte, cStride, step int, pix []byte, stride, width, height int, r image.Rectangle) {
+	for cy := r.Min.Y / 2; cy < (r.Max.Y+1)/2; cy++ {
+		y0 := cy * 2
+		y1 := min(y0+1, height-1)
+		for cx := r.Min.X / 2; cx < (r.Max.X+1)/2; cx++ {
+			x0 := cx * 2
+			x1 := min(x0+1, width-1)
+			var b, g, rr int32
+			for _, o := range [4]int{y0*stride + x0*4, y0*stride + x1*4, y1*stride + x0*4, y1*stride + x1*4} {
+				b += int32(pix[o])
+				g += int32(pix[o+1])
+				rr += int32(pix[o+2])
+			}
+			i := cy*cStride + cx*step
+			u[i] = clamp8(128 + (c.cbR*rr+c.cbG*g+c.cbB*b+1<<17)>>18)
+			v[i] = clamp8(128 + (c.crR*rr+c.crG*g+c.crB*b+1<<17)>>18)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package rawvideo
+
+import (
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// DefaultQueue is the number of frames buffered for a process when
+// Options.Queue is 0.
+const DefaultQueue = 8
+
+// Process is an encoder process fed through its standard input.
+type Process struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	w     *Writer
+	q     *queue
+	done  chan struct{}
+}
+
+// Start starts cmd and returns a writer feeding it video. cmd.Stdin must be
+// unset; Stdout and Stderr are left to the caller. Frames are copied into a
+// queue written by a separate goroutine, so a slow encoder does not stall
+// capture until the queue is full.
+func Start(cmd *exec.Cmd, opts *Options) (*Process, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	size := DefaultQueue
+	block := false
+	if opts != nil {
+		block = opts.Block
+		if opts.Queue > 0 {
+			size = opts.Queue
+		}
+	}
+	q := &queue{size: size, block: block}
+	q.cond = sync.NewCond(&q.mu)
+	p := &Process{
+		cmd:   cmd,
+		stdin: stdin,
+		w:     newWriter(q, opts),
+		q:     q,
+		done:  make(chan struct{}),
+	}
+	go p.feed()
+	return p, nil
+}
+
+// WriteFrame adds f to the video; see Writer.WriteFrame. It returns the
+// error of the process's input once writing to it failed.
+func (p *Process) WriteFrame(f *frame.Frame) error {
+	return p.w.WriteFrame(f)
+}
+
+// Tick advances the timeline without a new frame; see Writer.Tick.
+func (p *Process) Tick(now time.Time) error {
+	return p.w.Tick(now)
+}
+
+// Stats returns the frame counters.
+func (p *Process) Stats() Stats {
+	s := p.w.Stats()
+	p.q.mu.Lock()
+	s.Coalesced = p.q.coalesced
+	p.q.mu.Unlock()
+	return s
+}
+
+// Close writes the last frame, waits for the queue to drain, closes the
+// process's input and waits for it to exit.
+func (p *Process) Close() error {
+	err := p.w.Close()
+	p.q.close()
+	<-p.done
+	p.stdin.Close()
+	if werr := p.cmd.Wait(); werr != nil {
+		return werr
+	}
+	if err != nil {
+		return err
+	}
+	p.q.mu.Lock()
+	defer p.q.mu.Unlock()
+	return p.q.err
+}
+
+// feed writes queued frames to the process.
+func (p *Process) feed() {
+	defer close(p.done)
+	for {
+		b, n, ok := p.q.pop()
+		if !ok {
+			return
+		}
+		for i := 0; i < n; i++ {
+			if _, err := p.stdin.Write(b); err != nil {
+				p.q.fail(err)
+				return
+			}
+		}
+		p.q.release(b)
+	}
+}
+
+type queued struct {
+	b []byte
+	n int
+}
+
+// queue buffers output frames between a Writer and the feeding goroutine.
+type queue struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	items     []queued
+	free      [][]byte
+	size      int
+	block     bool
+	closed    bool
+	err       error
+	coalesced int64
+}
+
+func (q *queue) emit(b []byte, n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.block && len(q.items) >= q.size && q.err == nil {
+		q.cond.Wait()
+	}
+	if q.err != nil {
+		return q.err
+	}
+	if len(q.items) >= q.size {
+		// The encoder is behind: repeat the newest queued frame instead.
+		q.items[len(q.items)-1].n += n
+		q.coalesced += int64(n)
+		return nil
+	}
+	var buf []byte
+	if k := len(q.free); k > 0 && cap(q.free[k-1]) >= len(b) {
+		buf = q.free[k-1][:len(b)]
+		q.free = q.free[:k-1]
+	} else {
+		buf = make([]byte, len(b))
+	}
+	copy(buf, b)
+	q.items = append(q.items, queued{buf, n})
+	q.cond.Broadcast()
+	return nil
+}
+
+func (q *queue) pop() ([]byte, int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, 0, false
+	}
+	it := q.items[0]
+	q.items = q.items[1:]
+	q.cond.Broadcast()
+	return it.b, it.n, true
+}
+
+func (q *queue) release(b []byte) {
+	q.mu.Lock()
+	if len(q.free) < q.size {
+		q.free = append(q.free, b)
+	}
+	q.mu.Unlock()
+}
+
+func (q *queue) fail(err error) {
+	q.mu.Lock()
+	q.err = err
+	q.items = nil
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+func (q *queue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// FFmpegInput returns ffmpeg arguments that read the video from standard
+// input, for frames of the given size. Output options follow them, for
+// example:
+//
+//	args := append(rawvideo.FFmpegInput(w, h, opts), "-c:v", "libx264", "out.mp4")
+//	p, err := rawvideo.Start(exec.Command("ffmpeg", args...), opts)
+func FFmpegInput(width, height int, opts *Options) []string {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.FPS <= 0 {
+		o.FPS = DefaultFPS
+	}
+	colorspace, colorRange := "bt709", "tv"
+	if o.Matrix == BT601 {
+		colorspace = "smpte170m"
+	}
+	if o.FullRange {
+		colorRange = "pc"
+	}
+	if o.Format == Y4M {
+		// Y4M carries size, rate and range, but not the matrix.
+		return []string{"-colorspace", colorspace, "-f", "yuv4mpegpipe", "-i", "-"}
+	}
+	args := []string{
+		"-f", "rawvideo",
+		"-pix_fmt", o.Format.String(),
+		"-video_size", strconv.Itoa(width) + "x" + strconv.Itoa(height),
+		"-framerate", strconv.Itoa(o.FPS),
+	}
+	if o.Format == NV12 {
+		args = append(args, "-color_range", colorRange, "-colorspace", colorspace)
+	}
+	return append(args, "-i", "-")
+}
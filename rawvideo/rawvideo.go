@@ -0,0 +1,334 @@
+// Package rawvideo writes frames as uncompressed video for external encoders
+// such as ffmpeg or x264: YUV4MPEG2, raw BGRA or raw NV12 at a constant frame
+// rate.
+package rawvideo
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// Format is an output format.
+type Format int
+
+const (
+	// Y4M is YUV4MPEG2 with 4:2:0 chroma, understood by ffmpeg, x264 and most
+	// other encoders without further options.
+	Y4M Format = iota
+	// BGRA is the captured pixel layout, 4 bytes per pixel.
+	BGRA
+	// NV12 is 4:2:0 with a Y plane followed by interleaved Cb/Cr.
+	NV12
+)
+
+func (f Format) String() string {
+	switch f {
+	case Y4M:
+		return "y4m"
+	case BGRA:
+		return "bgra"
+	case NV12:
+		return "nv12"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Matrix selects the RGB to Y'CbCr conversion.
+type Matrix int
+
+const (
+	// BT709 is the matrix of HD video and the usual choice for screens.
+	BT709 Matrix = iota
+	BT601
+)
+
+// DefaultFPS is the output frame rate when Options.FPS is 0.
+const DefaultFPS = 30
+
+// ErrSizeChanged is returned when a frame's size differs from the first
+// frame's. Raw video streams cannot change resolution; start a new stream.
+var ErrSizeChanged = errors.New("rawvideo: frame size changed")
+
+// Options configures a Writer. A nil *Options writes Y4M at DefaultFPS.
+type Options struct {
+	Format Format
+	// FPS is the constant output rate. Frames are placed on this timeline by
+	// their timestamps, duplicated to fill gaps and dropped when several
+	// fall into one output frame.
+	FPS int
+	// Matrix and FullRange apply to Y4M and NV12. The default is BT.709 with
+	// limited (16-235) range, what encoders assume when nothing is tagged.
+	Matrix    Matrix
+	FullRange bool
+
+	// Queue and Block apply to Start. Queue is the number of distinct frames
+	// buffered for the process, DefaultQueue if 0. When the queue is full,
+	// frames are turned into repeats of the last queued frame, so the
+	// timeline stays correct while the encoder catches up; with Block set,
+	// the writer waits instead.
+	Queue int
+	Block bool
+}
+
+// Stats counts output frames.
+type Stats struct {
+	// Frames is the number of frames written, including duplicates.
+	Frames int64
+	// Duplicated counts frames repeated to keep the rate constant.
+	Duplicated int64
+	// Dropped counts input frames replaced by a later one before output.
+	Dropped int64
+	// Coalesced counts frames turned into repeats because a process fell
+	// behind. It is always 0 for writers not created by Start.
+	Coalesced int64
+}
+
+// sink receives each output frame; b is repeated n times and may be
+// modified once emit returns.
+type sink interface {
+	emit(b []byte, n int) error
+}
+
+type writerSink struct{ w io.Writer }
+
+func (s writerSink) emit(b []byte, n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := s.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writer converts frames and places them on a constant rate timeline. The
+// output is one frame behind the input, since a frame is written only once
+// it is known how long it stays on screen; call Tick while no frames arrive
+// to keep the output flowing, and Close to write the last frame.
+type Writer struct {
+	sink   sink
+	opts   Options
+	coeffs *yuvCoeffs
+
+	started       bool
+	width, height int
+	start         time.Time
+	interval      time.Duration
+	// slot is the next output frame. With pending set, out holds a frame for
+	// it that may still be replaced; otherwise out repeats what was written.
+	slot    int64
+	pending bool
+	out     []byte
+	image   []byte // out without the Y4M frame header
+	stats   Stats
+	err     error
+	closed  bool
+}
+
+// NewWriter returns a writer emitting video to w.
+func NewWriter(w io.Writer, opts *Options) *Writer {
+	return newWriter(writerSink{w}, opts)
+}
+
+func newWriter(s sink, opts *Options) *Writer {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.FPS <= 0 {
+		o.FPS = DefaultFPS
+	}
+	return &Writer{
+		sink:     s,
+		opts:     o,
+		coeffs:   newCoeffs(o.Matrix, o.FullRange),
+		interval: time.Second / time.Duration(o.FPS),
+	}
+}
+
+// FrameSize returns the size of one output frame in bytes, excluding the
+// Y4M frame header.
+func FrameSize(format Format, width, height int) int {
+	if format == BGRA {
+		return width * height * 4
+	}
+	cw, ch := (width+1)/2, (height+1)/2
+	return width*height + cw*ch*2
+}
+
+// Header returns the YUV4MPEG2 stream header for the options.
+func Header(width, height int, opts *Options) string {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.FPS <= 0 {
+		o.FPS = DefaultFPS
+	}
+	colorRange := "LIMITED"
+	if o.FullRange {
+		colorRange = "FULL"
+	}
+	// C420jpeg: chroma sited at the center of each 2x2 block.
+	return "YUV4MPEG2 W" + strconv.Itoa(width) + " H" + strconv.Itoa(height) +
+		" F" + strconv.Itoa(o.FPS) + ":1 Ip A1:1 C420jpeg XYSCSS=420JPEG XCOLORRANGE=" + colorRange + "\n"
+}
+
+// WriteFrame adds f at the time f.Time, or now if f has none. Only the
+// damaged regions of f are converted.
+func (vw *Writer) WriteFrame(f *frame.Frame) error {
+	if vw.err != nil {
+		return vw.err
+	}
+	if vw.closed {
+		return errors.New("rawvideo: writer is closed")
+	}
+	t := f.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	damage := f.Damage()
+	if !vw.started {
+		if f.Width <= 0 || f.Height <= 0 {
+			return errors.New("rawvideo: empty frame")
+		}
+		vw.width, vw.height = f.Width, f.Height
+		vw.start = t
+		vw.alloc()
+		if vw.opts.Format == Y4M {
+			if err := vw.emit([]byte(Header(f.Width, f.Height, &vw.opts)), 1); err != nil {
+				return err
+			}
+		}
+		vw.started = true
+		damage = nil
+	} else if f.Width != vw.width || f.Height != vw.height {
+		return ErrSizeChanged
+	}
+
+	if slot := vw.slotAt(t); slot > vw.slot {
+		if err := vw.flushTo(slot); err != nil {
+			return err
+		}
+	} else if vw.pending {
+		vw.stats.Dropped++
+	}
+	vw.convert(f, damage)
+	vw.pending = true
+	return nil
+}
+
+// Tick writes every output frame that ended before now, repeating the last
+// frame if nothing new arrived. Without it, an idle source produces no
+// output until its next frame.
+func (vw *Writer) Tick(now time.Time) error {
+	if vw.err != nil {
+		return vw.err
+	}
+	if !vw.started || vw.closed {
+		return nil
+	}
+	if slot := vw.slotAt(now); slot > vw.slot {
+		return vw.flushTo(slot)
+	}
+	return nil
+}
+
+// Stats returns the frame counters.
+func (vw *Writer) Stats() Stats {
+	return vw.stats
+}
+
+// Close writes the pending frame. The underlying writer is not closed.
+func (vw *Writer) Close() error {
+	if vw.closed {
+		return vw.err
+	}
+	vw.closed = true
+	if vw.err != nil || !vw.pending {
+		return vw.err
+	}
+	return vw.flushTo(vw.slot + 1)
+}
+
+// slotAt returns the output frame shown at t.
+func (vw *Writer) slotAt(t time.Time) int64 {
+	d := t.Sub(vw.start)
+	if d < 0 {
+		return 0
+	}
+	return int64((d + vw.interval/2) / vw.interval)
+}
+
+// flushTo writes the frames before slot.
+func (vw *Writer) flushTo(slot int64) error {
+	n := slot - vw.slot
+	dups := n
+	if vw.pending {
+		dups--
+	}
+	if err := vw.emit(vw.out, int(n)); err != nil {
+		return err
+	}
+	vw.stats.Frames += n
+	vw.stats.Duplicated += dups
+	vw.slot = slot
+	vw.pending = false
+	return nil
+}
+
+func (vw *Writer) emit(b []byte, n int) error {
+	if err := vw.sink.emit(b, n); err != nil {
+		vw.err = err
+		return err
+	}
+	return nil
+}
+
+func (vw *Writer) alloc() {
+	size := FrameSize(vw.opts.Format, vw.width, vw.height)
+	if vw.opts.Format == Y4M {
+		vw.out = make([]byte, len("FRAME\n")+size)
+		copy(vw.out, "FRAME\n")
+		vw.image = vw.out[len("FRAME\n"):]
+	} else {
+		vw.out = make([]byte, size)
+		vw.image = vw.out
+	}
+}
+
+// convert updates the output image from the damaged regions of f.
+func (vw *Writer) convert(f *frame.Frame, damage []image.Rectangle) {
+	if damage == nil {
+		damage = []image.Rectangle{f.Rect()}
+	}
+	w, h := vw.width, vw.height
+	cw, ch := (w+1)/2, (h+1)/2
+	for _, r := range damage {
+		r = r.Intersect(f.Rect())
+		if r.Empty() {
+			continue
+		}
+		switch vw.opts.Format {
+		case BGRA:
+			frame.CopyRect(vw.image, w*4, f.Pix, f.Stride, r)
+		case NV12:
+			// Chroma covers 2x2 blocks, so the region grows to even edges.
+			r = image.Rect(r.Min.X&^1, r.Min.Y&^1, min(r.Max.X+r.Max.X&1, w), min(r.Max.Y+r.Max.Y&1, h))
+			vw.coeffs.convertLuma(vw.image, w, f.Pix, f.Stride, r)
+			uv := vw.image[w*h:]
+			vw.coeffs.convertChroma(uv, uv[1:], cw*2, 2, f.Pix, f.Stride, w, h, r)
+		default:
+			r = image.Rect(r.Min.X&^1, r.Min.Y&^1, min(r.Max.X+r.Max.X&1, w), min(r.Max.Y+r.Max.Y&1, h))
+			vw.coeffs.convertLuma(vw.image, w, f.Pix, f.Stride, r)
+			u := vw.image[w*h:]
+			v := u[cw*ch:]
+			vw.coeffs.convertChroma(u, v, cw, 1, f.Pix, f.Stride, w, h, r)
+		}
+	}
+}
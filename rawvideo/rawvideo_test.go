@@ -0,0 +1,335 @@
+package rawvideo
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+var start = time.Unix(1700000000, 0)
+
+// gradient returns a frame whose colors change slowly, so 4:2:0 chroma loses
+// little of it.
+func gradient(w, h int) *frame.Frame {
+	f := frame.New(w, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			copy(f.Pix[f.PixOffset(x, y):], []byte{byte(40 + x*2), byte(200 - y*2), byte(60 + x + y), 0xFF})
+		}
+	}
+	f.Time = start
+	return f
+}
+
+// solid returns a frame of one color.
+func solid(w, h int, c color.RGBA) *frame.Frame {
+	f := frame.New(w, h)
+	for i := 0; i < len(f.Pix); i += 4 {
+		f.Pix[i], f.Pix[i+1], f.Pix[i+2], f.Pix[i+3] = c.B, c.G, c.R, 0xFF
+	}
+	f.Time = start
+	return f
+}
+
+func encode(t *testing.T, opts *Options, frames ...*frame.Frame) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf, opts)
+	for _, f := range frames {
+		if err := w.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// y4mFrames splits a YUV4MPEG2 stream into its header and frame images.
+func y4mFrames(t *testing.T, b []byte, w, h int) (string, [][]byte) {
+	t.Helper()
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		t.Fatal("no Y4M header")
+	}
+	header := string(b[:i])
+	b = b[i+1:]
+	size := FrameSize(Y4M, w, h)
+	var frames [][]byte
+	for len(b) > 0 {
+		if !bytes.HasPrefix(b, []byte("FRAME\n")) || len(b) < 6+size {
+			t.Fatalf("frame %d: bad frame header or %d bytes left", len(frames), len(b))
+		}
+		frames = append(frames, b[6:6+size])
+		b = b[6+size:]
+	}
+	return header, frames
+}
+
+// ycbcr wraps 4:2:0 planes as an image.YCbCr, which converts with the
+// full range BT.601 matrix of JFIF.
+func ycbcr(y, cb, cr []byte, w, h int) *image.YCbCr {
+	cw := (w + 1) / 2
+	return &image.YCbCr{
+		Y: y, Cb: cb, Cr: cr,
+		YStride: w, CStride: cw,
+		SubsampleRatio: image.YCbCrSubsampleRatio420,
+		Rect:           image.Rect(0, 0, w, h),
+	}
+}
+
+// checkImage fails if img differs from f by more than tol in a channel.
+func checkImage(t *testing.T, name string, img image.Image, f *frame.Frame, tol int) {
+	t.Helper()
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			p := f.Pix[f.PixOffset(x, y):]
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			for k, v := range []byte{c.B, c.G, c.R} {
+				if d := int(v) - int(p[k]); d < -tol || d > tol {
+					t.Fatalf("%s: pixel %d,%d is %v, want % x", name, x, y, c, p[:3])
+				}
+			}
+		}
+	}
+}
+
+func TestY4M(t *testing.T) {
+	f := gradient(33, 19)
+	opts := &Options{FPS: 25, Matrix: BT601, FullRange: true}
+	header, frames := y4mFrames(t, encode(t, opts, f), 33, 19)
+	if want := strings.TrimSuffix(Header(33, 19, opts), "\n"); header != want {
+		t.Errorf("header %q, want %q", header, want)
+	}
+	if !strings.HasPrefix(header, "YUV4MPEG2 W33 H19 F25:1 ") || !strings.Contains(header, "XCOLORRANGE=FULL") {
+		t.Errorf("header %q", header)
+	}
+	if len(frames) != 1 {
+		t.Fatalf("%d frames", len(frames))
+	}
+	n, c := 33*19, 17*10
+	img := frames[0]
+	checkImage(t, "y4m", ycbcr(img[:n], img[n:n+c], img[n+c:], 33, 19), f, 6)
+
+	// NV12 holds the same samples with Cb and Cr interleaved.
+	opts.Format = NV12
+	nv12 := encode(t, opts, f)
+	if len(nv12) != FrameSize(NV12, 33, 19) || !bytes.Equal(nv12[:n], img[:n]) {
+		t.Fatalf("NV12: %d bytes, luma differs from Y4M", len(nv12))
+	}
+	for i := 0; i < c; i++ {
+		if nv12[n+2*i] != img[n+i] || nv12[n+2*i+1] != img[n+c+i] {
+			t.Fatalf("NV12 chroma sample %d differs from Y4M", i)
+		}
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	colors := []color.RGBA{{255, 255, 255, 255}, {0, 0, 0, 255}, {255, 0, 0, 255}, {0, 0, 255, 255}}
+	for _, c := range []struct {
+		matrix Matrix
+		full   bool
+		want   [][3]int // Y, Cb, Cr per color
+	}{
+		{BT709, false, [][3]int{{235, 128, 128}, {16, 128, 128}, {63, 102, 240}, {32, 240, 118}}},
+		{BT601, false, [][3]int{{235, 128, 128}, {16, 128, 128}, {81, 90, 240}, {41, 240, 110}}},
+		{BT709, true, [][3]int{{255, 128, 128}, {0, 128, 128}, {54, 99, 255}, {18, 255, 116}}},
+	} {
+		for i, col := range colors {
+			_, frames := y4mFrames(t, encode(t, &Options{Matrix: c.matrix, FullRange: c.full}, solid(4, 2, col)), 4, 2)
+			img := frames[0]
+			got := [3]int{int(img[0]), int(img[8]), int(img[10])}
+			for k := range got {
+				if d := got[k] - c.want[i][k]; d < -1 || d > 1 {
+					t.Errorf("matrix %d full %v: %v is Y'CbCr %v, want %v", c.matrix, c.full, col, got, c.want[i])
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestBGRA(t *testing.T) {
+	f := gradient(10, 7)
+	out := encode(t, &Options{Format: BGRA}, f)
+	if !bytes.Equal(out, f.Pix) {
+		t.Error("BGRA output differs from the frame")
+	}
+}
+
+// TestTimeline places frames on a 10 fps timeline: gaps are filled by
+// repeating a frame, and frames sharing an output slot keep only the last.
+func TestTimeline(t *testing.T) {
+	shades := []byte{10, 20, 30, 40, 50}
+	var frames []*frame.Frame
+	for i, ms := range []int{0, 100, 350, 360, 370} {
+		f := solid(2, 2, color.RGBA{B: shades[i]})
+		f.Time = start.Add(time.Duration(ms) * time.Millisecond)
+		frames = append(frames, f)
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf, &Options{Format: BGRA, FPS: 10})
+	for _, f := range frames {
+		w.WriteFrame(f)
+	}
+	w.Close()
+
+	var got []byte
+	for b := buf.Bytes(); len(b) > 0; b = b[16:] {
+		got = append(got, b[0])
+	}
+	if want := []byte{10, 20, 20, 20, 50}; !bytes.Equal(got, want) {
+		t.Errorf("output frames %v, want %v", got, want)
+	}
+	if s := w.Stats(); s != (Stats{Frames: 5, Duplicated: 2, Dropped: 2}) {
+		t.Errorf("stats %+v", s)
+	}
+
+	// Tick keeps an idle source flowing.
+	buf.Reset()
+	w = NewWriter(&buf, &Options{Format: BGRA, FPS: 10})
+	w.WriteFrame(frames[0])
+	w.Tick(start.Add(320 * time.Millisecond))
+	if n := buf.Len() / 16; n != 3 {
+		t.Errorf("%d frames after 320ms idle, want 3", n)
+	}
+	// The repeated frame is already out, so Close adds nothing.
+	w.Close()
+	if s := w.Stats(); s.Frames != 3 || s.Duplicated != 2 {
+		t.Errorf("stats after Tick %+v", s)
+	}
+}
+
+// TestDamage checks that only damaged regions are converted.
+func TestDamage(t *testing.T) {
+	for _, format := range []Format{Y4M, BGRA, NV12} {
+		a := gradient(16, 12)
+		b := a.Clone()
+		b.Time = start.Add(time.Second / 30)
+		for _, p := range []image.Point{{5, 5}, {12, 2}} {
+			copy(b.Pix[b.PixOffset(p.X, p.Y):], []byte{0, 0, 0, 0xFF})
+		}
+		b.Dirty = []image.Rectangle{image.Rect(5, 5, 6, 6)}
+
+		out := encode(t, &Options{Format: format}, a, b)
+		if format == Y4M {
+			out = out[bytes.IndexByte(out, '\n')+1:]
+		}
+		size := len(out) / 2
+		first, second := out[:size], out[size:]
+		// The pixel outside the damage keeps its old value, so the frames
+		// differ only around 5,5.
+		want := encode(t, &Options{Format: format}, a)
+		c := b.Clone()
+		copy(c.Pix[c.PixOffset(12, 2):], a.Pix[a.PixOffset(12, 2):][:4])
+		c.Dirty = nil
+		want2 := encode(t, &Options{Format: format}, c)
+		if format == Y4M {
+			want = want[bytes.IndexByte(want, '\n')+1:]
+			want2 = want2[bytes.IndexByte(want2, '\n')+1:]
+		}
+		if !bytes.Equal(first, want) || !bytes.Equal(second, want2) {
+			t.Errorf("%v: output does not follow the damage", format)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	w := NewWriter(io.Discard, nil)
+	if err := w.WriteFrame(frame.New(0, 0)); err == nil {
+		t.Error("wrote an empty frame")
+	}
+	w.WriteFrame(gradient(8, 8))
+	if err := w.WriteFrame(gradient(8, 9)); err != ErrSizeChanged {
+		t.Errorf("resized frame: %v, want ErrSizeChanged", err)
+	}
+	w.Close()
+	if err := w.WriteFrame(gradient(8, 8)); err == nil {
+		t.Error("wrote a frame after Close")
+	}
+}
+
+func TestFFmpegInput(t *testing.T) {
+	for _, c := range []struct {
+		opts *Options
+		want string
+	}{
+		{nil, "-colorspace bt709 -f yuv4mpegpipe -i -"},
+		{&Options{Format: BGRA, FPS: 60}, "-f rawvideo -pix_fmt bgra -video_size 64x48 -framerate 60 -i -"},
+		{&Options{Format: NV12, Matrix: BT601, FullRange: true}, "-f rawvideo -pix_fmt nv12 -video_size 64x48 -framerate 30 -color_range pc -colorspace smpte170m -i -"},
+	} {
+		if got := strings.Join(FFmpegInput(64, 48, c.opts), " "); got != c.want {
+			t.Errorf("%+v: %q, want %q", c.opts, got, c.want)
+		}
+	}
+}
+
+// TestHelperProcess is the encoder process of TestStart: it copies its input
+// to its output.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("RAWVIDEO_HELPER") != "1" {
+		return
+	}
+	io.Copy(os.Stdout, os.Stdin)
+	os.Exit(0)
+}
+
+func TestStart(t *testing.T) {
+	var frames []*frame.Frame
+	for i := 0; i < 20; i++ {
+		f := gradient(24, 16)
+		f.Pix[0] = byte(i)
+		f.Time = start.Add(time.Duration(i) * 70 * time.Millisecond)
+		frames = append(frames, f)
+	}
+	// A blocking queue never coalesces, so the process gets every frame.
+	for _, opts := range []*Options{{FPS: 20, Block: true}, {FPS: 20, Format: NV12, Queue: 1, Block: true}} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+		cmd.Env = append(os.Environ(), "RAWVIDEO_HELPER=1")
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		p, err := Start(cmd, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range frames {
+			if err := p.WriteFrame(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+		want := encode(t, opts, frames...)
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("%v: process received %d bytes, want the %d bytes NewWriter writes", opts.Format, out.Len(), len(want))
+		}
+		if s := p.Stats(); s != (Stats{Frames: 28, Duplicated: 8}) {
+			t.Errorf("%v: stats %+v", opts.Format, s)
+		}
+	}
+
+	// A process that exits early fails the writes.
+	p, err := Start(exec.Command(os.Args[0], "-test.run=^$"), &Options{Block: true, Queue: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var werr error
+	for i := 0; i < 2000 && werr == nil; i++ {
+		f := gradient(64, 64)
+		f.Time = start.Add(time.Duration(i) * time.Second)
+		werr = p.WriteFrame(f)
+	}
+	if err := p.Close(); werr == nil && err == nil {
+		t.Error("writing to an exited process succeeded")
+	}
+}
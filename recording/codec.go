@@ -0,0 +1,123 @@
+package recording
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec compresses record payloads. Each payload is compressed on its own, so
+// records decode independently. Codecs must be safe for concurrent use.
+//
+// zstd is not built in, to keep the module free of dependencies outside the
+// standard library; wrap an implementation such as
+// github.com/klauspost/compress/zstd in a Codec and register it on both the
+// writing and the reading side.
+type Codec interface {
+	// ID identifies the codec in the file header. IDs below 16 are reserved.
+	ID() uint8
+	// Compress appends the compressed form of src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends the decompressed form of src to dst. rawLen is the
+	// size the data had before compression.
+	Decompress(dst, src []byte, rawLen int) ([]byte, error)
+}
+
+// Built-in codec IDs.
+const (
+	CodecNone    = 0
+	CodecDeflate = 1
+	// CodecZstd is the ID to use for a registered zstd codec.
+	CodecZstd = 2
+)
+
+var (
+	// None stores payloads uncompressed.
+	None Codec = noneCodec{}
+	// Deflate compresses with compress/flate at BestSpeed, which keeps up
+	// with capture and shrinks screen content well.
+	Deflate Codec = &deflateCodec{level: flate.BestSpeed}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[uint8]Codec{CodecNone: None, CodecDeflate: Deflate}
+)
+
+// RegisterCodec makes c available to readers. It replaces any codec
+// registered with the same ID.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.ID()] = c
+}
+
+func lookupCodec(id uint8) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("recording: unknown codec %d", id)
+	}
+	return c, nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) ID() uint8 { return CodecNone }
+
+func (noneCodec) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noneCodec) Decompress(dst, src []byte, rawLen int) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+type deflateCodec struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (c *deflateCodec) ID() uint8 { return CodecDeflate }
+
+func (c *deflateCodec) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	fw, _ := c.writers.Get().(*flate.Writer)
+	if fw == nil {
+		var err error
+		if fw, err = flate.NewWriter(buf, c.level); err != nil {
+			return dst, err
+		}
+	} else {
+		fw.Reset(buf)
+	}
+	defer c.writers.Put(fw)
+	if _, err := fw.Write(src); err != nil {
+		return dst, err
+	}
+	if err := fw.Close(); err != nil {
+		return dst, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *deflateCodec) Decompress(dst, src []byte, rawLen int) ([]byte, error) {
+	br := bytes.NewReader(src)
+	fr, _ := c.readers.Get().(io.ReadCloser)
+	if fr == nil {
+		fr = flate.NewReader(br)
+	} else if err := fr.(flate.Resetter).Reset(br, nil); err != nil {
+		return dst, err
+	}
+	defer c.readers.Put(fr)
+	n := len(dst)
+	dst = append(dst, make([]byte, rawLen)...)
+	if _, err := io.ReadFull(fr, dst[n:]); err != nil {
+		return dst[:n], ErrInvalid
+	}
+	return dst, nil
+}
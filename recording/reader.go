@@ -0,0 +1,430 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// Reader decodes a recording and seeks in it by time.
+type Reader struct {
+	r        io.ReadSeeker
+	br       *bufio.Reader
+	codec    Codec
+	tileSize int
+	end      int64 // offset of the index, or of the end of the data
+	frames   uint64
+	index    []indexEntry
+	last     int64
+
+	pos     int64 // offset of the next record
+	pending *recordHeader
+	f       frame.Frame
+	have    bool
+	raw     []byte
+	payload []byte
+}
+
+type recordHeader struct {
+	typ    byte
+	seq    uint64
+	time   int64
+	rawLen int
+	size   int
+}
+
+// Open reads the header and index of the recording in r. A recording whose
+// writer was not closed is scanned instead, and ends at the last complete
+// frame.
+func Open(r io.ReadSeeker) (*Reader, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, ErrInvalid
+	}
+	if string(hdr[:4]) != magic || hdr[4] != version {
+		return nil, ErrInvalid
+	}
+	codec, err := lookupCodec(hdr[5])
+	if err != nil {
+		return nil, err
+	}
+	rd := &Reader{
+		r:        r,
+		br:       bufio.NewReaderSize(r, 256*1024),
+		codec:    codec,
+		tileSize: int(binary.BigEndian.Uint16(hdr[6:])),
+	}
+	if rd.tileSize == 0 {
+		return nil, ErrInvalid
+	}
+	if err := rd.readIndex(size); err != nil {
+		if err := rd.scan(); err != nil {
+			return nil, err
+		}
+	}
+	if len(rd.index) == 0 {
+		return nil, errors.New("recording: no frames recorded")
+	}
+	return rd, rd.seek(headerSize)
+}
+
+// readIndex loads the trailing index, and the time of the last frame.
+func (rd *Reader) readIndex(size int64) error {
+	if size < headerSize+footerSize {
+		return ErrInvalid
+	}
+	var footer [footerSize]byte
+	if _, err := rd.r.Seek(size-footerSize, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rd.r, footer[:]); err != nil {
+		return err
+	}
+	off := int64(binary.BigEndian.Uint64(footer[:]))
+	if string(footer[8:]) != indexMagic || off < headerSize || off > size-footerSize-13 {
+		return ErrInvalid
+	}
+	b := make([]byte, size-footerSize-off)
+	if _, err := rd.r.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rd.r, b); err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint32(b[9:]))
+	if b[0] != recordIndex || len(b) != 13+n*24 {
+		return ErrInvalid
+	}
+	index := make([]indexEntry, n)
+	for i := range index {
+		e := b[13+i*24:]
+		index[i] = indexEntry{
+			offset: int64(binary.BigEndian.Uint64(e)),
+			seq:    binary.BigEndian.Uint64(e[8:]),
+			time:   int64(binary.BigEndian.Uint64(e[16:])),
+		}
+		if index[i].offset < headerSize || index[i].offset >= off {
+			return ErrInvalid
+		}
+	}
+	rd.frames = binary.BigEndian.Uint64(b[1:])
+	rd.index = index
+	rd.end = off
+
+	// The last frame follows the last keyframe, so only that span is read.
+	if n == 0 {
+		return nil
+	}
+	if err := rd.seek(index[n-1].offset); err != nil {
+		return err
+	}
+	for {
+		h, err := rd.peek()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rd.last = h.time
+		if err := rd.skip(); err != nil {
+			return err
+		}
+	}
+}
+
+// scan rebuilds the index by walking every record.
+func (rd *Reader) scan() error {
+	rd.index, rd.frames, rd.end = nil, 0, 1<<62
+	if err := rd.seek(headerSize); err != nil {
+		return err
+	}
+	for {
+		off := rd.pos
+		h, err := rd.peek()
+		if err != nil {
+			// A truncated or unknown record ends the recording.
+			rd.end = off
+			return nil
+		}
+		if err := rd.skip(); err != nil {
+			rd.end = off
+			return nil
+		}
+		if h.typ == recordKey {
+			rd.index = append(rd.index, indexEntry{offset: off, seq: h.seq, time: h.time})
+		}
+		if len(rd.index) > 0 {
+			rd.frames++
+			rd.last = h.time
+		}
+	}
+}
+
+// Len returns the number of frames.
+func (rd *Reader) Len() int {
+	return int(rd.frames)
+}
+
+// Start returns the time of the first frame.
+func (rd *Reader) Start() time.Time {
+	return time.Unix(0, rd.index[0].time)
+}
+
+// End returns the time of the last frame.
+func (rd *Reader) End() time.Time {
+	return time.Unix(0, rd.last)
+}
+
+// Next decodes the next frame. The frame and its buffer are reused by later
+// calls. Dirty is nil for keyframes; for deltas it lists the tiles that
+// changed, and Moves the regions copied before them. At the end of the
+// recording Next returns io.EOF.
+func (rd *Reader) Next() (*frame.Frame, error) {
+	h, err := rd.peek()
+	if err != nil {
+		return nil, err
+	}
+	rd.pending = nil
+	if cap(rd.payload) < h.size {
+		rd.payload = make([]byte, h.size)
+	}
+	payload := rd.payload[:h.size]
+	if err := rd.readFull(payload); err != nil {
+		return nil, err
+	}
+	rd.pos += int64(h.size)
+
+	raw := payload
+	if h.size > 0 {
+		if h.rawLen > maxPixels*3+16 {
+			return nil, ErrInvalid
+		}
+		if raw, err = rd.codec.Decompress(rd.raw[:0], payload, h.rawLen); err != nil {
+			return nil, err
+		}
+		rd.raw = raw
+		if len(raw) != h.rawLen {
+			return nil, ErrInvalid
+		}
+	}
+
+	f := &rd.f
+	f.Seq = h.seq
+	f.Time = time.Unix(0, h.time)
+	if h.typ == recordKey {
+		err = rd.decodeKey(raw)
+	} else if !rd.have {
+		err = errors.New("recording: delta without keyframe")
+	} else {
+		err = rd.decodeDelta(raw)
+	}
+	if err != nil {
+		rd.have = false
+		return nil, err
+	}
+	rd.have = true
+	return f, nil
+}
+
+func (rd *Reader) decodeKey(raw []byte) error {
+	if len(raw) < 8 {
+		return ErrInvalid
+	}
+	w := int(binary.BigEndian.Uint32(raw))
+	h := int(binary.BigEndian.Uint32(raw[4:]))
+	if w <= 0 || h <= 0 || w*h > maxPixels || len(raw) != 8+w*h*3 {
+		return ErrInvalid
+	}
+	f := &rd.f
+	if w != f.Width || h != f.Height {
+		f.Pix = make([]byte, w*h*4)
+		f.Width, f.Height, f.Stride = w, h, w*4
+	}
+	putBGR(f.Pix, f.Stride, f.Rect(), raw[8:])
+	f.Dirty, f.Moves = nil, f.Moves[:0]
+	return nil
+}
+
+func (rd *Reader) decodeDelta(raw []byte) error {
+	f := &rd.f
+	f.Moves = f.Moves[:0]
+	f.Dirty = f.Dirty[:0]
+	if f.Dirty == nil {
+		f.Dirty = []image.Rectangle{}
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+
+	if len(raw) < 4 {
+		return ErrInvalid
+	}
+	n := int(binary.BigEndian.Uint32(raw))
+	raw = raw[4:]
+	if n > len(raw)/24 {
+		return ErrInvalid
+	}
+	for i := 0; i < n; i++ {
+		var v [6]int
+		for j := range v {
+			v[j] = int(binary.BigEndian.Uint32(raw[j*4:]))
+		}
+		raw = raw[24:]
+		m := frame.Move{Src: image.Pt(v[0], v[1]), Dst: image.Rect(v[2], v[3], v[4], v[5])}
+		src := m.Dst.Sub(m.Dst.Min).Add(m.Src)
+		if m.Dst.Empty() || !m.Dst.In(f.Rect()) || !src.In(f.Rect()) {
+			return ErrInvalid
+		}
+		movePixels(f.Pix, f.Stride, m.Src, m.Dst)
+		f.Moves = append(f.Moves, m)
+	}
+
+	if len(raw) < 4 {
+		return ErrInvalid
+	}
+	n = int(binary.BigEndian.Uint32(raw))
+	raw = raw[4:]
+	ts := rd.tileSize
+	tiles := (f.Width + ts - 1) / ts * ((f.Height + ts - 1) / ts)
+	for i := 0; i < n; i++ {
+		if len(raw) < 4 {
+			return ErrInvalid
+		}
+		t := int(binary.BigEndian.Uint32(raw))
+		raw = raw[4:]
+		if t >= tiles {
+			return ErrInvalid
+		}
+		r := tileRect(t, ts, f.Width, f.Height)
+		if len(raw) < r.Dx()*r.Dy()*3 {
+			return ErrInvalid
+		}
+		raw = putBGR(f.Pix, f.Stride, r, raw)
+		f.Dirty = append(f.Dirty, r)
+	}
+	if len(raw) != 0 {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// FrameAt returns the last frame at or before t, or the first frame if t is
+// earlier. Decoding resumes from the current position when t lies ahead in
+// the same keyframe interval, so stepping forward through time is cheap.
+// The frame is reused by later calls.
+func (rd *Reader) FrameAt(t time.Time) (*frame.Frame, error) {
+	ns := t.UnixNano()
+	k := sort.Search(len(rd.index), func(i int) bool { return rd.index[i].time > ns }) - 1
+	k = max(k, 0)
+	key := rd.index[k]
+	// Keep going from the current frame if no keyframe lies between it and t.
+	resume := rd.have && rd.pos > key.offset && unixNano(rd.f.Time) <= ns
+	if !resume {
+		if err := rd.seek(key.offset); err != nil {
+			return nil, err
+		}
+		if _, err := rd.Next(); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		h, err := rd.peek()
+		if err == io.EOF || err == nil && h.time > ns {
+			return &rd.f, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := rd.Next(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Rewind positions the reader before the first frame.
+func (rd *Reader) Rewind() error {
+	return rd.seek(rd.index[0].offset)
+}
+
+func (rd *Reader) seek(off int64) error {
+	if _, err := rd.r.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	rd.br.Reset(rd.r)
+	rd.pos = off
+	rd.pending = nil
+	rd.have = false
+	return nil
+}
+
+// peek reads the header of the next record without its payload.
+func (rd *Reader) peek() (*recordHeader, error) {
+	if rd.pending != nil {
+		return rd.pending, nil
+	}
+	if rd.pos >= rd.end {
+		return nil, io.EOF
+	}
+	var b [recordSize]byte
+	if _, err := io.ReadFull(rd.br, b[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	h := &recordHeader{
+		typ:    b[0],
+		seq:    binary.BigEndian.Uint64(b[1:]),
+		time:   int64(binary.BigEndian.Uint64(b[9:])),
+		rawLen: int(binary.BigEndian.Uint32(b[17:])),
+		size:   int(binary.BigEndian.Uint32(b[21:])),
+	}
+	switch h.typ {
+	case recordKey, recordDelta:
+	case recordIndex:
+		return nil, io.EOF
+	default:
+		return nil, fmt.Errorf("recording: unknown record %q", h.typ)
+	}
+	rd.pos += recordSize
+	rd.pending = h
+	return h, nil
+}
+
+// skip discards the payload of the pending record.
+func (rd *Reader) skip() error {
+	h := rd.pending
+	rd.pending = nil
+	if _, err := rd.br.Discard(h.size); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	rd.pos += int64(h.size)
+	rd.have = false
+	return nil
+}
+
+// readFull reads len(b) bytes, treating a clean end of input as truncation.
+func (rd *Reader) readFull(b []byte) error {
+	if _, err := io.ReadFull(rd.br, b); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
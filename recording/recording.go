@@ -0,0 +1,103 @@
+// Package recording stores long captures compactly in a seekable file: full
+// keyframes at intervals and, in between, only the tiles that changed and the
+// regions that moved.
+package recording
+
+import (
+	"errors"
+	"image"
+	"time"
+)
+
+// A recording is laid out as
+//
+//	header:  "DDRC" version:u8 codec:u8 tileSize:u16
+//	records: type:u8 seq:u64 time:i64 rawLen:u32 len:u32 payload[len]
+//	index:   'I' frames:u64 keyframes:u32 { offset:u64 seq:u64 time:i64 }
+//	footer:  indexOffset:u64 "DDRI"
+//
+// Integers are big endian and time is Unix nanoseconds. Payloads are
+// compressed independently with the codec named in the header, rawLen being
+// their decompressed size; an empty payload is stored as is. Uncompressed:
+//
+//	keyframe 'K': width:u32 height:u32 pixels (BGR, row by row)
+//	delta    'D': moves:u32 { srcX:u32 srcY:u32 dst:4*u32 }
+//	              tiles:u32 { index:u32 pixels (BGR) }
+//
+// Moves are applied before tiles. The index lists keyframes; a recording that
+// was not closed has none and is scanned when opened.
+const (
+	magic       = "DDRC"
+	indexMagic  = "DDRI"
+	version     = 1
+	headerSize  = 8
+	recordSize  = 25
+	footerSize  = 12
+	recordKey   = 'K'
+	recordDelta = 'D'
+	recordIndex = 'I'
+
+	// maxPixels bounds decoded frames to protect against corrupt data.
+	maxPixels = 400_000_000
+)
+
+// DefaultTileSize is the edge of the tiles compared and stored in deltas.
+const DefaultTileSize = 64
+
+// DefaultKeyframeInterval is the time between keyframes when
+// Options.KeyframeInterval is 0. Seeking decodes at most this much.
+const DefaultKeyframeInterval = 10 * time.Second
+
+// ErrInvalid is returned for data that is not a valid recording.
+var ErrInvalid = errors.New("recording: invalid data")
+
+func tileRect(t, size, width, height int) image.Rectangle {
+	cols := (width + size - 1) / size
+	x, y := t%cols*size, t/cols*size
+	return image.Rect(x, y, min(x+size, width), min(y+size, height))
+}
+
+// movePixels copies the region at src to dst within pix, which may overlap.
+func movePixels(pix []byte, stride int, src image.Point, dst image.Rectangle) {
+	n := dst.Dx() * 4
+	dy := src.Y - dst.Min.Y
+	if dy >= 0 {
+		for y := dst.Min.Y; y < dst.Max.Y; y++ {
+			copy(pix[y*stride+dst.Min.X*4:][:n], pix[(y+dy)*stride+src.X*4:])
+		}
+		return
+	}
+	for y := dst.Max.Y - 1; y >= dst.Min.Y; y-- {
+		copy(pix[y*stride+dst.Min.X*4:][:n], pix[(y+dy)*stride+src.X*4:])
+	}
+}
+
+// appendBGR appends region r of a BGRA buffer without alpha.
+func appendBGR(dst, pix []byte, stride int, r image.Rectangle) []byte {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := pix[y*stride+r.Min.X*4 : y*stride+r.Max.X*4]
+		for i := 0; i < len(row); i += 4 {
+			dst = append(dst, row[i], row[i+1], row[i+2])
+		}
+	}
+	return dst
+}
+
+// putBGR writes BGR data into region r of a BGRA buffer and returns the rest.
+func putBGR(pix []byte, stride int, r image.Rectangle, src []byte) []byte {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := pix[y*stride+r.Min.X*4 : y*stride+r.Max.X*4]
+		for i := 0; i < len(row); i += 4 {
+			row[i], row[i+1], row[i+2], row[i+3] = src[0], src[1], src[2], 255
+			src = src[3:]
+		}
+	}
+	return src
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
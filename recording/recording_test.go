@@ -0,0 +1,326 @@
+package recording
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+var start = time.Unix(1700000000, 0)
+
+// recFrames returns frames 100ms apart: a noisy screen with a painted
+// region, a scroll reported as a move, an idle frame, damage that changed
+// nothing, and a size change.
+func recFrames() []*frame.Frame {
+	rnd := rand.New(rand.NewSource(1))
+	f := frame.New(100, 70)
+	rnd.Read(f.Pix)
+	f.Seq, f.Time = 1, start
+	frames := []*frame.Frame{f.Clone()}
+	next := func(dirty []image.Rectangle, moves ...frame.Move) {
+		f.Seq++
+		f.Time = f.Time.Add(100 * time.Millisecond)
+		f.Dirty, f.Moves = dirty, moves
+		frames = append(frames, f.Clone())
+	}
+
+	for y := 10; y < 20; y++ {
+		rnd.Read(f.Pix[f.PixOffset(70, y):f.PixOffset(90, y)])
+	}
+	next([]image.Rectangle{image.Rect(70, 10, 90, 20)})
+
+	// Scroll rows 10 to 60 up by 10 and fill the bottom.
+	copy(f.Pix[f.PixOffset(0, 0):f.PixOffset(0, 50)], f.Pix[f.PixOffset(0, 10):f.PixOffset(0, 60)])
+	rnd.Read(f.Pix[f.PixOffset(0, 50):f.PixOffset(0, 60)])
+	next([]image.Rectangle{image.Rect(0, 50, 100, 60)}, frame.Move{Src: image.Pt(0, 10), Dst: image.Rect(0, 0, 100, 50)})
+
+	next([]image.Rectangle{})
+	next([]image.Rectangle{image.Rect(0, 0, 100, 70)})
+	for i := 0; i < 4; i++ {
+		f.Pix[f.PixOffset(5+i*20, 65)] ^= 0xFF
+		next(nil)
+	}
+
+	g := frame.New(40, 30)
+	rnd.Read(g.Pix)
+	g.Seq, g.Time = f.Seq+1, f.Time.Add(100*time.Millisecond)
+	frames = append(frames, g.Clone())
+	g.Pix[0] ^= 0xFF
+	g.Seq, g.Time = g.Seq+1, g.Time.Add(100*time.Millisecond)
+	frames = append(frames, g.Clone())
+	return frames
+}
+
+func record(t *testing.T, opts *Options, frames []*frame.Frame) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf, opts)
+	for _, f := range frames {
+		if err := w.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// samePixels reports whether got holds the pixels of want, opaque.
+func samePixels(got, want *frame.Frame) bool {
+	if got.Width != want.Width || got.Height != want.Height {
+		return false
+	}
+	for y := 0; y < want.Height; y++ {
+		for x := 0; x < want.Width; x++ {
+			g, w := got.Pix[got.PixOffset(x, y):], want.Pix[want.PixOffset(x, y):]
+			if g[0] != w[0] || g[1] != w[1] || g[2] != w[2] || g[3] != 0xFF {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, opts := range []*Options{
+		nil,
+		{Codec: None, TileSize: 16},
+		{KeyframeInterval: 250 * time.Millisecond, TileSize: 7},
+	} {
+		frames := recFrames()
+		rd, err := Open(bytes.NewReader(record(t, opts, frames)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rd.Len() != len(frames) || !rd.Start().Equal(start) || !rd.End().Equal(frames[len(frames)-1].Time) {
+			t.Errorf("%+v: %d frames from %v to %v", opts, rd.Len(), rd.Start(), rd.End())
+		}
+		for i, want := range frames {
+			got, err := rd.Next()
+			if err != nil {
+				t.Fatalf("%+v: frame %d: %v", opts, i, err)
+			}
+			if got.Seq != want.Seq || !got.Time.Equal(want.Time) || !samePixels(got, want) {
+				t.Fatalf("%+v: frame %d: seq %d at %v differs", opts, i, got.Seq, got.Time)
+			}
+		}
+		if _, err := rd.Next(); err != io.EOF {
+			t.Errorf("%+v: after the last frame: %v, want io.EOF", opts, err)
+		}
+	}
+}
+
+func TestDeltas(t *testing.T) {
+	frames := recFrames()
+	rd, err := Open(bytes.NewReader(record(t, &Options{TileSize: 16}, frames)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirty [][]image.Rectangle
+	var moves [][]frame.Move
+	for range frames {
+		f, err := rd.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirty = append(dirty, append([]image.Rectangle(nil), f.Dirty...))
+		moves = append(moves, append([]frame.Move(nil), f.Moves...))
+		if f.Dirty == nil {
+			dirty[len(dirty)-1] = nil
+		} else if len(f.Dirty) == 0 {
+			dirty[len(dirty)-1] = []image.Rectangle{}
+		}
+	}
+
+	want := map[int][]image.Rectangle{
+		0:  nil,
+		1:  {image.Rect(64, 0, 80, 16), image.Rect(80, 0, 96, 16), image.Rect(64, 16, 80, 32), image.Rect(80, 16, 96, 32)},
+		3:  {},
+		4:  {},
+		5:  {image.Rect(0, 64, 16, 70)},
+		9:  nil,
+		10: {image.Rect(0, 0, 16, 16)},
+	}
+	for i, w := range want {
+		if !reflect.DeepEqual(dirty[i], w) {
+			t.Errorf("frame %d: tiles %v, want %v", i, dirty[i], w)
+		}
+	}
+	if m := moves[2]; len(m) != 1 || m[0] != frames[2].Moves[0] {
+		t.Errorf("scroll frame: moves %v", m)
+	}
+	// The area scrolled in is all that is stored besides the move.
+	for _, r := range dirty[2] {
+		if r.Max.Y <= 48 {
+			t.Errorf("scroll frame stores tile %v above the new rows", r)
+		}
+	}
+}
+
+func TestFrameAt(t *testing.T) {
+	frames := recFrames()
+	rd, err := Open(bytes.NewReader(record(t, &Options{KeyframeInterval: 300 * time.Millisecond}, frames)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ms := range []int{450, 460, 0, 1100, -50, 720, 30, 700, 5000, 210} {
+		at := start.Add(time.Duration(ms) * time.Millisecond)
+		want := frames[0]
+		for _, f := range frames {
+			if !f.Time.After(at) {
+				want = f
+			}
+		}
+		got, err := rd.FrameAt(at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Seq != want.Seq || !samePixels(got, want) {
+			t.Errorf("at %dms: frame %d, want %d", ms, got.Seq, want.Seq)
+		}
+	}
+
+	if err := rd.Rewind(); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := rd.Next(); err != nil || f.Seq != 1 {
+		t.Errorf("after Rewind: %v", err)
+	}
+}
+
+// TestUnclosed reads recordings whose writer stopped before Close, one of them
+// in the middle of a record.
+func TestUnclosed(t *testing.T) {
+	frames := recFrames()
+	var buf bytes.Buffer
+	w := NewWriter(&buf, &Options{Codec: None})
+	for _, f := range frames[:6] {
+		w.WriteFrame(f)
+	}
+	w.Flush()
+	flushed := buf.Len()
+	w.WriteFrame(frames[6])
+	w.Flush()
+
+	for _, c := range []struct {
+		name string
+		data []byte
+		n    int
+	}{
+		{"flushed", buf.Bytes(), 7},
+		{"cut mid-record", buf.Bytes()[:flushed+recordSize+3], 6},
+	} {
+		rd, err := Open(bytes.NewReader(c.data))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if rd.Len() != c.n || !rd.End().Equal(frames[c.n-1].Time) {
+			t.Errorf("%s: %d frames ending %v, want %d", c.name, rd.Len(), rd.End(), c.n)
+		}
+		for i := 0; i < c.n; i++ {
+			if f, err := rd.Next(); err != nil || !samePixels(f, frames[i]) {
+				t.Fatalf("%s: frame %d: %v", c.name, i, err)
+			}
+		}
+		if _, err := rd.Next(); err != io.EOF {
+			t.Errorf("%s: after frame %d: %v, want io.EOF", c.name, c.n, err)
+		}
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	frames := recFrames()[:3]
+	frames[2].Time = frames[0].Time.Add(-time.Second)
+	rd, err := Open(bytes.NewReader(record(t, nil, frames)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range frames {
+		f, _ := rd.Next()
+		if want := frames[min(i, 1)].Time; !f.Time.Equal(want) {
+			t.Errorf("frame %d at %v, want %v", i, f.Time, want)
+		}
+	}
+}
+
+// xorCodec is a registered codec inverting every byte.
+type xorCodec struct{}
+
+func (xorCodec) ID() uint8 { return 200 }
+
+func (xorCodec) Compress(dst, src []byte) ([]byte, error) {
+	for _, b := range src {
+		dst = append(dst, ^b)
+	}
+	return dst, nil
+}
+
+func (c xorCodec) Decompress(dst, src []byte, rawLen int) ([]byte, error) {
+	return c.Compress(dst, src)
+}
+
+func TestCodec(t *testing.T) {
+	frames := recFrames()
+	data := record(t, &Options{Codec: xorCodec{}}, frames)
+	if _, err := Open(bytes.NewReader(data)); err == nil {
+		t.Error("opened a recording with an unregistered codec")
+	}
+	RegisterCodec(xorCodec{})
+	rd, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range frames {
+		if got, err := rd.Next(); err != nil || !samePixels(got, want) {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if err := NewWriter(&bytes.Buffer{}, nil).Close(); err == nil {
+		t.Error("closed a recording without frames")
+	}
+	w := NewWriter(&bytes.Buffer{}, nil)
+	w.WriteFrame(frame.New(4, 4))
+	w.Close()
+	if err := w.WriteFrame(frame.New(4, 4)); err == nil {
+		t.Error("wrote a frame after Close")
+	}
+
+	valid := record(t, &Options{Codec: None}, recFrames()[:2])
+	corrupt := append([]byte(nil), valid...)
+	// The first keyframe claims a larger width than it holds.
+	corrupt[headerSize+recordSize+3] ^= 1
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad magic", append([]byte("DDRX"), valid[4:]...)},
+		{"bad version", append(append([]byte(magic), 9), valid[5:]...)},
+		{"header only", valid[:headerSize]},
+	} {
+		if _, err := Open(bytes.NewReader(c.data)); err == nil {
+			t.Errorf("%s: opened", c.name)
+		}
+	}
+	rd, err := Open(bytes.NewReader(corrupt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.Next(); !errors.Is(err, ErrInvalid) {
+		t.Errorf("corrupt keyframe: %v, want ErrInvalid", err)
+	}
+	if _, err := rd.Next(); err == nil {
+		t.Error("decoded a delta after a corrupt keyframe")
+	}
+}
@@ -0,0 +1,273 @@
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// Options configures a Writer. A nil *Options uses the defaults.
+type Options struct {
+	TileSize int
+	// KeyframeInterval is the time between keyframes. Keyframes are also
+	// written when the frame size changes.
+	KeyframeInterval time.Duration
+	// Codec compresses payloads. Nil uses Deflate.
+	Codec Codec
+}
+
+type indexEntry struct {
+	offset int64
+	seq    uint64
+	time   int64
+}
+
+// Writer appends frames to a recording. Frame pixels are stored without
+// alpha, and the cursor only as far as it was drawn into them.
+type Writer struct {
+	w      *bufio.Writer
+	opts   Options
+	offset int64
+	err    error
+	closed bool
+
+	width, height int
+	prev          []byte
+	lastKey       int64
+	lastTime      int64
+	frames        uint64
+	index         []indexEntry
+	raw, buf      []byte
+}
+
+// NewWriter returns a writer emitting a recording to w. The recording is
+// complete once Close has been called; w is not closed.
+func NewWriter(w io.Writer, opts *Options) *Writer {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.TileSize <= 0 || o.TileSize > 0xFFFF {
+		o.TileSize = DefaultTileSize
+	}
+	if o.KeyframeInterval <= 0 {
+		o.KeyframeInterval = DefaultKeyframeInterval
+	}
+	if o.Codec == nil {
+		o.Codec = Deflate
+	}
+	return &Writer{w: bufio.NewWriterSize(w, 256*1024), opts: o}
+}
+
+// WriteFrame appends f. Its timestamp is f.Time, or the current time if f has
+// none; timestamps going backwards are clamped so seeking stays ordered.
+// Only tiles within f.Damage() are compared against the previous frame.
+func (rw *Writer) WriteFrame(f *frame.Frame) error {
+	if rw.err != nil {
+		return rw.err
+	}
+	if rw.closed {
+		return errors.New("recording: writer is closed")
+	}
+	if rw.offset == 0 {
+		hdr := append([]byte(magic), version, rw.opts.Codec.ID())
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(rw.opts.TileSize))
+		if err := rw.write(hdr); err != nil {
+			return err
+		}
+	}
+
+	t := unixNano(f.Time)
+	if t == 0 {
+		t = time.Now().UnixNano()
+	}
+	t = max(t, rw.lastTime)
+	rw.lastTime = t
+
+	key := f.Width != rw.width || f.Height != rw.height ||
+		time.Duration(t-rw.lastKey) >= rw.opts.KeyframeInterval
+	typ := byte(recordDelta)
+	if key {
+		typ = recordKey
+		rw.raw = rw.keyframe(rw.raw[:0], f)
+		rw.lastKey = t
+		rw.index = append(rw.index, indexEntry{offset: rw.offset, seq: f.Seq, time: t})
+	} else {
+		rw.raw = rw.delta(rw.raw[:0], f)
+	}
+
+	rec := append(rw.buf[:0], typ)
+	rec = binary.BigEndian.AppendUint64(rec, f.Seq)
+	rec = binary.BigEndian.AppendUint64(rec, uint64(t))
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(rw.raw)))
+	rec = binary.BigEndian.AppendUint32(rec, 0)
+	if len(rw.raw) > 0 {
+		var err error
+		if rec, err = rw.opts.Codec.Compress(rec, rw.raw); err != nil {
+			rw.err = err
+			return err
+		}
+	}
+	binary.BigEndian.PutUint32(rec[recordSize-4:], uint32(len(rec)-recordSize))
+	rw.buf = rec
+	rw.frames++
+	return rw.write(rec)
+}
+
+func (rw *Writer) keyframe(raw []byte, f *frame.Frame) []byte {
+	rw.width, rw.height = f.Width, f.Height
+	rw.prev = make([]byte, f.Width*f.Height*4)
+	frame.CopyRect(rw.prev, f.Width*4, f.Pix, f.Stride, f.Rect())
+	raw = binary.BigEndian.AppendUint32(raw, uint32(f.Width))
+	raw = binary.BigEndian.AppendUint32(raw, uint32(f.Height))
+	return appendBGR(raw, f.Pix, f.Stride, f.Rect())
+}
+
+// delta encodes the moves of f and the tiles that still differ after them.
+// It returns an empty payload when nothing changed.
+func (rw *Writer) delta(raw []byte, f *frame.Frame) []byte {
+	stride := rw.width * 4
+	raw = binary.BigEndian.AppendUint32(raw, 0)
+	moves := 0
+	if !f.Full() {
+		for _, m := range f.Moves {
+			src := m.Dst.Sub(m.Dst.Min).Add(m.Src)
+			if m.Dst.Empty() || !m.Dst.In(f.Rect()) || !src.In(f.Rect()) {
+				// Out of bounds moves are left to the tile comparison.
+				continue
+			}
+			movePixels(rw.prev, stride, m.Src, m.Dst)
+			raw = binary.BigEndian.AppendUint32(raw, uint32(m.Src.X))
+			raw = binary.BigEndian.AppendUint32(raw, uint32(m.Src.Y))
+			for _, v := range []int{m.Dst.Min.X, m.Dst.Min.Y, m.Dst.Max.X, m.Dst.Max.Y} {
+				raw = binary.BigEndian.AppendUint32(raw, uint32(v))
+			}
+			moves++
+		}
+	}
+	binary.BigEndian.PutUint32(raw, uint32(moves))
+
+	countAt := len(raw)
+	raw = binary.BigEndian.AppendUint32(raw, 0)
+	tiles := 0
+	for _, t := range rw.changedTiles(f) {
+		r := tileRect(t, rw.opts.TileSize, rw.width, rw.height)
+		raw = binary.BigEndian.AppendUint32(raw, uint32(t))
+		raw = appendBGR(raw, f.Pix, f.Stride, r)
+		frame.CopyRect(rw.prev, stride, f.Pix, f.Stride, r)
+		tiles++
+	}
+	binary.BigEndian.PutUint32(raw[countAt:], uint32(tiles))
+	if moves == 0 && tiles == 0 {
+		return raw[:0]
+	}
+	return raw
+}
+
+// changedTiles returns the tiles touched by the damage of f whose pixels
+// differ from the previous frame.
+func (rw *Writer) changedTiles(f *frame.Frame) []int {
+	ts := rw.opts.TileSize
+	cols := (rw.width + ts - 1) / ts
+	rows := (rw.height + ts - 1) / ts
+	candidate := make([]bool, cols*rows)
+	damage := f.Damage()
+	if damage == nil {
+		damage = []image.Rectangle{f.Rect()}
+	}
+	for _, d := range damage {
+		d = d.Intersect(f.Rect())
+		if d.Empty() {
+			continue
+		}
+		for ty := d.Min.Y / ts; ty <= (d.Max.Y-1)/ts; ty++ {
+			for tx := d.Min.X / ts; tx <= (d.Max.X-1)/ts; tx++ {
+				candidate[ty*cols+tx] = true
+			}
+		}
+	}
+
+	var tiles []int
+	stride := rw.width * 4
+	for t, ok := range candidate {
+		if !ok {
+			continue
+		}
+		r := tileRect(t, ts, rw.width, rw.height)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			// Alpha is not stored, so it is not compared either.
+			a := f.Pix[y*f.Stride+r.Min.X*4 : y*f.Stride+r.Max.X*4]
+			b := rw.prev[y*stride+r.Min.X*4 : y*stride+r.Max.X*4]
+			if !bytes.Equal(a, b) && !equalBGR(a, b) {
+				tiles = append(tiles, t)
+				break
+			}
+		}
+	}
+	return tiles
+}
+
+func equalBGR(a, b []byte) bool {
+	for i := 0; i < len(a); i += 4 {
+		if a[i] != b[i] || a[i+1] != b[i+1] || a[i+2] != b[i+2] {
+			return false
+		}
+	}
+	return true
+}
+
+func (rw *Writer) write(b []byte) error {
+	n, err := rw.w.Write(b)
+	rw.offset += int64(n)
+	if err != nil {
+		rw.err = err
+	}
+	return err
+}
+
+// Flush writes buffered frames to the underlying writer. A recording that
+// ends without Close can still be read up to the last flushed frame.
+func (rw *Writer) Flush() error {
+	if rw.err != nil {
+		return rw.err
+	}
+	if err := rw.w.Flush(); err != nil {
+		rw.err = err
+	}
+	return rw.err
+}
+
+// Close writes the index and flushes the recording.
+func (rw *Writer) Close() error {
+	if rw.closed {
+		return rw.err
+	}
+	rw.closed = true
+	if rw.err != nil {
+		return rw.err
+	}
+	if rw.offset == 0 {
+		return errors.New("recording: no frames recorded")
+	}
+	indexOffset := rw.offset
+	b := []byte{recordIndex}
+	b = binary.BigEndian.AppendUint64(b, rw.frames)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(rw.index)))
+	for _, e := range rw.index {
+		b = binary.BigEndian.AppendUint64(b, uint64(e.offset))
+		b = binary.BigEndian.AppendUint64(b, e.seq)
+		b = binary.BigEndian.AppendUint64(b, uint64(e.time))
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(indexOffset))
+	b = append(b, indexMagic...)
+	if err := rw.write(b); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
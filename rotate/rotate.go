@@ -0,0 +1,151 @@
+// Package rotate converts BGRA images from the physical panel orientation
+// returned by Desktop Duplication to the logical desktop orientation.
+package rotate
+
+import (
+	"image"
+	"unsafe"
+
+	"github.com/shinkar94/godesktopdup/disp"
+	"github.com/shinkar94/godesktopdup/parallel"
+)
+
+const (
+	// kernel is the edge of the register-sized blocks transposed in one go.
+	kernel = 8
+	// block is the edge of the cache-sized blocks walked by Region. It keeps
+	// the block rows touched on both sides within L1.
+	block = 16
+)
+
+// LogicalSize returns the size of the rotated image.
+func LogicalSize(physWidth, physHeight int, rotation disp.ModeRotation) (int, int) {
+	if rotation == disp.ModeRotationRotate90 || rotation == disp.ModeRotationRotate270 {
+		return physHeight, physWidth
+	}
+	return physWidth, physHeight
+}
+
+// layout maps logical pixel (x, y) to source pixel base + x*stepX + y*stepY,
+// in pixels, for a source of the given pitch in pixels.
+func layout(physWidth, physHeight, pitch int, rotation disp.ModeRotation) (base, stepX, stepY int) {
+	switch rotation {
+	case disp.ModeRotationRotate90:
+		return (physHeight - 1) * pitch, -pitch, 1
+	case disp.ModeRotationRotate180:
+		return (physHeight-1)*pitch + physWidth - 1, -1, -pitch
+	case disp.ModeRotationRotate270:
+		return physWidth - 1, pitch, -1
+	default:
+		return 0, 1, pitch
+	}
+}
+
+func pixels(b []byte) []uint32 {
+	if len(b) < 4 {
+		return nil
+	}
+	return unsafe.Slice((*uint32)(unsafe.Pointer(&b[0])), len(b)/4)
+}
+
+// Frame writes the logical image of the physWidth x physHeight source into
+// dst, splitting it into bands of whole blocks across parallel.Default. Strides are in
+// bytes and must be multiples of 4; the source stride may include padding.
+func Frame(dst []byte, dstStride int, src []byte, srcStride, physWidth, physHeight int, rotation disp.ModeRotation) {
+	w, h := LogicalSize(physWidth, physHeight, rotation)
+	bands := (h + block - 1) / block
+	parallel.Default.Rows(bands, w*block, func(lo, hi int) {
+		r := image.Rect(0, lo*block, w, min(hi*block, h))
+		Region(dst, dstStride, src, srcStride, physWidth, physHeight, rotation, r)
+	})
+}
+
+// Region writes the logical rectangle r of the rotated source into dst.
+// The caller must keep r within the logical image.
+func Region(dst []byte, dstStride int, src []byte, srcStride, physWidth, physHeight int, rotation disp.ModeRotation, r image.Rectangle) {
+	if r.Empty() {
+		return
+	}
+	d, s := pixels(dst), pixels(src)
+	dstPitch, pitch := dstStride/4, srcStride/4
+	base, stepX, stepY := layout(physWidth, physHeight, pitch, rotation)
+
+	if stepX == 1 || stepX == -1 {
+		// Identity and 180: rows map to rows, no transpose needed.
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			row := d[y*dstPitch+r.Min.X : y*dstPitch+r.Max.X]
+			if stepX == 1 {
+				copy(row, s[base+r.Min.X+y*stepY:])
+				continue
+			}
+			p := base - r.Min.X + y*stepY
+			for x := range row {
+				row[x] = s[p-x]
+			}
+		}
+		return
+	}
+
+	for by := r.Min.Y; by < r.Max.Y; by += block {
+		bh := min(block, r.Max.Y-by)
+		for bx := r.Min.X; bx < r.Max.X; bx += block {
+			bw := min(block, r.Max.X-bx)
+			transposeBlock(d, dstPitch, s, base, stepX, stepY, bx, by, bw, bh)
+		}
+	}
+}
+
+// transposeBlock copies a block of up to block x block logical pixels, using
+// the 8x8 kernel for every full sub-block.
+func transposeBlock(d []uint32, dstPitch int, s []uint32, base, stepX, stepY, bx, by, bw, bh int) {
+	for ky := 0; ky < bh; ky += kernel {
+		for kx := 0; kx < bw; kx += kernel {
+			x, y := bx+kx, by+ky
+			if kx+kernel <= bw && ky+kernel <= bh {
+				transpose8(d, y*dstPitch+x, dstPitch, s, base+x*stepX+y*stepY, stepX, stepY)
+				continue
+			}
+			for yy := y; yy < min(y+kernel, by+bh); yy++ {
+				for xx := x; xx < min(x+kernel, bx+bw); xx++ {
+					d[yy*dstPitch+xx] = s[base+xx*stepX+yy*stepY]
+				}
+			}
+		}
+	}
+}
+
+// transpose8 copies 8x8 pixels. Each source row is read contiguously into a
+// local block, which is then written out one destination row at a time.
+func transpose8(d []uint32, dOff, dstPitch int, s []uint32, sOff, stepX, stepY int) {
+	var t [kernel * kernel]uint32
+	for i := 0; i < kernel; i++ {
+		p := sOff + i*stepX
+		t[i], t[8+i], t[16+i], t[24+i] = s[p], s[p+stepY], s[p+2*stepY], s[p+3*stepY]
+		t[32+i], t[40+i], t[48+i], t[56+i] = s[p+4*stepY], s[p+5*stepY], s[p+6*stepY], s[p+7*stepY]
+	}
+	for j := 0; j < kernel; j++ {
+		copy(d[dOff+j*dstPitch:][:kernel], t[j*kernel:])
+	}
+}
+
+// Naive writes the logical image one pixel at a time. It is the reference the
+// blocked kernels are checked against.
+func Naive(dst []byte, dstStride int, src []byte, srcStride, physWidth, physHeight int, rotation disp.ModeRotation) {
+	w, h := LogicalSize(physWidth, physHeight, rotation)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var px, py int
+			switch rotation {
+			case disp.ModeRotationRotate90:
+				px, py = y, w-1-x
+			case disp.ModeRotationRotate180:
+				px, py = w-1-x, h-1-y
+			case disp.ModeRotationRotate270:
+				px, py = h-1-y, x
+			default:
+				px, py = x, y
+			}
+			copy(dst[y*dstStride+x*4:][:4], src[py*srcStride+px*4:])
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package rotate
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"testing"
+
+	"github.com/shinkar94/godesktopdup/disp"
+)
+
+var rotations = []disp.ModeRotation{
+	disp.ModeRotationIdentity,
+	disp.ModeRotationRotate90,
+	disp.ModeRotationRotate180,
+	disp.ModeRotationRotate270,
+}
+
+// source returns a physWidth x physHeight image whose pixels are all distinct,
+// with pad bytes of padding after every row.
+func source(physWidth, physHeight, pad int) ([]byte, int) {
+	stride := physWidth*4 + pad
+	src := make([]byte, stride*physHeight)
+	for i := range src {
+		src[i] = byte(i*7 + i>>8)
+	}
+	return src, stride
+}
+
+// check compares Frame with Naive into destinations padded by pad bytes per
+// row. The padding is prefilled and must be left untouched.
+func check(t *testing.T, physWidth, physHeight, srcPad, dstPad int, rotation disp.ModeRotation) {
+	t.Helper()
+	src, srcStride := source(physWidth, physHeight, srcPad)
+	w, h := LogicalSize(physWidth, physHeight, rotation)
+	dstStride := w*4 + dstPad
+	want := bytes.Repeat([]byte{0xAA}, dstStride*h)
+	got := bytes.Repeat([]byte{0xAA}, dstStride*h)
+	Naive(want, dstStride, src, srcStride, physWidth, physHeight, rotation)
+	Frame(got, dstStride, src, srcStride, physWidth, physHeight, rotation)
+	if !bytes.Equal(got, want) {
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("%dx%d rotation %d pads %d/%d: pixel %d,%d differs",
+					physWidth, physHeight, rotation, srcPad, dstPad, i%dstStride/4, i/dstStride)
+			}
+		}
+	}
+}
+
+func TestFrame(t *testing.T) {
+	sizes := []image.Point{{1, 1}, {7, 3}, {8, 8}, {17, 9}, {33, 65}, {127, 45}}
+	for _, rotation := range rotations {
+		for _, sz := range sizes {
+			check(t, sz.X, sz.Y, 0, 0, rotation)
+			check(t, sz.X, sz.Y, 12, 4, rotation)
+		}
+	}
+}
+
+func TestRegion(t *testing.T) {
+	src, srcStride := source(37, 23, 8)
+	for _, rotation := range rotations {
+		w, h := LogicalSize(37, 23, rotation)
+		want := make([]byte, w*4*h)
+		Naive(want, w*4, src, srcStride, 37, 23, rotation)
+		r := image.Rect(3, 5, w-2, h-1)
+		got := make([]byte, w*4*h)
+		Region(got, w*4, src, srcStride, 37, 23, rotation, r)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				o := y*w*4 + x*4
+				inside := image.Pt(x, y).In(r)
+				if inside && !bytes.Equal(got[o:o+4], want[o:o+4]) {
+					t.Fatalf("rotation %d: pixel %d,%d differs", rotation, x, y)
+				}
+				if !inside && !bytes.Equal(got[o:o+4], make([]byte, 4)) {
+					t.Fatalf("rotation %d: pixel %d,%d outside %v written", rotation, x, y, r)
+				}
+			}
+		}
+	}
+}
+
+func FuzzFrame(f *testing.F) {
+	f.Add(uint8(17), uint8(9), uint8(3), uint8(1), uint8(1))
+	f.Add(uint8(1), uint8(200), uint8(0), uint8(0), uint8(2))
+	f.Add(uint8(65), uint8(33), uint8(1), uint8(2), uint8(3))
+	f.Fuzz(func(t *testing.T, width, height, srcPad, dstPad, rot uint8) {
+		if width == 0 || height == 0 {
+			return
+		}
+		rotation := rotations[int(rot)%len(rotations)]
+		check(t, int(width), int(height), int(srcPad%16)*4, int(dstPad%16)*4, rotation)
+	})
+}
+
+func BenchmarkFrame(b *testing.B) {
+	for _, sz := range []struct {
+		name          string
+		width, height int
+	}{
+		{"1080p", 1920, 1080},
+		{"1440p", 2560, 1440},
+		{"4K", 3840, 2160},
+	} {
+		// Padded the way mapped surfaces often are.
+		src, srcStride := source(sz.width, sz.height, 256)
+		dst := make([]byte, sz.width*4*sz.height)
+		for _, rotation := range rotations {
+			w, _ := LogicalSize(sz.width, sz.height, rotation)
+			for _, impl := range []struct {
+				name string
+				fn   func([]byte, int, []byte, int, int, int, disp.ModeRotation)
+			}{
+				{"naive", Naive},
+				{"frame", Frame},
+			} {
+				b.Run(fmt.Sprintf("%s/rot%d/%s", sz.name, rotation, impl.name), func(b *testing.B) {
+					b.SetBytes(int64(len(dst)))
+					for i := 0; i < b.N; i++ {
+						impl.fn(dst, w*4, src, srcStride, sz.width, sz.height, rotation)
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// RFC 2435 JPEG types: chroma subsampling without restart markers.
+const (
+	type422 = 0
+	type420 = 1
+)
+
+// maxDimension is the largest width or height RFC 2435 can describe, since
+// sizes travel in units of 8 pixels in one byte.
+const maxDimension = 2040
+
+var errUnsupportedJPEG = errors.New("rtp: JPEG is not baseline 4:2:2 or 4:2:0 with standard tables")
+
+// jpegParts are the pieces of a JPEG image RFC 2435 transmits.
+type jpegParts struct {
+	typ           byte
+	width, height int
+	quant         [128]byte // luma then chroma table, zig-zag order
+	scan          []byte    // entropy-coded data without EOI
+}
+
+// splitJPEG extracts what RFC 2435 sends from a baseline JPEG as written by
+// jpegenc: the quantization tables, the size, the subsampling and the scan.
+func splitJPEG(b []byte) (*jpegParts, error) {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return nil, errUnsupportedJPEG
+	}
+	p := &jpegParts{typ: 0xFF}
+	tables := 0
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return nil, errUnsupportedJPEG
+		}
+		marker := b[i+1]
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return nil, errUnsupportedJPEG
+		}
+		seg := b[i+4 : i+2+n]
+		switch marker {
+		case 0xDB:
+			for len(seg) >= 65 {
+				id := seg[0]
+				if id > 1 {
+					return nil, errUnsupportedJPEG
+				}
+				copy(p.quant[int(id)*64:], seg[1:65])
+				tables |= 1 << id
+				seg = seg[65:]
+			}
+		case 0xC0:
+			if len(seg) < 15 || seg[5] != 3 {
+				return nil, errUnsupportedJPEG
+			}
+			p.height = int(binary.BigEndian.Uint16(seg[1:]))
+			p.width = int(binary.BigEndian.Uint16(seg[3:]))
+			switch seg[7] {
+			case 0x21:
+				p.typ = type422
+			case 0x22:
+				p.typ = type420
+			}
+		case 0xDD:
+			// Restart intervals need the RFC 2435 restart types; jpegenc
+			// does not use them.
+			return nil, errUnsupportedJPEG
+		case 0xDA:
+			end := len(b)
+			if end-2 > i+2+n && b[end-2] == 0xFF && b[end-1] == 0xD9 {
+				end -= 2
+			}
+			p.scan = b[i+2+n : end]
+			if p.typ == 0xFF || tables != 3 || p.width == 0 || p.height == 0 {
+				return nil, errUnsupportedJPEG
+			}
+			return p, nil
+		}
+		i += 2 + n
+	}
+	return nil, errUnsupportedJPEG
+}
+
+// buildJPEG restores a complete JPEG image from RFC 2435 fields, following
+// the header construction of its appendix B.
+func buildJPEG(dst []byte, typ byte, width, height int, quant []byte, scan []byte) []byte {
+	segment := func(marker byte, data ...byte) {
+		dst = append(dst, 0xFF, marker, byte((len(data)+2)>>8), byte(len(data)+2))
+		dst = append(dst, data...)
+	}
+	dst = append(dst, 0xFF, 0xD8)
+
+	dqt := make([]byte, 0, 130)
+	dqt = append(dqt, 0)
+	dqt = append(dqt, quant[:64]...)
+	dqt = append(dqt, 1)
+	dqt = append(dqt, quant[64:128]...)
+	segment(0xDB, dqt...)
+
+	sampling := byte(0x21)
+	if typ == type420 {
+		sampling = 0x22
+	}
+	segment(0xC0,
+		8, byte(height>>8), byte(height), byte(width>>8), byte(width), 3,
+		1, sampling, 0,
+		2, 0x11, 1,
+		3, 0x11, 1,
+	)
+
+	var dht []byte
+	for i, spec := range stdHuffman {
+		dht = append(dht, byte((i%2)<<4|i/2))
+		dht = append(dht, spec.count[:]...)
+		dht = append(dht, spec.value...)
+	}
+	segment(0xC4, dht...)
+	segment(0xDA, 3, 1, 0x00, 2, 0x11, 3, 0x11, 0, 63, 0)
+
+	dst = append(dst, scan...)
+	return append(dst, 0xFF, 0xD9)
+}
+
+type huffSpec struct {
+	count [16]byte
+	value []byte
+}
+
+// stdHuffman are the tables of section K.3 of the JPEG specification, which
+// RFC 2435 senders and receivers assume: luminance DC, luminance AC,
+// chrominance DC, chrominance AC.
+var stdHuffman = [4]huffSpec{
+	{
+		count: [16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		value: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		count: [16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 0x7d},
+		value: []byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		count: [16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		value: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		count: [16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 0x77},
+		value: []byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
@@ -0,0 +1,263 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Frame is a JPEG image reassembled by a Receiver.
+type Frame struct {
+	JPEG []byte
+	// Timestamp is the RTP timestamp of the frame.
+	Timestamp uint32
+	// Time is the sender's capture time, known once a sender report has
+	// arrived; zero before that.
+	Time          time.Time
+	Width, Height int
+}
+
+// ReceiverStats counts what a Receiver got.
+type ReceiverStats struct {
+	Frames  int64
+	Packets int64
+	// Lost counts frames dropped because packets were missing.
+	Lost int64
+}
+
+// Receiver reassembles RTP/JPEG frames as sent by Sender. It expects the
+// quantization tables in band, which Sender always sends.
+type Receiver struct {
+	rtp, rtcp *net.UDPConn
+
+	mu sync.Mutex
+	// srTime and srRTP are the clock pair of the latest sender report.
+	srTime time.Time
+	srRTP  uint32
+	haveSR bool
+	stats  ReceiverStats
+
+	buf     []byte
+	scan    []byte
+	quant   [128]byte
+	typ     byte
+	width   int
+	height  int
+	ts      uint32
+	nextSeq uint16
+	started bool // a frame is in progress
+	ok      bool // and all of its packets arrived
+
+	done chan struct{}
+}
+
+// Listen returns a receiver on addr ("host:port") for RTP, and the next port
+// for RTCP. With port 0 it picks an even port whose successor is free.
+func Listen(addr string) (*Receiver, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, errors.New("rtp: invalid port " + strconv.Quote(port))
+	}
+	var rtpConn, rtcpConn *net.UDPConn
+	for try := 0; ; try++ {
+		rtpConn, rtcpConn, err = listenPair(host, p)
+		if err == nil || p != 0 || try == 20 {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	rtpConn.SetReadBuffer(4 << 20)
+	r := &Receiver{
+		rtp:  rtpConn,
+		rtcp: rtcpConn,
+		buf:  make([]byte, 65536),
+		done: make(chan struct{}),
+	}
+	go r.readReports()
+	return r, nil
+}
+
+// listenPair binds port and port+1 on host. Port 0 binds any free port, which
+// fails unless it happens to be even with a free successor.
+func listenPair(host string, port int) (*net.UDPConn, *net.UDPConn, error) {
+	a, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, nil, err
+	}
+	rtpConn := a.(*net.UDPConn)
+	p := rtpConn.LocalAddr().(*net.UDPAddr).Port
+	if p%2 != 0 {
+		rtpConn.Close()
+		return nil, nil, errors.New("rtp: odd port " + strconv.Itoa(p))
+	}
+	b, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(p+1)))
+	if err != nil {
+		rtpConn.Close()
+		return nil, nil, err
+	}
+	return rtpConn, b.(*net.UDPConn), nil
+}
+
+// Addr returns the RTP address; RTCP is on the next port.
+func (r *Receiver) Addr() *net.UDPAddr {
+	return r.rtp.LocalAddr().(*net.UDPAddr)
+}
+
+// ReadFrame returns the next complete frame. Frames with missing packets are
+// skipped. It must not be called concurrently.
+func (r *Receiver) ReadFrame() (*Frame, error) {
+	for {
+		n, err := r.rtp.Read(r.buf)
+		if err != nil {
+			return nil, err
+		}
+		if f := r.packet(r.buf[:n]); f != nil {
+			return f, nil
+		}
+	}
+}
+
+// packet adds one RTP packet to the frame in progress and returns the frame
+// when the packet completes it.
+func (r *Receiver) packet(b []byte) *Frame {
+	if len(b) < 12 || b[0]>>6 != 2 || b[1]&0x7F != PayloadType {
+		return nil
+	}
+	if b[0]&0x20 != 0 { // padding
+		pad := int(b[len(b)-1])
+		if pad == 0 || pad > len(b)-12 {
+			return nil
+		}
+		b = b[:len(b)-pad]
+	}
+	marker := b[1]&0x80 != 0
+	seq := binary.BigEndian.Uint16(b[2:])
+	ts := binary.BigEndian.Uint32(b[4:])
+	h := 12 + 4*int(b[0]&0x0F)
+	if b[0]&0x10 != 0 && len(b) >= h+4 { // header extension
+		h += 4 + 4*int(binary.BigEndian.Uint16(b[h+2:]))
+	}
+	if len(b) < h+8 {
+		return nil
+	}
+	jh := b[h : h+8]
+	payload := b[h+8:]
+	off := int(jh[1])<<16 | int(jh[2])<<8 | int(jh[3])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Packets++
+	if r.started && ts != r.ts {
+		// The previous frame never saw its last packet.
+		r.stats.Lost++
+		r.started = false
+	}
+	if !r.started {
+		r.started = true
+		r.ok = off == 0
+		r.ts = ts
+		r.scan = r.scan[:0]
+	} else if seq != r.nextSeq || off != len(r.scan) {
+		r.ok = false
+	}
+	r.nextSeq = seq + 1
+
+	if r.ok && off == 0 {
+		r.typ = jh[4]
+		r.width, r.height = int(jh[6])*8, int(jh[7])*8
+		// Only in band tables of two 64 byte 8 bit tables are supported.
+		if r.typ > type420 || jh[5] < 128 || len(payload) < 4+128 ||
+			payload[1] != 0 || binary.BigEndian.Uint16(payload[2:]) != 128 {
+			r.ok = false
+		} else {
+			copy(r.quant[:], payload[4:])
+			payload = payload[4+128:]
+		}
+	}
+	if r.ok {
+		r.scan = append(r.scan, payload...)
+	}
+	if !marker {
+		return nil
+	}
+	r.started = false
+	if !r.ok {
+		r.stats.Lost++
+		return nil
+	}
+	r.stats.Frames++
+	f := &Frame{
+		JPEG:      buildJPEG(make([]byte, 0, len(r.scan)+640), r.typ, r.width, r.height, r.quant[:], r.scan),
+		Timestamp: ts,
+		Width:     r.width,
+		Height:    r.height,
+	}
+	if r.haveSR {
+		d := time.Duration(int32(ts-r.srRTP)) * time.Second / clockRate
+		f.Time = r.srTime.Add(d)
+	}
+	return f
+}
+
+// readReports takes the clock mapping from sender reports until Close.
+func (r *Receiver) readReports() {
+	defer close(r.done)
+	buf := make([]byte, 1500)
+	for {
+		n, err := r.rtcp.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		// Walk the packets of a compound RTCP packet.
+		for b := buf[:n]; len(b) >= 4 && b[0]>>6 == 2; {
+			size := 4 + 4*int(binary.BigEndian.Uint16(b[2:]))
+			if size > len(b) {
+				break
+			}
+			if b[1] == 200 && size >= 28 {
+				ntp := binary.BigEndian.Uint64(b[8:])
+				r.mu.Lock()
+				r.srTime = fromNTP(ntp)
+				r.srRTP = binary.BigEndian.Uint32(b[16:])
+				r.haveSR = true
+				r.mu.Unlock()
+			}
+			b = b[size:]
+		}
+	}
+}
+
+// fromNTP converts a 64 bit NTP timestamp to a time.
+func fromNTP(v uint64) time.Time {
+	const ntpEpochOffset = 2208988800
+	sec := int64(v>>32) - ntpEpochOffset
+	ns := int64((v & 0xFFFFFFFF) * 1e9 >> 32)
+	return time.Unix(sec, ns)
+}
+
+// Stats returns the receive counters.
+func (r *Receiver) Stats() ReceiverStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Close stops the receiver. A blocked ReadFrame returns an error.
+func (r *Receiver) Close() error {
+	err := r.rtp.Close()
+	r.rtcp.Close()
+	<-r.done
+	return err
+}
@@ -0,0 +1,188 @@
+package rtp
+
+import (
+	"bytes"
+	"image/jpeg"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/jpegenc"
+	"github.com/shinkar94/godesktopdup/synth"
+)
+
+// packets collects the datagrams written by a Sender.
+type packets [][]byte
+
+func (p *packets) Write(b []byte) (int, error) {
+	*p = append(*p, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func nextFrame(t *testing.T, src frame.Source) *frame.Frame {
+	t.Helper()
+	f, err := src.GetFrame(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func checkJPEG(t *testing.T, b []byte, width, height int) {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("decoding JPEG: %v", err)
+	}
+	if r := img.Bounds(); r.Dx() != width || r.Dy() != height {
+		t.Fatalf("JPEG is %dx%d, want %dx%d", r.Dx(), r.Dy(), width, height)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	r, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	s, err := Dial(r.Addr().String(), &Options{Quality: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	const frames = 3
+	src := synth.New(synth.Options{Width: 320, Height: 240, Virtual: true})
+	got := make(chan *Frame, frames)
+	go func() {
+		defer close(got)
+		for i := 0; i < frames; i++ {
+			f, err := r.ReadFrame()
+			if err != nil {
+				return
+			}
+			got <- f
+		}
+	}()
+	for i := 0; i < frames; i++ {
+		if err := s.WriteFrame(nextFrame(t, src)); err != nil {
+			t.Fatal(err)
+		}
+		// Loopback UDP drops bursts once the socket buffer fills.
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	timeout := time.After(5 * time.Second)
+	var last uint32
+	for i := 0; i < frames; i++ {
+		select {
+		case f, ok := <-got:
+			if !ok {
+				t.Fatalf("receiver stopped after %d frames", i)
+			}
+			if f.Width != 320 || f.Height != 240 {
+				t.Errorf("frame %d is %dx%d", i, f.Width, f.Height)
+			}
+			if i > 0 && f.Timestamp <= last {
+				t.Errorf("frame %d timestamp %d after %d", i, f.Timestamp, last)
+			}
+			last = f.Timestamp
+			checkJPEG(t, f.JPEG, 320, 240)
+		case <-timeout:
+			t.Fatalf("received %d of %d frames", i, frames)
+		}
+	}
+	if st := s.Stats(); st.Frames != frames || st.Packets <= frames {
+		t.Errorf("sender stats %+v", st)
+	}
+	if st := r.Stats(); st.Frames != frames || st.Lost != 0 {
+		t.Errorf("receiver stats %+v", st)
+	}
+}
+
+func TestLostPacket(t *testing.T) {
+	var sent packets
+	s, err := NewSender(&sent, nil, &Options{MTU: 576})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := synth.New(synth.Options{Width: 320, Height: 240, Virtual: true})
+	if err := s.WriteFrame(nextFrame(t, src)); err != nil {
+		t.Fatal(err)
+	}
+	first := len(sent)
+	if first < 3 {
+		t.Fatalf("frame fits %d packets; need more to drop one", first)
+	}
+	if err := s.WriteFrame(nextFrame(t, src)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Receiver{}
+	var frames []*Frame
+	for i, p := range sent {
+		if i == 1 {
+			continue // drop a packet from the middle of the first frame
+		}
+		if f := r.packet(p); f != nil {
+			frames = append(frames, f)
+		}
+	}
+	if len(frames) != 1 {
+		t.Fatalf("got %d frames, want only the complete second one", len(frames))
+	}
+	checkJPEG(t, frames[0].JPEG, 320, 240)
+	if st := r.Stats(); st.Frames != 1 || st.Lost != 1 || st.Packets != int64(len(sent)-1) {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestJPEGRoundtrip(t *testing.T) {
+	f := nextFrame(t, synth.New(synth.Options{Width: 136, Height: 72, Virtual: true}))
+	for _, sub := range []jpegenc.Subsampling{jpegenc.Subsample422, jpegenc.Subsample420} {
+		e, err := jpegenc.NewEncoder(&jpegenc.Options{Quality: 75, Subsampling: sub})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := e.Encode(&buf, f.Pix, f.Width, f.Height, f.Stride); err != nil {
+			t.Fatal(err)
+		}
+		parts, err := splitJPEG(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%v: %v", sub, err)
+		}
+		rebuilt := buildJPEG(nil, parts.typ, parts.width, parts.height, parts.quant[:], parts.scan)
+
+		want, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := jpeg.Decode(bytes.NewReader(rebuilt))
+		if err != nil {
+			t.Fatalf("%v: decoding rebuilt JPEG: %v", sub, err)
+		}
+		b := want.Bounds()
+		if got.Bounds() != b {
+			t.Fatalf("%v: bounds %v, want %v", sub, got.Bounds(), b)
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if got.At(x, y) != want.At(x, y) {
+					t.Fatalf("%v: pixel %d,%d differs", sub, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	s, err := NewSender(io.Discard, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteFrame(frame.New(2048, 16)); err != ErrTooLarge {
+		t.Errorf("WriteFrame: %v, want ErrTooLarge", err)
+	}
+}
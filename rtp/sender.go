@@ -0,0 +1,329 @@
+// Package rtp sends frames as RTP/JPEG (RFC 2435) over UDP, with RTCP sender
+// reports, and includes a receiver for testing and simple monitoring tools.
+package rtp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/jpegenc"
+)
+
+// PayloadType is the static RTP payload type of JPEG.
+const PayloadType = 26
+
+// clockRate is the RTP clock of JPEG video.
+const clockRate = 90000
+
+// DefaultMTU is the path MTU assumed when Options.MTU is 0.
+const DefaultMTU = 1500
+
+// DefaultReportInterval is the time between RTCP sender reports when
+// Options.ReportInterval is 0.
+const DefaultReportInterval = 5 * time.Second
+
+// ErrTooLarge is returned for frames wider or higher than 2040 pixels, the
+// limit of RFC 2435. Scale them down first, for example with a scale.Scaler
+// in Fit mode.
+var ErrTooLarge = errors.New("rtp: frame larger than 2040x2040")
+
+// Options configures a Sender. A nil *Options uses the defaults.
+type Options struct {
+	// MTU bounds the size of IP packets; RTP packets are cut to fit it
+	// with IPv4 and UDP headers.
+	MTU int
+	// Quality is the JPEG quality, jpegenc.DefaultQuality if 0.
+	Quality int
+	// Subsampling must be 4:2:2 or 4:2:0, the layouts RFC 2435 defines.
+	// 4:4:4 (the zero value) is sent as 4:2:0.
+	Subsampling jpegenc.Subsampling
+	// SSRC identifies the stream. 0 picks a random one.
+	SSRC uint32
+	// ReportInterval is the time between RTCP sender reports.
+	ReportInterval time.Duration
+	// CNAME names the sender in reports. Defaults to the host name.
+	CNAME string
+}
+
+// Stats counts what a Sender sent.
+type Stats struct {
+	Frames  int64
+	Packets int64
+	// Bytes counts RTP payload bytes.
+	Bytes int64
+}
+
+// Sender packetizes frames as RTP/JPEG. Each Write to the RTP writer must
+// send one datagram, as writes to a UDP connection do.
+type Sender struct {
+	rtp, rtcp io.Writer
+	closers   []io.Closer
+	opts      Options
+	enc       *jpegenc.Encoder
+	jpeg      bytes.Buffer
+	pkt       []byte
+
+	mu sync.Mutex
+	// start and base map capture time to RTP time.
+	start   time.Time
+	base    uint32
+	seq     uint16
+	stats   Stats
+	started bool
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Dial returns a sender streaming to addr ("host:port"). RTCP goes to the
+// next port, as RTP conventionally pairs them.
+func Dial(addr string, opts *Options) (*Sender, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("rtp: invalid port %q", port)
+	}
+	rtpConn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	rtcpConn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(p+1)))
+	if err != nil {
+		rtpConn.Close()
+		return nil, err
+	}
+	s, err := NewSender(rtpConn, rtcpConn, opts)
+	if err != nil {
+		rtpConn.Close()
+		rtcpConn.Close()
+		return nil, err
+	}
+	s.closers = []io.Closer{rtpConn, rtcpConn}
+	return s, nil
+}
+
+// NewSender returns a sender writing RTP packets to rtp and RTCP packets to
+// rtcp, which may be nil to send no reports.
+func NewSender(rtp, rtcp io.Writer, opts *Options) (*Sender, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.MTU <= 0 {
+		o.MTU = DefaultMTU
+	}
+	if o.MTU < 576 {
+		return nil, errors.New("rtp: MTU below 576")
+	}
+	if o.Subsampling == jpegenc.Subsample444 {
+		o.Subsampling = jpegenc.Subsample420
+	}
+	if o.ReportInterval <= 0 {
+		o.ReportInterval = DefaultReportInterval
+	}
+	if o.CNAME == "" {
+		o.CNAME, _ = os.Hostname()
+	}
+	var r [8]byte
+	if _, err := rand.Read(r[:]); err != nil {
+		return nil, err
+	}
+	if o.SSRC == 0 {
+		o.SSRC = binary.BigEndian.Uint32(r[:])
+	}
+	enc, err := jpegenc.NewEncoder(&jpegenc.Options{Quality: o.Quality, Subsampling: o.Subsampling})
+	if err != nil {
+		return nil, err
+	}
+	s := &Sender{
+		rtp:  rtp,
+		rtcp: rtcp,
+		opts: o,
+		enc:  enc,
+		// Random initial values, as RFC 3550 recommends.
+		seq:  binary.BigEndian.Uint16(r[4:]),
+		base: binary.BigEndian.Uint32(r[4:]) ^ binary.BigEndian.Uint32(r[:]),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if rtcp != nil {
+		go s.report()
+	} else {
+		close(s.done)
+	}
+	return s, nil
+}
+
+// WriteFrame encodes f and sends it with the RTP timestamp of f.Time, or of
+// now if f has none.
+func (s *Sender) WriteFrame(f *frame.Frame) error {
+	if f.Width > maxDimension || f.Height > maxDimension {
+		return ErrTooLarge
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jpeg.Reset()
+	if err := s.enc.Encode(&s.jpeg, f.Pix, f.Width, f.Height, f.Stride); err != nil {
+		return err
+	}
+	parts, err := splitJPEG(s.jpeg.Bytes())
+	if err != nil {
+		return err
+	}
+	t := f.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	first := !s.started
+	if first {
+		s.start = t
+		s.started = true
+	}
+	ts := s.rtpTime(t)
+
+	// IPv4 and UDP headers, then the RTP and JPEG headers.
+	room := s.opts.MTU - 28 - 12 - 8
+	scan := parts.scan
+	for off := 0; off == 0 || off < len(scan); {
+		pkt := s.pkt[:0]
+		pkt = append(pkt, 0x80, PayloadType, byte(s.seq>>8), byte(s.seq))
+		pkt = binary.BigEndian.AppendUint32(pkt, ts)
+		pkt = binary.BigEndian.AppendUint32(pkt, s.opts.SSRC)
+		pkt = append(pkt, 0, byte(off>>16), byte(off>>8), byte(off))
+		// Q 255: the tables follow in the first packet of every frame.
+		pkt = append(pkt, parts.typ, 255, byte((parts.width+7)/8), byte((parts.height+7)/8))
+		n := room
+		if off == 0 {
+			pkt = append(pkt, 0, 0, 0, 128)
+			pkt = append(pkt, parts.quant[:]...)
+			n -= 4 + 128
+		}
+		n = min(n, len(scan)-off)
+		pkt = append(pkt, scan[off:off+n]...)
+		off += n
+		if off == len(scan) {
+			pkt[1] |= 0x80 // marker: last packet of the frame
+		}
+		s.pkt = pkt
+		if _, err := s.rtp.Write(pkt); err != nil {
+			return err
+		}
+		s.seq++
+		s.stats.Packets++
+		s.stats.Bytes += int64(len(pkt) - 12)
+	}
+	s.stats.Frames++
+	if first && s.rtcp != nil {
+		// Report at once so receivers can time frames from the start.
+		s.rtcp.Write(s.senderReport(time.Now(), false))
+	}
+	return nil
+}
+
+// rtpTime converts a capture time to the RTP clock. Called with mu held.
+func (s *Sender) rtpTime(t time.Time) uint32 {
+	d := t.Sub(s.start)
+	// Split so long sessions do not overflow.
+	return s.base + uint32(d/time.Second*clockRate+d%time.Second*clockRate/time.Second)
+}
+
+// Stats returns the send counters.
+func (s *Sender) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// report sends sender reports until Close.
+func (s *Sender) report() {
+	defer close(s.done)
+	t := time.NewTicker(s.opts.ReportInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			s.mu.Lock()
+			if s.started {
+				s.rtcp.Write(s.senderReport(time.Now(), false))
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// senderReport builds a compound RTCP packet: a sender report, the CNAME and
+// optionally a BYE. Called with mu held.
+func (s *Sender) senderReport(now time.Time, bye bool) []byte {
+	b := []byte{0x80, 200, 0, 6}
+	b = binary.BigEndian.AppendUint32(b, s.opts.SSRC)
+	b = binary.BigEndian.AppendUint64(b, ntpTime(now))
+	b = binary.BigEndian.AppendUint32(b, s.rtpTime(now))
+	b = binary.BigEndian.AppendUint32(b, uint32(s.stats.Packets))
+	b = binary.BigEndian.AppendUint32(b, uint32(s.stats.Bytes))
+
+	cname := s.opts.CNAME
+	if len(cname) > 255 {
+		cname = cname[:255]
+	}
+	// SDES chunk: SSRC, CNAME item, end of items, padded to 32 bits.
+	chunk := binary.BigEndian.AppendUint32(nil, s.opts.SSRC)
+	chunk = append(chunk, 1, byte(len(cname)))
+	chunk = append(chunk, cname...)
+	chunk = append(chunk, 0)
+	for len(chunk)%4 != 0 {
+		chunk = append(chunk, 0)
+	}
+	b = append(b, 0x81, 202)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(chunk)/4))
+	b = append(b, chunk...)
+
+	if bye {
+		b = append(b, 0x81, 203, 0, 1)
+		b = binary.BigEndian.AppendUint32(b, s.opts.SSRC)
+	}
+	return b
+}
+
+// ntpTime returns t as a 64 bit NTP timestamp.
+func ntpTime(t time.Time) uint64 {
+	const ntpEpochOffset = 2208988800 // seconds from 1900 to 1970
+	ns := t.UnixNano()
+	sec := uint64(ns/1e9) + ntpEpochOffset
+	frac := uint64(ns%1e9) << 32 / 1e9
+	return sec<<32 | frac
+}
+
+// Close sends a final report with a BYE and stops reporting. Connections
+// opened by Dial are closed.
+func (s *Sender) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		s.mu.Lock()
+		if s.rtcp != nil && s.started {
+			_, s.closeErr = s.rtcp.Write(s.senderReport(time.Now(), true))
+		}
+		s.mu.Unlock()
+		for _, c := range s.closers {
+			c.Close()
+		}
+	})
+	return s.closeErr
+}
@@ -0,0 +1,137 @@
+package scale
+
+import (
+	"math"
+	"sort"
+)
+
+// Filter selects the resampling kernel.
+type Filter int
+
+const (
+	Nearest Filter = iota
+	Bilinear
+	// Box averages all source pixels covered by a destination pixel.
+	Box
+	Lanczos3
+)
+
+func (f Filter) String() string {
+	switch f {
+	case Nearest:
+		return "nearest"
+	case Bilinear:
+		return "bilinear"
+	case Box:
+		return "box"
+	case Lanczos3:
+		return "lanczos3"
+	default:
+		return "unknown"
+	}
+}
+
+// contrib lists the source pixels contributing to one destination pixel.
+type contrib struct {
+	first   int
+	weights []float32
+}
+
+// axis holds the contributions for every destination pixel along one axis.
+type axis []contrib
+
+// newAxis computes contributions mapping srcLen pixels starting at srcOff onto dstLen pixels.
+// Source indices are clamped to [0, srcLimit).
+func newAxis(filter Filter, srcOff, srcLen, dstLen, srcLimit int) axis {
+	a := make(axis, dstLen)
+	scale := float64(srcLen) / float64(dstLen)
+	for i := range a {
+		left := float64(srcOff) + float64(i)*scale
+		center := left + scale/2 - 0.5
+		var lo, hi int
+		var weight func(j int) float64
+
+		switch filter {
+		case Nearest:
+			j := int(left + scale/2)
+			lo, hi = j, j
+			weight = func(int) float64 { return 1 }
+		case Bilinear:
+			lo, hi = int(math.Floor(center)), int(math.Floor(center))+1
+			weight = func(j int) float64 { return math.Max(0, 1-math.Abs(float64(j)-center)) }
+		case Box:
+			right := left + scale
+			lo, hi = int(math.Floor(left)), int(math.Ceil(right))-1
+			weight = func(j int) float64 {
+				return math.Max(0, math.Min(right, float64(j+1))-math.Max(left, float64(j)))
+			}
+		default:
+			stretch := math.Max(1, scale)
+			support := 3 * stretch
+			lo, hi = int(math.Ceil(center-support)), int(math.Floor(center+support))
+			weight = func(j int) float64 { return lanczos3((float64(j) - center) / stretch) }
+		}
+
+		first := clampIndex(lo, srcLimit)
+		last := clampIndex(hi, srcLimit)
+		ws := make([]float64, last-first+1)
+		sum := 0.0
+		for j := lo; j <= hi; j++ {
+			w := weight(j)
+			ws[clampIndex(j, srcLimit)-first] += w
+			sum += w
+		}
+		c := contrib{first: first, weights: make([]float32, len(ws))}
+		for k, w := range ws {
+			if sum != 0 {
+				w /= sum
+			}
+			c.weights[k] = float32(w)
+		}
+		a[i] = c
+	}
+	return a
+}
+
+func clampIndex(j, limit int) int {
+	if j < 0 {
+		return 0
+	}
+	if j >= limit {
+		return limit - 1
+	}
+	return j
+}
+
+func lanczos3(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	if x <= -3 || x >= 3 {
+		return 0
+	}
+	px := math.Pi * x
+	return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+}
+
+// span returns the range of destination indices whose contributions touch
+// source indices [lo, hi).
+func (a axis) span(lo, hi int) (int, int) {
+	start := sort.Search(len(a), func(i int) bool {
+		return a[i].first+len(a[i].weights) > lo
+	})
+	end := sort.Search(len(a), func(i int) bool {
+		return a[i].first >= hi
+	})
+	return start, end
+}
+
+// sourceRange returns the source indices used by destination indices [lo, hi).
+func (a axis) sourceRange(lo, hi int) (int, int) {
+	first, last := a[lo].first, 0
+	for i := lo; i < hi; i++ {
+		first = min(first, a[i].first)
+		last = max(last, a[i].first+len(a[i].weights))
+	}
+	return first, last
+}
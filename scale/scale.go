@@ -0,0 +1,294 @@
+package scale
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/parallel"
+)
+
+// Mode selects how the source aspect ratio is mapped onto the target size.
+type Mode int
+
+const (
+	// Stretch fills the target size, ignoring the aspect ratio.
+	Stretch Mode = iota
+	// Fit preserves the aspect ratio; the output is the largest size fitting
+	// the target, so one dimension may be smaller than requested.
+	Fit
+	// Fill preserves the aspect ratio and covers the target size, cropping
+	// the source evenly on both sides.
+	Fill
+	// Letterbox preserves the aspect ratio and centers the image in the exact
+	// target size, filling the rest with Background.
+	Letterbox
+)
+
+// Options configures a Scaler.
+type Options struct {
+	Width, Height int
+	Filter        Filter
+	Mode          Mode
+	Background    color.NRGBA
+	// Workers bounds the goroutines used per frame. 0 means GOMAXPROCS.
+	Workers int
+	// DirtyAware rescales only the destination regions affected by the frame's
+	// damage, keeping the rest of the previous output.
+	DirtyAware bool
+}
+
+// parallelThreshold is the destination area, in pixels, below which a region
+// is resampled on one goroutine. Each output pixel costs several taps, so it
+// is lower than parallel.DefaultThreshold.
+const parallelThreshold = 16 * 1024
+
+// Scaler is a frame.Stage resizing frames into a buffer it owns. Close it
+// when done, as it keeps worker goroutines.
+type Scaler struct {
+	opts Options
+
+	srcW, srcH int
+	dstW, dstH int
+	content    image.Rectangle
+	crop       image.Rectangle
+	xs, ys     axis
+	dst        []byte
+
+	pool    *parallel.Pool
+	tmpPool sync.Pool
+}
+
+// New returns a scaler producing frames of the configured size.
+func New(opts Options) (*Scaler, error) {
+	if opts.Width <= 0 || opts.Height <= 0 {
+		return nil, fmt.Errorf("invalid target size %dx%d", opts.Width, opts.Height)
+	}
+	if opts.Background.A == 0 {
+		opts.Background.A = 0xFF
+	}
+	return &Scaler{opts: opts, pool: parallel.New(opts.Workers, parallelThreshold)}, nil
+}
+
+// Close stops the scaler's worker goroutines. A closed scaler still works,
+// on the goroutine calling Apply.
+func (s *Scaler) Close() error {
+	s.pool.Close()
+	return nil
+}
+
+// Size returns the output size for a source of the given size.
+func (s *Scaler) Size(srcW, srcH int) (int, int) {
+	w, h, _, _ := layout(s.opts.Mode, srcW, srcH, s.opts.Width, s.opts.Height)
+	return w, h
+}
+
+// layout returns the output size, where the image lands in the output and
+// which part of the source it shows.
+func layout(mode Mode, srcW, srcH, w, h int) (int, int, image.Rectangle, image.Rectangle) {
+	crop := image.Rect(0, 0, srcW, srcH)
+	switch mode {
+	case Fit:
+		if srcW*h > srcH*w {
+			h = max(1, (srcH*w+srcW/2)/srcW)
+		} else {
+			w = max(1, (srcW*h+srcH/2)/srcH)
+		}
+		return w, h, image.Rect(0, 0, w, h), crop
+	case Fill:
+		if srcW*h > srcH*w {
+			cw := max(1, (w*srcH+h/2)/h)
+			crop = image.Rect((srcW-cw)/2, 0, (srcW-cw)/2+cw, srcH)
+		} else {
+			ch := max(1, (h*srcW+w/2)/w)
+			crop = image.Rect(0, (srcH-ch)/2, srcW, (srcH-ch)/2+ch)
+		}
+		return w, h, image.Rect(0, 0, w, h), crop
+	case Letterbox:
+		fw, fh, _, _ := layout(Fit, srcW, srcH, w, h)
+		x, y := (w-fw)/2, (h-fh)/2
+		return w, h, image.Rect(x, y, x+fw, y+fh), crop
+	default:
+		return w, h, image.Rect(0, 0, w, h), crop
+	}
+}
+
+// Apply scales f into the scaler's buffer and updates the frame to point at it,
+// mapping damage and the cursor position into output coordinates.
+func (s *Scaler) Apply(f *frame.Frame) error {
+	if f.Width <= 0 || f.Height <= 0 {
+		return fmt.Errorf("invalid frame size %dx%d", f.Width, f.Height)
+	}
+	full := !s.opts.DirtyAware || f.Full()
+	if f.Width != s.srcW || f.Height != s.srcH || s.dst == nil {
+		s.configure(f.Width, f.Height)
+		full = true
+	}
+
+	var regions []image.Rectangle
+	if full {
+		s.fillBars(image.Rect(0, 0, s.dstW, s.dstH))
+		regions = []image.Rectangle{s.content}
+	} else {
+		for _, r := range f.Damage() {
+			if d := s.mapRect(r); !d.Empty() {
+				regions = append(regions, d)
+			}
+		}
+		for _, r := range f.DrawnOver(s.dst) {
+			s.fillBars(r)
+			if d := r.Intersect(s.content); !d.Empty() {
+				regions = append(regions, d)
+			}
+		}
+		regions = frame.Disjoint(regions)
+	}
+
+	for _, r := range regions {
+		s.render(f.Pix, f.Stride, r)
+	}
+
+	// Map the tip: viewers draw the unscaled shape around it.
+	tip := f.Cursor.Tip()
+	tip.X, tip.Y = s.mapPoint(tip.X, tip.Y)
+	f.Cursor.X, f.Cursor.Y = tip.X-f.Cursor.HotSpot.X, tip.Y-f.Cursor.HotSpot.Y
+	f.Pix = s.dst
+	f.Width = s.dstW
+	f.Height = s.dstH
+	f.Stride = s.dstW * 4
+	f.Moves = nil
+	if full {
+		f.Dirty = nil
+	} else {
+		f.Dirty = regions
+		if f.Dirty == nil {
+			f.Dirty = []image.Rectangle{}
+		}
+	}
+	return nil
+}
+
+func (s *Scaler) configure(srcW, srcH int) {
+	s.srcW, s.srcH = srcW, srcH
+	s.dstW, s.dstH, s.content, s.crop = layout(s.opts.Mode, srcW, srcH, s.opts.Width, s.opts.Height)
+	s.xs = newAxis(s.opts.Filter, s.crop.Min.X, s.crop.Dx(), s.content.Dx(), srcW)
+	s.ys = newAxis(s.opts.Filter, s.crop.Min.Y, s.crop.Dy(), s.content.Dy(), srcH)
+	if len(s.dst) != s.dstW*s.dstH*4 {
+		s.dst = make([]byte, s.dstW*s.dstH*4)
+	}
+}
+
+// mapRect returns the destination region affected by source region r.
+func (s *Scaler) mapRect(r image.Rectangle) image.Rectangle {
+	r = r.Intersect(image.Rect(0, 0, s.srcW, s.srcH))
+	if r.Empty() {
+		return image.Rectangle{}
+	}
+	x0, x1 := s.xs.span(r.Min.X, r.Max.X)
+	y0, y1 := s.ys.span(r.Min.Y, r.Max.Y)
+	if x0 >= x1 || y0 >= y1 {
+		return image.Rectangle{}
+	}
+	return image.Rect(x0, y0, x1, y1).Add(s.content.Min)
+}
+
+func (s *Scaler) mapPoint(x, y int) (int, int) {
+	if s.crop.Dx() == 0 || s.crop.Dy() == 0 {
+		return x, y
+	}
+	return s.content.Min.X + (x-s.crop.Min.X)*s.content.Dx()/s.crop.Dx(),
+		s.content.Min.Y + (y-s.crop.Min.Y)*s.content.Dy()/s.crop.Dy()
+}
+
+// fillBars paints the part of r outside the content rectangle with the background.
+func (s *Scaler) fillBars(r image.Rectangle) {
+	bg := s.opts.Background
+	stride := s.dstW * 4
+	r = r.Intersect(image.Rect(0, 0, s.dstW, s.dstH))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := s.dst[y*stride:]
+		inside := y >= s.content.Min.Y && y < s.content.Max.Y
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if inside && x >= s.content.Min.X && x < s.content.Max.X {
+				x = s.content.Max.X - 1
+				continue
+			}
+			o := x * 4
+			row[o], row[o+1], row[o+2], row[o+3] = bg.B, bg.G, bg.R, bg.A
+		}
+	}
+}
+
+// render resamples destination region r (inside the content rectangle),
+// splitting its rows across workers.
+func (s *Scaler) render(src []byte, srcStride int, r image.Rectangle) {
+	s.pool.Rows(r.Dy(), r.Dx(), func(lo, hi int) {
+		s.renderBand(src, srcStride, image.Rect(r.Min.X, r.Min.Y+lo, r.Max.X, r.Min.Y+hi))
+	})
+}
+
+// renderBand runs the horizontal pass over the source rows the band needs,
+// then the vertical pass into the destination.
+func (s *Scaler) renderBand(src []byte, srcStride int, r image.Rectangle) {
+	cx0, cx1 := r.Min.X-s.content.Min.X, r.Max.X-s.content.Min.X
+	cy0, cy1 := r.Min.Y-s.content.Min.Y, r.Max.Y-s.content.Min.Y
+	sy0, sy1 := s.ys.sourceRange(cy0, cy1)
+	width := cx1 - cx0
+
+	need := (sy1 - sy0) * width * 4
+	tmpPtr, _ := s.tmpPool.Get().(*[]float32)
+	if tmpPtr == nil || cap(*tmpPtr) < need {
+		buf := make([]float32, need)
+		tmpPtr = &buf
+	}
+	tmp := (*tmpPtr)[:need]
+	defer s.tmpPool.Put(tmpPtr)
+
+	for sy := sy0; sy < sy1; sy++ {
+		srcRow := src[sy*srcStride:]
+		out := tmp[(sy-sy0)*width*4:]
+		for x := cx0; x < cx1; x++ {
+			c := &s.xs[x]
+			var b, g, rr float32
+			p := c.first * 4
+			for _, w := range c.weights {
+				b += w * float32(srcRow[p])
+				g += w * float32(srcRow[p+1])
+				rr += w * float32(srcRow[p+2])
+				p += 4
+			}
+			o := (x - cx0) * 4
+			out[o], out[o+1], out[o+2] = b, g, rr
+		}
+	}
+
+	stride := s.dstW * 4
+	for y := cy0; y < cy1; y++ {
+		c := &s.ys[y]
+		row := s.dst[(y+s.content.Min.Y)*stride+r.Min.X*4:]
+		for x := 0; x < width; x++ {
+			var b, g, rr float32
+			p := (c.first-sy0)*width*4 + x*4
+			for _, w := range c.weights {
+				b += w * tmp[p]
+				g += w * tmp[p+1]
+				rr += w * tmp[p+2]
+				p += width * 4
+			}
+			o := x * 4
+			row[o], row[o+1], row[o+2], row[o+3] = clampByte(b), clampByte(g), clampByte(rr), 0xFF
+		}
+	}
+}
+
+func clampByte(v float32) byte {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return byte(v + 0.5)
+}
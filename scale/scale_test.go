@@ -0,0 +1,412 @@
+package scale
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/synth"
+)
+
+var filters = []Filter{Nearest, Bilinear, Box, Lanczos3}
+
+// noise returns a w x h frame of random pixels.
+func noise(w, h int, seed int64) *frame.Frame {
+	f := frame.New(w, h)
+	rand.New(rand.NewSource(seed)).Read(f.Pix)
+	return f
+}
+
+func newScaler(t *testing.T, opts Options) *Scaler {
+	t.Helper()
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// scaled returns a copy of f scaled by s.
+func scaled(t *testing.T, s *Scaler, f *frame.Frame) *frame.Frame {
+	t.Helper()
+	f = f.Clone()
+	if err := s.Apply(f); err != nil {
+		t.Fatal(err)
+	}
+	return f.Clone()
+}
+
+// weights returns the normalized weights of the source pixels, clamped to
+// [0, limit), that destination pixel i of an axis mapping srcLen pixels from
+// off onto dstLen pixels samples. It follows the filter definitions directly
+// rather than the separable tables the scaler builds.
+func weights(filter Filter, off, srcLen, dstLen, limit, i int) map[int]float64 {
+	scale := float64(srcLen) / float64(dstLen)
+	left := float64(off) + float64(i)*scale
+	right := left + scale
+	center := (left+right)/2 - 0.5
+	clamp := func(j int) int { return min(max(j, 0), limit-1) }
+
+	ws := map[int]float64{}
+	switch filter {
+	case Nearest:
+		ws[clamp(int(math.Floor(left+scale/2)))] = 1
+		return ws
+	case Bilinear:
+		for j := int(center) - 2; j <= int(center)+2; j++ {
+			ws[clamp(j)] += math.Max(0, 1-math.Abs(float64(j)-center))
+		}
+	case Box:
+		for j := int(left) - 1; j <= int(right)+1; j++ {
+			ws[clamp(j)] += math.Max(0, math.Min(right, float64(j+1))-math.Max(left, float64(j)))
+		}
+	case Lanczos3:
+		stretch := math.Max(1, scale)
+		for j := int(center - 4*stretch); j <= int(center+4*stretch); j++ {
+			x := (float64(j) - center) / stretch
+			w := 1.0
+			switch {
+			case math.Abs(x) >= 3:
+				w = 0
+			case x != 0:
+				w = 3 * math.Sin(math.Pi*x) * math.Sin(math.Pi*x/3) / (math.Pi * math.Pi * x * x)
+			}
+			ws[clamp(j)] += w
+		}
+	}
+	sum := 0.0
+	for _, w := range ws {
+		sum += w
+	}
+	for j := range ws {
+		ws[j] /= sum
+	}
+	return ws
+}
+
+// reference resamples the crop rectangle of src onto a w x h image, pixel by
+// pixel in float64.
+func reference(src *frame.Frame, filter Filter, crop image.Rectangle, w, h int) []byte {
+	out := make([]byte, w*h*4)
+	for y := 0; y < h; y++ {
+		wy := weights(filter, crop.Min.Y, crop.Dy(), h, src.Height, y)
+		for x := 0; x < w; x++ {
+			wx := weights(filter, crop.Min.X, crop.Dx(), w, src.Width, x)
+			var sum [3]float64
+			for sy, a := range wy {
+				for sx, b := range wx {
+					p := src.PixOffset(sx, sy)
+					for c := range sum {
+						sum[c] += a * b * float64(src.Pix[p+c])
+					}
+				}
+			}
+			o := (y*w + x) * 4
+			for c, v := range sum {
+				out[o+c] = byte(math.Round(math.Min(255, math.Max(0, v))))
+			}
+			out[o+3] = 0xFF
+		}
+	}
+	return out
+}
+
+// compare fails if a channel of got is more than tol away from want.
+func compare(t *testing.T, name string, got *frame.Frame, want []byte, tol int) {
+	t.Helper()
+	for i := range want {
+		if d := int(got.Pix[i]) - int(want[i]); d < -tol || d > tol {
+			t.Fatalf("%s: pixel %d,%d channel %d is %d, want %d", name, i/4%got.Width, i/4/got.Width, i%4, got.Pix[i], want[i])
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	sizes := []struct{ srcW, srcH, w, h int }{
+		{40, 30, 17, 11},
+		{13, 9, 40, 31},
+		{40, 30, 40, 30},
+		{40, 30, 80, 10},
+		{1, 20, 5, 7},
+		{20, 1, 3, 1},
+		{1, 1, 4, 3},
+		{9, 9, 1, 1},
+		{1, 50, 1, 13},
+	}
+	for _, filter := range filters {
+		for _, sz := range sizes {
+			src := noise(sz.srcW, sz.srcH, int64(sz.srcW*sz.h))
+			s := newScaler(t, Options{Width: sz.w, Height: sz.h, Filter: filter})
+			got := scaled(t, s, src)
+			if got.Width != sz.w || got.Height != sz.h {
+				t.Fatalf("%v %dx%d to %dx%d: output %dx%d", filter, sz.srcW, sz.srcH, sz.w, sz.h, got.Width, got.Height)
+			}
+			want := reference(src, filter, src.Rect(), sz.w, sz.h)
+			compare(t, filter.String()+" "+image.Rect(0, 0, sz.w, sz.h).String(), got, want, 1)
+		}
+	}
+}
+
+// TestWorkers checks that splitting a frame across workers renders the same
+// pixels as one goroutine.
+func TestWorkers(t *testing.T) {
+	src := noise(300, 200, 1)
+	for _, filter := range filters {
+		one := scaled(t, newScaler(t, Options{Width: 170, Height: 130, Filter: filter, Workers: 1}), src)
+		many := scaled(t, newScaler(t, Options{Width: 170, Height: 130, Filter: filter, Workers: 4}), src)
+		if !bytes.Equal(one.Pix, many.Pix) {
+			t.Errorf("%v: output with 4 workers differs", filter)
+		}
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	src := noise(37, 23, 2)
+	for i := 3; i < len(src.Pix); i += 4 {
+		src.Pix[i] = 0xFF
+	}
+	for _, filter := range filters {
+		if got := scaled(t, newScaler(t, Options{Width: 37, Height: 23, Filter: filter}), src); !bytes.Equal(got.Pix, src.Pix) {
+			t.Errorf("%v: scaling to the same size changed pixels", filter)
+		}
+	}
+}
+
+func TestUniform(t *testing.T) {
+	src := frame.New(31, 17)
+	for i := 0; i < len(src.Pix); i += 4 {
+		copy(src.Pix[i:], []byte{10, 128, 250, 0xFF})
+	}
+	for _, filter := range filters {
+		for _, size := range []image.Point{{1, 1}, {7, 5}, {31, 1}, {1, 40}, {100, 60}} {
+			got := scaled(t, newScaler(t, Options{Width: size.X, Height: size.Y, Filter: filter}), src)
+			if want := bytes.Repeat([]byte{10, 128, 250, 0xFF}, size.X*size.Y); !bytes.Equal(got.Pix, want) {
+				t.Errorf("%v to %v: a uniform frame is no longer uniform", filter, size)
+			}
+		}
+	}
+}
+
+func TestBoxHalf(t *testing.T) {
+	src := noise(40, 30, 3)
+	got := scaled(t, newScaler(t, Options{Width: 20, Height: 15, Filter: Box}), src)
+	for y := 0; y < 15; y++ {
+		for x := 0; x < 20; x++ {
+			for c := 0; c < 3; c++ {
+				sum := 0
+				for _, p := range []image.Point{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+					sum += int(src.Pix[src.PixOffset(2*x+p.X, 2*y+p.Y)+c])
+				}
+				if v := int(got.Pix[got.PixOffset(x, y)+c]); v != (sum+2)/4 {
+					t.Fatalf("pixel %d,%d channel %d is %d, want the mean %d", x, y, c, v, (sum+2)/4)
+				}
+			}
+		}
+	}
+}
+
+func TestNearestDouble(t *testing.T) {
+	src := noise(9, 7, 4)
+	got := scaled(t, newScaler(t, Options{Width: 18, Height: 14, Filter: Nearest}), src)
+	for y := 0; y < 14; y++ {
+		for x := 0; x < 18; x++ {
+			g, w := got.Pix[got.PixOffset(x, y):][:3], src.Pix[src.PixOffset(x/2, y/2):][:3]
+			if !bytes.Equal(g, w) {
+				t.Fatalf("pixel %d,%d is % x, want % x", x, y, g, w)
+			}
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		mode          Mode
+		src, target   image.Point
+		size          image.Point
+		content, crop image.Rectangle
+	}{
+		{"stretch", Stretch, image.Pt(1920, 1080), image.Pt(800, 800), image.Pt(800, 800), image.Rect(0, 0, 800, 800), image.Rect(0, 0, 1920, 1080)},
+		{"fit wide", Fit, image.Pt(1920, 1080), image.Pt(800, 800), image.Pt(800, 450), image.Rect(0, 0, 800, 450), image.Rect(0, 0, 1920, 1080)},
+		{"fit tall", Fit, image.Pt(1080, 1920), image.Pt(800, 800), image.Pt(450, 800), image.Rect(0, 0, 450, 800), image.Rect(0, 0, 1080, 1920)},
+		{"fit thin", Fit, image.Pt(1, 1000), image.Pt(100, 100), image.Pt(1, 100), image.Rect(0, 0, 1, 100), image.Rect(0, 0, 1, 1000)},
+		{"fill wide", Fill, image.Pt(1920, 1080), image.Pt(800, 800), image.Pt(800, 800), image.Rect(0, 0, 800, 800), image.Rect(420, 0, 1500, 1080)},
+		{"fill tall", Fill, image.Pt(1080, 1920), image.Pt(800, 400), image.Pt(800, 400), image.Rect(0, 0, 800, 400), image.Rect(0, 690, 1080, 1230)},
+		{"letterbox wide", Letterbox, image.Pt(1920, 1080), image.Pt(800, 800), image.Pt(800, 800), image.Rect(0, 175, 800, 625), image.Rect(0, 0, 1920, 1080)},
+		{"letterbox tall", Letterbox, image.Pt(1080, 1920), image.Pt(800, 800), image.Pt(800, 800), image.Rect(175, 0, 625, 800), image.Rect(0, 0, 1080, 1920)},
+	} {
+		w, h, content, crop := layout(c.mode, c.src.X, c.src.Y, c.target.X, c.target.Y)
+		if image.Pt(w, h) != c.size || content != c.content || crop != c.crop {
+			t.Errorf("%s: %dx%d, content %v, crop %v", c.name, w, h, content, crop)
+		}
+		s := newScaler(t, Options{Width: c.target.X, Height: c.target.Y, Mode: c.mode})
+		if sw, sh := s.Size(c.src.X, c.src.Y); image.Pt(sw, sh) != c.size {
+			t.Errorf("%s: Size %dx%d, want %v", c.name, sw, sh, c.size)
+		}
+	}
+}
+
+// TestModes scales a frame whose pixels encode their column and row, so
+// nearest-neighbour output shows which source pixel each output pixel came from.
+func TestModes(t *testing.T) {
+	src := frame.New(192, 108)
+	for y := 0; y < src.Height; y++ {
+		for x := 0; x < src.Width; x++ {
+			copy(src.Pix[src.PixOffset(x, y):], []byte{byte(x), byte(y), 0x80, 0xFF})
+		}
+	}
+	src.Cursor.X, src.Cursor.Y = 96-2, 54-3
+	src.Cursor.HotSpot = image.Pt(2, 3)
+	bg := color.NRGBA{R: 1, G: 2, B: 3}
+
+	for _, c := range []struct {
+		mode          Mode
+		content, crop image.Rectangle
+		tip           image.Point
+	}{
+		{Fit, image.Rect(0, 0, 80, 45), image.Rect(0, 0, 192, 108), image.Pt(40, 22)},
+		{Fill, image.Rect(0, 0, 80, 80), image.Rect(42, 0, 150, 108), image.Pt(40, 40)},
+		{Letterbox, image.Rect(0, 17, 80, 62), image.Rect(0, 0, 192, 108), image.Pt(40, 39)},
+	} {
+		s := newScaler(t, Options{Width: 80, Height: 80, Mode: c.mode, Filter: Nearest, Background: bg})
+		got := scaled(t, s, src)
+		if want := image.Rect(0, 0, 80, 80); c.mode == Fit && got.Rect() != c.content || c.mode != Fit && got.Rect() != want {
+			t.Fatalf("mode %d: output %v", c.mode, got.Rect())
+		}
+		for y := 0; y < got.Height; y++ {
+			for x := 0; x < got.Width; x++ {
+				p := got.Pix[got.PixOffset(x, y):][:4]
+				if !image.Pt(x, y).In(c.content) {
+					if !bytes.Equal(p, []byte{3, 2, 1, 0xFF}) {
+						t.Fatalf("mode %d: bar pixel %d,%d is % x", c.mode, x, y, p)
+					}
+					continue
+				}
+				if from := image.Pt(int(p[0]), int(p[1])); !from.In(c.crop) || p[2] != 0x80 {
+					t.Fatalf("mode %d: pixel %d,%d comes from %v outside %v", c.mode, x, y, from, c.crop)
+				}
+			}
+		}
+		// The first and last content pixels sample both ends of the crop.
+		first := got.Pix[got.PixOffset(c.content.Min.X, c.content.Min.Y):]
+		last := got.Pix[got.PixOffset(c.content.Max.X-1, c.content.Max.Y-1):]
+		if int(first[0]) > c.crop.Min.X+2 || int(last[0]) < c.crop.Max.X-3 || int(first[1]) > c.crop.Min.Y+2 || int(last[1]) < c.crop.Max.Y-3 {
+			t.Errorf("mode %d: content spans %d,%d to %d,%d of crop %v", c.mode, first[0], first[1], last[0], last[1], c.crop)
+		}
+		if tip := got.Cursor.Tip(); tip != c.tip {
+			t.Errorf("mode %d: cursor tip %v, want %v", c.mode, tip, c.tip)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, size := range []image.Point{{0, 10}, {10, 0}, {-1, 5}} {
+		if _, err := New(Options{Width: size.X, Height: size.Y}); err == nil {
+			t.Errorf("New accepted %v", size)
+		}
+	}
+	if err := newScaler(t, Options{Width: 10, Height: 10}).Apply(&frame.Frame{}); err == nil {
+		t.Error("Apply accepted an empty frame")
+	}
+}
+
+// mark is a stage drawing a square at the cursor tip after scaling.
+type mark struct{}
+
+func (mark) Apply(f *frame.Frame) error {
+	r := image.Rect(-3, -3, 3, 3).Add(f.Cursor.Tip()).Intersect(f.Rect())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			copy(f.Pix[f.PixOffset(x, y):], []byte{0xFF, 0, 0xFF, 0xFF})
+		}
+	}
+	f.AddDirty(r)
+	return nil
+}
+
+// TestDirtyAware checks that rescaling only the damage gives the same output
+// as rescaling every frame whole, and that the reported damage covers every
+// output pixel that changed.
+func TestDirtyAware(t *testing.T) {
+	source := func() *synth.Source {
+		return synth.New(synth.Options{
+			Width: 320, Height: 200, FPS: 10,
+			Track:      synth.Circle(image.Pt(160, 100), 70, 3*time.Second),
+			DrawCursor: true, Virtual: true, Start: time.Unix(1700000000, 0),
+		})
+	}
+	for _, filter := range filters {
+		for _, mode := range []Mode{Stretch, Letterbox} {
+			opts := Options{Width: 150, Height: 150, Filter: filter, Mode: mode}
+			full := newScaler(t, opts)
+			opts.DirtyAware = true
+			dirty := newScaler(t, opts)
+			for _, stages := range [][]frame.Stage{{full}, {full, mark{}}} {
+				want := frame.Process(source(), stages...)
+				got := frame.Process(source(), append([]frame.Stage{dirty}, stages[1:]...)...)
+				var prev []byte
+				for i := 0; i < 30; i++ {
+					w, err := want.GetFrame(0)
+					if err != nil {
+						t.Fatal(err)
+					}
+					g, err := got.GetFrame(0)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(g.Pix, w.Pix) {
+						t.Fatalf("%v mode %d, %d stages: frame %d differs from a full rescale", filter, mode, len(stages), i)
+					}
+					if i > 0 && g.Full() {
+						t.Fatalf("%v mode %d: frame %d reported as fully changed", filter, mode, i)
+					}
+					if prev != nil {
+						for p := 0; p < len(prev); p += 4 {
+							pt := image.Pt(p/4%g.Width, p/4/g.Width)
+							if !bytes.Equal(prev[p:p+4], g.Pix[p:p+4]) && !inAny(pt, g.Damage()) {
+								t.Fatalf("%v mode %d: frame %d: pixel %v changed outside the damage %v", filter, mode, i, pt, g.Damage())
+							}
+						}
+					}
+					prev = append(prev[:0], g.Pix...)
+				}
+			}
+		}
+	}
+}
+
+func TestDirtyAwareMoves(t *testing.T) {
+	s := newScaler(t, Options{Width: 100, Height: 100, DirtyAware: true})
+	f := noise(200, 200, 5)
+	scaled(t, s, f)
+	f.Dirty = []image.Rectangle{}
+	f.Moves = []frame.Move{{Src: image.Pt(0, 0), Dst: image.Rect(100, 100, 120, 120)}}
+	got := scaled(t, s, f)
+	if len(got.Moves) != 0 || len(got.Dirty) != 1 || !image.Rect(50, 50, 60, 60).In(got.Dirty[0]) {
+		t.Errorf("moved region reported as moves %v, damage %v", got.Moves, got.Dirty)
+	}
+	if got.Dirty[0].Dx() > 14 {
+		t.Errorf("damage %v spreads far beyond the moved region", got.Dirty[0])
+	}
+
+	// A resize rescales everything.
+	got = scaled(t, s, noise(300, 100, 6))
+	if !got.Full() {
+		t.Errorf("resized source: damage %v, want the whole frame", got.Dirty)
+	}
+}
+
+func inAny(p image.Point, rs []image.Rectangle) bool {
+	for _, r := range rs {
+		if p.In(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package shmring
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func mapFile(f *os.File, size int, writable bool) ([]byte, error) {
+	prot := unix.PROT_READ
+	if writable {
+		prot |= unix.PROT_WRITE
+	}
+	return unix.Mmap(int(f.Fd()), 0, size, prot, unix.MAP_SHARED)
+}
+
+func unmap(b []byte) error {
+	return unix.Munmap(b)
+}
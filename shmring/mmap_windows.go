@@ -0,0 +1,32 @@
+//go:build windows
+
+package shmring
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+func mapFile(f *os.File, size int, writable bool) ([]byte, error) {
+	prot, access := uint32(windows.PAGE_READONLY), uint32(windows.FILE_MAP_READ)
+	if writable {
+		prot, access = windows.PAGE_READWRITE, windows.FILE_MAP_WRITE
+	}
+	h, err := windows.CreateFileMapping(windows.Handle(f.Fd()), nil, prot, 0, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The view keeps the mapping object alive.
+	defer windows.CloseHandle(h)
+	addr, err := windows.MapViewOfFile(h, access, 0, 0, uintptr(size))
+	if err != nil {
+		return nil, err
+	}
+	return unsafe.Slice((*byte)(unsafe.Add(nil, addr)), size), nil
+}
+
+func unmap(b []byte) error {
+	return windows.UnmapViewOfFile(uintptr(unsafe.Pointer(&b[0])))
+}
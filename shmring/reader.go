@@ -0,0 +1,179 @@
+package shmring
+
+import (
+	"image"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// pollInterval is how often GetFrame checks the ring for a new frame.
+const pollInterval = time.Millisecond
+
+// Stats counts what a Reader read.
+type Stats struct {
+	Frames int64
+	// Skipped counts frames overwritten before the reader got to them.
+	Skipped int64
+	// Retries counts copies repeated because the writer reused the slot
+	// meanwhile.
+	Retries int64
+}
+
+// Reader maps a ring read-only and returns its newest frames. It implements
+// frame.Source and is not safe for concurrent use; open one per goroutine.
+type Reader struct {
+	f             *os.File
+	b             []byte
+	slots         int
+	slotSize      int
+	width, height int
+	last          uint64
+	fr            frame.Frame
+	stats         Stats
+}
+
+// Open maps the ring file at path.
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := fi.Size()
+	if size < headerSize || int64(int(size)) != size {
+		f.Close()
+		return nil, ErrInvalid
+	}
+	b, err := mapFile(f, int(size), false)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := &Reader{
+		f:        f,
+		b:        b,
+		slots:    int(ne.Uint32(b[offSlots:])),
+		slotSize: int(ne.Uint32(b[offSlotSize:])),
+		width:    int(ne.Uint32(b[offMaxWidth:])),
+		height:   int(ne.Uint32(b[offMaxHeight:])),
+	}
+	if string(b[:4]) != magic || ne.Uint32(b[4:]) != version ||
+		r.slots < 2 || r.width <= 0 || r.height <= 0 || r.width > 1<<15 || r.height > 1<<15 ||
+		r.slotSize < slotSizeFor(r.width, r.height) ||
+		int64(headerSize)+int64(r.slots)*int64(r.slotSize) != size {
+		r.Close()
+		return nil, ErrInvalid
+	}
+	r.fr.Pix = make([]byte, r.width*r.height*4)
+	// Frames written before the reader opened are not skipped ones; the
+	// newest of them is returned first.
+	if head := loadHead(b); head > 0 {
+		r.last = head - 1
+	}
+	return r, nil
+}
+
+// GetFrame returns the newest frame not returned before, waiting up to
+// timeoutMs for the writer to publish one. It returns frame.ErrNoImageYet on
+// timeout and ErrClosed once the writer closed the ring. The frame stays
+// valid until the next call. Dirty is set when the frame directly follows the
+// previous one returned, and nil otherwise.
+func (r *Reader) GetFrame(timeoutMs uint) (*frame.Frame, error) {
+	deadline := time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+	for {
+		if head := loadHead(r.b); head > r.last {
+			if r.read(head) {
+				return &r.fr, nil
+			}
+			// Overwritten while copying: take the newer frame.
+			r.stats.Retries++
+			continue
+		}
+		if atomic.LoadUint32(word32(r.b, offClosed)) != 0 {
+			return nil, ErrClosed
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, frame.ErrNoImageYet
+		}
+		time.Sleep(min(left, pollInterval))
+	}
+}
+
+// read copies frame n into r.fr and reports whether the copy is consistent.
+func (r *Reader) read(n uint64) bool {
+	off := headerSize + int((n-1)%uint64(r.slots))*r.slotSize
+	s := r.b[off : off+r.slotSize]
+	lock := word(s, offLock)
+
+	l := atomic.LoadUint64(lock)
+	if l&1 != 0 || ne.Uint64(s[offNumber:]) != n {
+		return false
+	}
+	width, height := int(ne.Uint32(s[offWidth:])), int(ne.Uint32(s[offHeight:]))
+	if width > r.width || height > r.height {
+		return false
+	}
+	seq := ne.Uint64(s[offSeq:])
+	t := int64(ne.Uint64(s[offTime:]))
+	bounds := getRect(s[offBounds:])
+	dirty := ne.Uint32(s[offDirty:])
+	var rects []image.Rectangle
+	if dirty != dirtyFull && dirty <= maxDirty {
+		rects = r.fr.Dirty[:0]
+		if rects == nil {
+			rects = make([]image.Rectangle, 0, dirty)
+		}
+		for i := 0; i < int(dirty); i++ {
+			if rect := getRect(s[offRects+i*16:]).Intersect(image.Rect(0, 0, width, height)); !rect.Empty() {
+				rects = append(rects, rect)
+			}
+		}
+	}
+	copy(r.fr.Pix[:width*height*4], s[slotMetaSize:])
+	if atomic.LoadUint64(lock) != l {
+		return false
+	}
+
+	if n != r.last+1 || dirty == dirtyFull || width != r.fr.Width || height != r.fr.Height {
+		rects = nil
+	}
+	r.stats.Frames++
+	r.stats.Skipped += int64(n - r.last - 1)
+	r.last = n
+	r.fr.Width, r.fr.Height, r.fr.Stride = width, height, width*4
+	r.fr.Pix = r.fr.Pix[:width*height*4]
+	r.fr.Dirty = rects
+	r.fr.Seq = seq
+	r.fr.Time = time.Time{}
+	if t != 0 {
+		r.fr.Time = time.Unix(0, t)
+	}
+	r.fr.Bounds = bounds
+	return true
+}
+
+// Stats returns the read counters.
+func (r *Reader) Stats() Stats {
+	return r.stats
+}
+
+// Close unmaps the ring.
+func (r *Reader) Close() error {
+	if r.b == nil {
+		return nil
+	}
+	err := unmap(r.b)
+	r.b = nil
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+// Package shmring shares captured frames with other processes through a ring
+// of slots in a memory-mapped file. One process writes; any number of
+// processes map the file read-only and take the newest frame without copying
+// it through a socket.
+package shmring
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"sync/atomic"
+	"unsafe"
+)
+
+// A ring file is laid out as
+//
+//	header: "DDSR" version:u32 slots:u32 slotSize:u32 maxWidth:u32
+//	        maxHeight:u32 head:u64 closed:u32, padded to headerSize
+//	slots:  lock:u64 number:u64 seq:u64 time:i64 width:u32 height:u32
+//	        bounds:4*i32 dirty:u32 reserved:u32 { rect:4*i32 }*maxDirty,
+//	        then pixels (BGRA, tightly packed), padded to slotSize
+//
+// Integers are in host byte order, as the ring never leaves the machine. head
+// is the number of frames written; frame n lives in slot (n-1) % slots with
+// number n. lock is a seqlock: odd while the writer fills the slot, so a
+// reader that sees the same even value before and after copying got a
+// consistent frame. dirty is the number of rects changed since frame n-1, or
+// dirtyFull.
+const (
+	magic        = "DDSR"
+	version      = 1
+	headerSize   = 4096
+	slotMetaSize = 1024
+	maxDirty     = (slotMetaSize - 64) / 16
+	dirtyFull    = 0xFFFFFFFF
+
+	offSlots     = 8
+	offSlotSize  = 12
+	offMaxWidth  = 16
+	offMaxHeight = 20
+	offHead      = 24
+	offClosed    = 32
+
+	offLock   = 0
+	offNumber = 8
+	offSeq    = 16
+	offTime   = 24
+	offWidth  = 32
+	offHeight = 36
+	offBounds = 40
+	offDirty  = 56
+	offRects  = 64
+)
+
+// DefaultSlots is the number of slots when Options.Slots is 0. Readers that
+// fall more than this many frames behind skip to the newest one.
+const DefaultSlots = 3
+
+// ErrTooLarge is returned for frames larger than the ring was created for.
+var ErrTooLarge = errors.New("shmring: frame larger than the ring's slots")
+
+// ErrInvalid is returned when opening a file that is not a ring.
+var ErrInvalid = errors.New("shmring: invalid ring file")
+
+// ErrClosed is returned by readers once the writer closed the ring and every
+// frame was read.
+var ErrClosed = errors.New("shmring: ring closed by writer")
+
+var ne = binary.NativeEndian
+
+// slotSizeFor returns the slot size for frames up to width x height, rounded
+// to whole pages.
+func slotSizeFor(width, height int) int {
+	n := slotMetaSize + width*height*4
+	return (n + 4095) &^ 4095
+}
+
+// word returns the 64 bit word at off for atomic access. Mappings are page
+// aligned and every atomic field is 8 byte aligned within them.
+func word(b []byte, off int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&b[off]))
+}
+
+func word32(b []byte, off int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&b[off]))
+}
+
+func loadHead(b []byte) uint64 {
+	return atomic.LoadUint64(word(b, offHead))
+}
+
+func putRect(b []byte, r image.Rectangle) {
+	ne.PutUint32(b, uint32(int32(r.Min.X)))
+	ne.PutUint32(b[4:], uint32(int32(r.Min.Y)))
+	ne.PutUint32(b[8:], uint32(int32(r.Max.X)))
+	ne.PutUint32(b[12:], uint32(int32(r.Max.Y)))
+}
+
+func getRect(b []byte) image.Rectangle {
+	return image.Rect(
+		int(int32(ne.Uint32(b))), int(int32(ne.Uint32(b[4:]))),
+		int(int32(ne.Uint32(b[8:]))), int(int32(ne.Uint32(b[12:]))),
+	)
+}
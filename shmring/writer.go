@@ -0,0 +1,153 @@
+package shmring
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// Options configures a ring. A nil *Options uses the defaults.
+type Options struct {
+	// Slots is the number of frames the ring holds, at least 2.
+	Slots int
+}
+
+// Writer publishes frames into a ring file. It is not safe for concurrent
+// use.
+type Writer struct {
+	f             *os.File
+	b             []byte
+	slots         int
+	slotSize      int
+	width, height int
+	head          uint64
+	// lastWidth and lastHeight are the size of the previous frame, whose
+	// damage is only meaningful at the same size.
+	lastWidth, lastHeight int
+}
+
+// Create creates a ring file at path for frames up to width x height pixels
+// and maps it for writing. An existing file is removed first, so readers
+// still mapping it see no new frames and should reopen the path; Windows
+// refuses to remove it while they have it open. On Linux, a path under
+// /dev/shm keeps the ring in memory. The file is readable only by its owner;
+// frames are screen contents.
+func Create(path string, width, height int, opts *Options) (*Writer, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.Slots == 0 {
+		o.Slots = DefaultSlots
+	}
+	if o.Slots < 2 {
+		return nil, errors.New("shmring: fewer than 2 slots")
+	}
+	if width <= 0 || height <= 0 || width > 1<<15 || height > 1<<15 {
+		return nil, errors.New("shmring: invalid frame size")
+	}
+	slotSize := slotSizeFor(width, height)
+	size := int64(headerSize) + int64(o.Slots)*int64(slotSize)
+	if int64(int(size)) != size {
+		return nil, errors.New("shmring: ring too large")
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	b, err := mapFile(f, int(size), true)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	ne.PutUint32(b[4:], version)
+	ne.PutUint32(b[offSlots:], uint32(o.Slots))
+	ne.PutUint32(b[offSlotSize:], uint32(slotSize))
+	ne.PutUint32(b[offMaxWidth:], uint32(width))
+	ne.PutUint32(b[offMaxHeight:], uint32(height))
+	// The magic goes last: readers reject the file until the header is set.
+	copy(b, magic)
+	return &Writer{
+		f:        f,
+		b:        b,
+		slots:    o.Slots,
+		slotSize: slotSize,
+		width:    width,
+		height:   height,
+	}, nil
+}
+
+// WriteFrame copies f into the next slot and publishes it. Readers still
+// copying the frame previously held by the slot notice and retry.
+func (w *Writer) WriteFrame(f *frame.Frame) error {
+	if w.b == nil {
+		return errors.New("shmring: writer is closed")
+	}
+	if f.Width > w.width || f.Height > w.height {
+		return ErrTooLarge
+	}
+	n := w.head + 1
+	off := headerSize + int((n-1)%uint64(w.slots))*w.slotSize
+	s := w.b[off : off+w.slotSize]
+	lock := word(s, offLock)
+
+	atomic.AddUint64(lock, 1)
+	ne.PutUint64(s[offNumber:], n)
+	ne.PutUint64(s[offSeq:], f.Seq)
+	var t int64
+	if !f.Time.IsZero() {
+		t = f.Time.UnixNano()
+	}
+	ne.PutUint64(s[offTime:], uint64(t))
+	ne.PutUint32(s[offWidth:], uint32(f.Width))
+	ne.PutUint32(s[offHeight:], uint32(f.Height))
+	putRect(s[offBounds:], f.Bounds)
+	damage := f.Damage()
+	if f.Full() || len(damage) > maxDirty || f.Width != w.lastWidth || f.Height != w.lastHeight {
+		ne.PutUint32(s[offDirty:], dirtyFull)
+	} else {
+		ne.PutUint32(s[offDirty:], uint32(len(damage)))
+		for i, r := range damage {
+			putRect(s[offRects+i*16:], r)
+		}
+	}
+	frame.CopyRect(s[slotMetaSize:], f.Width*4, f.Pix, f.Stride, f.Rect())
+	atomic.AddUint64(lock, 1)
+
+	atomic.StoreUint64(word(w.b, offHead), n)
+	w.head = n
+	w.lastWidth, w.lastHeight = f.Width, f.Height
+	return nil
+}
+
+// Frames returns the number of frames written.
+func (w *Writer) Frames() uint64 {
+	return w.head
+}
+
+// Close marks the ring closed, so readers return ErrClosed after the last
+// frame, and unmaps it. The file is left in place.
+func (w *Writer) Close() error {
+	if w.b == nil {
+		return nil
+	}
+	atomic.StoreUint32(word32(w.b, offClosed), 1)
+	err := unmap(w.b)
+	w.b = nil
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
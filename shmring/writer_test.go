@@ -0,0 +1,312 @@
+package shmring
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// testFrame returns a frame whose pixels are all v, with a padded stride.
+func testFrame(width, height int, seq uint64, v byte) *frame.Frame {
+	stride := width*4 + 12
+	pix := make([]byte, stride*height)
+	for i := range pix {
+		pix[i] = v
+	}
+	return &frame.Frame{
+		Pix:    pix,
+		Width:  width,
+		Height: height,
+		Stride: stride,
+		Seq:    seq,
+		Time:   time.Unix(1700000000, int64(seq)),
+		Bounds: image.Rect(100, 0, 100+width, height),
+	}
+}
+
+func create(t *testing.T, width, height int, opts *Options) (*Writer, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ring")
+	w, err := Create(path, width, height, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w, path
+}
+
+func open(t *testing.T, path string) *Reader {
+	t.Helper()
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// uniform reports whether the visible pixels of f are all v.
+func uniform(f *frame.Frame, v byte) bool {
+	for y := 0; y < f.Height; y++ {
+		for _, b := range f.Pix[y*f.Stride : y*f.Stride+f.Width*4] {
+			if b != v {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestRoundtrip(t *testing.T) {
+	w, path := create(t, 64, 48, nil)
+	r := open(t, path)
+
+	in := testFrame(64, 48, 7, 0)
+	for i := range in.Pix {
+		in.Pix[i] = byte(i * 7)
+	}
+	if err := w.WriteFrame(in); err != nil {
+		t.Fatal(err)
+	}
+	out, err := r.GetFrame(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Width != 64 || out.Height != 48 || out.Seq != 7 || !out.Time.Equal(in.Time) || out.Bounds != in.Bounds {
+		t.Fatalf("got %dx%d seq %d time %v bounds %v", out.Width, out.Height, out.Seq, out.Time, out.Bounds)
+	}
+	if !out.Full() {
+		t.Errorf("first frame has dirty rects %v", out.Dirty)
+	}
+	for y := 0; y < 48; y++ {
+		if !bytes.Equal(out.Pix[y*out.Stride:][:64*4], in.Pix[y*in.Stride:][:64*4]) {
+			t.Fatalf("row %d differs", y)
+		}
+	}
+
+	// A following frame carries its damage.
+	next := testFrame(64, 48, 8, 0x55)
+	next.Dirty = []image.Rectangle{image.Rect(0, 0, 8, 8), image.Rect(60, 40, 64, 48)}
+	next.Moves = []frame.Move{{Src: image.Pt(0, 0), Dst: image.Rect(10, 10, 18, 18)}}
+	if err := w.WriteFrame(next); err != nil {
+		t.Fatal(err)
+	}
+	out, err = r.GetFrame(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := next.Damage(); !reflect.DeepEqual(out.Dirty, want) {
+		t.Errorf("dirty %v, want %v", out.Dirty, want)
+	}
+	if !uniform(out, 0x55) {
+		t.Error("second frame pixels differ")
+	}
+
+	// Smaller frames fit, and a size change makes the frame full.
+	if err := w.WriteFrame(testFrame(32, 16, 9, 0x66)); err != nil {
+		t.Fatal(err)
+	}
+	out, err = r.GetFrame(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Width != 32 || out.Height != 16 || out.Stride != 32*4 || !out.Full() || !uniform(out, 0x66) {
+		t.Errorf("resized frame: %dx%d stride %d dirty %v", out.Width, out.Height, out.Stride, out.Dirty)
+	}
+
+	if err := w.WriteFrame(testFrame(65, 48, 10, 0)); err != ErrTooLarge {
+		t.Errorf("oversized frame: %v, want ErrTooLarge", err)
+	}
+	if st := r.Stats(); st.Frames != 3 || st.Skipped != 0 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestSkipped(t *testing.T) {
+	w, path := create(t, 16, 16, &Options{Slots: 3})
+	for n := uint64(1); n <= 2; n++ {
+		if err := w.WriteFrame(testFrame(16, 16, n, byte(n))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Frames written before the reader opened are not counted as skipped;
+	// the newest one is returned first.
+	r := open(t, path)
+	f, err := r.GetFrame(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Seq != 2 || !uniform(f, 2) {
+		t.Fatalf("first read got seq %d", f.Seq)
+	}
+	if st := r.Stats(); st.Skipped != 0 {
+		t.Fatalf("skipped %d frames written before Open", st.Skipped)
+	}
+
+	// Falling behind by more than the ring holds skips to the newest frame.
+	for n := uint64(3); n <= 7; n++ {
+		f := testFrame(16, 16, n, byte(n))
+		f.Dirty = []image.Rectangle{image.Rect(0, 0, 1, 1)}
+		if err := w.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err = r.GetFrame(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Seq != 7 || !uniform(f, 7) {
+		t.Fatalf("got seq %d, want 7", f.Seq)
+	}
+	if !f.Full() {
+		t.Errorf("frame after a skip has dirty rects %v", f.Dirty)
+	}
+	if st := r.Stats(); st.Frames != 2 || st.Skipped != 4 {
+		t.Errorf("stats %+v, want 2 frames and 4 skipped", st)
+	}
+	if _, err := r.GetFrame(0); err != frame.ErrNoImageYet {
+		t.Errorf("no new frame: %v, want ErrNoImageYet", err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	w, path := create(t, 16, 16, nil)
+	r := open(t, path)
+	if _, err := r.GetFrame(10); err != frame.ErrNoImageYet {
+		t.Fatalf("empty ring: %v, want ErrNoImageYet", err)
+	}
+	if err := w.WriteFrame(testFrame(16, 16, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteFrame(testFrame(16, 16, 2, 2)); err == nil {
+		t.Error("WriteFrame after Close succeeded")
+	}
+
+	// The last frame is still delivered before ErrClosed.
+	if f, err := r.GetFrame(10); err != nil || f.Seq != 1 {
+		t.Fatalf("last frame: %v", err)
+	}
+	if _, err := r.GetFrame(10); err != ErrClosed {
+		t.Fatalf("after close: %v, want ErrClosed", err)
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ring")
+	if err := os.WriteFile(path, make([]byte, 2*headerSize), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Open: %v, want ErrInvalid", err)
+	}
+}
+
+func TestSeqlock(t *testing.T) {
+	w, path := create(t, 16, 16, nil)
+	r := open(t, path)
+	if err := w.WriteFrame(testFrame(16, 16, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// While the writer holds the slot, its lock is odd and readers retry
+	// until it is released.
+	lock := word(w.b[headerSize:], offLock)
+	atomic.AddUint64(lock, 1)
+	got := make(chan error, 1)
+	go func() {
+		_, err := r.GetFrame(1000)
+		got <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-got:
+		t.Fatalf("read a slot locked by the writer: %v", err)
+	default:
+	}
+	atomic.AddUint64(lock, 1)
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	if st := r.Stats(); st.Frames != 1 || st.Retries == 0 {
+		t.Errorf("stats %+v, want 1 frame and retries", st)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	const frames = 500
+	w, path := create(t, 256, 256, &Options{Slots: 2})
+	r := open(t, path)
+
+	done := make(chan error, 1)
+	go func() {
+		f := testFrame(256, 256, 0, 0)
+		for n := uint64(1); n <= frames; n++ {
+			f.Seq = n
+			for i := range f.Pix {
+				f.Pix[i] = byte(n)
+			}
+			if err := w.WriteFrame(f); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- w.Close()
+	}()
+
+	var last uint64
+	for {
+		f, err := r.GetFrame(1000)
+		if err == ErrClosed {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Seq <= last {
+			t.Fatalf("seq %d after %d", f.Seq, last)
+		}
+		// A torn copy would mix the pixels of two frames.
+		if !uniform(f, byte(f.Seq)) {
+			t.Fatalf("frame %d is torn", f.Seq)
+		}
+		last = f.Seq
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if last != frames {
+		t.Errorf("last frame %d, want %d", last, frames)
+	}
+	st := r.Stats()
+	if st.Frames+st.Skipped != frames {
+		t.Errorf("stats %+v do not add up to %d frames", st, frames)
+	}
+	t.Logf("read %d, skipped %d, retried %d", st.Frames, st.Skipped, st.Retries)
+}
+
+func TestCreateMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows files have no Unix permission bits")
+	}
+	_, path := create(t, 16, 16, nil)
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := st.Mode().Perm(); perm&0o077 != 0 {
+		t.Errorf("ring file mode %v is accessible to group or others", perm)
+	}
+}
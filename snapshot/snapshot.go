@@ -0,0 +1,115 @@
+// Package snapshot encodes single frames to image files.
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/jpegenc"
+	"github.com/shinkar94/godesktopdup/pngenc"
+	"github.com/shinkar94/godesktopdup/qoi"
+)
+
+// Format is an image file format.
+type Format int
+
+const (
+	PNG Format = iota
+	JPEG
+	// QOI is lossless like PNG but encodes many times faster, for
+	// high-frequency captures.
+	QOI
+)
+
+func (f Format) String() string {
+	switch f {
+	case PNG:
+		return "png"
+	case JPEG:
+		return "jpeg"
+	case QOI:
+		return "qoi"
+	default:
+		return "unknown"
+	}
+}
+
+// Extension returns the usual file name extension, including the dot.
+func (f Format) Extension() string {
+	switch f {
+	case JPEG:
+		return ".jpg"
+	default:
+		return "." + f.String()
+	}
+}
+
+// ParseFormat returns the format for a name or file extension such as "png" or ".jpg".
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "png", ".png":
+		return PNG, nil
+	case "jpeg", "jpg", ".jpeg", ".jpg":
+		return JPEG, nil
+	case "qoi", ".qoi":
+		return QOI, nil
+	}
+	return 0, fmt.Errorf("unknown image format %q", s)
+}
+
+// Options configures encoding. A nil *Options uses the defaults of each format.
+type Options struct {
+	// PNGLevel is the PNG compression level.
+	PNGLevel pngenc.CompressionLevel
+	// Quality is the JPEG quality, 1 to 100. 0 means jpegenc.DefaultQuality.
+	Quality     int
+	Subsampling jpegenc.Subsampling
+	// Metadata embeds the capture time, output name and bounds as PNG tEXt chunks.
+	Metadata bool
+}
+
+// Encode writes f in the given format.
+func Encode(w io.Writer, f *frame.Frame, format Format, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	switch format {
+	case PNG:
+		po := &pngenc.Options{Level: opts.PNGLevel}
+		if opts.Metadata {
+			po.Text = Metadata(f)
+		}
+		return pngenc.Encode(w, f.Pix, f.Width, f.Height, f.Stride, po)
+	case JPEG:
+		return jpegenc.Encode(w, f.Pix, f.Width, f.Height, f.Stride, &jpegenc.Options{
+			Quality:     opts.Quality,
+			Subsampling: opts.Subsampling,
+		})
+	case QOI:
+		return qoi.Encode(w, f.Pix, f.Width, f.Height, f.Stride, nil)
+	default:
+		return fmt.Errorf("unknown image format %d", format)
+	}
+}
+
+// Metadata returns the capture metadata of f as PNG text entries.
+// "Creation Time" is a keyword registered by the PNG specification.
+func Metadata(f *frame.Frame) []pngenc.Text {
+	var text []pngenc.Text
+	if !f.Time.IsZero() {
+		text = append(text, pngenc.Text{Keyword: "Creation Time", Value: f.Time.UTC().Format(time.RFC3339Nano)})
+	}
+	if f.Output != "" {
+		text = append(text, pngenc.Text{Keyword: "Output", Value: f.Output})
+	}
+	if !f.Bounds.Empty() {
+		b := f.Bounds
+		text = append(text, pngenc.Text{
+			Keyword: "Bounds",
+			Value:   fmt.Sprintf("%d,%d,%d,%d", b.Min.X, b.Min.Y, b.Max.X, b.Max.Y),
+		})
+	}
+	return text
+}
@@ -0,0 +1,146 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/pngenc"
+	"github.com/shinkar94/godesktopdup/qoi"
+)
+
+// testFrame returns an opaque gradient frame with capture metadata.
+func testFrame() *frame.Frame {
+	f := frame.New(48, 32)
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			copy(f.Pix[f.PixOffset(x, y):], []byte{byte(x * 5), byte(y * 7), byte(x + y), 0xFF})
+		}
+	}
+	f.Time = time.Date(2024, 5, 6, 7, 8, 9, 500000000, time.FixedZone("", 3600))
+	f.Output = `\\.\DISPLAY2`
+	f.Bounds = image.Rect(1920, 0, 3840, 1080)
+	return f
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want Format
+	}{
+		{"png", PNG}, {".png", PNG},
+		{"jpeg", JPEG}, {"jpg", JPEG}, {".jpeg", JPEG}, {".jpg", JPEG},
+		{"qoi", QOI}, {".qoi", QOI},
+	} {
+		if got, err := ParseFormat(c.in); err != nil || got != c.want {
+			t.Errorf("ParseFormat(%q) = %v, %v, want %v", c.in, got, err, c.want)
+		}
+	}
+	for _, in := range []string{"", "gif", "PNG", "png."} {
+		if _, err := ParseFormat(in); err == nil {
+			t.Errorf("ParseFormat(%q) succeeded", in)
+		}
+	}
+	// Every extension parses back to its format.
+	for _, f := range []Format{PNG, JPEG, QOI} {
+		if got, err := ParseFormat(f.Extension()); err != nil || got != f {
+			t.Errorf("%v: extension %q parses to %v, %v", f, f.Extension(), got, err)
+		}
+		if got, _ := ParseFormat(f.String()); got != f {
+			t.Errorf("%v: name parses to %v", f, got)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	f := testFrame()
+	for _, c := range []struct {
+		format Format
+		decode func(*bytes.Buffer) (image.Image, error)
+		tol    int
+	}{
+		{PNG, func(b *bytes.Buffer) (image.Image, error) { return png.Decode(b) }, 0},
+		{JPEG, func(b *bytes.Buffer) (image.Image, error) { return jpeg.Decode(b) }, 12},
+		{QOI, func(b *bytes.Buffer) (image.Image, error) { return qoi.DecodeImage(b) }, 0},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, f, c.format, &Options{Quality: 95}); err != nil {
+			t.Fatal(err)
+		}
+		img, err := c.decode(&buf)
+		if err != nil {
+			t.Fatalf("%v: %v", c.format, err)
+		}
+		if img.Bounds() != f.Rect() {
+			t.Fatalf("%v: bounds %v", c.format, img.Bounds())
+		}
+		for y := 0; y < f.Height; y++ {
+			for x := 0; x < f.Width; x++ {
+				p := f.Pix[f.PixOffset(x, y):]
+				got := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				for i, v := range []byte{got.B, got.G, got.R} {
+					if d := int(v) - int(p[i]); d < -c.tol || d > c.tol {
+						t.Fatalf("%v: pixel %d,%d is %v, want % x", c.format, x, y, got, p[:3])
+					}
+				}
+			}
+		}
+	}
+	if err := Encode(&bytes.Buffer{}, f, Format(9), nil); err == nil {
+		t.Error("encoded an unknown format")
+	}
+}
+
+// textChunks returns the tEXt entries of a PNG file.
+func textChunks(b []byte) map[string]string {
+	text := map[string]string{}
+	for b = b[len(pngenc.Signature):]; len(b) >= 12; {
+		n := int(binary.BigEndian.Uint32(b))
+		if string(b[4:8]) == "tEXt" {
+			kv := bytes.SplitN(b[8:8+n], []byte{0}, 2)
+			text[string(kv[0])] = string(kv[1])
+		}
+		b = b[12+n:]
+	}
+	return text
+}
+
+func TestMetadata(t *testing.T) {
+	f := testFrame()
+	var buf bytes.Buffer
+	if err := Encode(&buf, f, PNG, &Options{Metadata: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Creation Time": "2024-05-06T06:08:09.5Z",
+		"Output":        `\\.\DISPLAY2`,
+		"Bounds":        "1920,0,3840,1080",
+	}
+	got := textChunks(buf.Bytes())
+	if len(got) != len(want) {
+		t.Errorf("text entries %q, want %q", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s is %q, want %q", k, got[k], v)
+		}
+	}
+	if _, err := png.Decode(&buf); err != nil {
+		t.Errorf("PNG with metadata: %v", err)
+	}
+
+	buf.Reset()
+	Encode(&buf, f, PNG, nil)
+	if got := textChunks(buf.Bytes()); len(got) != 0 {
+		t.Errorf("metadata %q written without Options.Metadata", got)
+	}
+	if text := Metadata(frame.New(4, 4)); len(text) != 0 {
+		t.Errorf("metadata %v for a frame without capture details", text)
+	}
+}
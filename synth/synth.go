@@ -0,0 +1,288 @@
+package synth
+
+import (
+	"image"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/cursor"
+	"github.com/shinkar94/godesktopdup/disp"
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// Options configures a synthetic source.
+type Options struct {
+	Width, Height int
+	// FPS is the rate at which frames are produced. Defaults to 30.
+	FPS int
+	// Static disables the moving block, so frames are only produced when the
+	// cursor moves, like an idle desktop.
+	Static bool
+	// Track moves the cursor. Nil means no cursor.
+	Track Track
+	// Protected, if set, reports for the time since the start whether frames
+	// are flagged as having protected content masked out.
+	Protected func(t time.Duration) bool
+	// DrawCursor composites the cursor into the frame like SetCaptureCursor(true).
+	DrawCursor bool
+	// Virtual advances time by one frame interval per GetFrame call instead of
+	// following the wall clock, for deterministic output.
+	Virtual bool
+	// Start is the time of the first frame. Defaults to time.Now().
+	Start  time.Time
+	Output string
+}
+
+// Source produces synthetic frames: a static test pattern with a bouncing
+// block and a cursor following a Track. It implements frame.Source and
+// reports damage the same way DesktopDuplication does.
+type Source struct {
+	opts     Options
+	interval time.Duration
+	start    time.Time
+	elapsed  time.Duration
+	f        frame.Frame
+
+	block      image.Rectangle
+	velocity   image.Point
+	shape      *cursor.Shape
+	cursorRect image.Rectangle
+}
+
+// New returns a synthetic source.
+func New(opts Options) *Source {
+	if opts.Width <= 0 {
+		opts.Width = 640
+	}
+	if opts.Height <= 0 {
+		opts.Height = 480
+	}
+	if opts.FPS <= 0 {
+		opts.FPS = 30
+	}
+	if opts.Start.IsZero() {
+		opts.Start = time.Now()
+	}
+	if opts.Output == "" {
+		opts.Output = "SYNTHETIC"
+	}
+	size := min(64, opts.Width/4, opts.Height/4)
+	s := &Source{
+		opts:     opts,
+		interval: time.Second / time.Duration(opts.FPS),
+		start:    opts.Start,
+		elapsed:  -1,
+		block:    image.Rect(0, 0, size, size),
+		velocity: image.Pt(max(1, opts.Width/97), max(1, opts.Height/89)),
+	}
+	s.f = frame.Frame{
+		Pix:    make([]byte, opts.Width*opts.Height*4),
+		Width:  opts.Width,
+		Height: opts.Height,
+		Stride: opts.Width * 4,
+		Output: opts.Output,
+		Bounds: image.Rect(0, 0, opts.Width, opts.Height),
+	}
+	if opts.Track != nil {
+		s.shape = ArrowShape()
+	}
+	return s
+}
+
+// GetFrame returns the next frame, or frame.ErrNoImageYet if nothing changed
+// within the timeout.
+func (s *Source) GetFrame(timeoutMs uint) (*frame.Frame, error) {
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	deadline := time.Now().Add(timeout)
+	for {
+		next := s.elapsed + s.interval
+		if s.elapsed < 0 {
+			next = 0
+		}
+		if !s.opts.Virtual {
+			due := s.start.Add(next)
+			if wait := time.Until(due); wait > 0 {
+				if time.Now().Add(wait).After(deadline) {
+					time.Sleep(time.Until(deadline))
+					return nil, frame.ErrNoImageYet
+				}
+				time.Sleep(wait)
+			} else if s.elapsed >= 0 {
+				// Skip frames we are late for, like DDA accumulating frames.
+				next = time.Since(s.start) / s.interval * s.interval
+			}
+		}
+		first := s.elapsed < 0
+		s.elapsed = next
+		if s.render(first) {
+			return &s.f, nil
+		}
+		if s.opts.Virtual || !time.Now().Before(deadline) {
+			return nil, frame.ErrNoImageYet
+		}
+	}
+}
+
+// render advances the scene to s.elapsed and reports whether anything changed.
+func (s *Source) render(first bool) bool {
+	f := &s.f
+	f.Time = s.start.Add(s.elapsed)
+	f.Moves = f.Moves[:0]
+	f.Cursor.Shape = nil
+	f.Cursor.LastUpdate = 0
+	switch {
+	case first:
+		f.Dirty = nil
+	case f.Dirty == nil:
+		f.Dirty = make([]image.Rectangle, 0, 8)
+	default:
+		f.Dirty = f.Dirty[:0]
+	}
+
+	if first {
+		s.renderRect(f.Rect())
+	}
+	if !s.opts.Static {
+		old := s.block
+		s.moveBlock()
+		s.renderRect(old)
+		s.renderRect(s.block)
+		f.AddDirty(old)
+		f.AddDirty(s.block)
+	}
+
+	if s.opts.Track != nil {
+		x, y, visible := s.opts.Track(s.elapsed)
+		tip := image.Pt(x, y)
+		if first {
+			f.Cursor.ShapeID = s.shape.ID
+			f.Cursor.HotSpot = s.shape.HotSpot
+			f.Cursor.Shape = s.shape
+		}
+		if first || tip != f.Cursor.Tip() || visible != f.Cursor.Visible {
+			// Like DXGI, the position is the shape's top-left corner.
+			origin := tip.Sub(s.shape.HotSpot)
+			f.Cursor.X, f.Cursor.Y, f.Cursor.Visible = origin.X, origin.Y, visible
+			f.Cursor.LastUpdate = int64(s.elapsed) + 1
+		}
+		if s.opts.DrawCursor {
+			if !s.cursorRect.Empty() {
+				s.renderRect(s.cursorRect)
+				f.AddDirty(s.cursorRect)
+			}
+			s.cursorRect = image.Rectangle{}
+			if f.Cursor.Visible {
+				s.shape.Draw(f.Pix, f.Width, f.Height, f.Stride, tip.X, tip.Y)
+				origin := image.Pt(f.Cursor.X, f.Cursor.Y)
+				s.cursorRect = image.Rect(0, 0, s.shape.Mask.Width, s.shape.Mask.Height).Add(origin).Intersect(f.Rect())
+				f.AddDirty(s.cursorRect)
+			}
+		}
+	}
+
+	protected := s.opts.Protected != nil && s.opts.Protected(s.elapsed)
+	if !first && len(f.Dirty) == 0 && f.Cursor.LastUpdate == 0 && protected == f.Protected {
+		return false
+	}
+	f.Protected = protected
+	f.Seq++
+	return true
+}
+
+func (s *Source) moveBlock() {
+	r := s.block.Add(s.velocity)
+	if r.Min.X < 0 || r.Max.X > s.opts.Width {
+		s.velocity.X = -s.velocity.X
+	}
+	if r.Min.Y < 0 || r.Max.Y > s.opts.Height {
+		s.velocity.Y = -s.velocity.Y
+	}
+	s.block = s.block.Add(s.velocity)
+}
+
+// renderRect draws the background pattern and the block into r.
+func (s *Source) renderRect(r image.Rectangle) {
+	f := &s.f
+	r = r.Intersect(f.Rect())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := f.Pix[y*f.Stride:]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			o := x * 4
+			if image.Pt(x, y).In(s.block) && !s.opts.Static {
+				row[o], row[o+1], row[o+2], row[o+3] = 0x20, 0x80, 0xF0, 0xFF
+				continue
+			}
+			bar := x * 8 / f.Width
+			shade := byte(0x40 + y*0xBF/max(1, f.Height-1))
+			var b, g, r byte
+			if bar&1 != 0 {
+				b = shade
+			}
+			if bar&2 != 0 {
+				r = shade
+			}
+			if bar&4 != 0 {
+				g = shade
+			}
+			if (x/32+y/32)&1 == 0 {
+				b, g, r = b|0x10, g|0x10, r|0x10
+			}
+			row[o], row[o+1], row[o+2], row[o+3] = b, g, r, 0xFF
+		}
+	}
+}
+
+// ArrowShape returns a monochrome arrow pointer decoded like a DXGI shape.
+func ArrowShape() *cursor.Shape {
+	// X is black (AND=0, XOR=0), o is white (AND=0, XOR=1), . is transparent.
+	rows := []string{
+		"X...........",
+		"XX..........",
+		"XoX.........",
+		"XooX........",
+		"XoooX.......",
+		"XooooX......",
+		"XoooooX.....",
+		"XooooooX....",
+		"XoooooooX...",
+		"XooooooooX..",
+		"XoooooXXXXX.",
+		"XooXooX.....",
+		"XoX.XooX....",
+		"XX..XooX....",
+		"X....XooX...",
+		".....XooX...",
+		"......XX....",
+	}
+	const width = 16
+	height := len(rows)
+	pitch := width / 8
+	buf := make([]byte, pitch*height*2)
+	andMask := buf[:pitch*height]
+	xorMask := buf[pitch*height:]
+	for i := range andMask {
+		andMask[i] = 0xFF
+	}
+	for y, row := range rows {
+		for x, c := range row {
+			bit := byte(0x80) >> (x & 7)
+			switch c {
+			case 'X':
+				andMask[y*pitch+x/8] &^= bit
+			case 'o':
+				andMask[y*pitch+x/8] &^= bit
+				xorMask[y*pitch+x/8] |= bit
+			}
+		}
+	}
+	info := disp.DuplicationPointerShapeInfo{
+		Type:   disp.DuplicationPointerShapeTypeMonochrome,
+		Width:  width,
+		Height: uint32(height * 2),
+		Pitch:  uint32(pitch),
+	}
+	shape, err := cursor.Decode(info, buf)
+	if err != nil {
+		panic(err)
+	}
+	return shape
+}
@@ -0,0 +1,63 @@
+package synth
+
+import (
+	"image"
+	"math"
+	"time"
+)
+
+// Track returns the position of the cursor's hot spot and its visibility at
+// elapsed time t.
+type Track func(t time.Duration) (x, y int, visible bool)
+
+// Circle moves the cursor around a circle once per period.
+func Circle(center image.Point, radius int, period time.Duration) Track {
+	return func(t time.Duration) (int, int, bool) {
+		angle := 2 * math.Pi * float64(t%period) / float64(period)
+		return center.X + int(math.Round(float64(radius)*math.Cos(angle))),
+			center.Y + int(math.Round(float64(radius)*math.Sin(angle))), true
+	}
+}
+
+// Line moves the cursor from one point to another and back, taking d per leg.
+func Line(from, to image.Point, d time.Duration) Track {
+	return func(t time.Duration) (int, int, bool) {
+		phase := float64(t%(2*d)) / float64(d)
+		if phase > 1 {
+			phase = 2 - phase
+		}
+		return from.X + int(math.Round(float64(to.X-from.X)*phase)),
+			from.Y + int(math.Round(float64(to.Y-from.Y)*phase)), true
+	}
+}
+
+// Waypoint is a cursor position at a point in time.
+type Waypoint struct {
+	At     time.Duration
+	Pos    image.Point
+	Hidden bool
+}
+
+// Path interpolates linearly between waypoints sorted by At. The cursor stays
+// at the first waypoint before it and at the last one after it.
+func Path(points ...Waypoint) Track {
+	return func(t time.Duration) (int, int, bool) {
+		if len(points) == 0 {
+			return 0, 0, false
+		}
+		if t <= points[0].At {
+			return points[0].Pos.X, points[0].Pos.Y, !points[0].Hidden
+		}
+		for i := 1; i < len(points); i++ {
+			a, b := points[i-1], points[i]
+			if t > b.At {
+				continue
+			}
+			k := float64(t-a.At) / float64(max(1, b.At-a.At))
+			return a.Pos.X + int(math.Round(float64(b.Pos.X-a.Pos.X)*k)),
+				a.Pos.Y + int(math.Round(float64(b.Pos.Y-a.Pos.Y)*k)), !a.Hidden
+		}
+		last := points[len(points)-1]
+		return last.Pos.X, last.Pos.Y, !last.Hidden
+	}
+}
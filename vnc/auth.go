@@ -0,0 +1,38 @@
+package vnc
+
+import (
+	"crypto/des"
+	"crypto/rand"
+	"crypto/subtle"
+)
+
+// newChallenge returns a random VNC authentication challenge.
+func newChallenge() ([]byte, error) {
+	c := make([]byte, 16)
+	_, err := rand.Read(c)
+	return c, err
+}
+
+// vncResponse returns the expected response to a challenge: the challenge
+// DES-encrypted with the password, truncated or zero padded to 8 bytes, as
+// key. VNC reverses the bits of every key byte.
+func vncResponse(password string, challenge []byte) []byte {
+	var key [8]byte
+	copy(key[:], password)
+	for i, b := range key {
+		b = b>>4 | b<<4
+		b = b&0xCC>>2 | b&0x33<<2
+		key[i] = b&0xAA>>1 | b&0x55<<1
+	}
+	block, _ := des.NewCipher(key[:])
+	out := make([]byte, len(challenge))
+	for i := 0; i+8 <= len(challenge); i += 8 {
+		block.Encrypt(out[i:], challenge[i:])
+	}
+	return out
+}
+
+// checkResponse reports whether response answers challenge for password.
+func checkResponse(password string, challenge, response []byte) bool {
+	return subtle.ConstantTimeCompare(vncResponse(password, challenge), response) == 1
+}
@@ -0,0 +1,41 @@
+package vnc
+
+import (
+	"bytes"
+	"crypto/des"
+	"math/bits"
+	"testing"
+)
+
+// desResponse answers a VNC challenge the way viewers do.
+func desResponse(password string, challenge []byte) []byte {
+	var key [8]byte
+	copy(key[:], password)
+	for i, b := range key {
+		key[i] = bits.Reverse8(b)
+	}
+	block, err := des.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	out := make([]byte, 16)
+	block.Encrypt(out, challenge)
+	block.Encrypt(out[8:], challenge[8:])
+	return out
+}
+
+func TestCheckResponse(t *testing.T) {
+	challenge := []byte("0123456789abcdef")
+	if got, want := vncResponse("pass", challenge), desResponse("pass", challenge); !bytes.Equal(got, want) {
+		t.Fatalf("response % x, want % x", got, want)
+	}
+	if !checkResponse("secret99", challenge, desResponse("secret99", challenge)) {
+		t.Error("right password refused")
+	}
+	if !checkResponse("secret99 and more", challenge, desResponse("secret99", challenge)) {
+		t.Error("password not truncated to 8 bytes")
+	}
+	if checkResponse("secret98", challenge, desResponse("secret99", challenge)) {
+		t.Error("wrong password accepted")
+	}
+}
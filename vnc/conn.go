@@ -0,0 +1,497 @@
+package vnc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/cursor"
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// Security types.
+const (
+	securityNone = 1
+	securityVNC  = 2
+)
+
+// Client to server message types.
+const (
+	msgSetPixelFormat = 0
+	msgSetEncodings   = 2
+	msgUpdateRequest  = 3
+	msgKeyEvent       = 4
+	msgPointerEvent   = 5
+	msgClientCutText  = 6
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	// readyTimeout bounds the wait for the first frame of the source.
+	readyTimeout = 5 * time.Second
+	maxCutText   = 1 << 20
+	// maxDamage is the number of pending rectangles above which they are
+	// merged into their bounding box.
+	maxDamage = 64
+)
+
+// conn is a connected viewer. A reader goroutine handles client messages;
+// the sender goroutine answers update requests once there is something to send.
+type conn struct {
+	s       *Server
+	nc      net.Conn
+	br      *bufio.Reader
+	version int
+
+	mu sync.Mutex
+	pf *pixelFormat
+	// encoding is the preferred encoding for pixel data.
+	encoding    int32
+	copyRect    bool
+	cursor      bool
+	desktopSize bool
+	quality     int
+	// Pending update, sent when the viewer has requested one.
+	requested   bool
+	full        bool
+	resized     bool
+	damage      []image.Rectangle
+	moves       []frame.Move
+	cursorDirty bool
+
+	// Owned by the sender.
+	width, height int
+	enc           encoder
+	// snap holds the pixels being encoded, copied from the framebuffer.
+	snap framebuffer
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// ServeConn runs the RFB protocol on nc until the viewer disconnects.
+func (s *Server) ServeConn(nc net.Conn) error {
+	defer nc.Close()
+	c := &conn{
+		s:        s,
+		nc:       nc,
+		br:       bufio.NewReader(nc),
+		pf:       serverFormat(),
+		encoding: encRaw,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := c.handshake(); err != nil {
+		return err
+	}
+	ready, err := s.join(c)
+	if err != nil {
+		return err
+	}
+	defer s.leave(c)
+	select {
+	case <-ready:
+	case <-time.After(readyTimeout):
+		return errors.New("vnc: no frame from source")
+	}
+	if err := c.serverInit(); err != nil {
+		return err
+	}
+	nc.SetDeadline(time.Time{})
+
+	go c.sendLoop()
+	err = c.readLoop()
+	close(c.done)
+	return err
+}
+
+// handshake negotiates the protocol version and security and reads ClientInit.
+func (c *conn) handshake() error {
+	if _, err := io.WriteString(c.nc, "RFB 003.008\n"); err != nil {
+		return err
+	}
+	var v [12]byte
+	if _, err := io.ReadFull(c.br, v[:]); err != nil {
+		return err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(v[:]), "RFB %03d.%03d\n", &major, &minor); err != nil || major != 3 {
+		return fmt.Errorf("vnc: unsupported protocol version %q", v[:])
+	}
+	switch {
+	case minor >= 8:
+		c.version = 8
+	case minor == 7:
+		c.version = 7
+	default:
+		c.version = 3
+	}
+
+	security := byte(securityNone)
+	if c.s.opts.Password != "" {
+		security = securityVNC
+	}
+	if c.version == 3 {
+		if err := writeUint32(c.nc, uint32(security)); err != nil {
+			return err
+		}
+	} else {
+		if _, err := c.nc.Write([]byte{1, security}); err != nil {
+			return err
+		}
+		chosen, err := c.br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if chosen != security {
+			c.fail("security type not offered")
+			return fmt.Errorf("vnc: viewer chose security type %d", chosen)
+		}
+	}
+
+	if security == securityVNC {
+		challenge, err := newChallenge()
+		if err != nil {
+			return err
+		}
+		if _, err := c.nc.Write(challenge); err != nil {
+			return err
+		}
+		response := make([]byte, 16)
+		if _, err := io.ReadFull(c.br, response); err != nil {
+			return err
+		}
+		if !checkResponse(c.s.opts.Password, challenge, response) {
+			c.fail("authentication failed")
+			return errors.New("vnc: authentication failed")
+		}
+	}
+	// Before 3.8, SecurityResult is only sent after VNC authentication.
+	if security == securityVNC || c.version == 8 {
+		if err := writeUint32(c.nc, 0); err != nil {
+			return err
+		}
+	}
+
+	// ClientInit carries the shared flag; viewers always share the output.
+	_, err := c.br.ReadByte()
+	return err
+}
+
+// fail sends a failed SecurityResult, with the reason from 3.8 on.
+func (c *conn) fail(reason string) {
+	b := binary.BigEndian.AppendUint32(nil, 1)
+	if c.version == 8 {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(reason)))
+		b = append(b, reason...)
+	}
+	c.nc.Write(b)
+}
+
+func (c *conn) serverInit() error {
+	c.s.mu.Lock()
+	err := c.s.err
+	c.s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	c.s.fbMu.RLock()
+	c.width, c.height = c.s.fb.width, c.s.fb.height
+	name := c.s.opts.Name
+	if name == "" {
+		name = c.s.fb.output
+	}
+	c.s.fbMu.RUnlock()
+
+	b := binary.BigEndian.AppendUint16(nil, uint16(c.width))
+	b = binary.BigEndian.AppendUint16(b, uint16(c.height))
+	b = append(b, c.pf.marshal()...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(name)))
+	b = append(b, name...)
+
+	c.mu.Lock()
+	c.full = true
+	c.mu.Unlock()
+	_, err = c.nc.Write(b)
+	return err
+}
+
+func writeUint32(w io.Writer, v uint32) error {
+	_, err := w.Write(binary.BigEndian.AppendUint32(nil, v))
+	return err
+}
+
+// signal wakes the sender.
+func (c *conn) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// notify adds a framebuffer change to the pending update.
+func (c *conn) notify(ch *change) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cursorDirty = c.cursorDirty || ch.cursor && c.cursor
+	switch {
+	case ch.resized:
+		c.resized = true
+		fallthrough
+	case ch.full:
+		c.full = true
+	}
+	if c.full {
+		c.damage, c.moves = c.damage[:0], c.moves[:0]
+		c.signal()
+		return
+	}
+
+	// A move can only be replayed by the viewer if its source is up to date
+	// there; otherwise its destination is resent as pixels.
+	for _, m := range ch.moves {
+		src := m.Dst.Add(m.Src.Sub(m.Dst.Min))
+		if c.copyRect && !overlaps(c.damage, src) {
+			c.moves = append(c.moves, m)
+		} else {
+			c.damage = append(c.damage, m.Dst)
+		}
+	}
+	c.damage = append(c.damage, ch.dirty...)
+	if len(c.damage) > maxDamage {
+		union := image.Rectangle{}
+		for _, r := range c.damage {
+			union = union.Union(r)
+		}
+		c.damage = append(c.damage[:0], union)
+	}
+	c.signal()
+}
+
+func overlaps(rs []image.Rectangle, r image.Rectangle) bool {
+	for _, d := range rs {
+		if d.Overlaps(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *conn) readLoop() error {
+	var b [20]byte
+	for {
+		t, err := c.br.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case msgSetPixelFormat:
+			if _, err := io.ReadFull(c.br, b[:19]); err != nil {
+				return err
+			}
+			pf, err := parsePixelFormat(b[3:19])
+			if err != nil {
+				return err
+			}
+			c.mu.Lock()
+			c.pf = pf
+			c.mu.Unlock()
+
+		case msgSetEncodings:
+			if _, err := io.ReadFull(c.br, b[:3]); err != nil {
+				return err
+			}
+			encs := make([]byte, 4*int(binary.BigEndian.Uint16(b[1:])))
+			if _, err := io.ReadFull(c.br, encs); err != nil {
+				return err
+			}
+			c.setEncodings(encs)
+
+		case msgUpdateRequest:
+			if _, err := io.ReadFull(c.br, b[:9]); err != nil {
+				return err
+			}
+			incremental := b[0] != 0
+			x, y := int(binary.BigEndian.Uint16(b[1:])), int(binary.BigEndian.Uint16(b[3:]))
+			w, h := int(binary.BigEndian.Uint16(b[5:])), int(binary.BigEndian.Uint16(b[7:]))
+			c.mu.Lock()
+			c.requested = true
+			if !incremental {
+				c.damage = append(c.damage, image.Rect(x, y, x+w, y+h))
+			}
+			c.mu.Unlock()
+			c.signal()
+
+		case msgKeyEvent:
+			if _, err := io.ReadFull(c.br, b[:7]); err != nil {
+				return err
+			}
+			if in := c.s.opts.Injector; in != nil {
+				in.Key(binary.BigEndian.Uint32(b[3:]), b[0] != 0)
+			}
+
+		case msgPointerEvent:
+			if _, err := io.ReadFull(c.br, b[:5]); err != nil {
+				return err
+			}
+			if in := c.s.opts.Injector; in != nil {
+				in.Pointer(int(binary.BigEndian.Uint16(b[1:])), int(binary.BigEndian.Uint16(b[3:])), b[0])
+			}
+
+		case msgClientCutText:
+			if _, err := io.ReadFull(c.br, b[:7]); err != nil {
+				return err
+			}
+			n := binary.BigEndian.Uint32(b[3:])
+			if n > maxCutText {
+				return fmt.Errorf("vnc: cut text of %d bytes", n)
+			}
+			if _, err := c.br.Discard(int(n)); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("vnc: unknown message type %d", t)
+		}
+	}
+}
+
+// setEncodings applies a SetEncodings list, in the viewer's order of preference.
+func (c *conn) setEncodings(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.encoding = encRaw
+	c.copyRect, c.cursor, c.desktopSize = false, false, false
+	c.quality = 0
+	chosen := false
+	for i := 0; i+4 <= len(b); i += 4 {
+		e := int32(binary.BigEndian.Uint32(b[i:]))
+		switch {
+		case e == encRaw || e == encHextile || e == encZRLE || e == encTight:
+			if !chosen {
+				c.encoding, chosen = e, true
+			}
+		case e == encCopyRect:
+			c.copyRect = true
+		case e == encCursor:
+			c.cursor = true
+			c.cursorDirty = true
+		case e == encDesktopSize:
+			c.desktopSize = true
+		case e >= encQualityLevel0 && e <= encQualityLevel9:
+			c.quality = tightQuality[e-encQualityLevel0]
+		}
+	}
+}
+
+// snapshot returns the sender's copy of the framebuffer, sized width x height.
+func (c *conn) snapshot(width, height int) *framebuffer {
+	if c.snap.width != width || c.snap.height != height {
+		c.snap = framebuffer{pix: make([]byte, width*height*4), width: width, height: height}
+	}
+	return &c.snap
+}
+
+// sendLoop sends an update whenever one was requested and something changed.
+func (c *conn) sendLoop() {
+	defer c.nc.Close()
+	var scratch []byte
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.wake:
+		}
+
+		c.mu.Lock()
+		if !c.requested || !(c.full || c.resized || c.cursorDirty || len(c.damage) > 0 || len(c.moves) > 0) {
+			c.mu.Unlock()
+			continue
+		}
+		c.requested = false
+		c.enc.pf = c.pf
+		if c.enc.quality != c.quality {
+			c.enc.quality, c.enc.jpeg = c.quality, nil
+		}
+		encoding, desktopSize := c.encoding, c.desktopSize
+		full, resized, cursorDirty := c.full, c.resized, c.cursorDirty
+		damage := append([]image.Rectangle(nil), c.damage...)
+		moves := append([]frame.Move(nil), c.moves...)
+		c.damage, c.moves = c.damage[:0], c.moves[:0]
+		c.full, c.resized, c.cursorDirty = false, false, false
+		if resized && desktopSize {
+			// The resize goes alone; pixels follow on the next request.
+			c.full = true
+		}
+		c.mu.Unlock()
+
+		var u update
+		c.s.fbMu.RLock()
+		fb := &c.s.fb
+		if resized && desktopSize {
+			c.width, c.height = fb.width, fb.height
+			c.s.fbMu.RUnlock()
+			c.enc.desktopSize(&u, c.width, c.height)
+		} else {
+			bounds := image.Rect(0, 0, c.width, c.height).Intersect(image.Rect(0, 0, fb.width, fb.height))
+			var shape *cursor.Shape
+			if cursorDirty && fb.cursorVisible {
+				shape = fb.shape
+			}
+			if full {
+				damage = append(damage[:0], bounds)
+				moves = nil
+			}
+			copies := moves[:0]
+			for _, m := range moves {
+				src := m.Dst.Add(m.Src.Sub(m.Dst.Min))
+				if m.Dst.In(bounds) && src.In(bounds) {
+					copies = append(copies, m)
+				} else {
+					damage = append(damage, m.Dst)
+				}
+			}
+			// Encode from a copy of the damaged pixels, so a slow viewer
+			// does not hold up capture.
+			snap := c.snapshot(fb.width, fb.height)
+			for i, r := range damage {
+				damage[i] = r.Intersect(bounds)
+				frame.CopyRect(snap.pix, snap.width*4, fb.pix, fb.width*4, damage[i])
+			}
+			c.s.fbMu.RUnlock()
+
+			if cursorDirty {
+				c.enc.cursorShape(&u, shape)
+			}
+			for _, m := range copies {
+				c.enc.copyRect(&u, m.Dst, m.Src)
+			}
+			for _, r := range damage {
+				if r.Empty() {
+					continue
+				}
+				switch encoding {
+				case encHextile:
+					c.enc.hextile(&u, snap, r)
+				case encZRLE:
+					c.enc.zrle(&u, snap, r, &scratch)
+				case encTight:
+					c.enc.tight(&u, snap, r, &scratch)
+				default:
+					c.enc.raw(&u, snap, r)
+				}
+			}
+		}
+
+		if _, err := c.nc.Write(u.message()); err != nil {
+			return
+		}
+	}
+}
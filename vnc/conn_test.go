@@ -0,0 +1,694 @@
+package vnc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// scripted is a source returning the frames pushed by a test.
+type scripted struct {
+	frames chan *frame.Frame
+}
+
+func newScripted() *scripted {
+	return &scripted{frames: make(chan *frame.Frame, 1)}
+}
+
+func (s *scripted) GetFrame(timeoutMs uint) (*frame.Frame, error) {
+	t := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+	defer t.Stop()
+	select {
+	case f := <-s.frames:
+		return f, nil
+	case <-t.C:
+		return nil, frame.ErrNoImageYet
+	}
+}
+
+// testFrame returns a frame with noise, a solid area, a two color checker
+// board and a few colored stripes, so every subencoding is used.
+func testFrame(w, h int) *frame.Frame {
+	f := frame.New(w, h)
+	rand.New(rand.NewSource(int64(w * h))).Read(f.Pix)
+	set := func(x, y int, b, g, r byte) {
+		copy(f.Pix[f.PixOffset(x, y):], []byte{b, g, r, 0xFF})
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			switch {
+			case x < w/4:
+				f.Pix[f.PixOffset(x, y)+3] = 0xFF
+			case x < w/2:
+				set(x, y, 0x20, 0x40, 0x60)
+			case x < 3*w/4:
+				if (x/3+y/3)%2 == 0 {
+					set(x, y, 0xFF, 0xFF, 0xFF)
+				} else {
+					set(x, y, 0, 0, 0x80)
+				}
+			default:
+				v := byte(y / 4 % 5 * 50)
+				set(x, y, v, 0xFF-v, v/2)
+			}
+		}
+	}
+	return f
+}
+
+// client is a viewer keeping its framebuffer in the server's pixel format.
+type client struct {
+	t  *testing.T
+	nc net.Conn
+	br *bufio.Reader
+
+	width, height int
+	name          string
+	fb            []uint32
+	zrle          inflater
+	tight         [4]inflater
+}
+
+// inflater decompresses a zlib stream that arrives in flushed pieces.
+type inflater struct {
+	in  []byte
+	out int
+}
+
+// read returns the data decompressed from the stream so far plus chunk that
+// was not returned before.
+func (z *inflater) read(t *testing.T, chunk []byte) []byte {
+	z.in = append(z.in, chunk...)
+	r, err := zlib.NewReader(bytes.NewReader(z.in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(r)
+	b := out[z.out:]
+	z.out = len(out)
+	return b
+}
+
+// dial connects a viewer speaking the given protocol version and returns it
+// with the channel receiving the result of ServeConn.
+func dial(t *testing.T, s *Server, version string) (*client, chan error) {
+	sc, cc := net.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- s.ServeConn(sc) }()
+	t.Cleanup(func() { cc.Close() })
+	c := &client{t: t, nc: cc, br: bufio.NewReader(cc)}
+	if got := string(c.read(12)); got != "RFB 003.008\n" {
+		t.Fatalf("server version %q", got)
+	}
+	c.write([]byte(version))
+	return c, errc
+}
+
+// connect runs a 3.8 handshake and reads ServerInit.
+func connect(t *testing.T, s *Server, password string) *client {
+	c, _ := dial(t, s, "RFB 003.008\n")
+	security := byte(securityNone)
+	if password != "" {
+		security = securityVNC
+	}
+	if types := c.read(int(c.u8())); !bytes.Equal(types, []byte{security}) {
+		t.Fatalf("security types % x", types)
+	}
+	c.write([]byte{security})
+	if security == securityVNC {
+		c.write(desResponse(password, c.read(16)))
+	}
+	if result := c.u32(); result != 0 {
+		t.Fatalf("security result %d", result)
+	}
+	c.init()
+	return c
+}
+
+// init sends ClientInit and reads ServerInit.
+func (c *client) init() {
+	c.write([]byte{1})
+	c.width, c.height = int(c.u16()), int(c.u16())
+	if pf := c.read(16); !bytes.Equal(pf, serverFormat().marshal()) {
+		c.t.Fatalf("pixel format % x", pf)
+	}
+	c.name = string(c.read(int(c.u32())))
+	c.fb = make([]uint32, c.width*c.height)
+}
+
+func (c *client) read(n int) []byte {
+	c.t.Helper()
+	c.nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.br, b); err != nil {
+		c.t.Fatal(err)
+	}
+	return b
+}
+
+func (c *client) u8() byte    { return c.read(1)[0] }
+func (c *client) u16() uint16 { return binary.BigEndian.Uint16(c.read(2)) }
+func (c *client) u32() uint32 { return binary.BigEndian.Uint32(c.read(4)) }
+
+func (c *client) write(b []byte) {
+	c.t.Helper()
+	c.nc.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.nc.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) setEncodings(encs ...int32) {
+	b := []byte{msgSetEncodings, 0}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(encs)))
+	for _, e := range encs {
+		b = binary.BigEndian.AppendUint32(b, uint32(e))
+	}
+	c.write(b)
+}
+
+func (c *client) request(incremental bool) {
+	b := []byte{msgUpdateRequest, 0}
+	if incremental {
+		b[1] = 1
+	}
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(c.width))
+	b = binary.BigEndian.AppendUint16(b, uint16(c.height))
+	c.write(b)
+}
+
+// rect is a decoded rectangle header. For CopyRect, src is its source.
+type rect struct {
+	r   image.Rectangle
+	enc int32
+	src image.Point
+	// jpeg marks Tight rectangles sent as JPEG, whose pixels are approximate.
+	jpeg bool
+}
+
+// update reads a FramebufferUpdate and applies it to the framebuffer.
+func (c *client) update() []rect {
+	c.t.Helper()
+	if typ := c.u8(); typ != 0 {
+		c.t.Fatalf("message type %d, want FramebufferUpdate", typ)
+	}
+	c.read(1)
+	n := int(c.u16())
+	rects := make([]rect, n)
+	for i := range rects {
+		x, y, w, h := int(c.u16()), int(c.u16()), int(c.u16()), int(c.u16())
+		rc := rect{r: image.Rect(x, y, x+w, y+h), enc: int32(c.u32())}
+		switch rc.enc {
+		case encRaw:
+			c.raw(rc.r)
+		case encCopyRect:
+			rc.src = image.Pt(int(c.u16()), int(c.u16()))
+			c.copyRect(rc.r, rc.src)
+		case encHextile:
+			c.hextile(rc.r)
+		case encZRLE:
+			c.zrleRect(rc.r)
+		case encTight:
+			rc.jpeg = c.tightRect(rc.r)
+		case encDesktopSize:
+			c.width, c.height = w, h
+			c.fb = make([]uint32, w*h)
+		case encCursor:
+			c.read(w*h*4 + (w+7)/8*h)
+		default:
+			c.t.Fatalf("rectangle %v has encoding %d", rc.r, rc.enc)
+		}
+		rects[i] = rc
+	}
+	return rects
+}
+
+func (c *client) fill(r image.Rectangle, v uint32) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c.fb[y*c.width+x] = v
+		}
+	}
+}
+
+func (c *client) pixel() uint32 {
+	return binary.LittleEndian.Uint32(c.read(4))
+}
+
+func (c *client) raw(r image.Rectangle) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c.fb[y*c.width+x] = c.pixel()
+		}
+	}
+}
+
+func (c *client) copyRect(r image.Rectangle, src image.Point) {
+	tmp := make([]uint32, 0, r.Dx()*r.Dy())
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			tmp = append(tmp, c.fb[(src.Y+y)*c.width+src.X+x])
+		}
+	}
+	for y := 0; y < r.Dy(); y++ {
+		copy(c.fb[(r.Min.Y+y)*c.width+r.Min.X:], tmp[y*r.Dx():(y+1)*r.Dx()])
+	}
+}
+
+func (c *client) hextile(r image.Rectangle) {
+	var bg, fg uint32
+	for ty := r.Min.Y; ty < r.Max.Y; ty += 16 {
+		for tx := r.Min.X; tx < r.Max.X; tx += 16 {
+			t := image.Rect(tx, ty, min(tx+16, r.Max.X), min(ty+16, r.Max.Y))
+			flags := c.u8()
+			if flags&hextileRaw != 0 {
+				c.raw(t)
+				continue
+			}
+			if flags&hextileBackground != 0 {
+				bg = c.pixel()
+			}
+			c.fill(t, bg)
+			if flags&hextileForeground != 0 {
+				fg = c.pixel()
+			}
+			if flags&hextileAnySubrects == 0 {
+				continue
+			}
+			for n := int(c.u8()); n > 0; n-- {
+				v := fg
+				if flags&hextileColoured != 0 {
+					v = c.pixel()
+				}
+				xy, wh := c.u8(), c.u8()
+				x, y := tx+int(xy>>4), ty+int(xy&15)
+				c.fill(image.Rect(x, y, x+int(wh>>4)+1, y+int(wh&15)+1), v)
+			}
+		}
+	}
+}
+
+// zdata reads from decompressed data.
+type zdata struct {
+	t *testing.T
+	b []byte
+}
+
+func (d *zdata) next(n int) []byte {
+	if len(d.b) < n {
+		d.t.Fatalf("decompressed data ends %d bytes early", n-len(d.b))
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+// cpixel reads a 3 byte ZRLE CPIXEL of the server format.
+func (d *zdata) cpixel() uint32 {
+	b := d.next(3)
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func (d *zdata) runLength() int {
+	n := 1
+	for {
+		b := d.next(1)[0]
+		n += int(b)
+		if b != 255 {
+			return n
+		}
+	}
+}
+
+func (c *client) zrleRect(r image.Rectangle) {
+	d := &zdata{t: c.t, b: c.zrle.read(c.t, c.read(int(c.u32())))}
+	for ty := r.Min.Y; ty < r.Max.Y; ty += 64 {
+		for tx := r.Min.X; tx < r.Max.X; tx += 64 {
+			t := image.Rect(tx, ty, min(tx+64, r.Max.X), min(ty+64, r.Max.Y))
+			w := t.Dx()
+			px := make([]uint32, 0, w*t.Dy())
+			sub := int(d.next(1)[0])
+			var pal []uint32
+			if sub >= 2 && sub <= 16 || sub >= 130 {
+				n := sub
+				if sub >= 130 {
+					n = sub - 128
+				}
+				for i := 0; i < n; i++ {
+					pal = append(pal, d.cpixel())
+				}
+			}
+			switch {
+			case sub == 0:
+				for len(px) < cap(px) {
+					px = append(px, d.cpixel())
+				}
+			case sub == 1:
+				v := d.cpixel()
+				for len(px) < cap(px) {
+					px = append(px, v)
+				}
+			case sub <= 16:
+				bits := 4
+				if sub == 2 {
+					bits = 1
+				} else if sub <= 4 {
+					bits = 2
+				}
+				for y := 0; y < t.Dy(); y++ {
+					row := d.next((w*bits + 7) / 8)
+					for x := 0; x < w; x++ {
+						i := row[x*bits/8] >> (8 - bits - x*bits%8) & (1<<bits - 1)
+						px = append(px, pal[i])
+					}
+				}
+			case sub == 128:
+				for len(px) < cap(px) {
+					v := d.cpixel()
+					for n := d.runLength(); n > 0; n-- {
+						px = append(px, v)
+					}
+				}
+			case sub >= 130:
+				for len(px) < cap(px) {
+					i := d.next(1)[0]
+					n := 1
+					if i&128 != 0 {
+						n = d.runLength()
+					}
+					for ; n > 0; n-- {
+						px = append(px, pal[i&127])
+					}
+				}
+			default:
+				c.t.Fatalf("ZRLE subencoding %d", sub)
+			}
+			if len(px) != cap(px) {
+				c.t.Fatalf("ZRLE tile %v has %d pixels", t, len(px))
+			}
+			for y := 0; y < t.Dy(); y++ {
+				copy(c.fb[(t.Min.Y+y)*c.width+t.Min.X:], px[y*w:(y+1)*w])
+			}
+		}
+	}
+	if len(d.b) != 0 {
+		c.t.Fatalf("%d bytes after the ZRLE tiles", len(d.b))
+	}
+}
+
+func (c *client) compactLength() int {
+	b := c.u8()
+	n := int(b & 0x7F)
+	if b&0x80 != 0 {
+		b = c.u8()
+		n |= int(b&0x7F) << 7
+		if b&0x80 != 0 {
+			n |= int(c.u8()) << 14
+		}
+	}
+	return n
+}
+
+// tpixel converts a Tight RGB TPIXEL to the server format.
+func tpixel(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+// tightRect decodes a Tight rectangle and reports whether it was JPEG.
+func (c *client) tightRect(r image.Rectangle) bool {
+	ctl := c.u8()
+	for i := range c.tight {
+		if ctl&(1<<i) != 0 {
+			c.tight[i] = inflater{}
+		}
+	}
+	switch ctl >> 4 {
+	case tightFill >> 4:
+		c.fill(r, tpixel(c.read(3)))
+		return false
+	case tightJPEG >> 4:
+		img, err := jpeg.Decode(bytes.NewReader(c.read(c.compactLength())))
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if img.Bounds().Size() != r.Size() {
+			c.t.Fatalf("JPEG of %v for %v", img.Bounds(), r)
+		}
+		for y := 0; y < r.Dy(); y++ {
+			for x := 0; x < r.Dx(); x++ {
+				cr, cg, cb, _ := img.At(x, y).RGBA()
+				c.fb[(r.Min.Y+y)*c.width+r.Min.X+x] = cr>>8<<16 | cg>>8<<8 | cb>>8
+			}
+		}
+		return true
+	}
+
+	var pal []uint32
+	size := r.Dx() * r.Dy() * 3
+	if ctl&tightExplicitFilter != 0 {
+		if filter := c.u8(); filter != tightFilterPalette {
+			c.t.Fatalf("Tight filter %d", filter)
+		}
+		for n := int(c.u8()) + 1; n > 0; n-- {
+			pal = append(pal, tpixel(c.read(3)))
+		}
+		size = r.Dx() * r.Dy()
+		if len(pal) == 2 {
+			size = (r.Dx() + 7) / 8 * r.Dy()
+		}
+	}
+	var data []byte
+	if size < tightMinCompress {
+		data = c.read(size)
+	} else {
+		data = c.tight[ctl>>4&3].read(c.t, c.read(c.compactLength()))
+	}
+	if len(data) != size {
+		c.t.Fatalf("Tight rectangle %v has %d bytes of data, want %d", r, len(data), size)
+	}
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			var v uint32
+			switch {
+			case pal == nil:
+				v = tpixel(data[(y*r.Dx()+x)*3:])
+			case len(pal) == 2:
+				v = pal[data[y*((r.Dx()+7)/8)+x/8]>>(7-x%8)&1]
+			default:
+				v = pal[data[y*r.Dx()+x]]
+			}
+			c.fb[(r.Min.Y+y)*c.width+r.Min.X+x] = v
+		}
+	}
+	return false
+}
+
+// check compares the framebuffer with f, allowing tol per channel.
+func (c *client) check(f *frame.Frame, tol int) {
+	c.t.Helper()
+	if c.width != f.Width || c.height != f.Height {
+		c.t.Fatalf("viewer is %dx%d, frame %dx%d", c.width, c.height, f.Width, f.Height)
+	}
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			p := f.Pix[f.PixOffset(x, y):]
+			v := c.fb[y*c.width+x]
+			for i, want := range []byte{p[0], p[1], p[2]} {
+				if d := int(byte(v>>(8*i))) - int(want); d > tol || d < -tol {
+					c.t.Fatalf("pixel %d,%d is %06x, want %02x%02x%02x", x, y, v, p[2], p[1], p[0])
+				}
+			}
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	for _, c := range []struct {
+		version string
+		// securityList is set when the server offers a list to choose from.
+		securityList bool
+	}{
+		{"RFB 003.003\n", false},
+		{"RFB 003.007\n", true},
+		{"RFB 003.889\n", true},
+	} {
+		src := newScripted()
+		src.frames <- testFrame(32, 16)
+		v, _ := dial(t, New(src, &Options{Name: "desk"}), c.version)
+		if c.securityList {
+			if types := v.read(int(v.u8())); !bytes.Equal(types, []byte{securityNone}) {
+				t.Fatalf("%q: security types % x", c.version, types)
+			}
+			v.write([]byte{securityNone})
+		} else if typ := v.u32(); typ != securityNone {
+			t.Fatalf("%q: security type %d", c.version, typ)
+		}
+		if c.version == "RFB 003.889\n" {
+			if result := v.u32(); result != 0 {
+				t.Fatalf("%q: security result %d", c.version, result)
+			}
+		}
+		v.init()
+		if v.width != 32 || v.height != 16 || v.name != "desk" {
+			t.Errorf("%q: ServerInit %dx%d %q", c.version, v.width, v.height, v.name)
+		}
+	}
+
+	_, errc := dial(t, New(newScripted(), nil), "RFB 004.000\n")
+	if err := <-errc; err == nil {
+		t.Error("protocol version 4 accepted")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	src := newScripted()
+	src.frames <- testFrame(32, 16)
+	s := New(src, &Options{Password: "secret99"})
+	v := connect(t, s, "secret99")
+	v.request(false)
+	v.update()
+	v.check(testFrame(32, 16), 0)
+
+	for _, version := range []string{"RFB 003.008\n", "RFB 003.003\n"} {
+		v, errc := dial(t, s, version)
+		if version == "RFB 003.003\n" {
+			if typ := v.u32(); typ != securityVNC {
+				t.Fatalf("%q: security type %d", version, typ)
+			}
+		} else {
+			v.read(int(v.u8()))
+			v.write([]byte{securityVNC})
+		}
+		v.write(desResponse("wrong", v.read(16)))
+		if result := v.u32(); result != 1 {
+			t.Errorf("%q: security result %d for a wrong password", version, result)
+		}
+		if version == "RFB 003.008\n" {
+			if reason := string(v.read(int(v.u32()))); reason != "authentication failed" {
+				t.Errorf("reason %q", reason)
+			}
+		}
+		if err := <-errc; err == nil {
+			t.Errorf("%q: wrong password accepted", version)
+		}
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		encs []int32
+	}{
+		{"Raw", []int32{encRaw}},
+		{"Hextile", []int32{encHextile, encRaw}},
+		{"ZRLE", []int32{encZRLE}},
+		{"Tight", []int32{encTight}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			src := newScripted()
+			f := testFrame(150, 90)
+			src.frames <- f.Clone()
+			v := connect(t, New(src, &Options{FPS: 200}), "")
+			v.setEncodings(c.encs...)
+			v.request(false)
+			rects := v.update()
+			v.check(f, 0)
+			if rects[0].enc != c.encs[0] {
+				t.Errorf("encoding %d, want %d", rects[0].enc, c.encs[0])
+			}
+
+			// Only the damage is sent after that, and the persistent
+			// compression streams carry on.
+			for i, d := range []image.Rectangle{image.Rect(30, 20, 60, 50), image.Rect(140, 0, 150, 90)} {
+				noise := frame.New(f.Width, f.Height)
+				rand.New(rand.NewSource(int64(i))).Read(noise.Pix)
+				f = f.Clone()
+				frame.CopyRect(f.Pix, f.Stride, noise.Pix, noise.Stride, d)
+				f.Dirty = []image.Rectangle{d}
+				v.request(true)
+				src.frames <- f
+				for _, r := range v.update() {
+					if !r.r.In(d) {
+						t.Errorf("update %d: rectangle %v outside the damage %v", i, r.r, d)
+					}
+				}
+				v.check(f, 0)
+			}
+		})
+	}
+}
+
+func TestTightJPEG(t *testing.T) {
+	f := frame.New(150, 90)
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			copy(f.Pix[f.PixOffset(x, y):], []byte{byte(x), byte(y * 2), byte(x + y), 0xFF})
+		}
+	}
+	src := newScripted()
+	src.frames <- f
+	v := connect(t, New(src, &Options{FPS: 200}), "")
+	v.setEncodings(encTight, encQualityLevel0+9)
+	v.request(false)
+	for _, r := range v.update() {
+		if !r.jpeg {
+			t.Errorf("rectangle %v of a gradient not sent as JPEG", r.r)
+		}
+	}
+	v.check(f, 8)
+}
+
+func TestCopyRect(t *testing.T) {
+	src := newScripted()
+	f := testFrame(100, 60)
+	src.frames <- f.Clone()
+	v := connect(t, New(src, &Options{FPS: 200}), "")
+	v.setEncodings(encRaw, encCopyRect)
+	v.request(false)
+	v.update()
+
+	dst := image.Rect(50, 30, 70, 50)
+	frame.CopyRect(f.Pix[f.PixOffset(dst.Min.X, dst.Min.Y):], f.Stride, f.Pix, f.Stride, image.Rect(0, 0, 20, 20))
+	next := f.Clone()
+	next.Dirty = []image.Rectangle{}
+	next.Moves = []frame.Move{{Src: image.Pt(0, 0), Dst: dst}}
+	v.request(true)
+	src.frames <- next
+	rects := v.update()
+	if len(rects) != 1 || rects[0].enc != encCopyRect || rects[0].r != dst || rects[0].src != image.Pt(0, 0) {
+		t.Fatalf("rectangles %+v, want one CopyRect", rects)
+	}
+	v.check(f, 0)
+}
+
+func TestDesktopSize(t *testing.T) {
+	src := newScripted()
+	src.frames <- testFrame(64, 48)
+	v := connect(t, New(src, &Options{FPS: 200}), "")
+	v.setEncodings(encRaw, encDesktopSize)
+	v.request(false)
+	v.update()
+
+	f := testFrame(96, 40)
+	v.request(true)
+	src.frames <- f.Clone()
+	rects := v.update()
+	if len(rects) != 1 || rects[0].enc != encDesktopSize || rects[0].r != image.Rect(0, 0, 96, 40) {
+		t.Fatalf("rectangles %+v, want one DesktopSize", rects)
+	}
+	v.request(true)
+	v.update()
+	v.check(f, 0)
+}
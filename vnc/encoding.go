@@ -0,0 +1,538 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+
+	"github.com/shinkar94/godesktopdup/cursor"
+	"github.com/shinkar94/godesktopdup/jpegenc"
+)
+
+// Encoding types and pseudo-encodings.
+const (
+	encRaw         = 0
+	encCopyRect    = 1
+	encHextile     = 5
+	encTight       = 7
+	encZRLE        = 16
+	encCursor      = -239
+	encDesktopSize = -223
+	// Tight JPEG quality levels 0 to 9 are -32 to -23.
+	encQualityLevel0 = -32
+	encQualityLevel9 = -23
+)
+
+// zstream is a persistent zlib stream. Viewers keep one inflater per stream
+// for the whole connection, so it is flushed, never closed, after each rectangle.
+type zstream struct {
+	buf bytes.Buffer
+	w   *zlib.Writer
+}
+
+func newZstream() *zstream {
+	z := &zstream{}
+	z.w, _ = zlib.NewWriterLevel(&z.buf, zlib.BestSpeed)
+	return z
+}
+
+// compress returns data compressed and flushed. The result is valid until the
+// next call.
+func (z *zstream) compress(data []byte) []byte {
+	z.buf.Reset()
+	z.w.Write(data)
+	z.w.Flush()
+	return z.buf.Bytes()
+}
+
+// update accumulates the rectangles of a FramebufferUpdate message.
+type update struct {
+	buf   []byte
+	rects int
+}
+
+func (u *update) header(r image.Rectangle, enc int32) {
+	u.buf = binary.BigEndian.AppendUint16(u.buf, uint16(r.Min.X))
+	u.buf = binary.BigEndian.AppendUint16(u.buf, uint16(r.Min.Y))
+	u.buf = binary.BigEndian.AppendUint16(u.buf, uint16(r.Dx()))
+	u.buf = binary.BigEndian.AppendUint16(u.buf, uint16(r.Dy()))
+	u.buf = binary.BigEndian.AppendUint32(u.buf, uint32(enc))
+	u.rects++
+}
+
+// message returns the complete FramebufferUpdate message.
+func (u *update) message() []byte {
+	msg := []byte{0, 0, byte(u.rects >> 8), byte(u.rects)}
+	return append(msg, u.buf...)
+}
+
+// encoder holds the per-connection state of the encodings.
+type encoder struct {
+	pf     *pixelFormat
+	px     []uint32
+	zrleZ  *zstream
+	tightZ [3]*zstream
+	// quality is the Tight JPEG quality, 0 if the viewer did not enable JPEG.
+	quality int
+	jpeg    *jpegenc.Encoder
+}
+
+// pixels translates region r of the framebuffer.
+func (e *encoder) pixels(fb *framebuffer, r image.Rectangle) []uint32 {
+	e.px = e.pf.translate(e.px[:0], fb.pix, fb.width*4, r)
+	return e.px
+}
+
+func (e *encoder) raw(u *update, fb *framebuffer, r image.Rectangle) {
+	u.header(r, encRaw)
+	for _, v := range e.pixels(fb, r) {
+		u.buf = e.pf.put(u.buf, v)
+	}
+}
+
+func (e *encoder) copyRect(u *update, dst image.Rectangle, src image.Point) {
+	u.header(dst, encCopyRect)
+	u.buf = binary.BigEndian.AppendUint16(u.buf, uint16(src.X))
+	u.buf = binary.BigEndian.AppendUint16(u.buf, uint16(src.Y))
+}
+
+// palette collects the distinct colors of a tile, up to a limit.
+type palette struct {
+	colors []uint32
+	index  map[uint32]int
+	counts []int
+}
+
+func (p *palette) reset() {
+	p.colors = p.colors[:0]
+	p.counts = p.counts[:0]
+	if p.index == nil {
+		p.index = make(map[uint32]int)
+	}
+	clear(p.index)
+}
+
+// collect adds the colors of px and reports false if there are more than limit.
+func (p *palette) collect(px []uint32, limit int) bool {
+	p.reset()
+	for _, v := range px {
+		i, ok := p.index[v]
+		if !ok {
+			if len(p.colors) == limit {
+				return false
+			}
+			i = len(p.colors)
+			p.index[v] = i
+			p.colors = append(p.colors, v)
+			p.counts = append(p.counts, 0)
+		}
+		p.counts[i]++
+	}
+	return true
+}
+
+// Hextile subencoding flags.
+const (
+	hextileRaw         = 1
+	hextileBackground  = 2
+	hextileForeground  = 4
+	hextileAnySubrects = 8
+	hextileColoured    = 16
+)
+
+func (e *encoder) hextile(u *update, fb *framebuffer, r image.Rectangle) {
+	u.header(r, encHextile)
+	var pal palette
+	var bg, fg uint32
+	haveBg, haveFg := false, false
+	var tile []uint32
+	var covered [256]bool
+	bpp := e.pf.bytesPerPixel()
+	for ty := r.Min.Y; ty < r.Max.Y; ty += 16 {
+		for tx := r.Min.X; tx < r.Max.X; tx += 16 {
+			t := image.Rect(tx, ty, min(tx+16, r.Max.X), min(ty+16, r.Max.Y))
+			w, h := t.Dx(), t.Dy()
+			tile = e.pf.translate(tile[:0], fb.pix, fb.width*4, t)
+
+			mark := len(u.buf)
+			u.buf = append(u.buf, 0)
+			if !pal.collect(tile, 16) {
+				e.hextileRaw(u, mark, tile)
+				haveBg, haveFg = false, false
+				continue
+			}
+			flags := byte(0)
+			tileBg := pal.colors[0]
+			for i, n := range pal.counts {
+				if n > pal.counts[pal.index[tileBg]] {
+					tileBg = pal.colors[i]
+				}
+			}
+			if !haveBg || tileBg != bg {
+				flags |= hextileBackground
+				u.buf = e.pf.put(u.buf, tileBg)
+				bg, haveBg = tileBg, true
+			}
+			if len(pal.colors) == 1 {
+				u.buf[mark] = flags
+				continue
+			}
+
+			mono := len(pal.colors) == 2
+			if mono {
+				tileFg := pal.colors[0]
+				if tileFg == bg {
+					tileFg = pal.colors[1]
+				}
+				if !haveFg || tileFg != fg {
+					flags |= hextileForeground
+					u.buf = e.pf.put(u.buf, tileFg)
+					fg, haveFg = tileFg, true
+				}
+			} else {
+				flags |= hextileColoured
+				haveFg = false
+			}
+			flags |= hextileAnySubrects
+			count := len(u.buf)
+			u.buf = append(u.buf, 0)
+			n := 0
+			limit := mark + 1 + w*h*bpp
+			clear(covered[:])
+			for y := 0; y < h && len(u.buf) < limit; y++ {
+				for x := 0; x < w; x++ {
+					c := tile[y*w+x]
+					if c == bg || covered[y*16+x] {
+						continue
+					}
+					// Grow right, then down while whole rows match.
+					sw := 1
+					for x+sw < w && tile[y*w+x+sw] == c && !covered[y*16+x+sw] {
+						sw++
+					}
+					sh := 1
+				grow:
+					for y+sh < h {
+						for i := 0; i < sw; i++ {
+							if tile[(y+sh)*w+x+i] != c || covered[(y+sh)*16+x+i] {
+								break grow
+							}
+						}
+						sh++
+					}
+					for j := 0; j < sh; j++ {
+						for i := 0; i < sw; i++ {
+							covered[(y+j)*16+x+i] = true
+						}
+					}
+					if !mono {
+						u.buf = e.pf.put(u.buf, c)
+					}
+					u.buf = append(u.buf, byte(x<<4|y), byte((sw-1)<<4|(sh-1)))
+					n++
+				}
+			}
+			if len(u.buf) >= limit || n > 255 {
+				e.hextileRaw(u, mark, tile)
+				haveBg, haveFg = false, false
+				continue
+			}
+			u.buf[mark] = flags
+			u.buf[count] = byte(n)
+		}
+	}
+}
+
+// hextileRaw replaces the tile started at mark with a raw tile.
+func (e *encoder) hextileRaw(u *update, mark int, tile []uint32) {
+	u.buf = append(u.buf[:mark], hextileRaw)
+	for _, v := range tile {
+		u.buf = e.pf.put(u.buf, v)
+	}
+}
+
+// runLength appends a ZRLE run length.
+func runLength(b []byte, n int) []byte {
+	for n--; n >= 255; n -= 255 {
+		b = append(b, 255)
+	}
+	return append(b, byte(n))
+}
+
+func runLengthSize(n int) int {
+	return (n-1)/255 + 1
+}
+
+func (e *encoder) zrle(u *update, fb *framebuffer, r image.Rectangle, scratch *[]byte) {
+	if e.zrleZ == nil {
+		e.zrleZ = newZstream()
+	}
+	u.header(r, encZRLE)
+	shift := e.pf.compactShift()
+	cp := e.pf.cpixelSize()
+	data := (*scratch)[:0]
+	var pal palette
+	var tile []uint32
+	for ty := r.Min.Y; ty < r.Max.Y; ty += 64 {
+		for tx := r.Min.X; tx < r.Max.X; tx += 64 {
+			t := image.Rect(tx, ty, min(tx+64, r.Max.X), min(ty+64, r.Max.Y))
+			w, h := t.Dx(), t.Dy()
+			tile = e.pf.translate(tile[:0], fb.pix, fb.width*4, t)
+
+			few := pal.collect(tile, 127)
+			if few && len(pal.colors) == 1 {
+				data = append(data, 1)
+				data = e.pf.putC(data, tile[0], shift)
+				continue
+			}
+
+			// Estimate each subencoding and keep the smallest.
+			runBytes, palRunBytes := 0, 0
+			for i := 0; i < len(tile); {
+				j := i + 1
+				for j < len(tile) && tile[j] == tile[i] {
+					j++
+				}
+				runBytes += cp + runLengthSize(j-i)
+				if j-i == 1 {
+					palRunBytes++
+				} else {
+					palRunBytes += 1 + runLengthSize(j-i)
+				}
+				i = j
+			}
+			best, size := 0, w*h*cp
+			if runBytes < size {
+				best, size = 128, runBytes
+			}
+			bits := 0
+			if few {
+				n := len(pal.colors)
+				if s := n*cp + palRunBytes; s < size {
+					best, size = 128+n, s
+				}
+				switch {
+				case n <= 2:
+					bits = 1
+				case n <= 4:
+					bits = 2
+				case n <= 16:
+					bits = 4
+				}
+				if bits > 0 {
+					if s := n*cp + h*((w*bits+7)/8); s <= size {
+						best, size = n, s
+					}
+				}
+			}
+
+			data = append(data, byte(best))
+			switch {
+			case best == 0:
+				for _, v := range tile {
+					data = e.pf.putC(data, v, shift)
+				}
+			case best == 128:
+				for i := 0; i < len(tile); {
+					j := i + 1
+					for j < len(tile) && tile[j] == tile[i] {
+						j++
+					}
+					data = e.pf.putC(data, tile[i], shift)
+					data = runLength(data, j-i)
+					i = j
+				}
+			case best > 128:
+				for _, c := range pal.colors {
+					data = e.pf.putC(data, c, shift)
+				}
+				for i := 0; i < len(tile); {
+					j := i + 1
+					for j < len(tile) && tile[j] == tile[i] {
+						j++
+					}
+					idx := byte(pal.index[tile[i]])
+					if j-i == 1 {
+						data = append(data, idx)
+					} else {
+						data = runLength(append(data, idx|128), j-i)
+					}
+					i = j
+				}
+			default:
+				for _, c := range pal.colors {
+					data = e.pf.putC(data, c, shift)
+				}
+				for y := 0; y < h; y++ {
+					var acc byte
+					n := 0
+					for x := 0; x < w; x++ {
+						acc = acc<<bits | byte(pal.index[tile[y*w+x]])
+						n += bits
+						if n == 8 {
+							data = append(data, acc)
+							acc, n = 0, 0
+						}
+					}
+					if n > 0 {
+						data = append(data, acc<<(8-n))
+					}
+				}
+			}
+		}
+	}
+	*scratch = data
+	z := e.zrleZ.compress(data)
+	u.buf = binary.BigEndian.AppendUint32(u.buf, uint32(len(z)))
+	u.buf = append(u.buf, z...)
+}
+
+// Tight compression control values.
+const (
+	tightFill           = 0x80
+	tightJPEG           = 0x90
+	tightExplicitFilter = 0x40
+	tightFilterPalette  = 1
+	// tightMinCompress is the data size below which Tight sends data uncompressed.
+	tightMinCompress = 12
+	// Rectangles are split so that neither dimension exceeds tightMaxSize.
+	tightMaxSize = 256
+)
+
+// tightQuality maps Tight quality levels to JPEG quality, as TigerVNC does.
+var tightQuality = [10]int{15, 29, 41, 42, 62, 77, 79, 86, 92, 100}
+
+// compactLength appends a Tight compact length.
+func compactLength(b []byte, n int) []byte {
+	switch {
+	case n < 1<<7:
+		return append(b, byte(n))
+	case n < 1<<14:
+		return append(b, byte(n)|0x80, byte(n>>7))
+	default:
+		return append(b, byte(n)|0x80, byte(n>>7)|0x80, byte(n>>14))
+	}
+}
+
+func (e *encoder) tight(u *update, fb *framebuffer, r image.Rectangle, scratch *[]byte) {
+	for ty := r.Min.Y; ty < r.Max.Y; ty += tightMaxSize {
+		for tx := r.Min.X; tx < r.Max.X; tx += tightMaxSize {
+			e.tightRect(u, fb, image.Rect(tx, ty, min(tx+tightMaxSize, r.Max.X), min(ty+tightMaxSize, r.Max.Y)), scratch)
+		}
+	}
+}
+
+func (e *encoder) tightRect(u *update, fb *framebuffer, r image.Rectangle, scratch *[]byte) {
+	u.header(r, encTight)
+	rgb := e.pf.tightRGB()
+	px := e.pixels(fb, r)
+	var pal palette
+	few := pal.collect(px, 64)
+	if few && len(pal.colors) == 1 {
+		u.buf = append(u.buf, tightFill)
+		u.buf = e.pf.putT(u.buf, px[0], rgb)
+		return
+	}
+
+	// Photographic content, many colors over a reasonable area, goes to JPEG.
+	if !few && e.quality > 0 && e.pf.bpp >= 16 && r.Dx() >= 8 && r.Dy() >= 8 {
+		if e.jpeg == nil {
+			e.jpeg, _ = jpegenc.NewEncoder(&jpegenc.Options{Quality: e.quality, Subsampling: jpegenc.Subsample420})
+		}
+		var buf bytes.Buffer
+		off := r.Min.Y*fb.width*4 + r.Min.X*4
+		if e.jpeg.Encode(&buf, fb.pix[off:], r.Dx(), r.Dy(), fb.width*4) == nil {
+			u.buf = append(u.buf, tightJPEG)
+			u.buf = compactLength(u.buf, buf.Len())
+			u.buf = append(u.buf, buf.Bytes()...)
+			return
+		}
+	}
+
+	data := (*scratch)[:0]
+	stream := 0
+	if few {
+		// Palette filter: 1 bit per pixel for two colors, a byte otherwise.
+		stream = 1
+		if len(pal.colors) > 2 {
+			stream = 2
+		}
+		u.buf = append(u.buf, byte(stream<<4)|tightExplicitFilter, tightFilterPalette, byte(len(pal.colors)-1))
+		for _, c := range pal.colors {
+			u.buf = e.pf.putT(u.buf, c, rgb)
+		}
+		w := r.Dx()
+		if len(pal.colors) == 2 {
+			for y := 0; y < r.Dy(); y++ {
+				var acc byte
+				n := 0
+				for _, v := range px[y*w : y*w+w] {
+					acc = acc<<1 | byte(pal.index[v])
+					if n++; n == 8 {
+						data = append(data, acc)
+						acc, n = 0, 0
+					}
+				}
+				if n > 0 {
+					data = append(data, acc<<(8-n))
+				}
+			}
+		} else {
+			for _, v := range px {
+				data = append(data, byte(pal.index[v]))
+			}
+		}
+	} else {
+		u.buf = append(u.buf, 0)
+		for _, v := range px {
+			data = e.pf.putT(data, v, rgb)
+		}
+	}
+	*scratch = data
+
+	if len(data) < tightMinCompress {
+		u.buf = append(u.buf, data...)
+		return
+	}
+	if e.tightZ[stream] == nil {
+		e.tightZ[stream] = newZstream()
+	}
+	z := e.tightZ[stream].compress(data)
+	u.buf = compactLength(u.buf, len(z))
+	u.buf = append(u.buf, z...)
+}
+
+// cursorShape appends a Cursor pseudo-encoding rectangle for shape. A nil
+// shape sends an empty cursor, hiding the pointer.
+func (e *encoder) cursorShape(u *update, shape *cursor.Shape) {
+	if shape == nil || shape.Image == nil {
+		u.header(image.Rectangle{}, encCursor)
+		return
+	}
+	img := shape.Image
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	u.header(image.Rect(shape.HotSpot.X, shape.HotSpot.Y, shape.HotSpot.X+w, shape.HotSpot.Y+h), encCursor)
+	mask := make([]byte, (w+7)/8*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.Pix[y*img.Stride+x*4:]
+			r, g, b, a := p[0], p[1], p[2], p[3]
+			// Image is premultiplied; the cursor encoding has a 1 bit mask.
+			if a >= 128 {
+				mask[y*((w+7)/8)+x/8] |= 0x80 >> (x % 8)
+				r, g, b = unpremultiply(r, a), unpremultiply(g, a), unpremultiply(b, a)
+			}
+			u.buf = e.pf.put(u.buf, e.pf.blueLUT[b]|e.pf.greenLUT[g]|e.pf.redLUT[r])
+		}
+	}
+	u.buf = append(u.buf, mask...)
+}
+
+func unpremultiply(c, a byte) byte {
+	return byte(min(int(c)*255/int(a), 255))
+}
+
+func (e *encoder) desktopSize(u *update, width, height int) {
+	u.header(image.Rect(0, 0, width, height), encDesktopSize)
+}
@@ -0,0 +1,169 @@
+package vnc
+
+import (
+	"errors"
+	"image"
+)
+
+// pixelFormat is the RFB PIXEL_FORMAT structure.
+type pixelFormat struct {
+	bpp, depth                      uint8
+	bigEndian, trueColor            bool
+	redMax, greenMax, blueMax       uint16
+	redShift, greenShift, blueShift uint8
+	redLUT, greenLUT, blueLUT       [256]uint32
+	native                          bool
+}
+
+// serverFormat matches the BGRA layout of captured frames, so clients that
+// keep it get pixels without conversion.
+func serverFormat() *pixelFormat {
+	pf := &pixelFormat{
+		bpp: 32, depth: 24, trueColor: true,
+		redMax: 255, greenMax: 255, blueMax: 255,
+		redShift: 16, greenShift: 8, blueShift: 0,
+	}
+	pf.init()
+	return pf
+}
+
+func parsePixelFormat(b []byte) (*pixelFormat, error) {
+	pf := &pixelFormat{
+		bpp:        b[0],
+		depth:      b[1],
+		bigEndian:  b[2] != 0,
+		trueColor:  b[3] != 0,
+		redMax:     uint16(b[4])<<8 | uint16(b[5]),
+		greenMax:   uint16(b[6])<<8 | uint16(b[7]),
+		blueMax:    uint16(b[8])<<8 | uint16(b[9]),
+		redShift:   b[10],
+		greenShift: b[11],
+		blueShift:  b[12],
+	}
+	switch {
+	case pf.bpp != 8 && pf.bpp != 16 && pf.bpp != 32:
+		return nil, errors.New("vnc: unsupported bits per pixel")
+	case !pf.trueColor:
+		return nil, errors.New("vnc: color map pixel formats are not supported")
+	case pf.redMax == 0 || pf.greenMax == 0 || pf.blueMax == 0:
+		return nil, errors.New("vnc: invalid pixel format")
+	}
+	pf.init()
+	return pf, nil
+}
+
+func (pf *pixelFormat) init() {
+	for i := range pf.redLUT {
+		pf.redLUT[i] = (uint32(i)*uint32(pf.redMax) + 127) / 255 << pf.redShift
+		pf.greenLUT[i] = (uint32(i)*uint32(pf.greenMax) + 127) / 255 << pf.greenShift
+		pf.blueLUT[i] = (uint32(i)*uint32(pf.blueMax) + 127) / 255 << pf.blueShift
+	}
+	pf.native = pf.bpp == 32 && !pf.bigEndian &&
+		pf.redMax == 255 && pf.greenMax == 255 && pf.blueMax == 255 &&
+		pf.redShift == 16 && pf.greenShift == 8 && pf.blueShift == 0
+}
+
+func (pf *pixelFormat) marshal() []byte {
+	b := make([]byte, 16)
+	b[0], b[1] = pf.bpp, pf.depth
+	if pf.bigEndian {
+		b[2] = 1
+	}
+	if pf.trueColor {
+		b[3] = 1
+	}
+	b[4], b[5] = byte(pf.redMax>>8), byte(pf.redMax)
+	b[6], b[7] = byte(pf.greenMax>>8), byte(pf.greenMax)
+	b[8], b[9] = byte(pf.blueMax>>8), byte(pf.blueMax)
+	b[10], b[11], b[12] = pf.redShift, pf.greenShift, pf.blueShift
+	return b
+}
+
+func (pf *pixelFormat) bytesPerPixel() int {
+	return int(pf.bpp) / 8
+}
+
+// translate appends the pixel values of region r of a BGRA buffer, row by row.
+func (pf *pixelFormat) translate(dst []uint32, pix []byte, stride int, r image.Rectangle) []uint32 {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := pix[y*stride+r.Min.X*4 : y*stride+r.Max.X*4]
+		if pf.native {
+			for i := 0; i < len(row); i += 4 {
+				dst = append(dst, uint32(row[i])|uint32(row[i+1])<<8|uint32(row[i+2])<<16)
+			}
+			continue
+		}
+		for i := 0; i < len(row); i += 4 {
+			dst = append(dst, pf.blueLUT[row[i]]|pf.greenLUT[row[i+1]]|pf.redLUT[row[i+2]])
+		}
+	}
+	return dst
+}
+
+// put appends a pixel value in the client's size and byte order.
+func (pf *pixelFormat) put(dst []byte, v uint32) []byte {
+	switch pf.bpp {
+	case 8:
+		return append(dst, byte(v))
+	case 16:
+		if pf.bigEndian {
+			return append(dst, byte(v>>8), byte(v))
+		}
+		return append(dst, byte(v), byte(v>>8))
+	default:
+		if pf.bigEndian {
+			return append(dst, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+		}
+		return append(dst, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	}
+}
+
+// compactShift returns how a 32 bit pixel is shortened to the 3 byte CPIXEL of
+// ZRLE: 0 if the color bits fit in the low bytes, 8 if they fit in the high
+// ones, or -1 if pixels are sent whole.
+func (pf *pixelFormat) compactShift() int {
+	if pf.bpp != 32 || pf.depth > 24 {
+		return -1
+	}
+	mask := uint32(pf.redMax)<<pf.redShift | uint32(pf.greenMax)<<pf.greenShift | uint32(pf.blueMax)<<pf.blueShift
+	switch {
+	case mask&0xFF000000 == 0:
+		return 0
+	case mask&0x000000FF == 0:
+		return 8
+	}
+	return -1
+}
+
+// cpixelSize returns the size of a ZRLE CPIXEL.
+func (pf *pixelFormat) cpixelSize() int {
+	if pf.compactShift() >= 0 {
+		return 3
+	}
+	return pf.bytesPerPixel()
+}
+
+// putC appends a ZRLE CPIXEL.
+func (pf *pixelFormat) putC(dst []byte, v uint32, shift int) []byte {
+	if shift < 0 {
+		return pf.put(dst, v)
+	}
+	v >>= uint(shift)
+	if pf.bigEndian {
+		return append(dst, byte(v>>16), byte(v>>8), byte(v))
+	}
+	return append(dst, byte(v), byte(v>>8), byte(v>>16))
+}
+
+// tightRGB reports whether Tight sends pixels as 3 byte RGB TPIXELs.
+func (pf *pixelFormat) tightRGB() bool {
+	return pf.bpp == 32 && pf.depth == 24 && pf.redMax == 255 && pf.greenMax == 255 && pf.blueMax == 255
+}
+
+// putT appends a Tight TPIXEL.
+func (pf *pixelFormat) putT(dst []byte, v uint32, rgb bool) []byte {
+	if !rgb {
+		return pf.put(dst, v)
+	}
+	return append(dst, byte(v>>pf.redShift), byte(v>>pf.greenShift), byte(v>>pf.blueShift))
+}
@@ -0,0 +1,286 @@
+// Package vnc serves the frames of a source to VNC viewers over RFB 3.8.
+// Viewers speaking 3.3 and 3.7 are accepted too.
+package vnc
+
+import (
+	"errors"
+	"image"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/cursor"
+	"github.com/shinkar94/godesktopdup/frame"
+)
+
+// DefaultFPS is the capture rate used when Options.FPS is 0.
+const DefaultFPS = 30
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("vnc: server closed")
+
+// Injector receives input events from viewers.
+type Injector interface {
+	// Key presses or releases the key with the given X11 keysym.
+	Key(keysym uint32, down bool)
+	// Pointer moves the pointer to x, y, relative to the output's top-left
+	// corner, with the buttons in mask pressed: bit 0 is the left button,
+	// 1 the middle, 2 the right, 3 and 4 are wheel up and down.
+	Pointer(x, y int, mask uint8)
+}
+
+// Options configures a Server. A nil *Options uses the defaults.
+type Options struct {
+	// Password enables VNC authentication. Only the first 8 bytes are used.
+	// VNC authentication does not encrypt the session; tunnel it over SSH or
+	// TLS outside trusted networks.
+	Password string
+	// Name is the desktop name shown by viewers. Defaults to the output name.
+	Name string
+	// FPS caps how often the source is read. Defaults to DefaultFPS.
+	FPS int
+	// Injector receives keyboard and pointer events. Nil makes the server view-only.
+	Injector Injector
+}
+
+// framebuffer is the server's copy of the latest frame, shared by all connections.
+type framebuffer struct {
+	pix           []byte
+	width, height int
+	output        string
+	shape         *cursor.Shape
+	cursorVisible bool
+}
+
+// change describes how a frame changed the framebuffer.
+type change struct {
+	// full is set when every pixel must be resent, resized when the size changed too.
+	full, resized bool
+	dirty         []image.Rectangle
+	moves         []frame.Move
+	cursor        bool
+}
+
+// Server serves a frame source to VNC viewers. Move rects become CopyRect
+// rectangles and dirty rects are sent in the encoding the viewer prefers:
+// Raw, Hextile, ZRLE or Tight (with JPEG when the viewer sends a quality
+// level). The Cursor pseudo-encoding carries the pointer shape, so sources
+// should not draw the cursor into frames; DesktopSize reports resolution changes.
+//
+// The source is read by a single goroutine, only while viewers are connected.
+type Server struct {
+	src  frame.Source
+	opts Options
+
+	mu        sync.Mutex
+	conns     map[*conn]struct{}
+	listeners map[net.Listener]struct{}
+	running   bool
+	closed    bool
+	// ready is closed once the framebuffer holds a frame or capture failed.
+	ready chan struct{}
+	err   error
+
+	fbMu sync.RWMutex
+	fb   framebuffer
+}
+
+// New returns a server for the frames of src. The server becomes the only
+// reader of src.
+func New(src frame.Source, opts *Options) *Server {
+	s := &Server{
+		src:       src,
+		conns:     make(map[*conn]struct{}),
+		listeners: make(map[net.Listener]struct{}),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.FPS <= 0 {
+		s.opts.FPS = DefaultFPS
+	}
+	return s
+}
+
+// ListenAndServe listens on the TCP address addr, ":5900" if empty, and serves viewers.
+func (s *Server) ListenAndServe(addr string) error {
+	if addr == "" {
+		addr = ":5900"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts viewers on l until l fails or the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(nc)
+	}
+}
+
+// Close stops the listeners and disconnects all viewers.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	return nil
+}
+
+// Viewers returns the number of connected viewers.
+func (s *Server) Viewers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// join registers an authenticated connection, starting capture if needed,
+// and returns a channel closed once the framebuffer is usable.
+func (s *Server) join(c *conn) (<-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrServerClosed
+	}
+	s.conns[c] = struct{}{}
+	if !s.running {
+		s.running = true
+		s.err = nil
+		s.ready = make(chan struct{})
+		// The framebuffer is kept while capture is stopped, since sources
+		// report the damage accumulated meanwhile with the next frame. An
+		// idle source sends no frame at all, so do not wait for one.
+		s.fbMu.RLock()
+		started := s.fb.pix != nil
+		s.fbMu.RUnlock()
+		if started {
+			close(s.ready)
+		}
+		go s.capture(s.ready, started)
+	}
+	return s.ready, nil
+}
+
+func (s *Server) leave(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+}
+
+// capture reads the source while viewers are connected. ready is closed
+// with the first frame unless started says it already was.
+func (s *Server) capture(ready chan struct{}, started bool) {
+	interval := time.Second / time.Duration(s.opts.FPS)
+	timeoutMs := uint(interval / time.Millisecond)
+	for {
+		s.mu.Lock()
+		if len(s.conns) == 0 {
+			s.running = false
+			s.mu.Unlock()
+			if !started {
+				close(ready)
+			}
+			return
+		}
+		s.mu.Unlock()
+
+		f, err := s.src.GetFrame(timeoutMs)
+		next := time.Now().Add(interval)
+		if errors.Is(err, frame.ErrNoImageYet) {
+			continue
+		}
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.running = false
+			for c := range s.conns {
+				c.nc.Close()
+			}
+			s.mu.Unlock()
+			if !started {
+				close(ready)
+			}
+			return
+		}
+
+		ch := s.store(f)
+		if !started {
+			started = true
+			close(ready)
+		}
+		s.mu.Lock()
+		for c := range s.conns {
+			c.notify(ch)
+		}
+		s.mu.Unlock()
+		time.Sleep(time.Until(next))
+	}
+}
+
+// store copies f into the framebuffer.
+func (s *Server) store(f *frame.Frame) *change {
+	s.fbMu.Lock()
+	defer s.fbMu.Unlock()
+	fb := &s.fb
+	ch := &change{}
+	first := false
+	if fb.pix == nil || fb.width != f.Width || fb.height != f.Height {
+		ch.resized = fb.pix != nil
+		fb.width, fb.height = f.Width, f.Height
+		fb.pix = make([]byte, f.Width*f.Height*4)
+		first = true
+	}
+	fb.output = f.Output
+	if first || f.Full() {
+		ch.full = true
+		frame.CopyRect(fb.pix, fb.width*4, f.Pix, f.Stride, f.Rect())
+	} else {
+		ch.dirty = append([]image.Rectangle(nil), f.Dirty...)
+		ch.moves = append([]frame.Move(nil), f.Moves...)
+		for _, r := range f.Damage() {
+			frame.CopyRect(fb.pix, fb.width*4, f.Pix, f.Stride, r.Intersect(f.Rect()))
+		}
+	}
+
+	if shape := f.Cursor.Shape; shape != nil && (fb.shape == nil || fb.shape.ID != shape.ID) {
+		fb.shape = shape
+		ch.cursor = true
+	}
+	if f.Cursor.Visible != fb.cursorVisible {
+		fb.cursorVisible = f.Cursor.Visible
+		ch.cursor = true
+	}
+	return ch
+}
@@ -0,0 +1,566 @@
+// Package wsview streams frames to browsers over WebSocket as tiles that
+// changed, and serves a minimal canvas viewer for them.
+package wsview
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"image"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/cursor"
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/jpegenc"
+)
+
+//go:embed viewer.html
+var viewerHTML []byte
+
+const (
+	// DefaultFPS is the capture rate used when Options.FPS is 0.
+	DefaultFPS = 30
+	// DefaultTileSize is the tile edge used when Options.TileSize is 0.
+	DefaultTileSize = 64
+)
+
+// Server to viewer message types. All integers are little endian.
+const (
+	// msgInit: type, u16 width, u16 height, u16 tile size. Sent on connect,
+	// on resize and in reply to a keyframe request; every tile follows.
+	msgInit = 0
+	// msgTiles: type, u32 seq, u32 count, then per tile u16 x, y, w, h and
+	// u8 codec: codecFill with 3 bytes RGB, or codecJPEG with u32 length and data.
+	// The viewer acknowledges every batch.
+	msgTiles = 1
+	// msgCursor: type, i16 x, i16 y of the pointer tip, u8 visible, u8 has
+	// shape, and with a shape u16 hot spot x, y and u32 length of a PNG image.
+	msgCursor = 2
+)
+
+// Viewer to server message types.
+const (
+	// msgAck: type, u32 seq of a processed tile batch.
+	msgAck = 1
+	// msgKeyframe: type. Asks for an init message and every tile, for viewers
+	// that lost track of the screen.
+	msgKeyframe = 2
+)
+
+const (
+	codecFill = 0
+	codecJPEG = 1
+)
+
+// maxInFlight is the number of unacknowledged tile batches per viewer. When
+// it is reached, changes accumulate and are sent as one batch later.
+const maxInFlight = 2
+
+// Options configures a Server. A nil *Options uses the defaults.
+type Options struct {
+	// FPS caps how often the source is read. Defaults to DefaultFPS.
+	FPS int
+	// TileSize is the edge of the square tiles frames are split into, from
+	// 16 to 65535. Other values use DefaultTileSize.
+	TileSize int
+	// MinQuality and MaxQuality bound the JPEG quality, which adapts to each
+	// viewer's bandwidth. They default to 30 and 85.
+	MinQuality, MaxQuality int
+	// AllowedOrigins lists origins, such as "https://example.com", whose
+	// pages may open the WebSocket besides pages of the server itself. "*"
+	// allows any page, which lets every site the user visits read the screen.
+	AllowedOrigins []string
+}
+
+// framebuffer is the server's copy of the latest frame, shared by all viewers.
+type framebuffer struct {
+	pix           []byte
+	width, height int
+	cols, rows    int
+	// versions counts changes per tile, keying the encoded tile cache.
+	versions []uint64
+	cursor   cursor.State
+	shape    *cursor.Shape
+}
+
+func (fb *framebuffer) tileRect(i, size int) image.Rectangle {
+	x, y := i%fb.cols*size, i/fb.cols*size
+	return image.Rect(x, y, min(x+size, fb.width), min(y+size, fb.height))
+}
+
+// cachedTile is a tile encoded at one quality.
+type cachedTile struct {
+	version uint64
+	quality int
+	data    []byte
+}
+
+// Server is an http.Handler serving the viewer page and, on WebSocket
+// requests to the same URL, the tile stream.
+//
+// Only tiles overlapping a frame's damage are sent, so an idle desktop costs
+// a few bytes for cursor moves. Each viewer has a window of unacknowledged
+// batches: a slow viewer gets fewer, larger batches and a lower JPEG quality,
+// which rises again while it keeps up. Encoded tiles are shared between
+// viewers at the same quality.
+type Server struct {
+	src  frame.Source
+	opts Options
+
+	mu      sync.Mutex
+	viewers map[*viewer]struct{}
+	running bool
+
+	fbMu sync.RWMutex
+	fb   framebuffer
+
+	cacheMu  sync.Mutex
+	cache    [][]cachedTile
+	encoders map[int]*jpegenc.Encoder
+}
+
+// New returns a server for the frames of src. The server becomes the only
+// reader of src.
+func New(src frame.Source, opts *Options) *Server {
+	s := &Server{
+		src:      src,
+		viewers:  make(map[*viewer]struct{}),
+		encoders: make(map[int]*jpegenc.Encoder),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.FPS <= 0 {
+		s.opts.FPS = DefaultFPS
+	}
+	if s.opts.TileSize < 16 || s.opts.TileSize > 0xFFFF {
+		s.opts.TileSize = DefaultTileSize
+	}
+	if s.opts.MinQuality <= 0 {
+		s.opts.MinQuality = 30
+	}
+	if s.opts.MaxQuality <= 0 {
+		s.opts.MaxQuality = 85
+	}
+	s.opts.MaxQuality = min(s.opts.MaxQuality, 100)
+	s.opts.MinQuality = min(s.opts.MinQuality, s.opts.MaxQuality)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isUpgrade(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(viewerHTML)
+		return
+	}
+	// Browsers let any page open WebSockets to any host, localhost included.
+	if !checkOrigin(r, s.opts.AllowedOrigins) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	ws, err := upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.close()
+	s.serve(ws)
+}
+
+// Viewers returns the number of connected viewers.
+func (s *Server) Viewers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.viewers)
+}
+
+// viewer is a connected browser. Pending changes are kept as a set of dirty
+// tiles, so changes made while the viewer is busy merge.
+type viewer struct {
+	ws *wsConn
+
+	mu          sync.Mutex
+	init        bool
+	dirty       []bool
+	ndirty      int
+	cursorDirty bool
+	// shapeSent is the ID of the last pointer shape sent, owned by the sender.
+	shapeSent   uint64
+	sent, acked uint32
+	// congested is set when changes had to wait for the window.
+	congested bool
+	// calm counts batches sent without waiting, to raise the quality.
+	calm    int
+	quality int
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+func (v *viewer) signal() {
+	select {
+	case v.wake <- struct{}{}:
+	default:
+	}
+}
+
+// markAll marks every tile dirty and schedules an init message.
+func (v *viewer) markAll(tiles int) {
+	v.init = true
+	v.cursorDirty = true
+	if len(v.dirty) != tiles {
+		v.dirty = make([]bool, tiles)
+	}
+	for i := range v.dirty {
+		v.dirty[i] = true
+	}
+	v.ndirty = tiles
+}
+
+func (s *Server) serve(ws *wsConn) {
+	v := &viewer{
+		ws:      ws,
+		quality: s.opts.MaxQuality,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	// The framebuffer is kept while capture is stopped, and an idle source
+	// sends no frame, so send what it holds right away.
+	s.fbMu.RLock()
+	if tiles := s.fb.cols * s.fb.rows; s.fb.pix != nil {
+		v.markAll(tiles)
+		v.signal()
+	}
+	s.fbMu.RUnlock()
+	s.mu.Lock()
+	s.viewers[v] = struct{}{}
+	if !s.running {
+		s.running = true
+		go s.capture()
+	}
+	s.mu.Unlock()
+
+	go s.send(v)
+	s.read(v)
+	close(v.done)
+
+	s.mu.Lock()
+	delete(s.viewers, v)
+	s.mu.Unlock()
+}
+
+// read handles viewer messages until the connection ends.
+func (s *Server) read(v *viewer) {
+	for {
+		op, msg, err := v.ws.readMessage()
+		if err != nil {
+			return
+		}
+		if op != opBinary || len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case msgAck:
+			if len(msg) < 5 {
+				return
+			}
+			v.mu.Lock()
+			v.acked = binary.LittleEndian.Uint32(msg[1:])
+			v.mu.Unlock()
+			v.signal()
+		case msgKeyframe:
+			s.fbMu.RLock()
+			tiles := s.fb.cols * s.fb.rows
+			s.fbMu.RUnlock()
+			v.mu.Lock()
+			if tiles > 0 && !v.init {
+				v.markAll(tiles)
+			}
+			v.mu.Unlock()
+			v.signal()
+		}
+	}
+}
+
+// send writes pending changes whenever the window allows.
+func (s *Server) send(v *viewer) {
+	defer v.ws.close()
+	var dirty []int
+	for {
+		select {
+		case <-v.done:
+			return
+		case <-v.wake:
+		}
+
+		v.mu.Lock()
+		sendCursor := v.cursorDirty
+		v.cursorDirty = false
+		init := v.init
+		dirty = dirty[:0]
+		if v.ndirty > 0 {
+			if v.sent-v.acked >= maxInFlight {
+				if !v.congested {
+					v.congested = true
+					v.quality = max(v.quality-10, s.opts.MinQuality)
+				}
+				v.calm = 0
+			} else {
+				for i, d := range v.dirty {
+					if d {
+						dirty = append(dirty, i)
+						v.dirty[i] = false
+					}
+				}
+				v.ndirty = 0
+				v.init = false
+				v.sent++
+				if !v.congested {
+					// Probe for more bandwidth after a while without waiting.
+					if v.calm++; v.calm >= 30 {
+						v.calm = 0
+						v.quality = min(v.quality+5, s.opts.MaxQuality)
+					}
+				}
+				v.congested = false
+			}
+		}
+		seq, quality := v.sent, v.quality
+		v.mu.Unlock()
+
+		var msgs [][]byte
+		s.fbMu.RLock()
+		if init && len(dirty) > 0 {
+			msgs = append(msgs, s.initMessage())
+		}
+		if sendCursor {
+			msgs = append(msgs, s.cursorMessage(v))
+		}
+		if len(dirty) > 0 {
+			msgs = append(msgs, s.tilesMessage(seq, dirty, quality))
+		}
+		s.fbMu.RUnlock()
+
+		for _, m := range msgs {
+			if err := v.ws.writeMessage(opBinary, m); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// initMessage is built with fbMu held.
+func (s *Server) initMessage() []byte {
+	b := []byte{msgInit}
+	b = binary.LittleEndian.AppendUint16(b, uint16(s.fb.width))
+	b = binary.LittleEndian.AppendUint16(b, uint16(s.fb.height))
+	return binary.LittleEndian.AppendUint16(b, uint16(s.opts.TileSize))
+}
+
+// cursorMessage is built with fbMu held. The shape is included only when it
+// differs from the last one sent to v.
+func (s *Server) cursorMessage(v *viewer) []byte {
+	c := s.fb.cursor
+	tip := c.Tip()
+	b := []byte{msgCursor}
+	b = binary.LittleEndian.AppendUint16(b, uint16(int16(tip.X)))
+	b = binary.LittleEndian.AppendUint16(b, uint16(int16(tip.Y)))
+	visible := byte(0)
+	if c.Visible {
+		visible = 1
+	}
+	b = append(b, visible)
+	shape := s.fb.shape
+	var png bytes.Buffer
+	if shape == nil || shape.ID == v.shapeSent || cursor.EncodePNG(&png, shape) != nil {
+		return append(b, 0)
+	}
+	v.shapeSent = shape.ID
+	b = append(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, uint16(shape.HotSpot.X))
+	b = binary.LittleEndian.AppendUint16(b, uint16(shape.HotSpot.Y))
+	b = binary.LittleEndian.AppendUint32(b, uint32(png.Len()))
+	return append(b, png.Bytes()...)
+}
+
+// tilesMessage encodes the given tiles; it is built with fbMu held.
+func (s *Server) tilesMessage(seq uint32, tiles []int, quality int) []byte {
+	b := []byte{msgTiles}
+	b = binary.LittleEndian.AppendUint32(b, seq)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	count := 0
+	for _, i := range tiles {
+		if i >= len(s.fb.versions) {
+			continue
+		}
+		r := s.fb.tileRect(i, s.opts.TileSize)
+		for _, v := range []int{r.Min.X, r.Min.Y, r.Dx(), r.Dy()} {
+			b = binary.LittleEndian.AppendUint16(b, uint16(v))
+		}
+		if p, ok := s.solid(r); ok {
+			b = append(b, codecFill, p[2], p[1], p[0])
+		} else {
+			data := s.encodeTile(i, r, quality)
+			b = append(b, codecJPEG)
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+			b = append(b, data...)
+		}
+		count++
+	}
+	binary.LittleEndian.PutUint32(b[5:], uint32(count))
+	return b
+}
+
+// solid returns the color of r if all its pixels are equal.
+func (s *Server) solid(r image.Rectangle) ([]byte, bool) {
+	stride := s.fb.width * 4
+	first := s.fb.pix[r.Min.Y*stride+r.Min.X*4:]
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := s.fb.pix[y*stride+r.Min.X*4 : y*stride+r.Max.X*4]
+		for i := 0; i < len(row); i += 4 {
+			if row[i] != first[0] || row[i+1] != first[1] || row[i+2] != first[2] {
+				return nil, false
+			}
+		}
+	}
+	return first[:4], true
+}
+
+// encodeTile returns tile i as JPEG, shared with other viewers at the same quality.
+func (s *Server) encodeTile(i int, r image.Rectangle, quality int) []byte {
+	version := s.fb.versions[i]
+	s.cacheMu.Lock()
+	for _, c := range s.cache[i] {
+		if c.version == version && c.quality == quality {
+			s.cacheMu.Unlock()
+			return c.data
+		}
+	}
+	e, ok := s.encoders[quality]
+	if !ok {
+		e, _ = jpegenc.NewEncoder(&jpegenc.Options{Quality: quality, Subsampling: jpegenc.Subsample420})
+		s.encoders[quality] = e
+	}
+	s.cacheMu.Unlock()
+
+	var buf bytes.Buffer
+	stride := s.fb.width * 4
+	e.Encode(&buf, s.fb.pix[r.Min.Y*stride+r.Min.X*4:], r.Dx(), r.Dy(), stride)
+	data := buf.Bytes()
+
+	s.cacheMu.Lock()
+	entries := s.cache[i][:0]
+	for _, c := range s.cache[i] {
+		if c.version == version {
+			entries = append(entries, c)
+		}
+	}
+	s.cache[i] = append(entries, cachedTile{version: version, quality: quality, data: data})
+	s.cacheMu.Unlock()
+	return data
+}
+
+// capture reads the source while viewers are connected. The framebuffer is
+// kept when it stops: sources report the damage accumulated meanwhile with
+// the next frame.
+func (s *Server) capture() {
+	interval := time.Second / time.Duration(s.opts.FPS)
+	timeoutMs := uint(interval / time.Millisecond)
+	for {
+		s.mu.Lock()
+		if len(s.viewers) == 0 {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		f, err := s.src.GetFrame(timeoutMs)
+		next := time.Now().Add(interval)
+		if errors.Is(err, frame.ErrNoImageYet) {
+			continue
+		}
+		if err != nil {
+			// Viewers reconnect, which restarts capture.
+			s.mu.Lock()
+			s.running = false
+			for v := range s.viewers {
+				v.ws.close()
+			}
+			s.mu.Unlock()
+			return
+		}
+		s.store(f)
+		time.Sleep(time.Until(next))
+	}
+}
+
+// store copies f into the framebuffer and marks the changed tiles dirty for
+// every viewer.
+func (s *Server) store(f *frame.Frame) {
+	size := s.opts.TileSize
+	s.fbMu.Lock()
+	fb := &s.fb
+	resized := fb.pix == nil || fb.width != f.Width || fb.height != f.Height
+	if resized {
+		fb.width, fb.height = f.Width, f.Height
+		fb.cols, fb.rows = (f.Width+size-1)/size, (f.Height+size-1)/size
+		fb.pix = make([]byte, f.Width*f.Height*4)
+		fb.versions = make([]uint64, fb.cols*fb.rows)
+		s.cacheMu.Lock()
+		s.cache = make([][]cachedTile, fb.cols*fb.rows)
+		s.cacheMu.Unlock()
+	}
+
+	damage := f.Damage()
+	if resized || damage == nil {
+		damage = []image.Rectangle{f.Rect()}
+	}
+	tiles := make(map[int]struct{})
+	for _, r := range damage {
+		r = r.Intersect(f.Rect())
+		if r.Empty() {
+			continue
+		}
+		frame.CopyRect(fb.pix, fb.width*4, f.Pix, f.Stride, r)
+		for ty := r.Min.Y / size; ty <= (r.Max.Y-1)/size; ty++ {
+			for tx := r.Min.X / size; tx <= (r.Max.X-1)/size; tx++ {
+				i := ty*fb.cols + tx
+				if _, ok := tiles[i]; !ok {
+					tiles[i] = struct{}{}
+					fb.versions[i]++
+				}
+			}
+		}
+	}
+
+	cursorChanged := f.Cursor.X != fb.cursor.X || f.Cursor.Y != fb.cursor.Y || f.Cursor.Visible != fb.cursor.Visible
+	if shape := f.Cursor.Shape; shape != nil && (fb.shape == nil || fb.shape.ID != shape.ID) {
+		fb.shape = shape
+		cursorChanged = true
+	}
+	fb.cursor = f.Cursor
+	ntiles := fb.cols * fb.rows
+	s.fbMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for v := range s.viewers {
+		v.mu.Lock()
+		if resized || len(v.dirty) != ntiles {
+			v.markAll(ntiles)
+		} else {
+			for i := range tiles {
+				if !v.dirty[i] {
+					v.dirty[i] = true
+					v.ndirty++
+				}
+			}
+		}
+		v.cursorDirty = v.cursorDirty || cursorChanged
+		v.mu.Unlock()
+		v.signal()
+	}
+}
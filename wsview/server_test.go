@@ -0,0 +1,200 @@
+package wsview
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shinkar94/godesktopdup/frame"
+	"github.com/shinkar94/godesktopdup/synth"
+)
+
+// scripted is a source returning the frames pushed by a test.
+type scripted struct {
+	frames chan *frame.Frame
+}
+
+func newScripted() *scripted {
+	return &scripted{frames: make(chan *frame.Frame, 1)}
+}
+
+func (s *scripted) GetFrame(timeoutMs uint) (*frame.Frame, error) {
+	t := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+	defer t.Stop()
+	select {
+	case f := <-s.frames:
+		return f, nil
+	case <-t.C:
+		return nil, frame.ErrNoImageYet
+	}
+}
+
+// tile is a decoded tile of a msgTiles message.
+type tile struct {
+	rect  image.Rectangle
+	fill  []byte
+	image image.Image
+}
+
+// readTiles reads messages up to the next tile batch, returning it and the
+// init and cursor messages before it.
+func (c *client) readTiles(t *testing.T) (init, cursor []byte, seq uint32, tiles []tile) {
+	t.Helper()
+	for {
+		op, msg := c.read(t)
+		if op != opBinary || len(msg) == 0 {
+			t.Fatalf("message with opcode %d, %d bytes", op, len(msg))
+		}
+		switch msg[0] {
+		case msgInit:
+			init = msg
+			continue
+		case msgCursor:
+			cursor = msg
+			continue
+		case msgTiles:
+		default:
+			t.Fatalf("unknown message type %d", msg[0])
+		}
+
+		seq = binary.LittleEndian.Uint32(msg[1:])
+		count := int(binary.LittleEndian.Uint32(msg[5:]))
+		p := msg[9:]
+		for i := 0; i < count; i++ {
+			x, y := int(binary.LittleEndian.Uint16(p)), int(binary.LittleEndian.Uint16(p[2:]))
+			w, h := int(binary.LittleEndian.Uint16(p[4:])), int(binary.LittleEndian.Uint16(p[6:]))
+			tl := tile{rect: image.Rect(x, y, x+w, y+h)}
+			switch p[8] {
+			case codecFill:
+				tl.fill, p = p[9:12], p[12:]
+			case codecJPEG:
+				n := int(binary.LittleEndian.Uint32(p[9:]))
+				img, err := jpeg.Decode(bytes.NewReader(p[13 : 13+n]))
+				if err != nil {
+					t.Fatalf("tile %v: %v", tl.rect, err)
+				}
+				tl.image, p = img, p[13+n:]
+			default:
+				t.Fatalf("tile %v has codec %d", tl.rect, p[8])
+			}
+			tiles = append(tiles, tl)
+		}
+		if len(p) != 0 {
+			t.Fatalf("%d bytes after %d tiles", len(p), count)
+		}
+		return init, cursor, seq, tiles
+	}
+}
+
+func ack(seq uint32) []byte {
+	return clientFrame(true, opBinary, binary.LittleEndian.AppendUint32([]byte{msgAck}, seq))
+}
+
+// gray returns a w x h frame of one color.
+func gray(w, h int, v byte) *frame.Frame {
+	f := frame.New(w, h)
+	for i := range f.Pix {
+		f.Pix[i] = v
+	}
+	return f
+}
+
+func TestStream(t *testing.T) {
+	src := newScripted()
+	s := New(src, &Options{FPS: 200, TileSize: 64})
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	c, _ := dial(t, srv.URL, nil)
+
+	f := gray(150, 70, 0x40)
+	f.Cursor.X, f.Cursor.Y, f.Cursor.Visible = 20, 30, true
+	f.Cursor.Shape = synth.ArrowShape()
+	src.frames <- f
+	init, cur, seq, tiles := c.readTiles(t)
+	if want := []byte{msgInit, 150, 0, 70, 0, 64, 0}; !bytes.Equal(init, want) {
+		t.Errorf("init % x, want % x", init, want)
+	}
+	if len(cur) < 15 || int16(binary.LittleEndian.Uint16(cur[1:])) != 20 || cur[5] != 1 || cur[6] != 1 {
+		t.Fatalf("cursor message % x", cur[:min(len(cur), 15)])
+	}
+	if _, err := png.Decode(bytes.NewReader(cur[15:])); err != nil {
+		t.Errorf("cursor shape: %v", err)
+	}
+	if len(tiles) != 3*2 {
+		t.Fatalf("%d tiles, want 6", len(tiles))
+	}
+	for _, tl := range tiles {
+		if !bytes.Equal(tl.fill, []byte{0x40, 0x40, 0x40}) {
+			t.Errorf("tile %v: fill % x", tl.rect, tl.fill)
+		}
+	}
+	if tiles[5].rect != image.Rect(128, 64, 150, 70) {
+		t.Errorf("last tile %v", tiles[5].rect)
+	}
+	c.write(ack(seq))
+
+	// Only the tiles under the damage are sent, detailed ones as JPEG.
+	f = gray(150, 70, 0x40)
+	for y := 10; y < 20; y++ {
+		for x := 60; x < 80; x++ {
+			f.Pix[f.PixOffset(x, y)] = byte(x * 12)
+		}
+	}
+	f.Dirty = []image.Rectangle{image.Rect(60, 10, 80, 20)}
+	f.Cursor.X, f.Cursor.Y, f.Cursor.Visible = 20, 30, true
+	src.frames <- f
+	init, cur, seq, tiles = c.readTiles(t)
+	if init != nil || cur != nil {
+		t.Error("init or cursor message sent for unchanged size and cursor")
+	}
+	if len(tiles) != 2 || tiles[0].rect != image.Rect(0, 0, 64, 64) || tiles[1].rect != image.Rect(64, 0, 128, 64) {
+		t.Fatalf("tiles %v", tiles)
+	}
+	if tiles[1].image == nil || tiles[1].image.Bounds() != image.Rect(0, 0, 64, 64) {
+		t.Errorf("changed tile is not a 64x64 JPEG")
+	}
+	c.write(ack(seq))
+
+	// A keyframe request resends everything.
+	c.write(clientFrame(true, opBinary, []byte{msgKeyframe}))
+	init, _, _, tiles = c.readTiles(t)
+	if init == nil || len(tiles) != 6 {
+		t.Errorf("keyframe: init %v, %d tiles", init != nil, len(tiles))
+	}
+}
+
+func TestTileSize(t *testing.T) {
+	for _, c := range []struct{ size, want int }{
+		{0, DefaultTileSize},
+		{8, DefaultTileSize},
+		{16, 16},
+		{0xFFFF, 0xFFFF},
+		{0x10000, DefaultTileSize},
+	} {
+		if got := New(nil, &Options{TileSize: c.size}).opts.TileSize; got != c.want {
+			t.Errorf("TileSize %d: %d, want %d", c.size, got, c.want)
+		}
+	}
+}
+
+// TestManyTiles checks that batches of more than 65535 tiles keep their count.
+func TestManyTiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("allocates a 16 megapixel frame")
+	}
+	s := New(nil, &Options{TileSize: 16})
+	s.store(frame.New(300*16, 220*16))
+	tiles := make([]int, 300*220)
+	for i := range tiles {
+		tiles[i] = i
+	}
+	msg := s.tilesMessage(1, tiles, 50)
+	if n := binary.LittleEndian.Uint32(msg[5:]); n != 300*220 {
+		t.Errorf("count %d, want %d", n, 300*220)
+	}
+}
@@ -0,0 +1,192 @@
+package wsview
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// WebSocket opcodes, RFC 6455 section 5.2.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// maxMessage bounds messages from viewers, which only send small control messages.
+const maxMessage = 64 * 1024
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errClosed = errors.New("wsview: connection closed")
+
+// wsConn is the server side of a WebSocket connection.
+type wsConn struct {
+	nc net.Conn
+	br *bufio.Reader
+	// wmu serializes writes, since control frames are answered by the reader.
+	wmu sync.Mutex
+}
+
+// isUpgrade reports whether r asks for a WebSocket connection.
+func isUpgrade(r *http.Request) bool {
+	return headerHas(r.Header, "Connection", "upgrade") && headerHas(r.Header, "Upgrade", "websocket")
+}
+
+func headerHas(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkOrigin reports whether a browser on the page r comes from may open the
+// WebSocket: the Origin's host must be the requested host or the origin must
+// be in allowed. Requests without Origin do not come from browsers and pass.
+func checkOrigin(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// upgrade performs the opening handshake and takes over the connection.
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "bad websocket handshake", http.StatusBadRequest)
+		return nil, errors.New("wsview: bad websocket handshake")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("wsview: response does not support hijacking")
+	}
+	nc, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	if _, err := nc.Write([]byte(resp)); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &wsConn{nc: nc, br: rw.Reader}, nil
+}
+
+// writeMessage sends data as a single unfragmented frame.
+func (c *wsConn) writeMessage(op byte, data []byte) error {
+	hdr := make([]byte, 0, 10)
+	hdr = append(hdr, 0x80|op)
+	switch n := len(data); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xFFFF:
+		hdr = binary.BigEndian.AppendUint16(append(hdr, 126), uint16(n))
+	default:
+		hdr = binary.BigEndian.AppendUint64(append(hdr, 127), uint64(n))
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	bufs := net.Buffers{hdr, data}
+	_, err := bufs.WriteTo(c.nc)
+	return err
+}
+
+// readMessage returns the next data message, answering pings and closes on
+// the way. Fragmented messages are reassembled.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var msg []byte
+	var msgOp byte
+	for {
+		var h [2]byte
+		if _, err := io.ReadFull(c.br, h[:]); err != nil {
+			return 0, nil, err
+		}
+		fin, op := h[0]&0x80 != 0, h[0]&0x0F
+		if h[1]&0x80 == 0 {
+			return 0, nil, errors.New("wsview: unmasked client frame")
+		}
+		n := uint64(h[1] & 0x7F)
+		switch n {
+		case 126:
+			var b [2]byte
+			if _, err := io.ReadFull(c.br, b[:]); err != nil {
+				return 0, nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(b[:]))
+		case 127:
+			var b [8]byte
+			if _, err := io.ReadFull(c.br, b[:]); err != nil {
+				return 0, nil, err
+			}
+			n = binary.BigEndian.Uint64(b[:])
+		}
+		if n > maxMessage || uint64(len(msg))+n > maxMessage {
+			return 0, nil, errors.New("wsview: message too large")
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return 0, nil, err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return 0, nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeMessage(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+		case opPong:
+		case opClose:
+			c.writeMessage(opClose, payload[:min(len(payload), 2)])
+			return 0, nil, errClosed
+		case opText, opBinary, opContinuation:
+			if op != opContinuation {
+				msgOp = op
+				msg = msg[:0]
+			}
+			msg = append(msg, payload...)
+			if fin {
+				return msgOp, msg, nil
+			}
+		default:
+			return 0, nil, errors.New("wsview: unknown opcode")
+		}
+	}
+}
+
+func (c *wsConn) close() error {
+	return c.nc.Close()
+}
@@ -0,0 +1,264 @@
+package wsview
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client is the browser side of a WebSocket connection.
+type client struct {
+	nc net.Conn
+	br *bufio.Reader
+}
+
+// dial opens a WebSocket to the server at url with the given extra headers
+// and returns the handshake response.
+func dial(t *testing.T, url string, header http.Header) (*client, *http.Response) {
+	t.Helper()
+	nc, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if err := req.Write(nc); err != nil {
+		t.Fatal(err)
+	}
+	c := &client{nc: nc, br: bufio.NewReader(nc)}
+	resp, err := http.ReadResponse(c.br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, resp
+}
+
+// clientFrame returns a masked client frame.
+func clientFrame(fin bool, op byte, payload []byte) []byte {
+	b := []byte{op}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, 0x80|byte(n))
+	case n <= 0xFFFF:
+		b = binary.BigEndian.AppendUint16(append(b, 0x80|126), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint64(append(b, 0x80|127), uint64(n))
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask[:]...)
+	for i, v := range payload {
+		b = append(b, v^mask[i%4])
+	}
+	return b
+}
+
+func (c *client) write(frames ...[]byte) error {
+	_, err := c.nc.Write(bytes.Join(frames, nil))
+	return err
+}
+
+// read is readFrame failing the test on errors.
+func (c *client) read(t *testing.T) (byte, []byte) {
+	t.Helper()
+	op, payload, err := c.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return op, payload
+}
+
+// readFrame returns the next server frame, which must be unfragmented and
+// unmasked.
+func (c *client) readFrame() (byte, []byte, error) {
+	c.nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var h [2]byte
+	if _, err := io.ReadFull(c.br, h[:]); err != nil {
+		return 0, nil, err
+	}
+	if h[0]&0x80 == 0 || h[1]&0x80 != 0 {
+		return 0, nil, fmt.Errorf("server frame header % x", h)
+	}
+	n := uint64(h[1])
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	return h[0] & 0x0F, payload, nil
+}
+
+func TestCheckOrigin(t *testing.T) {
+	for _, c := range []struct {
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{"", nil, true},
+		{"http://viewer.test:8080", nil, true},
+		{"https://VIEWER.test:8080", nil, true},
+		{"http://viewer.test", nil, false},
+		{"https://evil.test", nil, false},
+		{"null", nil, false},
+		{"https://app.test", []string{"https://app.test/"}, true},
+		{"https://app.test.evil", []string{"https://app.test"}, false},
+		{"https://evil.test", []string{"*"}, true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://viewer.test:8080/view/", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if got := checkOrigin(r, c.allowed); got != c.want {
+			t.Errorf("origin %q allowed %q: %v, want %v", c.origin, c.allowed, got, c.want)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	srv := httptest.NewServer(New(newScripted(), nil))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !bytes.Equal(page, viewerHTML) {
+		t.Errorf("page: %s %q, %d bytes", resp.Status, resp.Header.Get("Content-Type"), len(page))
+	}
+
+	// The key and accept value are the example of RFC 6455 section 1.3.
+	_, resp = dial(t, srv.URL, nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("upgrade: %s, accept %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	for _, c := range []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"foreign origin", http.Header{"Origin": {"https://evil.test"}}, http.StatusForbidden},
+		{"old version", http.Header{"Sec-Websocket-Version": {"8"}}, http.StatusBadRequest},
+		{"no key", http.Header{"Sec-Websocket-Key": {""}}, http.StatusBadRequest},
+	} {
+		if _, resp := dial(t, srv.URL, c.header); resp.StatusCode != c.want {
+			t.Errorf("%s: %s, want %d", c.name, resp.Status, c.want)
+		}
+	}
+}
+
+// pipe returns a server connection and the client end of it.
+func pipe(t *testing.T) (*wsConn, *client) {
+	s, c := net.Pipe()
+	t.Cleanup(func() {
+		s.Close()
+		c.Close()
+	})
+	return &wsConn{nc: s, br: bufio.NewReader(s)}, &client{nc: c, br: bufio.NewReader(c)}
+}
+
+func TestReadMessage(t *testing.T) {
+	ws, c := pipe(t)
+	long := bytes.Repeat([]byte("x"), 300)
+	go c.write(
+		clientFrame(false, opText, []byte("hel")),
+		clientFrame(true, opPing, []byte("p")),
+		clientFrame(false, opContinuation, []byte("lo ")),
+		clientFrame(true, opContinuation, long),
+		clientFrame(true, opBinary, []byte{msgAck, 1, 0, 0, 0}),
+		clientFrame(true, opClose, []byte{0x03, 0xE8, 'b', 'y', 'e'}),
+	)
+	pong := make(chan []byte, 1)
+	closed := make(chan []byte, 1)
+	go func() {
+		if op, p, err := c.readFrame(); err == nil && op == opPong {
+			pong <- p
+		}
+		if op, p, err := c.readFrame(); err == nil && op == opClose {
+			closed <- p
+		}
+		close(pong)
+		close(closed)
+	}()
+
+	op, msg, err := ws.readMessage()
+	if err != nil || op != opText || string(msg) != "hello "+string(long) {
+		t.Fatalf("fragmented message: %d %q %v", op, msg, err)
+	}
+	if p := <-pong; string(p) != "p" {
+		t.Errorf("pong payload %q", p)
+	}
+	op, msg, err = ws.readMessage()
+	if err != nil || op != opBinary || !bytes.Equal(msg, []byte{msgAck, 1, 0, 0, 0}) {
+		t.Fatalf("binary message: %d % x %v", op, msg, err)
+	}
+	if _, _, err := ws.readMessage(); err != errClosed {
+		t.Errorf("after close: %v, want errClosed", err)
+	}
+	if p := <-closed; !bytes.Equal(p, []byte{0x03, 0xE8}) {
+		t.Errorf("close reply % x, want the status code", p)
+	}
+}
+
+func TestReadMessageInvalid(t *testing.T) {
+	unmasked := []byte{0x80 | opBinary, 1, msgKeyframe}
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"unmasked", unmasked},
+		{"too large", clientFrame(true, opBinary, make([]byte, maxMessage+1))[:14]},
+		{"too large in fragments", append(clientFrame(false, opBinary, make([]byte, maxMessage)), clientFrame(true, opContinuation, []byte{1})...)},
+		{"unknown opcode", clientFrame(true, 0x3, nil)},
+	} {
+		ws, cl := pipe(t)
+		go cl.write(c.data)
+		if _, _, err := ws.readMessage(); err == nil {
+			t.Errorf("%s: read succeeded", c.name)
+		}
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		ws, c := pipe(t)
+		data := bytes.Repeat([]byte{byte(n)}, n)
+		go ws.writeMessage(opBinary, data)
+		op, got := c.read(t)
+		if op != opBinary || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: opcode %d, read %d bytes", n, op, len(got))
+		}
+	}
+}